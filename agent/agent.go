@@ -0,0 +1,404 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package agent runs a long-lived inventory service on a host. On a schedule
+// it enumerates the attached devices, audits each against its last snapshot
+// with AuditFile, records the result in the device history, saves a new
+// snapshot and uploads the records of new and changed devices. Records that
+// cannot be uploaded are kept in the state directory and retried on the
+// next run. The agent reports its status on a local socket.
+package agent
+
+import (
+	`context`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`sync`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	SnapshotDir string = `snapshots`
+	HistoryDir string = `history`
+	PendingFile string = `pending.json`
+	SnapshotExt string = `.json`
+)
+
+// EnumerateFunc returns the devices attached to the host and a function
+// that releases them when the run is over.
+type EnumerateFunc func() ([]gocmdb.Auditable, func(), error)
+
+// Agent audits the devices of a host on a schedule.
+type Agent struct {
+	Config    *Config
+	Enumerate EnumerateFunc
+	Uploader  Uploader
+	Store     history.Store
+	Cipher    *crypt.Cipher
+
+	status    Status
+	pending   []*history.Record
+	trigger   chan struct{}
+	mutex     sync.Mutex
+	runMutex  sync.Mutex
+}
+
+// Status describes the state of the agent and the outcome of its last run.
+type Status struct {
+	Started     time.Time		`json:"started"`
+	Running     bool		`json:"running"`
+	Runs        int			`json:"runs"`
+	LastRun     time.Time		`json:"last_run,omitempty"`
+	LastSuccess time.Time		`json:"last_success,omitempty"`
+	LastError   string		`json:"last_error,omitempty"`
+	NextRun     time.Time		`json:"next_run,omitempty"`
+	Devices     int			`json:"devices"`
+	Changed     int			`json:"changed"`
+	Pending     int			`json:"pending"`
+}
+
+// Summary is the outcome of a single run.
+type Summary struct {
+	Time     time.Time		`json:"time"`
+	Devices  int			`json:"devices"`
+	New      int			`json:"new"`
+	Changed  int			`json:"changed"`
+	Uploaded int			`json:"uploaded"`
+	Pending  int			`json:"pending"`
+	Dropped  int			`json:"dropped,omitempty"`
+	Errors   []string		`json:"errors,omitempty"`
+}
+
+// New instantiates an agent, creating its state directory and loading any
+// records left pending by an earlier process. The history is kept in a
+// FileStore in the state directory and the pending records in PendingFile,
+// both encrypted with the usbci snapshot cipher if one is installed. If the
+// configuration has a server URL, records are uploaded with a client of
+// package client configured from it.
+func New(cfg *Config, enum EnumerateFunc) (*Agent, error) {
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(cfg.StateDir, SnapshotDir), 0750); err != nil {
+		return nil, err
+	}
+
+	store, err := history.NewFileStore(filepath.Join(cfg.StateDir, HistoryDir))
+
+	if err != nil {
+		return nil, err
+	}
+
+	store.Cipher = usbci.SnapshotCipher()
+
+	this := &Agent{
+		Config: cfg,
+		Enumerate: enum,
+		Store: store,
+		Cipher: store.Cipher,
+		trigger: make(chan struct{}, 1),
+	}
+
+	if cfg.ServerURL != `` {
+		if this.Uploader, err = cfg.uploader(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = this.loadPending(); err != nil {
+		return nil, err
+	}
+
+	this.status.Pending = len(this.pending)
+
+	return this, nil
+}
+
+// Run runs the agent until the context is canceled: once at start, then on
+// the configured schedule or when triggered through the status socket. A
+// run in progress when the context is canceled is completed before Run
+// returns.
+func (this *Agent) Run(ctx context.Context) (error) {
+
+	this.mutex.Lock()
+	this.status.Started = time.Now()
+	this.mutex.Unlock()
+
+	var srv *statusServer
+
+	if this.Config.Socket != `` {
+
+		var err error
+
+		if srv, err = this.serve(this.Config.Socket); err != nil {
+			return err
+		}
+
+		defer srv.close()
+	}
+
+	for {
+		this.RunOnce()
+
+		next := this.Config.Next(time.Now())
+
+		this.mutex.Lock()
+		this.status.NextRun = next
+		this.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-this.trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Trigger requests a run as soon as the agent is idle.
+func (this *Agent) Trigger() {
+	select {
+	case this.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the current status of the agent.
+func (this *Agent) Status() (Status) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.status
+}
+
+// RunOnce enumerates and audits the devices once, uploads the records of
+// new and changed devices along with any left pending, and updates the
+// status. Errors with single devices do not stop the run; they are
+// reported in the summary.
+func (this *Agent) RunOnce() (*Summary) {
+
+	this.runMutex.Lock()
+	defer this.runMutex.Unlock()
+
+	this.mutex.Lock()
+	this.status.Running = true
+	this.mutex.Unlock()
+
+	sum := this.run()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.status.Running = false
+	this.status.Runs++
+	this.status.LastRun = sum.Time
+	this.status.Devices = sum.Devices
+	this.status.Changed = sum.Changed
+	this.status.Pending = sum.Pending
+	this.status.LastError = ``
+
+	if len(sum.Errors) == 0 {
+		this.status.LastSuccess = sum.Time
+	} else {
+		this.status.LastError = sum.Errors[len(sum.Errors) - 1]
+	}
+
+	return sum
+}
+
+// run performs a run without updating the status.
+func (this *Agent) run() (sum *Summary) {
+
+	sum = &Summary{Time: time.Now()}
+
+	devs, release, err := this.Enumerate()
+
+	if release != nil {
+		defer release()
+	}
+
+	if err != nil {
+		sum.Errors = append(sum.Errors, err.Error())
+	}
+
+	for _, dev := range devs {
+
+		sum.Devices++
+
+		rec, isNew, err := this.audit(dev)
+
+		if err != nil {
+			sum.Errors = append(sum.Errors, fmt.Sprintf(`%s: %v`, history.Key(dev), err))
+			continue
+		}
+
+		switch {
+		case isNew:
+			sum.New++
+		case len(rec.Changes) > 0:
+			sum.Changed++
+		default:
+			continue
+		}
+
+		this.pending = append(this.pending, rec)
+	}
+
+	if max := this.maxPending(); len(this.pending) > max {
+		sum.Dropped = len(this.pending) - max
+		this.pending = append([]*history.Record{}, this.pending[sum.Dropped:]...)
+		sum.Errors = append(sum.Errors, fmt.Sprintf(`upload queue full: %d oldest records dropped`, sum.Dropped))
+	}
+
+	if err = this.upload(sum); err != nil {
+		sum.Errors = append(sum.Errors, err.Error())
+	}
+
+	sum.Pending = len(this.pending)
+
+	return sum
+}
+
+// audit audits a device against its last snapshot, places the results in
+// its Changes field, records it in the history and saves a new snapshot.
+// A device without a snapshot is new and is recorded without changes.
+func (this *Agent) audit(dev gocmdb.Auditable) (rec *history.Record, isNew bool, err error) {
+
+	fn := this.snapshotFile(dev)
+
+	if _, err = os.Stat(fn); os.IsNotExist(err) {
+		isNew = true
+		dev.SetChanges(nil)
+	} else if err != nil {
+		return nil, false, err
+	} else if err = dev.AuditFile(fn); err != nil {
+		return nil, false, err
+	}
+
+	if rec, err = history.NewRecord(dev); err != nil {
+		return nil, false, err
+	}
+
+	if err = this.Store.Append(rec); err != nil {
+		return nil, false, err
+	}
+
+	return rec, isNew, dev.Save(fn)
+}
+
+// upload uploads the pending records and keeps those that fail in the
+// state directory.
+func (this *Agent) upload(sum *Summary) (err error) {
+
+	if this.Uploader != nil && len(this.pending) > 0 {
+
+		if err = this.Uploader.Upload(this.pending); err == nil {
+			sum.Uploaded = len(this.pending)
+			this.pending = nil
+		} else {
+			err = fmt.Errorf(`upload: %v`, err)
+		}
+	}
+
+	if serr := this.savePending(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// snapshotFile constructs the snapshot filename of a device from its stable
+// identity, so that a device is compared with its own snapshot even when it
+// moves to another port. Names are mapped as history file names are.
+func (this *Agent) snapshotFile(dev gocmdb.Auditable) (string) {
+	name := history.FileName(history.Key(dev), this.Cipher)
+	return filepath.Join(this.Config.StateDir, SnapshotDir, name + SnapshotExt)
+}
+
+// maxPending returns the configured limit of pending records.
+func (this *Agent) maxPending() (int) {
+
+	if this.Config.MaxPending > 0 {
+		return this.Config.MaxPending
+	}
+
+	return DefaultMaxPending
+}
+
+// loadPending reads the records left pending by an earlier run, decrypting
+// them if they were encrypted.
+func (this *Agent) loadPending() (error) {
+
+	fn := filepath.Join(this.Config.StateDir, PendingFile)
+	b, err := ioutil.ReadFile(fn)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if b, err = this.Cipher.Open(b); err != nil {
+		return fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return json.Unmarshal(b, &this.pending)
+}
+
+// savePending writes the pending records to the state directory, encrypted
+// if the agent has a cipher, or removes the file if there are none.
+func (this *Agent) savePending() (error) {
+
+	fn := filepath.Join(this.Config.StateDir, PendingFile)
+
+	if len(this.pending) == 0 {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(this.pending)
+
+	if err != nil {
+		return err
+	}
+
+	if this.Cipher != nil {
+		if b, err = this.Cipher.Encrypt(b); err != nil {
+			return err
+		}
+	}
+
+	if err = ioutil.WriteFile(fn + `.tmp`, b, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(fn + `.tmp`, fn)
+}
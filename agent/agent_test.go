@@ -0,0 +1,299 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	`bytes`
+	`context`
+	`encoding/json`
+	`errors`
+	`io/ioutil`
+	`net`
+	`net/http`
+	`net/http/httptest`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+type testUploader struct {
+	recs []*history.Record
+	err error
+}
+
+func (this *testUploader) Upload(recs []*history.Record) (error) {
+	if this.err != nil {
+		return this.err
+	}
+	this.recs = append(this.recs, recs...)
+	return nil
+}
+
+// enumerate returns an EnumerateFunc that restores the device in the named
+// test report on each run.
+func enumerate(t *testing.T, k *string) (EnumerateFunc) {
+
+	return func() ([]gocmdb.Auditable, func(), error) {
+
+		return []gocmdb.Auditable{testdevice.Magtek(t, *k)}, func() {}, nil
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `agent`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	key := `mag1`
+	up := new(testUploader)
+
+	a, err := New(&Config{StateDir: dir, Interval: Duration{time.Hour}}, enumerate(t, &key))
+	gotest.Ok(t, err)
+	a.Uploader = up
+
+	sum := a.RunOnce()
+	gotest.Assert(t, len(sum.Errors) == 0, `first run should succeed`)
+	gotest.Assert(t, sum.New == 1 && sum.Uploaded == 1, `new device should be uploaded`)
+
+	sum = a.RunOnce()
+	gotest.Assert(t, sum.New == 0 && sum.Changed == 0 && sum.Uploaded == 0,
+		`unchanged device should not be uploaded`)
+
+	key = `mag2`
+	up.err = errors.New(`offline`)
+
+	sum = a.RunOnce()
+	gotest.Assert(t, sum.Changed == 1 && sum.Pending == 1, `failed upload should be pending`)
+	gotest.Assert(t, len(sum.Errors) == 1, `failed upload should be reported`)
+	gotest.Assert(t, a.Status().LastError != ``, `status should report the last error`)
+
+	_, err = os.Stat(filepath.Join(dir, PendingFile))
+	gotest.Ok(t, err)
+
+	a, err = New(&Config{StateDir: dir, Interval: Duration{time.Hour}}, enumerate(t, &key))
+	gotest.Ok(t, err)
+	gotest.Assert(t, a.Status().Pending == 1, `pending records should survive a restart`)
+
+	up.err = nil
+	a.Uploader = up
+
+	sum = a.RunOnce()
+	gotest.Assert(t, sum.Uploaded == 1 && sum.Pending == 0, `pending record should be uploaded`)
+	gotest.Assert(t, len(up.recs) == 2, `uploader should receive new and changed records`)
+	gotest.Assert(t, len(up.recs[1].Changes) == 2, `changed record should contain the audit changes`)
+
+	_, err = os.Stat(filepath.Join(dir, PendingFile))
+	gotest.Assert(t, os.IsNotExist(err), `pending file should be removed`)
+
+	recs, err := a.Store.Records(up.recs[0].Key)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(recs) == 4, `every run should be recorded in the history`)
+}
+
+func TestPendingQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `agent`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := crypt.NewCipher(bytes.Repeat([]byte{3}, crypt.KeySize))
+	gotest.Ok(t, err)
+
+	usbci.SetSnapshotCipher(c)
+	defer usbci.SetSnapshotCipher(nil)
+
+	key := `mag1`
+	cfg := &Config{StateDir: dir, Interval: Duration{time.Hour}, MaxPending: 2}
+
+	a, err := New(cfg, enumerate(t, &key))
+	gotest.Ok(t, err)
+	a.Uploader = &testUploader{err: errors.New(`offline`)}
+
+	for _, k := range []string{`mag1`, `mag2`} {
+		key = k
+		sum := a.RunOnce()
+		gotest.Assert(t, sum.Dropped == 0, `queue below the limit should not drop records`)
+	}
+
+	key = `mag1`
+	sum := a.RunOnce()
+	gotest.Assert(t, sum.Pending == 2 && sum.Dropped == 1, `oldest record should be dropped at the limit`)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, PendingFile))
+	gotest.Ok(t, err)
+	gotest.Assert(t, crypt.IsEncrypted(b), `pending file should be encrypted`)
+
+	fis, err := ioutil.ReadDir(filepath.Join(dir, SnapshotDir))
+	gotest.Ok(t, err)
+
+	name := c.Name(history.Key(testdevice.Magtek(t, `mag1`))) + SnapshotExt
+	gotest.Assert(t, len(fis) == 1 && fis[0].Name() == name, `snapshot should be named by a digest of the device key`)
+
+	a, err = New(cfg, enumerate(t, &key))
+	gotest.Ok(t, err)
+	gotest.Assert(t, a.Status().Pending == 2, `encrypted pending records should survive a restart`)
+
+	usbci.SetSnapshotCipher(nil)
+
+	_, err = New(cfg, enumerate(t, &key))
+	gotest.Assert(t, err != nil, `encrypted pending records should not load without the key`)
+}
+
+func TestRun(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `agent`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	key := `mag1`
+	sock := filepath.Join(dir, SocketName)
+	cfg := &Config{StateDir: dir, Socket: sock, Interval: Duration{time.Hour}}
+
+	a, err := New(cfg, enumerate(t, &key))
+	gotest.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- a.Run(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, `unix`, sock)
+		},
+	}}
+
+	status := func() (s Status) {
+		resp, err := client.Get(`http://agent` + StatusPath)
+		gotest.Ok(t, err)
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		gotest.Ok(t, err)
+		return s
+	}
+
+	var s Status
+
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(sock); err == nil {
+			if s = status(); s.Runs == 1 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	gotest.Assert(t, s.Runs == 1 && s.Devices == 1, `agent should run at start`)
+
+	resp, err := client.Post(`http://agent` + RunPath, ``, nil)
+	gotest.Ok(t, err)
+	resp.Body.Close()
+	gotest.Assert(t, resp.StatusCode == http.StatusAccepted, `run should be accepted`)
+
+	for i := 0; i < 100 && s.Runs < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s = status()
+	}
+
+	gotest.Assert(t, s.Runs == 2, `agent should run when triggered`)
+
+	cancel()
+	gotest.Ok(t, <-done)
+
+	_, err = os.Stat(sock)
+	gotest.Assert(t, os.IsNotExist(err), `socket should be removed on shutdown`)
+}
+
+func TestConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `agent`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, `agent.json`)
+
+	err = ioutil.WriteFile(fn, []byte(`{"state_dir": "/var/lib/gocmdb", "times": ["02:30", "14:00"], "jitter": "0s"}`), 0640)
+	gotest.Ok(t, err)
+
+	cfg, err := LoadConfig(fn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, cfg.Socket == `/var/lib/gocmdb/` + SocketName, `socket should default to state directory`)
+	gotest.Assert(t, cfg.UploadTimeout.Duration == DefaultUploadTimeout, `upload timeout should default`)
+
+	now := time.Date(2017, 9, 1, 15, 0, 0, 0, time.Local)
+	gotest.Assert(t, cfg.Next(now).Equal(time.Date(2017, 9, 2, 2, 30, 0, 0, time.Local)),
+		`next run should be the first daily time after now`)
+
+	now = time.Date(2017, 9, 1, 3, 0, 0, 0, time.Local)
+	gotest.Assert(t, cfg.Next(now).Equal(time.Date(2017, 9, 1, 14, 0, 0, 0, time.Local)),
+		`next run should be later the same day`)
+
+	cfg = &Config{StateDir: dir, Interval: Duration{time.Hour}, Jitter: Duration{time.Minute}}
+
+	for i := 0; i < 10; i++ {
+		next := cfg.Next(now)
+		gotest.Assert(t, !next.Before(now.Add(time.Hour)) && next.Before(now.Add(time.Hour + time.Minute)),
+			`jitter should delay the run by less than the configured jitter`)
+	}
+
+	err = ioutil.WriteFile(fn, []byte(`{"state_dir": "x", "times": ["25:00"]}`), 0640)
+	gotest.Ok(t, err)
+
+	_, err = LoadConfig(fn)
+	gotest.Assert(t, err != nil, `invalid time should be rejected`)
+}
+
+func TestServerUpload(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `agent`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var auth []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get(`Authorization`))
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.Write([]byte(`{"accepted": 1}`))
+	}))
+	defer ts.Close()
+
+	tokenFn := filepath.Join(dir, `token`)
+	gotest.Ok(t, ioutil.WriteFile(tokenFn, []byte("secret\n"), 0600))
+
+	key := `mag1`
+	cfg := &Config{StateDir: dir, Interval: Duration{time.Hour}, ServerURL: ts.URL, TokenFile: tokenFn}
+
+	a, err := New(cfg, enumerate(t, &key))
+	gotest.Ok(t, err)
+
+	sum := a.RunOnce()
+	gotest.Assert(t, sum.Uploaded == 1, `new device should be uploaded to the server`)
+	gotest.Assert(t, len(auth) == 1 && auth[0] == `Bearer secret`, `upload should carry the bearer token`)
+
+	cfg.TokenFile = filepath.Join(dir, `missing`)
+
+	_, err = New(cfg, enumerate(t, &key))
+	gotest.Assert(t, err != nil, `missing token file should be refused`)
+}
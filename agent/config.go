@@ -0,0 +1,228 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`math/rand`
+	`path/filepath`
+	`sort`
+	`strings`
+	`time`
+
+	`github.com/jscherff/gocmdb/client`
+)
+
+const (
+	DefaultInterval time.Duration = time.Hour
+	DefaultJitter time.Duration = 5 * time.Minute
+	DefaultUploadTimeout time.Duration = 30 * time.Second
+	DefaultMaxPending int = 1000
+
+	SocketName string = `agent.sock`
+	TimeOfDayFormat string = `15:04`
+)
+
+// Config is the agent configuration, read from a JSON file. Durations are
+// strings such as "1h" or "90s". If Times is set, the agent runs daily at
+// each of the given local times, such as "02:30"; otherwise it runs every
+// Interval. A random delay of up to Jitter is added to every scheduled run
+// so that many hosts do not upload at once. At most MaxPending records are
+// kept for upload while the server is unreachable; the oldest are dropped
+// first, and remain in the local history.
+//
+// Records are uploaded to the CMDB server at ServerURL, if set, with the
+// TLS and retry settings of package client: CAFile verifies the server,
+// CertFile and KeyFile hold a client certificate, and TokenFile holds a
+// bearer token, so that uploads are accepted by a server that requires
+// authentication.
+type Config struct {
+	StateDir      string		`json:"state_dir"`
+	Socket        string		`json:"socket"`
+	Interval      Duration		`json:"interval"`
+	Times         []string		`json:"times"`
+	Jitter        Duration		`json:"jitter"`
+	ServerURL     string		`json:"server_url"`
+	UploadTimeout Duration		`json:"upload_timeout"`
+	UploadRetries int		`json:"upload_retries"`
+	CAFile        string		`json:"ca_file"`
+	CertFile      string		`json:"cert_file"`
+	KeyFile       string		`json:"key_file"`
+	ServerName    string		`json:"server_name"`
+	TokenFile     string		`json:"token_file"`
+	VendorID      string		`json:"vendor_id"`
+	ProductID     string		`json:"product_id"`
+	MaxPending    int		`json:"max_pending"`
+}
+
+// Duration is a time.Duration that is read from and written to JSON as a
+// string such as "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes the duration as a string.
+func (this Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.String())
+}
+
+// UnmarshalJSON reads the duration from a string.
+func (this *Duration) UnmarshalJSON(b []byte) (error) {
+
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	this.Duration = d
+
+	return nil
+}
+
+// LoadConfig reads a configuration file, applies defaults and validates
+// the result.
+func LoadConfig(fn string) (*Config, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &Config{
+		Interval: Duration{DefaultInterval},
+		Jitter: Duration{DefaultJitter},
+		UploadTimeout: Duration{DefaultUploadTimeout},
+		MaxPending: DefaultMaxPending,
+	}
+
+	if err = json.Unmarshal(b, this); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	if this.Socket == `` && this.StateDir != `` {
+		this.Socket = filepath.Join(this.StateDir, SocketName)
+	}
+
+	if err = this.Validate(); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return this, nil
+}
+
+// Validate checks the configuration for missing or invalid settings.
+func (this *Config) Validate() (error) {
+
+	if this.StateDir == `` {
+		return fmt.Errorf(`state_dir is required`)
+	}
+
+	if len(this.Times) == 0 && this.Interval.Duration <= 0 {
+		return fmt.Errorf(`interval must be positive`)
+	}
+
+	if this.Jitter.Duration < 0 {
+		return fmt.Errorf(`jitter must not be negative`)
+	}
+
+	if this.MaxPending < 0 {
+		return fmt.Errorf(`max_pending must not be negative`)
+	}
+
+	for _, t := range this.Times {
+		if _, err := time.Parse(TimeOfDayFormat, t); err != nil {
+			return fmt.Errorf(`invalid time %q: expected HH:MM`, t)
+		}
+	}
+
+	return nil
+}
+
+// uploader instantiates a client for the CMDB server at ServerURL.
+func (this *Config) uploader() (*client.Client, error) {
+
+	var token []byte
+
+	if this.TokenFile != `` {
+
+		var err error
+
+		if token, err = ioutil.ReadFile(this.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return client.New(&client.Config{
+		URL: this.ServerURL,
+		Timeout: this.UploadTimeout.Duration,
+		Retries: this.UploadRetries,
+		CAFile: this.CAFile,
+		CertFile: this.CertFile,
+		KeyFile: this.KeyFile,
+		ServerName: this.ServerName,
+		Token: strings.TrimSpace(string(token)),
+	})
+}
+
+// Next returns the time of the next scheduled run after now, including a
+// random jitter.
+func (this *Config) Next(now time.Time) (time.Time) {
+
+	next := now.Add(this.Interval.Duration)
+
+	if len(this.Times) > 0 {
+		next = this.nextTime(now)
+	}
+
+	if this.Jitter.Duration > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(this.Jitter.Duration))))
+	}
+
+	return next
+}
+
+// nextTime returns the first of the daily run times after now.
+func (this *Config) nextTime(now time.Time) (time.Time) {
+
+	var times []time.Time
+
+	for _, s := range this.Times {
+
+		t, _ := time.Parse(TimeOfDayFormat, s)
+		at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+
+		times = append(times, at)
+	}
+
+	sort.Slice(times, func(i, j int) (bool) {
+		return times[i].Before(times[j])
+	})
+
+	return times[0]
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	`context`
+	`encoding/json`
+	`net`
+	`net/http`
+	`os`
+	`time`
+)
+
+const (
+	StatusPath string = `/status`
+	RunPath string = `/run`
+
+	shutdownTimeout time.Duration = 5 * time.Second
+)
+
+// statusServer serves the agent status over HTTP on a Unix socket. GET
+// StatusPath returns the Status as JSON; POST RunPath triggers a run.
+type statusServer struct {
+	fn string
+	srv *http.Server
+}
+
+// serve listens on a Unix socket, replacing a stale socket file left by a
+// process that did not shut down cleanly.
+func (this *Agent) serve(fn string) (*statusServer, error) {
+
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := net.Listen(`unix`, fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(fn, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(StatusPath, this.handleStatus)
+	mux.HandleFunc(RunPath, this.handleRun)
+
+	ss := &statusServer{fn: fn, srv: &http.Server{Handler: mux}}
+	go ss.srv.Serve(ln)
+
+	return ss, nil
+}
+
+// close shuts the server down and removes the socket file.
+func (this *statusServer) close() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	this.srv.Shutdown(ctx)
+	os.Remove(this.fn)
+}
+
+// handleStatus writes the agent status.
+func (this *Agent) handleStatus(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(this.Status())
+}
+
+// handleRun triggers a run.
+func (this *Agent) handleRun(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	this.Trigger()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,350 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auditlog keeps a tamper-evident, append-only log of device audits,
+// NVRAM writes and resets. Each entry carries the hash of the previous
+// entry, so modifying, removing or reordering entries breaks the chain, and
+// the hash of the last entry is kept in a separate head file, so removing
+// entries from the end of the log is detected as well.
+package auditlog
+
+import (
+	`bufio`
+	`bytes`
+	`crypto/sha256`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	HeadExt string = `.head`
+)
+
+var (
+	// GenesisHash is the previous hash of the first entry.
+	GenesisHash = strings.Repeat(`0`, sha256.Size * 2)
+
+	ErrChain = errors.New(`hash chain broken`)
+	ErrTruncated = errors.New(`log truncated`)
+)
+
+// Entry is one record in the log. Hash covers every other field.
+type Entry struct {
+	Seq   uint64			`json:"seq"`
+	Time  time.Time			`json:"time"`
+	Type  string			`json:"type"`
+	Data  json.RawMessage		`json:"data"`
+	Prev  string			`json:"prev"`
+	Hash  string			`json:"hash"`
+}
+
+// Head identifies the last entry of a log.
+type Head struct {
+	Seq  uint64			`json:"seq"`
+	Hash string			`json:"hash"`
+}
+
+// Log is an open audit log file.
+type Log struct {
+	fn string
+	head Head
+	mutex sync.Mutex
+}
+
+// Open opens or creates a log file, verifying the existing chain so that
+// new entries are never appended to a log that has been tampered with. If
+// the process died between syncing an entry and updating the head file,
+// the head file is brought up to date.
+func Open(fn string) (*Log, error) {
+
+	head, err := Verify(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := readHead(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if saved == nil && head.Seq > 0 || saved != nil && *saved != *head {
+		if err = writeHead(fn, head); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Log{fn: fn, head: *head}, nil
+}
+
+// Head returns the sequence number and hash of the last entry. Keeping a
+// copy elsewhere, such as in a CMDB, allows truncation of both the log and
+// its head file to be detected with VerifyHead.
+func (this *Log) Head() (Head) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.head
+}
+
+// Append adds an entry of the given type with data encoded as JSON. The
+// entry is synced to disk before the head file is updated.
+func (this *Log) Append(typ string, data interface{}) (*Entry, error) {
+
+	d, err := json.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	e := &Entry{
+		Seq: this.head.Seq + 1,
+		Time: time.Now().UTC(),
+		Type: typ,
+		Data: d,
+		Prev: this.head.Hash,
+	}
+
+	if e.Hash, err = e.hash(); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.OpenFile(this.fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fh.Write(append(b, '\n')); err == nil {
+		err = fh.Sync()
+	}
+
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.head = Head{Seq: e.Seq, Hash: e.Hash}
+
+	return e, writeHead(this.fn, &this.head)
+}
+
+// Record appends a device event. Its signature matches the event handler
+// of package usbci.
+func (this *Log) Record(e *usbci.Event) (error) {
+	_, err := this.Append(e.Action, e)
+	return err
+}
+
+// Attach records every device event in the log.
+func (this *Log) Attach() {
+	usbci.SetEventHandler(this.Record)
+}
+
+// Entries reads all entries of a log file without verifying them.
+func Entries(fn string) (es []*Entry, err error) {
+
+	fh, err := os.Open(fn)
+
+	if os.IsNotExist(err) {
+		return es, nil
+	}
+
+	if err != nil {
+		return es, err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		e := new(Entry)
+
+		if err = json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return es, fmt.Errorf(`line %d: %v`, line, err)
+		}
+
+		es = append(es, e)
+	}
+
+	return es, scanner.Err()
+}
+
+// Verify checks the hash chain of a log file and its head file and returns
+// the head of the log. A missing log with no head file is a valid empty log.
+// A log one entry ahead of its head file, or with one entry and no head
+// file, is valid too: Append syncs each entry before updating the head
+// file, so that is what a crash in between leaves behind.
+func Verify(fn string) (*Head, error) {
+
+	es, err := Entries(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	head := &Head{Hash: GenesisHash}
+	prev := *head
+
+	for _, e := range es {
+
+		if e.Seq != head.Seq + 1 {
+			return nil, fmt.Errorf(`entry %d: %v: expected sequence %d`, e.Seq, ErrChain, head.Seq + 1)
+		}
+
+		if e.Prev != head.Hash {
+			return nil, fmt.Errorf(`entry %d: %v: previous hash mismatch`, e.Seq, ErrChain)
+		}
+
+		if h, err := e.hash(); err != nil {
+			return nil, err
+		} else if h != e.Hash {
+			return nil, fmt.Errorf(`entry %d: %v: entry modified`, e.Seq, ErrChain)
+		}
+
+		prev = *head
+		head.Seq, head.Hash = e.Seq, e.Hash
+	}
+
+	saved, err := readHead(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+
+	case saved == nil && head.Seq > 1:
+		return nil, fmt.Errorf(`%v: head file missing`, ErrTruncated)
+
+	case saved == nil, *saved == *head:
+		return head, nil
+
+	case *saved == prev:
+		return head, nil
+	}
+
+	return nil, fmt.Errorf(`%v: log ends at entry %d, head file records entry %d`,
+		ErrTruncated, head.Seq, saved.Seq)
+}
+
+// VerifyHead verifies a log file and checks that it ends with a head
+// obtained earlier from an independent source. Entries appended since are
+// allowed, so the expected entry must still be present and unmodified.
+func VerifyHead(fn string, expect Head) (*Head, error) {
+
+	head, err := Verify(fn)
+
+	if err != nil || expect.Seq == 0 {
+		return head, err
+	}
+
+	if head.Seq < expect.Seq {
+		return nil, fmt.Errorf(`%v: log ends at entry %d, expected at least %d`,
+			ErrTruncated, head.Seq, expect.Seq)
+	}
+
+	es, err := Entries(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if es[expect.Seq - 1].Hash != expect.Hash {
+		return nil, fmt.Errorf(`entry %d: %v: hash does not match expected head`, expect.Seq, ErrChain)
+	}
+
+	return head, nil
+}
+
+// hash computes the hash of an entry over every field except Hash.
+func (this *Entry) hash() (string, error) {
+
+	e := *this
+	e.Hash = ``
+
+	b, err := json.Marshal(&e)
+
+	if err != nil {
+		return ``, err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readHead reads the head file of a log, returning nil if there is none.
+func readHead(fn string) (*Head, error) {
+
+	b, err := ioutil.ReadFile(fn + HeadExt)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	head := new(Head)
+
+	if err = json.Unmarshal(bytes.TrimSpace(b), head); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn + HeadExt, err)
+	}
+
+	return head, nil
+}
+
+// writeHead replaces the head file of a log atomically.
+func writeHead(fn string, head *Head) (error) {
+
+	b, err := json.Marshal(head)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := fn + HeadExt + `.tmp`
+
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fn + HeadExt)
+}
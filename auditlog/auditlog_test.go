@@ -0,0 +1,212 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlog
+
+import (
+	`bytes`
+	`encoding/json`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func newLog(t *testing.T) (string, func()) {
+
+	dir, err := ioutil.TempDir(``, `auditlog`)
+	gotest.Ok(t, err)
+
+	return filepath.Join(dir, `audit.log`), func() { os.RemoveAll(dir) }
+}
+
+func TestAttach(t *testing.T) {
+
+	fn, cleanup := newLog(t)
+	defer cleanup()
+
+	l, err := Open(fn)
+	gotest.Ok(t, err)
+
+	l.Attach()
+	defer usbci.SetEventHandler(nil)
+
+	mag := testdevice.Magtek(t, `mag2`)
+
+	err = mag.AuditJSON(testdata.Jsn(`mag1`))
+	gotest.Ok(t, err)
+
+	err = mag.AuditJSON([]byte(`not json`))
+	gotest.Assert(t, err != nil, `invalid baseline should produce an error`)
+
+	es, err := Entries(fn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(es) == 2, `log should contain both audits`)
+	gotest.Assert(t, es[0].Type == usbci.EventAudit, `entry type should be the event action`)
+
+	var e usbci.Event
+
+	err = json.Unmarshal(es[0].Data, &e)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(e.Changes) == 2, `audit entry should record changes`)
+	gotest.Assert(t, e.Device == mag.Identity(), `audit entry should record device identity`)
+
+	err = json.Unmarshal(es[1].Data, &e)
+	gotest.Ok(t, err)
+	gotest.Assert(t, e.Error != ``, `failed audit entry should record the error`)
+
+	head, err := Verify(fn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, *head == l.Head(), `verified head should match log head`)
+}
+
+func TestVerify(t *testing.T) {
+
+	fn, cleanup := newLog(t)
+	defer cleanup()
+
+	l, err := Open(fn)
+	gotest.Ok(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(`test`, map[string]int{`n`: i})
+		gotest.Ok(t, err)
+	}
+
+	mid := Head{Seq: 3}
+
+	es, err := Entries(fn)
+	gotest.Ok(t, err)
+	mid.Hash = es[2].Hash
+
+	_, err = VerifyHead(fn, mid)
+	gotest.Ok(t, err)
+
+	b, err := ioutil.ReadFile(fn)
+	gotest.Ok(t, err)
+
+	lines := strings.SplitAfter(string(b), "\n")
+
+	t.Run("modification", func(t *testing.T) {
+
+		err := ioutil.WriteFile(fn, bytes.Replace(b, []byte(`{"n":2}`), []byte(`{"n":7}`), 1), 0640)
+		gotest.Ok(t, err)
+
+		_, err = Verify(fn)
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), ErrChain.Error()), `modified entry should be detected`)
+
+		_, err = Open(fn)
+		gotest.Assert(t, err != nil, `tampered log should not be opened for appending`)
+	})
+
+	t.Run("removal", func(t *testing.T) {
+
+		err := ioutil.WriteFile(fn, []byte(lines[0] + strings.Join(lines[2:], ``)), 0640)
+		gotest.Ok(t, err)
+
+		_, err = Verify(fn)
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), ErrChain.Error()), `removed entry should be detected`)
+	})
+
+	t.Run("truncation", func(t *testing.T) {
+
+		err := ioutil.WriteFile(fn, []byte(strings.Join(lines[:4], ``)), 0640)
+		gotest.Ok(t, err)
+
+		_, err = Verify(fn)
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), ErrTruncated.Error()), `truncated log should be detected`)
+
+		err = writeHead(fn, &Head{Seq: 2, Hash: es[1].Hash})
+		gotest.Ok(t, err)
+
+		err = ioutil.WriteFile(fn, []byte(strings.Join(lines[:2], ``)), 0640)
+		gotest.Ok(t, err)
+
+		_, err = Verify(fn)
+		gotest.Ok(t, err)
+
+		_, err = VerifyHead(fn, mid)
+		gotest.Assert(t, err != nil, `truncation of log and head should be detected with an expected head`)
+	})
+}
+
+func TestCrashRecovery(t *testing.T) {
+
+	fn, cleanup := newLog(t)
+	defer cleanup()
+
+	l, err := Open(fn)
+	gotest.Ok(t, err)
+
+	_, err = l.Append(`test`, map[string]int{`n`: 1})
+	gotest.Ok(t, err)
+
+	t.Run("first entry", func(t *testing.T) {
+
+		// The process died after syncing the first entry and before
+		// writing the head file.
+
+		gotest.Ok(t, os.Remove(fn + HeadExt))
+
+		_, err := Verify(fn)
+		gotest.Ok(t, err)
+
+		l, err = Open(fn)
+		gotest.Ok(t, err)
+
+		saved, err := readHead(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, saved != nil && *saved == l.Head(), `open should write the missing head file`)
+	})
+
+	t.Run("later entry", func(t *testing.T) {
+
+		before := l.Head()
+
+		_, err := l.Append(`test`, map[string]int{`n`: 2})
+		gotest.Ok(t, err)
+
+		// The process died after syncing the second entry and before
+		// updating the head file.
+
+		gotest.Ok(t, writeHead(fn, &before))
+
+		l, err = Open(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, l.Head().Seq == 2, `open should recover the synced entry`)
+
+		_, err = l.Append(`test`, map[string]int{`n`: 3})
+		gotest.Ok(t, err)
+
+		head, err := Verify(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, head.Seq == 3, `log should be appendable after recovery`)
+	})
+
+	t.Run("two entries ahead", func(t *testing.T) {
+
+		es, err := Entries(fn)
+		gotest.Ok(t, err)
+		gotest.Ok(t, writeHead(fn, &Head{Seq: 1, Hash: es[0].Hash}))
+
+		_, err = Verify(fn)
+		gotest.Assert(t, err != nil, `log more than one entry ahead of its head should not verify`)
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package batch makes NVRAM writes to many devices safer. A Plan records
+// the writes the Configurable setters would make without making them. A
+// Journal records the previous value of every property on disk before it
+// is written, so that a batch can be rolled back if any device fails, or
+// after the process dies in the middle of the batch.
+package batch
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`sync`
+
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+// Undoer is a device whose writes can be undone, such as a usbci.Magtek.
+type Undoer interface {
+	Identity() (string)
+	Undo(*usbci.Write) (error)
+}
+
+// Plan collects the writes of a dry run.
+type Plan struct {
+	writes []*usbci.Write
+	mutex sync.Mutex
+}
+
+// Journal is a rollback journal file.
+type Journal struct {
+	fn string
+	writes []*usbci.Write
+	mutex sync.Mutex
+}
+
+// Handle records a write and skips it. Its signature matches the write
+// handler of package usbci.
+func (this *Plan) Handle(w *usbci.Write) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.writes = append(this.writes, w)
+	return false, nil
+}
+
+// Attach makes every NVRAM write a dry run recorded in the plan.
+func (this *Plan) Attach() {
+	usbci.SetWriteHandler(this.Handle)
+}
+
+// Writes returns the writes recorded so far.
+func (this *Plan) Writes() ([]*usbci.Write) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]*usbci.Write{}, this.writes...)
+}
+
+// Open opens or creates a journal file. A journal that already holds
+// writes belongs to a batch that was neither committed nor rolled back,
+// and should be rolled back before a new batch is started.
+func Open(fn string) (*Journal, error) {
+
+	this := &Journal{fn: fn}
+
+	b, err := ioutil.ReadFile(fn)
+
+	if os.IsNotExist(err) {
+		return this, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &this.writes); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return this, nil
+}
+
+// Handle records a write in the journal and syncs the journal to disk
+// before letting the write through. Its signature matches the write handler
+// of package usbci.
+func (this *Journal) Handle(w *usbci.Write) (bool, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if err := this.save(append(this.writes, w)); err != nil {
+		return false, err
+	}
+
+	this.writes = append(this.writes, w)
+
+	return true, nil
+}
+
+// Attach records every NVRAM write in the journal.
+func (this *Journal) Attach() {
+	usbci.SetWriteHandler(this.Handle)
+}
+
+// Writes returns the writes recorded in the journal.
+func (this *Journal) Writes() ([]*usbci.Write) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]*usbci.Write{}, this.writes...)
+}
+
+// Commit ends the batch and removes the journal file.
+func (this *Journal) Commit() (error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.writes = nil
+
+	if err := os.Remove(this.fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Rollback undoes the writes in the journal, newest first, on the given
+// devices, and removes the journal file if all of them were undone. Writes
+// that cannot be undone, such as those to devices not given, are kept in
+// the journal so that the rollback can be retried. A journaled write may
+// not have been made before the process died; undoing it is harmless.
+func (this *Journal) Rollback(devs ...Undoer) (error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	index := make(map[string]Undoer)
+
+	for _, dev := range devs {
+		index[dev.Identity()] = dev
+	}
+
+	var (
+		kept []*usbci.Write
+		errs []string
+	)
+
+	for i := len(this.writes) - 1; i >= 0; i-- {
+
+		w := this.writes[i]
+		dev, ok := index[w.Device]
+
+		if !ok && w.NewDevice != `` {
+			dev, ok = index[w.NewDevice]
+		}
+
+		if !ok {
+			kept = append([]*usbci.Write{w}, kept...)
+			errs = append(errs, fmt.Sprintf(`%s: device not found`, w.Device))
+			continue
+		}
+
+		if err := dev.Undo(w); err != nil {
+			kept = append([]*usbci.Write{w}, kept...)
+			errs = append(errs, fmt.Sprintf(`%s: %v`, w.Device, err))
+		}
+	}
+
+	if len(kept) > 0 {
+
+		if err := this.save(kept); err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		this.writes = kept
+
+		return fmt.Errorf(`rollback incomplete: %s`, strings.Join(errs, `; `))
+	}
+
+	this.writes = nil
+
+	if err := os.Remove(this.fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Run calls op for each device with the journal attached, and rolls back
+// the writes to all devices if op fails for any of them, or commits them
+// otherwise. The write handler is removed when Run returns.
+func (this *Journal) Run(devs []Undoer, op func(Undoer) (error)) (error) {
+
+	if len(this.Writes()) > 0 {
+		return fmt.Errorf(`%s: journal holds an unfinished batch; roll it back first`, this.fn)
+	}
+
+	this.Attach()
+	defer usbci.SetWriteHandler(nil)
+
+	for _, dev := range devs {
+
+		if err := op(dev); err != nil {
+
+			err = fmt.Errorf(`%s: %v`, dev.Identity(), err)
+			usbci.SetWriteHandler(nil)
+
+			if rerr := this.Rollback(devs...); rerr != nil {
+				return fmt.Errorf(`%v; %v`, err, rerr)
+			}
+
+			return fmt.Errorf(`%v; batch rolled back`, err)
+		}
+	}
+
+	return this.Commit()
+}
+
+// save replaces the journal file atomically with the given writes.
+func (this *Journal) save(writes []*usbci.Write) (error) {
+
+	b, err := json.MarshalIndent(writes, ``, `  `)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := this.fn + `.tmp`
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = fh.Write(append(b, '\n')); err == nil {
+		err = fh.Sync()
+	}
+
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, this.fn); err != nil {
+		return err
+	}
+
+	if dh, err := os.Open(filepath.Dir(this.fn)); err == nil {
+		dh.Sync()
+		dh.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`testing`
+
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gotest`
+)
+
+// fakeDevice keeps a device serial number in memory.
+type fakeDevice struct {
+	key string
+	sn string
+	fail bool
+}
+
+func (this *fakeDevice) Identity() (string) {
+	return this.key
+}
+
+func (this *fakeDevice) Undo(w *usbci.Write) (error) {
+	this.sn = w.OldValue
+	return nil
+}
+
+// set journals and makes a write the way a usbci setter does.
+func (this *fakeDevice) set(j *Journal, val string) (error) {
+
+	if this.fail {
+		return fmt.Errorf(`command error: 1`)
+	}
+
+	w := &usbci.Write{Device: this.key, Property: usbci.FieldDeviceSN, OldValue: this.sn, NewValue: val}
+
+	if _, err := j.Handle(w); err != nil {
+		return err
+	}
+
+	this.sn = val
+
+	return nil
+}
+
+func TestPlan(t *testing.T) {
+
+	p := new(Plan)
+	apply, err := p.Handle(&usbci.Write{Device: `a`, NewValue: `24FFFFF`})
+
+	gotest.Ok(t, err)
+	gotest.Assert(t, !apply, `dry run should skip writes`)
+	gotest.Assert(t, len(p.Writes()) == 1, `dry run should record writes`)
+}
+
+func TestJournal(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `batch`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, `journal.json`)
+
+	t.Run("Commit", func(t *testing.T) {
+
+		j, err := Open(fn)
+		gotest.Ok(t, err)
+
+		a, b := &fakeDevice{key: `a`, sn: `OLDA`}, &fakeDevice{key: `b`, sn: `OLDB`}
+
+		err = j.Run([]Undoer{a, b}, func(dev Undoer) (error) {
+			return dev.(*fakeDevice).set(j, `NEW` + dev.Identity())
+		})
+
+		gotest.Ok(t, err)
+		gotest.Assert(t, a.sn == `NEWa` && b.sn == `NEWb`, `writes should be kept`)
+
+		_, err = os.Stat(fn)
+		gotest.Assert(t, os.IsNotExist(err), `commit should remove the journal`)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+
+		j, err := Open(fn)
+		gotest.Ok(t, err)
+
+		a, b := &fakeDevice{key: `a`, sn: `OLDA`}, &fakeDevice{key: `b`, sn: `OLDB`, fail: true}
+
+		err = j.Run([]Undoer{a, b}, func(dev Undoer) (error) {
+			return dev.(*fakeDevice).set(j, `NEW` + dev.Identity())
+		})
+
+		gotest.Assert(t, err != nil, `failed batch should return an error`)
+		gotest.Assert(t, a.sn == `OLDA`, `failed batch should be rolled back`)
+		gotest.Assert(t, len(j.Writes()) == 0, `rolled back journal should be empty`)
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+
+		j, err := Open(fn)
+		gotest.Ok(t, err)
+
+		a, b := &fakeDevice{key: `a`, sn: `OLDA`}, &fakeDevice{key: `b`, sn: `OLDB`}
+		gotest.Ok(t, a.set(j, `NEWA`))
+		gotest.Ok(t, b.set(j, `NEWB`))
+		gotest.Ok(t, a.set(j, `NEWA2`))
+
+		// The process dies here; the next one finds the journal.
+
+		j, err = Open(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(j.Writes()) == 3, `journal should survive the process`)
+
+		err = j.Run([]Undoer{a, b}, func(Undoer) (error) { return nil })
+		gotest.Assert(t, err != nil, `unfinished batch should block a new one`)
+
+		err = j.Rollback(a)
+		gotest.Assert(t, err != nil, `rollback without every device should be incomplete`)
+		gotest.Assert(t, a.sn == `OLDA`, `writes should be undone newest first`)
+
+		j, err = Open(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(j.Writes()) == 1, `writes not undone should be kept`)
+
+		gotest.Ok(t, j.Rollback(a, b))
+		gotest.Assert(t, b.sn == `OLDB`, `remaining writes should be undone`)
+
+		_, err = os.Stat(fn)
+		gotest.Assert(t, os.IsNotExist(err), `completed rollback should remove the journal`)
+	})
+
+	t.Run("Factory SN Rollback", func(t *testing.T) {
+
+		j, err := Open(fn)
+		gotest.Ok(t, err)
+
+		a := &fakeDevice{key: `0801-0001-OLDF`, sn: `OLDF`}
+		w := &usbci.Write{Device: a.key, NewDevice: `0801-0001-NEWF`, Property: usbci.FieldFactorySN, OldValue: a.sn, NewValue: `NEWF`}
+
+		_, err = j.Handle(w)
+		gotest.Ok(t, err)
+		a.key, a.sn = w.NewDevice, w.NewValue
+
+		// The process dies here; the device now has its new identity.
+
+		j, err = Open(fn)
+		gotest.Ok(t, err)
+		gotest.Ok(t, j.Rollback(a))
+		gotest.Assert(t, a.sn == `OLDF`, `factory SN write should be undone under the new identity`)
+	})
+}
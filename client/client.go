@@ -0,0 +1,452 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client submits devices to a CMDB server of package server. It
+// registers devices, submits audits, records host check-ins, looks up
+// serial numbers and fetches the baseline of a device from the server so
+// that it can be audited without a local snapshot. Failed requests are
+// retried with exponential backoff; submissions carry an idempotency key
+// so that the server does not apply a retried submission twice. If the
+// client has a Queue, submissions that still cannot be delivered are
+// queued on disk and delivered, in order, before the next submission once
+// the server can be reached again.
+package client
+
+import (
+	`bytes`
+	`crypto/rand`
+	`crypto/tls`
+	`crypto/x509`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`net/http`
+	`net/url`
+	`strings`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/server`
+)
+
+const (
+	DefaultTimeout time.Duration = 30 * time.Second
+	DefaultRetries int = 3
+	DefaultBackoff time.Duration = time.Second
+	MaxBackoff time.Duration = time.Minute
+)
+
+var (
+	// ErrQueued is returned by submissions that could not be delivered
+	// and were queued for later delivery.
+	ErrQueued = errors.New(`server unavailable: request queued`)
+)
+
+// Config configures a Client. Zero values select the defaults; negative
+// Retries disables retries. CAFile adds trusted certificate authorities;
+// CertFile and KeyFile configure a client certificate. Token is sent as a
+// bearer token to servers that require one. QueueDir enables the offline
+// queue.
+type Config struct {
+	URL                string
+	Timeout            time.Duration
+	Retries            int
+	Backoff            time.Duration
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+	Token              string
+	QueueDir           string
+}
+
+// Client is a CMDB server client.
+type Client struct {
+	URL     string
+	HTTP    *http.Client
+	Retries int
+	Backoff time.Duration
+	Token   string
+	Queue   *Queue
+}
+
+// StatusError is a response from the server with an error status.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+// Error describes the response.
+func (this *StatusError) Error() (string) {
+	return fmt.Sprintf(`server: %d %s: %s`, this.Status, http.StatusText(this.Status), this.Message)
+}
+
+// Permanent reports whether retrying the request cannot succeed, which is
+// the case for client errors other than timeouts and rate limiting.
+func (this *StatusError) Permanent() (bool) {
+	return this.Status >= 400 && this.Status < 500 &&
+		this.Status != http.StatusRequestTimeout &&
+		this.Status != http.StatusTooManyRequests
+}
+
+// New instantiates a Client.
+func New(cfg *Config) (*Client, error) {
+
+	if cfg.URL == `` {
+		return nil, fmt.Errorf(`server URL is required`)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &Client{
+		URL: strings.TrimSuffix(cfg.URL, `/`),
+		HTTP: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		Retries: cfg.Retries,
+		Backoff: cfg.Backoff,
+		Token: cfg.Token,
+	}
+
+	if this.HTTP.Timeout == 0 {
+		this.HTTP.Timeout = DefaultTimeout
+	}
+
+	if this.Retries == 0 {
+		this.Retries = DefaultRetries
+	} else if this.Retries < 0 {
+		this.Retries = 0
+	}
+
+	if this.Backoff == 0 {
+		this.Backoff = DefaultBackoff
+	}
+
+	if cfg.QueueDir != `` {
+		if this.Queue, err = NewQueue(cfg.QueueDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return this, nil
+}
+
+// Register registers devices with the server.
+func (this *Client) Register(devs ...gocmdb.Registerable) (regs []*server.Registration, err error) {
+
+	js := make([]json.RawMessage, len(devs))
+
+	for i, dev := range devs {
+		if js[i], err = dev.JSON(); err != nil {
+			return nil, err
+		}
+	}
+
+	return regs, this.submit(http.MethodPost, `/v1/devices`, js, &regs)
+}
+
+// SubmitAudit submits the current state of audited devices and the changes
+// found by their most recent audits.
+func (this *Client) SubmitAudit(devs ...gocmdb.Auditable) (error) {
+
+	recs := make([]*history.Record, len(devs))
+
+	for i, dev := range devs {
+
+		rec, err := history.NewRecord(dev)
+
+		if err != nil {
+			return err
+		}
+
+		recs[i] = rec
+	}
+
+	return this.submit(http.MethodPost, `/v1/audits`, recs, nil)
+}
+
+// Upload submits history records. It implements agent.Uploader, and is the
+// uploader of agents with a server URL; records that are queued count as
+// uploaded, since the queue delivers them later.
+func (this *Client) Upload(recs []*history.Record) (error) {
+
+	if len(recs) == 0 {
+		return nil
+	}
+
+	if err := this.submit(http.MethodPost, `/v1/audits`, recs, nil); err != ErrQueued {
+		return err
+	}
+
+	return nil
+}
+
+// CheckIn records a host check-in.
+func (this *Client) CheckIn(ci *server.CheckIn) (error) {
+	return this.submit(http.MethodPost, `/v1/checkins`, ci, nil)
+}
+
+// Baseline fetches the latest snapshot of a device known to the server.
+func (this *Client) Baseline(dev gocmdb.Identifiable) ([]byte, error) {
+
+	var snap json.RawMessage
+
+	err := this.do(http.MethodGet, `/v1/devices/` + url.PathEscape(history.Key(dev)), nil, &snap)
+
+	return snap, err
+}
+
+// Compare compares a device with its baseline on the server and returns an
+// array of differences.
+func (this *Client) Compare(dev gocmdb.Auditable) ([][]string, error) {
+
+	snap, err := this.Baseline(dev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dev.CompareJSON(snap)
+}
+
+// Audit audits a device against its baseline on the server, placing the
+// results in the device Changes field.
+func (this *Client) Audit(dev gocmdb.Auditable) (error) {
+
+	snap, err := this.Baseline(dev)
+
+	if err != nil {
+		return err
+	}
+
+	return dev.AuditJSON(snap)
+}
+
+// FindSerial returns the devices known to the server with a serial number.
+func (this *Client) FindSerial(sn string) (devs []*server.Device, err error) {
+	return devs, this.do(http.MethodGet, `/v1/serials/` + url.PathEscape(sn), nil, &devs)
+}
+
+// Flush delivers queued submissions and returns the number delivered.
+func (this *Client) Flush() (int, error) {
+
+	if this.Queue == nil {
+		return 0, nil
+	}
+
+	return this.Queue.Drain(func(req *Request) (error) {
+		return this.send(req, nil)
+	})
+}
+
+// submit delivers a submission. If the server cannot be reached and the
+// client has a queue, the submission is queued, behind any submissions
+// already queued, and ErrQueued is returned. Every submission carries an
+// idempotency key, kept when it is retried or queued, so that the server
+// applies it only once.
+func (this *Client) submit(method, path string, v, out interface{}) (error) {
+
+	body, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := newIdempotencyKey()
+
+	if err != nil {
+		return err
+	}
+
+	req := &Request{Method: method, Path: path, Body: body, Key: key}
+
+	if this.Queue == nil {
+		return this.send(req, out)
+	}
+
+	if _, err = this.Flush(); err == nil {
+		if err = this.send(req, out); err == nil || isPermanent(err) {
+			return err
+		}
+	}
+
+	req.Queued = time.Now()
+
+	if qerr := this.Queue.Push(req); qerr != nil {
+		return fmt.Errorf(`%v; queue: %v`, err, qerr)
+	}
+
+	return ErrQueued
+}
+
+// do sends a request with a JSON body, if any, and decodes a JSON response.
+func (this *Client) do(method, path string, v, out interface{}) (error) {
+
+	req := &Request{Method: method, Path: path}
+
+	if v != nil {
+
+		var err error
+
+		if req.Body, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+
+	return this.send(req, out)
+}
+
+// send sends a request, retrying with exponential backoff after network
+// errors and responses with temporary error statuses.
+func (this *Client) send(req *Request, out interface{}) (err error) {
+
+	backoff := this.Backoff
+
+	for try := 0; try <= this.Retries; try++ {
+
+		if try > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+		}
+
+		if err = this.sendOnce(req, out); err == nil || isPermanent(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// sendOnce sends a request once.
+func (this *Client) sendOnce(req *Request, out interface{}) (error) {
+
+	var r io.Reader
+
+	if req.Body != nil {
+		r = bytes.NewReader(req.Body)
+	}
+
+	hreq, err := http.NewRequest(req.Method, this.URL + req.Path, r)
+
+	if err != nil {
+		return err
+	}
+
+	if req.Body != nil {
+		hreq.Header.Set(`Content-Type`, `application/json`)
+	}
+
+	hreq.Header.Set(`Accept`, `application/json`)
+
+	if req.Key != `` {
+		hreq.Header.Set(server.IdempotencyHeader, req.Key)
+	}
+
+	if this.Token != `` {
+		hreq.Header.Set(`Authorization`, `Bearer ` + this.Token)
+	}
+
+	resp, err := this.HTTP.Do(hreq)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := new(server.Error)
+
+		if json.Unmarshal(b, e) != nil || e.Error == `` {
+			e.Error = string(bytes.TrimSpace(b))
+		}
+
+		return &StatusError{Status: resp.StatusCode, Message: e.Error}
+	}
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newIdempotencyKey returns a random idempotency key.
+func newIdempotencyKey() (string, error) {
+
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// newTLSConfig builds the TLS configuration of a client.
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+
+	tc := &tls.Config{
+		ServerName: cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != `` {
+
+		b, err := ioutil.ReadFile(cfg.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if tc.RootCAs, err = x509.SystemCertPool(); err != nil || tc.RootCAs == nil {
+			tc.RootCAs = x509.NewCertPool()
+		}
+
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf(`%s: no certificates found`, cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != `` || cfg.KeyFile != `` {
+
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	`encoding/pem`
+	`io/ioutil`
+	`net/http`
+	`net/http/httptest`
+	`os`
+	`path/filepath`
+	`sync/atomic`
+	`testing`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/server`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+// flaky wraps a handler and answers 503 Service Unavailable while down.
+// While lose is positive, requests are handled but their responses are
+// replaced by 503 Service Unavailable.
+type flaky struct {
+	http.Handler
+	down int32
+	lose int32
+	calls int32
+}
+
+func (this *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	atomic.AddInt32(&this.calls, 1)
+
+	if atomic.LoadInt32(&this.down) != 0 {
+		http.Error(w, `maintenance`, http.StatusServiceUnavailable)
+		return
+	}
+
+	if atomic.AddInt32(&this.lose, -1) >= 0 {
+		this.Handler.ServeHTTP(httptest.NewRecorder(), r)
+		http.Error(w, `gateway lost response`, http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.StoreInt32(&this.lose, 0)
+
+	this.Handler.ServeHTTP(w, r)
+}
+
+func newServer(t *testing.T, dir string) (*flaky) {
+
+	hs, err := history.NewFileStore(filepath.Join(dir, `server`))
+	gotest.Ok(t, err)
+
+	s, err := server.NewHistoryStore(hs, ``)
+	gotest.Ok(t, err)
+
+	return &flaky{Handler: server.New(s)}
+}
+
+func TestClient(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `client`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := newServer(t, dir)
+	ts := httptest.NewTLSServer(srv)
+	defer ts.Close()
+
+	ca := filepath.Join(dir, `ca.pem`)
+	err = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: ts.Certificate().Raw}), 0640)
+	gotest.Ok(t, err)
+
+	_, err = New(&Config{URL: ts.URL, CAFile: filepath.Join(dir, `missing.pem`)})
+	gotest.Assert(t, err != nil, `missing CA file should be an error`)
+
+	c, err := New(&Config{
+		URL: ts.URL,
+		CAFile: ca,
+		Retries: 1,
+		Backoff: time.Millisecond,
+		QueueDir: filepath.Join(dir, `queue`),
+	})
+	gotest.Ok(t, err)
+
+	mag1 := testdevice.Magtek(t, `mag1`)
+
+	t.Run("Register() and Baseline()", func(t *testing.T) {
+
+		regs, err := c.Register(mag1)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(regs) == 1 && regs[0].Created, `device should be registered`)
+
+		snap, err := c.Baseline(mag1)
+		gotest.Ok(t, err)
+
+		ss, err := mag1.CompareJSON(snap)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 0, `baseline should match registered device`)
+
+		_, err = c.Baseline(testdevice.Magtek(t, `gen1`))
+		se, ok := err.(*StatusError)
+		gotest.Assert(t, ok && se.Status == http.StatusNotFound && se.Permanent(), `unknown baseline should be not found`)
+	})
+
+	t.Run("Audit() and SubmitAudit()", func(t *testing.T) {
+
+		mag2 := testdevice.Magtek(t, `mag2`)
+
+		err := c.Audit(mag2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(mag2.Changes) == 2, `audit against server baseline should find changes`)
+
+		err = c.SubmitAudit(mag2)
+		gotest.Ok(t, err)
+
+		ss, err := c.Compare(mag2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 0, `submitted audit should become the baseline`)
+	})
+
+	t.Run("FindSerial()", func(t *testing.T) {
+
+		devs, err := c.FindSerial(mag1.SerialNum)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 1 && devs[0].Key == mag1.Identity(), `serial should identify device`)
+	})
+
+	t.Run("offline queue", func(t *testing.T) {
+
+		atomic.StoreInt32(&srv.down, 1)
+		calls := atomic.LoadInt32(&srv.calls)
+
+		err := c.CheckIn(&server.CheckIn{HostName: `register-1`})
+		gotest.Assert(t, err == ErrQueued, `check-in should be queued while server is down`)
+		gotest.Assert(t, atomic.LoadInt32(&srv.calls) - calls == 2, `request should be retried before queueing`)
+
+		err = c.SubmitAudit(testdevice.Magtek(t, `mag1`))
+		gotest.Assert(t, err == ErrQueued, `audit should be queued while server is down`)
+		gotest.Assert(t, c.Queue.Len() == 2, `queue should hold both submissions`)
+
+		rec, err := history.NewRecord(testdevice.Magtek(t, `mag2`))
+		gotest.Ok(t, err)
+
+		err = c.Upload([]*history.Record{rec})
+		gotest.Ok(t, err)
+		gotest.Assert(t, c.Queue.Len() == 3, `queued upload should not be an error`)
+
+		atomic.StoreInt32(&srv.down, 0)
+
+		err = c.CheckIn(&server.CheckIn{HostName: `register-2`})
+		gotest.Ok(t, err)
+		gotest.Assert(t, c.Queue.Len() == 0, `queue should be flushed when server returns`)
+
+		recs, err := srv.Handler.(*server.Server).Store.Records(mag1.Identity())
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 4, `queued audit and upload should be delivered`)
+
+		cis, err := srv.Handler.(*server.Server).Store.CheckIns()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(cis) == 2, `queued check-in should be delivered`)
+	})
+
+	t.Run("lost responses", func(t *testing.T) {
+
+		atomic.StoreInt32(&srv.lose, 1)
+
+		err := c.SubmitAudit(testdevice.Magtek(t, `mag1`))
+		gotest.Ok(t, err)
+
+		recs, err := srv.Handler.(*server.Server).Store.Records(mag1.Identity())
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 5, `retried audit should be applied once`)
+	})
+
+	t.Run("rejected requests", func(t *testing.T) {
+
+		err := c.Queue.Push(&Request{Method: `POST`, Path: `/v1/checkins`, Body: []byte(`{}`)})
+		gotest.Ok(t, err)
+
+		n, err := c.Flush()
+		gotest.Ok(t, err)
+		gotest.Assert(t, n == 0 && c.Queue.Len() == 0 && c.Queue.Rejected() == 1,
+			`invalid request should be rejected, not retried`)
+	})
+}
+
+// testReader is a Magtek reader whose NVRAM is simulated in memory.
+type testReader struct {
+	*usbci.Magtek
+	nvram string
+	fail bool
+}
+
+func (this *testReader) GetDeviceSN() (string, error) {
+	return this.nvram, nil
+}
+
+func (this *testReader) SetDeviceSN(val string) (error) {
+	if this.fail {
+		this.nvram = val[:len(val) - 1]
+	} else {
+		this.nvram = val
+	}
+	return nil
+}
+
+func (this *testReader) Refresh() (map[string]bool) {
+	this.DeviceSN, this.SerialNum = this.nvram, this.nvram
+	return nil
+}
+
+func TestProvision(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `client`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := newServer(t, dir)
+
+	alloc, err := server.NewAllocator(filepath.Join(dir, `allocations.json`),
+		&server.Pool{Name: `store`, Format: `S%06d`, Next: 1})
+	gotest.Ok(t, err)
+
+	srv.Handler.(*server.Server).Allocator = alloc
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c, err := New(&Config{URL: ts.URL, Retries: -1})
+	gotest.Ok(t, err)
+
+	pools, err := c.Pools()
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(pools) == 1 && pools[0].Name == `store`, `pool should be listed`)
+
+	dev := &testReader{Magtek: testdevice.Magtek(t, `mag1`)}
+
+	a, err := c.Provision(`store`, dev)
+	gotest.Ok(t, err)
+	gotest.Assert(t, a.Serial == `S000001` && a.State == server.StateConfirmed, `allocation should be confirmed`)
+	gotest.Assert(t, dev.nvram == a.Serial && dev.SerialNum == a.Serial, `serial should be written and refreshed`)
+
+	_, err = c.Provision(`store`, dev)
+	gotest.Assert(t, err == ErrHasSerial, `serialized device should be refused`)
+
+	bad := &testReader{Magtek: testdevice.Magtek(t, `gen1`), fail: true}
+
+	a, err = c.Provision(`store`, bad)
+	gotest.Assert(t, err != nil, `failed verification should be an error`)
+
+	a, err = alloc.Allocation(a.Serial)
+	gotest.Ok(t, err)
+	gotest.Assert(t, a.State == server.StateReleased, `failed allocation should be released`)
+
+	_, err = c.Provision(`none`, &testReader{Magtek: testdevice.Magtek(t, `mag2`)})
+	se, ok := err.(*StatusError)
+	gotest.Assert(t, ok && se.Status == http.StatusNotFound, `unknown pool should not be found`)
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	`errors`
+	`fmt`
+	`net/http`
+	`net/url`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/server`
+)
+
+var (
+	ErrHasSerial = errors.New(`device already has a serial number`)
+)
+
+// Pools returns the serial number pools of the server.
+func (this *Client) Pools() (pools []*server.Pool, err error) {
+	return pools, this.do(http.MethodGet, `/v1/pools`, nil, &pools)
+}
+
+// Reserve reserves the next serial number of a pool for a device.
+func (this *Client) Reserve(pool string, dev gocmdb.Identifiable) (a *server.Allocation, err error) {
+
+	req := &server.AllocationRequest{Key: history.Key(dev), HostName: dev.Host()}
+	err = this.do(http.MethodPost, `/v1/pools/` + url.PathEscape(pool) + `/allocations`, req, &a)
+
+	return a, err
+}
+
+// Confirm confirms that a reserved serial number was written to its device.
+func (this *Client) Confirm(a *server.Allocation) (*server.Allocation, error) {
+	return this.allocation(a, `confirm`)
+}
+
+// Release releases a reserved serial number that was not written.
+func (this *Client) Release(a *server.Allocation) (*server.Allocation, error) {
+	return this.allocation(a, `release`)
+}
+
+// Provision gives a device without a serial number a unique serial number
+// from a pool: it reserves the serial number, writes it with SetDeviceSN,
+// reads it back from the device and confirms the allocation. If the write
+// or the verification fails, the reservation is released. Devices that
+// already have a serial number are refused with ErrHasSerial.
+func (this *Client) Provision(pool string, dev gocmdb.Configurable) (*server.Allocation, error) {
+
+	sn, err := dev.GetDeviceSN()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sn != `` {
+		return nil, ErrHasSerial
+	}
+
+	a, err := this.Reserve(pool, dev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = dev.SetDeviceSN(a.Serial); err == nil {
+		if sn, err = dev.GetDeviceSN(); err == nil && sn != a.Serial {
+			err = fmt.Errorf(`serial number reads back as %q, expected %q`, sn, a.Serial)
+		}
+	}
+
+	if err != nil {
+
+		if _, rerr := this.Release(a); rerr != nil {
+			return a, fmt.Errorf(`%v; release %s: %v`, err, a.Serial, rerr)
+		}
+
+		return a, err
+	}
+
+	dev.Refresh()
+
+	return this.Confirm(a)
+}
+
+// allocation confirms or releases an allocation.
+func (this *Client) allocation(a *server.Allocation, action string) (na *server.Allocation, err error) {
+
+	req := &server.AllocationRequest{Key: a.Key}
+	err = this.do(http.MethodPost, `/v1/allocations/` + url.PathEscape(a.Serial) + `/` + action, req, &na)
+
+	return na, err
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`sort`
+	`strings`
+	`sync`
+	`time`
+)
+
+const (
+	QueueExt string = `.json`
+	RejectedDir string = `rejected`
+)
+
+// Request is a submission held in the offline queue.
+type Request struct {
+	Method string			`json:"method"`
+	Path   string			`json:"path"`
+	Body   json.RawMessage		`json:"body"`
+	Key    string			`json:"idempotency_key,omitempty"`
+	Queued time.Time		`json:"queued"`
+}
+
+// Queue holds submissions that could not be delivered, one file per
+// request in a directory, so that they survive a restart. Requests are
+// delivered in the order they were queued.
+type Queue struct {
+	Dir string
+	seq int64
+	mutex sync.Mutex
+}
+
+// NewQueue instantiates a Queue, creating its directory if needed.
+func NewQueue(dir string) (*Queue, error) {
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &Queue{Dir: dir}, nil
+}
+
+// Push adds a request to the end of the queue.
+func (this *Queue) Push(req *Request) (error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	b, err := json.Marshal(req)
+
+	if err != nil {
+		return err
+	}
+
+	seq := time.Now().UnixNano()
+
+	if seq <= this.seq {
+		seq = this.seq + 1
+	}
+
+	this.seq = seq
+	fn := filepath.Join(this.Dir, fmt.Sprintf(`%020d%s`, seq, QueueExt))
+
+	if err = ioutil.WriteFile(fn + `.tmp`, b, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(fn + `.tmp`, fn)
+}
+
+// Len returns the number of queued requests.
+func (this *Queue) Len() (int) {
+	fns, _ := this.files()
+	return len(fns)
+}
+
+// Drain calls send with each queued request, oldest first, removing each
+// request that is sent. A request refused with a permanent error, one with
+// a Permanent method that returns true, is moved to the RejectedDir
+// subdirectory for inspection so that it does not block the queue. Drain
+// stops at the first other error and returns the number of requests sent.
+func (this *Queue) Drain(send func(*Request) (error)) (n int, err error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fns, err := this.files()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, fn := range fns {
+
+		b, err := ioutil.ReadFile(fn)
+
+		if err != nil {
+			return n, err
+		}
+
+		req := new(Request)
+
+		if err = json.Unmarshal(b, req); err != nil {
+			return n, fmt.Errorf(`%s: %v`, fn, err)
+		}
+
+		if err = send(req); isPermanent(err) {
+			if err = this.reject(fn); err != nil {
+				return n, err
+			}
+			continue
+		} else if err != nil {
+			return n, err
+		}
+
+		if err = os.Remove(fn); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// Rejected returns the number of rejected requests.
+func (this *Queue) Rejected() (int) {
+	fis, _ := ioutil.ReadDir(filepath.Join(this.Dir, RejectedDir))
+	return len(fis)
+}
+
+// reject moves a request file to the rejected directory.
+func (this *Queue) reject(fn string) (error) {
+
+	dir := filepath.Join(this.Dir, RejectedDir)
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	return os.Rename(fn, filepath.Join(dir, filepath.Base(fn)))
+}
+
+// isPermanent reports whether an error says that retrying cannot succeed.
+func isPermanent(err error) (bool) {
+	p, ok := err.(interface{Permanent() (bool)})
+	return ok && p.Permanent()
+}
+
+// files returns the queued request files in order.
+func (this *Queue) files() (fns []string, err error) {
+
+	fis, err := ioutil.ReadDir(this.Dir)
+
+	if err != nil {
+		return fns, err
+	}
+
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), QueueExt) {
+			fns = append(fns, filepath.Join(this.Dir, fi.Name()))
+		}
+	}
+
+	sort.Strings(fns)
+
+	return fns, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gocmdb-auditlog verifies the hash chain of an audit log and
+// reports its head, or lists its entries. A head recorded earlier, e.g. in
+// a CMDB, can be given to detect truncation of both the log and its head
+// file.
+//
+// Usage:
+//
+//	gocmdb-auditlog [-expect seq:hash] audit.log
+//	gocmdb-auditlog -list audit.log
+package main
+
+import (
+	`encoding/json`
+	`flag`
+	`fmt`
+	`os`
+	`strconv`
+	`strings`
+
+	`github.com/jscherff/gocmdb/auditlog`
+)
+
+const (
+	ExitOK int = 0
+	ExitError int = 1
+	ExitInvalid int = 2
+)
+
+var (
+	fExpect = flag.String(`expect`, ``, `expected head entry as seq:hash`)
+	fList = flag.Bool(`list`, false, `list entries, one JSON object per line, after verifying`)
+)
+
+func main() {
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-expect seq:hash] [-list] audit.log\n", os.Args[0])
+		os.Exit(ExitError)
+	}
+
+	fn := flag.Arg(0)
+
+	expect, err := parseHead(*fExpect)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	head, err := auditlog.VerifyHead(fn, expect)
+
+	if err != nil {
+		fatal(ExitInvalid, err)
+	}
+
+	if *fList {
+
+		es, err := auditlog.Entries(fn)
+
+		if err != nil {
+			fatal(ExitError, err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+
+		for _, e := range es {
+			if err = enc.Encode(e); err != nil {
+				fatal(ExitError, err)
+			}
+		}
+
+		return
+	}
+
+	fmt.Printf("%s: valid, %d entries, head %d:%s\n", fn, head.Seq, head.Seq, head.Hash)
+}
+
+// parseHead parses a head given as seq:hash.
+func parseHead(s string) (head auditlog.Head, err error) {
+
+	if s == `` {
+		return head, nil
+	}
+
+	parts := strings.SplitN(s, `:`, 2)
+
+	if len(parts) != 2 {
+		return head, fmt.Errorf(`invalid head %q: expected seq:hash`, s)
+	}
+
+	if head.Seq, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return head, fmt.Errorf(`invalid head %q: %v`, s, err)
+	}
+
+	head.Hash = parts[1]
+
+	return head, nil
+}
+
+// fatal prints an error and exits with the given code.
+func fatal(code int, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(code)
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gocmdb-duplicates finds serial numbers shared by more than one
+// device in a history store or a set of snapshot files, explains each
+// conflict and proposes corrected serial numbers.
+//
+// Usage:
+//
+//	gocmdb-duplicates [-key file] [-json] -history dir
+//	gocmdb-duplicates [-json] -db file
+//	gocmdb-duplicates [-key file] [-json] snapshot.json ...
+package main
+
+import (
+	`encoding/json`
+	`flag`
+	`fmt`
+	`os`
+
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/duplicates`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/sqlstore`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	ExitOK int = 0
+	ExitError int = 1
+	ExitConflicts int = 2
+)
+
+var (
+	fHistory = flag.String(`history`, ``, `history directory to check`)
+	fDB = flag.String(`db`, ``, `SQLite database file to check`)
+	fKey = flag.String(`key`, ``, `encryption key file for encrypted snapshots and history`)
+	fJSON = flag.Bool(`json`, false, `print conflicts as a JSON array`)
+)
+
+func main() {
+
+	flag.Parse()
+
+	sources := 0
+
+	for _, set := range []bool{flag.NArg() > 0, *fHistory != ``, *fDB != ``} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-key file] [-json] -history dir | -db file | snapshot.json ...\n", os.Args[0])
+		os.Exit(ExitError)
+	}
+
+	var (
+		ciph *crypt.Cipher
+		devs []*duplicates.Device
+		err error
+	)
+
+	if *fKey != `` {
+		if ciph, err = crypt.LoadKey(*fKey); err != nil {
+			fatal(err)
+		}
+		usbci.SetSnapshotCipher(ciph)
+	}
+
+	switch {
+
+	case *fHistory != ``:
+		var hs *history.FileStore
+		if hs, err = history.NewFileStore(*fHistory); err == nil {
+			hs.Cipher = ciph
+			devs, err = duplicates.FromStore(hs)
+		}
+
+	case *fDB != ``:
+		var repo *sqlstore.Repo
+		if repo, err = sqlstore.Open(*fDB); err == nil {
+			defer repo.Close()
+			devs, err = duplicates.FromStore(repo)
+		}
+
+	default:
+		devs, err = duplicates.FromFiles(flag.Args()...)
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+
+	cs := duplicates.Find(devs)
+
+	if *fJSON {
+
+		if cs == nil {
+			cs = []*duplicates.Conflict{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent(``, `  `)
+
+		if err = enc.Encode(cs); err != nil {
+			fatal(err)
+		}
+
+	} else {
+
+		for _, c := range cs {
+
+			fmt.Println(c)
+
+			for _, p := range c.Proposals {
+				fmt.Printf("\t%s: change %q to %q (%s)\n", p.Source, p.OldValue, p.NewValue, p.Reason)
+			}
+		}
+	}
+
+	if len(cs) > 0 {
+		os.Exit(ExitConflicts)
+	}
+}
+
+// fatal prints an error and exits.
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(ExitError)
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gocmdb-schema prints the JSON Schema, XML Schema, CSV columns or
+// NVP names of a reportable device type, or validates a JSON or XML report
+// against the generated schema.
+//
+// Usage:
+//
+//	gocmdb-schema [-type generic|magtek] [-format json|xsd|csv|nvp]
+//	gocmdb-schema [-type generic|magtek] -validate report.json
+package main
+
+import (
+	`bytes`
+	`flag`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`strings`
+
+	`github.com/jscherff/gocmdb/schema`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	ExitOK int = 0
+	ExitError int = 1
+	ExitInvalid int = 2
+)
+
+var (
+	fType = flag.String(`type`, `magtek`, `device type: generic or magtek`)
+	fFormat = flag.String(`format`, `json`, `schema format: json, xsd, csv or nvp`)
+	fValidate = flag.String(`validate`, ``, `validate a JSON or XML report `+
+		`file against the schema instead of printing it`)
+
+	types = map[string]string{
+		`generic`: new(usbci.Generic).Type(),
+		`magtek`: new(usbci.Magtek).Type(),
+	}
+)
+
+func main() {
+
+	flag.Parse()
+
+	objectType, ok := types[strings.ToLower(*fType)]
+
+	if !ok {
+		objectType = *fType
+	}
+
+	obj, err := usbci.NewObject(objectType)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	if *fValidate != `` {
+		validate(obj, *fValidate)
+		return
+	}
+
+	var b []byte
+
+	switch strings.ToLower(*fFormat) {
+
+	case `json`:
+		var s *schema.Schema
+		if s, err = schema.JSONSchema(obj); err == nil {
+			b, err = s.PrettyJSON()
+		}
+
+	case `xsd`, `xml`:
+		var s *schema.XMLSchema
+		if s, err = schema.XSD(obj); err == nil {
+			b, err = s.PrettyXML()
+		}
+
+	case `csv`, `nvp`:
+		var fs []schema.Field
+		if fs, err = schema.Fields(obj, strings.ToLower(*fFormat)); err == nil {
+			for _, f := range fs {
+				b = append(b, f.Name + "\n"...)
+			}
+		}
+
+	default:
+		err = fmt.Errorf(`unknown format %q`, *fFormat)
+	}
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	os.Stdout.Write(b)
+
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		fmt.Println()
+	}
+}
+
+// validate checks a report file against the schema for an object.
+func validate(obj interface{}, fn string) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	var v interface{Validate([]byte) (error)}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`<`)) {
+		v, err = schema.XSD(obj)
+	} else {
+		v, err = schema.JSONSchema(obj)
+	}
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	if err = v.Validate(b); err != nil {
+		fatal(ExitInvalid, err)
+	}
+
+	fmt.Printf("%s: valid\n", fn)
+}
+
+// fatal prints an error and exits with the given code.
+func fatal(code int, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(code)
+}
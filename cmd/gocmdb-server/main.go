@@ -0,0 +1,190 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gocmdb-server serves the CMDB REST API of package server. Devices
+// are kept in a directory of history files or in a SQLite database, and
+// host check-ins in a JSON file beside them. With -pools the server
+// allocates serial numbers from the pools defined in a JSON file and keeps
+// the allocations in the data directory. With -cert and -key the server
+// uses TLS.
+//
+// Requests, including queries, are not authenticated unless -tokens or
+// -client-ca is given. With -tokens they must carry one of the bearer tokens
+// in the file; with -client-ca they may instead present a client certificate
+// issued by one of the CAs in the file, which requires TLS.
+//
+// Usage:
+//
+//	gocmdb-server [-listen addr] [-dir dir | -db file] [-pools file] [-cert file -key file]
+//		[-tokens file] [-client-ca file]
+package main
+
+import (
+	`context`
+	`crypto/tls`
+	`crypto/x509`
+	`flag`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`os`
+	`os/signal`
+	`path/filepath`
+	`syscall`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/server`
+	`github.com/jscherff/gocmdb/sqlstore`
+)
+
+const (
+	ExitOK int = 0
+	ExitError int = 1
+
+	CheckInFile string = `checkins.json`
+	AllocationFile string = `allocations.json`
+)
+
+var (
+	fListen = flag.String(`listen`, `:8080`, `listen address`)
+	fDir = flag.String(`dir`, `gocmdb-data`, `data directory`)
+	fDB = flag.String(`db`, ``, `SQLite database file, used instead of history files in the data directory`)
+	fPools = flag.String(`pools`, ``, `serial number pool definitions, a JSON array of pools`)
+	fCert = flag.String(`cert`, ``, `TLS certificate file`)
+	fKey = flag.String(`key`, ``, `TLS private key file`)
+	fTokens = flag.String(`tokens`, ``, `bearer tokens accepted for changes, one per line`)
+	fClientCA = flag.String(`client-ca`, ``, `CA certificates of client certificates accepted for changes`)
+)
+
+func main() {
+
+	flag.Parse()
+
+	if err := os.MkdirAll(*fDir, 0750); err != nil {
+		fatal(ExitError, err)
+	}
+
+	var (
+		hs history.Store
+		err error
+	)
+
+	if *fDB != `` {
+		var repo *sqlstore.Repo
+		if repo, err = sqlstore.Open(*fDB); err == nil {
+			defer repo.Close()
+			hs = repo
+		}
+	} else {
+		hs, err = history.NewFileStore(filepath.Join(*fDir, `history`))
+	}
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	store, err := server.NewHistoryStore(hs, filepath.Join(*fDir, CheckInFile))
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	handler := server.New(store)
+
+	if *fPools != `` {
+
+		pools, err := server.LoadPools(*fPools)
+
+		if err != nil {
+			fatal(ExitError, err)
+		}
+
+		if handler.Allocator, err = server.NewAllocator(filepath.Join(*fDir, AllocationFile), pools...); err != nil {
+			fatal(ExitError, err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr: *fListen,
+		Handler: handler,
+		ReadTimeout: time.Minute,
+		WriteTimeout: time.Minute,
+	}
+
+	var auths []server.Authorizer
+
+	if *fTokens != `` {
+
+		tokens, err := server.LoadTokens(*fTokens)
+
+		if err != nil {
+			fatal(ExitError, err)
+		}
+
+		auths = append(auths, server.BearerTokens(tokens...))
+	}
+
+	if *fClientCA != `` {
+
+		if *fCert == `` {
+			fatal(ExitError, fmt.Errorf(`-client-ca requires -cert and -key`))
+		}
+
+		b, err := ioutil.ReadFile(*fClientCA)
+
+		if err != nil {
+			fatal(ExitError, err)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(b) {
+			fatal(ExitError, fmt.Errorf(`%s: no certificates found`, *fClientCA))
+		}
+
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		auths = append(auths, server.ClientCert)
+	}
+
+	if len(auths) > 0 {
+		handler.Authorize = server.AnyOf(auths...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+
+	if *fCert != `` || *fKey != `` {
+		err = srv.ListenAndServeTLS(*fCert, *fKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		fatal(ExitError, err)
+	}
+}
+
+// fatal prints an error and exits with the given code.
+func fatal(code int, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(code)
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`flag`
+	`fmt`
+	`os`
+	`os/signal`
+	`syscall`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/agent`
+)
+
+// cmdAgent runs the inventory agent until it receives SIGINT or SIGTERM.
+func cmdAgent(args []string) (int) {
+
+	fs := flag.NewFlagSet(`agent`, flag.ExitOnError)
+	config := fs.String(`config`, `gocmdb-agent.json`, `agent configuration file`)
+	once := fs.Bool(`once`, false, `run once, print the summary and exit`)
+	fs.Parse(args)
+
+	cfg, err := agent.LoadConfig(*config)
+
+	if err != nil {
+		fatal(ExitUsage, err)
+	}
+
+	sel := &selector{vid: cfg.VendorID, pid: cfg.ProductID}
+
+	if err = sel.validate(); err != nil {
+		fatal(ExitUsage, err)
+	}
+
+	a, err := agent.New(cfg, sel.enumerate)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	if *once {
+
+		sum := a.RunOnce()
+		sel.json = true
+		sel.print(sum)
+
+		if len(sum.Errors) > 0 {
+			return ExitError
+		}
+
+		return ExitOK
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = a.Run(ctx); err != nil {
+		warn(err)
+		return ExitError
+	}
+
+	return ExitOK
+}
+
+// enumerate opens the selected devices for an agent run.
+func (this *selector) enumerate() ([]gocmdb.Auditable, func(), error) {
+
+	ctx := gousb.NewContext()
+	devs, err := this.open(ctx)
+
+	release := func() {
+		closeAll(devs)
+		ctx.Close()
+	}
+
+	ads := make([]gocmdb.Auditable, len(devs))
+
+	for i, dev := range devs {
+		ads[i] = dev.GenericUSB
+	}
+
+	if err != nil {
+		err = fmt.Errorf(`enumerate: %v`, err)
+	}
+
+	return ads, release, err
+}
@@ -0,0 +1,661 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/batch`
+	`github.com/jscherff/gocmdb/client`
+	`github.com/jscherff/gocmdb/inventory`
+	`github.com/jscherff/gocmdb/provision`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	ActionSave string = `save`
+	ActionProvision string = `provision`
+)
+
+// Listing identifies a device in the output of the list command.
+type Listing struct {
+	BusNumber  int			`json:"bus_number"`
+	PortNumber int			`json:"port_number"`
+	BusAddress int			`json:"bus_address"`
+	VendorID   string		`json:"vendor_id"`
+	ProductID  string		`json:"product_id"`
+	ObjectType string		`json:"object_type"`
+	SerialNum  string		`json:"serial_number"`
+	Device     string		`json:"device"`
+}
+
+// Result is the outcome of an operation on a device.
+type Result struct {
+	Device     string			`json:"device"`
+	Action     string			`json:"action,omitempty"`
+	File       string			`json:"file,omitempty"`
+	OldValue   string			`json:"old_value,omitempty"`
+	NewValue   string			`json:"new_value,omitempty"`
+	Changes    [][]string		`json:"changes,omitempty"`
+	Violations []*usbci.PolicyError	`json:"violations,omitempty"`
+	DryRun     bool			`json:"dry_run,omitempty"`
+	Error      string			`json:"error,omitempty"`
+}
+
+// cmdList lists the selected devices.
+func cmdList(args []string) (int) {
+
+	fs, sel := newFlagSet(`list`)
+	fs.Parse(args)
+
+	return run(sel, func(devs []device) (int) {
+
+		for _, dev := range devs {
+
+			l := &Listing{
+				BusNumber: dev.gen.BusNumber,
+				PortNumber: dev.gen.PortNumber,
+				BusAddress: dev.gen.BusAddress,
+				VendorID: dev.gen.VendorID,
+				ProductID: dev.gen.ProductID,
+				ObjectType: dev.gen.ObjectType,
+				SerialNum: dev.gen.SerialNum,
+				Device: dev.gen.Identity(),
+			}
+
+			sel.print(l, strconv.Itoa(l.BusNumber), strconv.Itoa(l.PortNumber),
+				strconv.Itoa(l.BusAddress), l.VendorID, l.ProductID,
+				l.ObjectType, l.SerialNum)
+		}
+
+		return ExitOK
+	})
+}
+
+// cmdReport reports the selected devices in the requested format.
+func cmdReport(args []string) (int) {
+
+	fs, sel := newFlagSet(`report`)
+	format := fs.String(`format`, `json`, `report format: json, xml, csv, nvp or legacy`)
+	pretty := fs.Bool(`pretty`, false, `indent json and xml reports`)
+	inv := fs.Bool(`inventory`, false, `wrap the reports in an inventory with host metadata`)
+	fs.Parse(args)
+
+	switch *format {
+	case `json`, `xml`, `csv`, `nvp`, `legacy`:
+	default:
+		fatal(ExitUsage, fmt.Errorf(`unknown report format %q`, *format))
+	}
+
+	return run(sel, func(devs []device) (int) {
+
+		doc := inventory.New()
+
+		for _, dev := range devs {
+			doc.Add(dev)
+		}
+
+		var (
+			b []byte
+			err error
+		)
+
+		if *inv {
+			b, err = documentReport(doc, *format, *pretty)
+		} else {
+			b, err = deviceReport(doc, *format, *pretty)
+		}
+
+		if err != nil {
+			warn(err)
+			return ExitError
+		}
+
+		os.Stdout.Write(b)
+
+		return ExitOK
+	})
+}
+
+// documentReport reports an inventory, or another document such as a
+// reconciliation, as a single document.
+func documentReport(doc gocmdb.Reportable, format string, pretty bool) (b []byte, err error) {
+
+	switch format {
+	case `json`:
+		if pretty {
+			b, err = doc.PrettyJSON()
+		} else {
+			b, err = doc.JSON()
+		}
+	case `xml`:
+		if pretty {
+			b, err = doc.PrettyXML()
+		} else {
+			b, err = doc.XML()
+		}
+	case `csv`:
+		return doc.CSV()
+	case `nvp`:
+		return doc.NVP()
+	case `legacy`:
+		return doc.Legacy(), nil
+	}
+
+	return append(b, '\n'), err
+}
+
+// deviceReport reports each device of an inventory on its own: JSON and XML
+// reports one per line unless indented, CSV reports under a single header
+// and NVP reports separated by blank lines.
+func deviceReport(doc *inventory.Inventory, format string, pretty bool) (b []byte, err error) {
+
+	switch format {
+	case `csv`:
+		return doc.CSV()
+	case `legacy`:
+		return doc.Legacy(), nil
+	}
+
+	for i, dev := range doc.Devices {
+
+		var r []byte
+
+		switch {
+		case format == `json` && pretty:
+			r, err = dev.PrettyJSON()
+		case format == `json`:
+			r, err = dev.JSON()
+		case format == `xml` && pretty:
+			r, err = dev.PrettyXML()
+		case format == `xml`:
+			r, err = dev.XML()
+		case format == `nvp`:
+			if i > 0 {
+				b = append(b, '\n')
+			}
+			r, err = dev.NVP()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, r...)
+
+		if len(r) > 0 && r[len(r) - 1] != '\n' {
+			b = append(b, '\n')
+		}
+	}
+
+	return b, nil
+}
+
+// cmdSave saves a snapshot of each selected device in a directory.
+func cmdSave(args []string) (int) {
+
+	fs, sel := newFlagSet(`save`)
+	dir := fs.String(`dir`, `.`, `snapshot directory`)
+	format := fs.String(`format`, `json`, `snapshot format: json, yaml, toml, xml, csv or nvp`)
+	fs.Parse(args)
+
+	return run(sel, func(devs []device) (code int) {
+
+		for _, dev := range devs {
+
+			r := &Result{Device: dev.gen.Identity(), Action: ActionSave}
+			r.File = snapshotFile(*dir, dev, *format)
+
+			if err := dev.Save(r.File); err != nil {
+				code = sel.fail(r, err)
+				continue
+			}
+
+			sel.print(r, r.Device, r.File)
+		}
+
+		return code
+	})
+}
+
+// cmdAudit audits each selected device against its snapshot in a directory
+// and prints the changes, one per line in text output.
+func cmdAudit(args []string) (int) {
+
+	fs, sel := newFlagSet(`audit`)
+	dir := fs.String(`dir`, `.`, `snapshot directory`)
+	format := fs.String(`format`, `json`, `snapshot format: json, yaml, toml, xml, csv or nvp`)
+	fs.Parse(args)
+
+	return run(sel, func(devs []device) (code int) {
+
+		changed := false
+
+		for _, dev := range devs {
+
+			r := &Result{Device: dev.gen.Identity(), Action: usbci.EventAudit}
+			r.File = snapshotFile(*dir, dev, *format)
+
+			if err := dev.AuditFile(r.File); err != nil {
+				code = sel.fail(r, err)
+				continue
+			}
+
+			r.Changes = dev.GetChanges()
+			r.Violations = dev.gen.CheckSerials()
+			changed = changed || len(r.Changes) > 0 || len(r.Violations) > 0
+
+			if sel.json {
+				sel.print(r)
+				continue
+			}
+
+			for _, c := range r.Changes {
+				sel.print(nil, append([]string{r.Device}, c...)...)
+			}
+
+			for _, v := range r.Violations {
+				sel.print(nil, r.Device, `policy`, v.Field, v.Serial, strings.Join(v.Violations, `; `))
+			}
+		}
+
+		return exitCode(code, nil, changed)
+	})
+}
+
+// cmdSerial gets, sets, erases, copies or provisions the configurable
+// serial numbers of the selected devices, writes them from a manifest, or
+// rolls back a journaled batch.
+func cmdSerial(args []string) (int) {
+
+	if len(args) == 0 {
+		fatal(ExitUsage, fmt.Errorf(`serial: missing action: get, set, erase, copy-factory, provision, manifest or rollback`))
+	}
+
+	action := args[0]
+
+	fs, sel := newFlagSet(`serial ` + action)
+	url := fs.String(`server`, ``, `CMDB server URL, for provision`)
+	ca := fs.String(`ca`, ``, `CA certificate file of the CMDB server, for provision`)
+	tfn := fs.String(`token-file`, ``, `file holding the bearer token of the CMDB server, for provision`)
+	dryRun := fs.Bool(`dry-run`, false, `report the writes that would be made without making them`)
+	jfn := fs.String(`journal`, ``, `rollback journal file; roll back all devices if any fails`)
+	report := fs.String(`report`, ``, `write the manifest result report to this .json or .csv file`)
+	fs.Parse(args[1:])
+
+	var op func(gocmdb.Configurable, *Result) (error)
+
+	switch action {
+
+	case `get`:
+		return run(sel, func(devs []device) (int) {
+			for _, dev := range devs {
+				r := &Result{Device: dev.gen.Identity(), NewValue: dev.ID()}
+				sel.print(r, r.Device, r.NewValue)
+			}
+			return ExitOK
+		})
+
+	case `set`:
+		if fs.NArg() != 1 {
+			fatal(ExitUsage, fmt.Errorf(`serial set: expected one serial number`))
+		}
+		val := fs.Arg(0)
+		op = func(cdev gocmdb.Configurable, r *Result) (error) {
+			r.Action, r.NewValue = usbci.EventSetDeviceSN, val
+			return cdev.SetDeviceSN(val)
+		}
+
+	case `erase`:
+		op = func(cdev gocmdb.Configurable, r *Result) (error) {
+			r.Action = usbci.EventEraseDeviceSN
+			return cdev.EraseDeviceSN()
+		}
+
+	case `copy-factory`:
+		n := usbci.DefaultSNLength
+		if fs.NArg() > 0 {
+			var err error
+			if n, err = strconv.Atoi(fs.Arg(0)); err != nil || n <= 0 {
+				fatal(ExitUsage, fmt.Errorf(`serial copy-factory: invalid length %q`, fs.Arg(0)))
+			}
+		}
+		op = func(cdev gocmdb.Configurable, r *Result) (error) {
+			r.Action = usbci.EventCopyFactorySN
+			return cdev.CopyFactorySN(n)
+		}
+
+	case `provision`:
+		if fs.NArg() != 1 || *url == `` {
+			fatal(ExitUsage, fmt.Errorf(`serial provision: expected -server and one pool name`))
+		}
+		var token []byte
+		if *tfn != `` {
+			var err error
+			if token, err = ioutil.ReadFile(*tfn); err != nil {
+				fatal(ExitError, err)
+			}
+		}
+		c, err := client.New(&client.Config{URL: *url, CAFile: *ca, Token: strings.TrimSpace(string(token))})
+		if err != nil {
+			fatal(ExitError, err)
+		}
+		pool := fs.Arg(0)
+		op = func(cdev gocmdb.Configurable, r *Result) (error) {
+			r.Action = ActionProvision
+			a, err := c.Provision(pool, cdev)
+			if a != nil {
+				r.NewValue = a.Serial
+			}
+			return err
+		}
+
+	case `manifest`:
+		if fs.NArg() != 1 || *jfn != `` {
+			fatal(ExitUsage, fmt.Errorf(`serial manifest: expected one manifest file and no -journal`))
+		}
+		m, err := provision.LoadManifest(fs.Arg(0))
+		if err != nil {
+			fatal(ExitError, err)
+		}
+		return run(sel, func(devs []device) (int) {
+			return sel.manifest(m, devs, *dryRun, *report)
+		})
+
+	case `rollback`:
+		if *jfn == `` {
+			fatal(ExitUsage, fmt.Errorf(`serial rollback: expected -journal`))
+		}
+		return run(sel, func(devs []device) (int) {
+			return sel.transaction(*jfn, devs, nil)
+		})
+
+	default:
+		fatal(ExitUsage, fmt.Errorf(`serial: unknown action %q`, action))
+	}
+
+	if (*dryRun || *jfn != ``) && action == `provision` {
+		fatal(ExitUsage, fmt.Errorf(`serial provision: -dry-run and -journal are not supported`))
+	}
+
+	if *dryRun && *jfn != `` {
+		fatal(ExitUsage, fmt.Errorf(`serial %s: -dry-run and -journal are exclusive`, action))
+	}
+
+	var plan *batch.Plan
+
+	if *dryRun {
+		plan = new(batch.Plan)
+		plan.Attach()
+		defer usbci.SetWriteHandler(nil)
+	}
+
+	// apply changes the serial number of one device and checks that it
+	// reads back as expected, unless it is a dry run.
+	apply := func(dev device, r *Result) (error) {
+
+		cdev, ok := dev.GenericUSB.(gocmdb.Configurable)
+
+		if !ok {
+			return fmt.Errorf(`serial number is not configurable`)
+		}
+
+		if err := op(cdev, r); err != nil || plan != nil {
+			return err
+		}
+
+		dev.Refresh()
+
+		if r.Action != usbci.EventEraseDeviceSN && r.NewValue != `` && dev.ID() != r.NewValue {
+			return fmt.Errorf(`serial number reads back as %q`, dev.ID())
+		}
+
+		r.NewValue = dev.ID()
+
+		return nil
+	}
+
+	return run(sel, func(devs []device) (code int) {
+
+		if action == `set` && len(devs) != 1 {
+			warn(fmt.Errorf(`serial set: %d devices selected, select exactly one`, len(devs)))
+			return ExitUsage
+		}
+
+		if *jfn != `` {
+			return sel.transaction(*jfn, devs, apply)
+		}
+
+		for _, dev := range devs {
+
+			r := &Result{Device: dev.gen.Identity(), OldValue: dev.ID()}
+			seen := 0
+
+			if plan != nil {
+				seen = len(plan.Writes())
+			}
+
+			if err := apply(dev, r); err != nil {
+				code = sel.fail(r, err)
+				continue
+			}
+
+			if plan == nil {
+				sel.print(r, r.Device, r.Action, r.OldValue, r.NewValue)
+				continue
+			}
+
+			for _, w := range plan.Writes()[seen:] {
+				r := &Result{Device: w.Device, Action: w.Action, OldValue: w.OldValue, NewValue: w.NewValue, DryRun: true}
+				sel.print(r, r.Device, r.Action, r.OldValue, r.NewValue, `dry-run`)
+			}
+		}
+
+		return code
+	})
+}
+
+// manifest writes the device serial numbers assigned in a manifest to the
+// selected readers and prints the results, writing the full report to a
+// file if one is given.
+func (this *selector) manifest(m provision.Manifest, devs []device, dryRun bool, fn string) (int) {
+
+	var readers []provision.Reader
+
+	for _, dev := range devs {
+		if r, ok := dev.GenericUSB.(provision.Reader); ok {
+			readers = append(readers, r)
+		}
+	}
+
+	rpt, err := provision.Run(m, readers, dryRun)
+
+	if err != nil {
+		warn(err)
+		return ExitError
+	}
+
+	for _, r := range rpt.Results {
+		this.print(r, r.FactorySN, r.DeviceSN, r.OldValue, r.NewValue, string(r.Status), r.Error)
+	}
+
+	if fn != `` {
+
+		var b []byte
+
+		if strings.ToLower(filepath.Ext(fn)) == `.csv` {
+			b, err = rpt.CSV()
+		} else {
+			b, err = rpt.JSON()
+		}
+
+		if err == nil {
+			err = ioutil.WriteFile(fn, b, 0640)
+		}
+
+		if err != nil {
+			warn(err)
+			return ExitError
+		}
+	}
+
+	if rpt.Failed() {
+		return ExitError
+	}
+
+	return ExitOK
+}
+
+// transaction applies a serial number change to every device with a
+// rollback journal, and rolls back all devices if any of them fails. With
+// no change, it rolls back the unfinished batch in the journal instead.
+func (this *selector) transaction(fn string, devs []device, apply func(device, *Result) (error)) (code int) {
+
+	j, err := batch.Open(fn)
+
+	if err != nil {
+		warn(err)
+		return ExitError
+	}
+
+	var undoers []batch.Undoer
+	index := make(map[string]device)
+
+	for _, dev := range devs {
+
+		u, ok := dev.GenericUSB.(batch.Undoer)
+
+		if !ok {
+			warn(fmt.Errorf(`%s: serial number is not configurable; batch not started`, dev.gen.Identity()))
+			return ExitError
+		}
+
+		undoers = append(undoers, u)
+		index[u.Identity()] = dev
+	}
+
+	if apply == nil {
+
+		ws := j.Writes()
+
+		if err = j.Rollback(undoers...); err != nil {
+			warn(err)
+			return ExitError
+		}
+
+		for i := len(ws) - 1; i >= 0; i-- {
+			r := &Result{Device: ws[i].Device, Action: usbci.EventRollback, OldValue: ws[i].NewValue, NewValue: ws[i].OldValue}
+			this.print(r, r.Device, r.Action, r.OldValue, r.NewValue)
+		}
+
+		return ExitOK
+	}
+
+	var rs []*Result
+
+	err = j.Run(undoers, func(u batch.Undoer) (error) {
+		dev := index[u.Identity()]
+		r := &Result{Device: u.Identity(), OldValue: dev.ID()}
+		rs = append(rs, r)
+		return apply(dev, r)
+	})
+
+	if err != nil {
+
+		if len(rs) == 0 {
+			warn(err)
+			return ExitError
+		}
+
+		for _, r := range rs {
+			code = this.fail(r, err)
+		}
+
+		return code
+	}
+
+	for _, r := range rs {
+		this.print(r, r.Device, r.Action, r.OldValue, r.NewValue)
+	}
+
+	return ExitOK
+}
+
+// cmdReset resets the selected devices.
+func cmdReset(args []string) (int) {
+
+	fs, sel := newFlagSet(`reset`)
+	fs.Parse(args)
+
+	return run(sel, func(devs []device) (code int) {
+
+		for _, dev := range devs {
+
+			r := &Result{Device: dev.gen.Identity(), Action: usbci.EventReset}
+
+			if err := dev.Reset(); err != nil {
+				code = sel.fail(r, err)
+				continue
+			}
+
+			sel.print(r, r.Device, r.Action)
+		}
+
+		return code
+	})
+}
+
+// snapshotFile constructs the snapshot filename of a device.
+func snapshotFile(dir string, dev device, format string) (string) {
+	return filepath.Join(dir, dev.Filename() + `.` + strings.ToLower(format))
+}
+
+// print prints a result as a line of JSON or as a line of tab-separated
+// fields, depending on the output format of the command.
+func (this *selector) print(v interface{}, fields ...string) {
+
+	if !this.json {
+		fmt.Println(strings.Join(fields, "\t"))
+		return
+	}
+
+	if b, err := json.Marshal(v); err != nil {
+		warn(err)
+	} else {
+		fmt.Println(string(b))
+	}
+}
+
+// fail reports an operation that failed on a device: as a line of JSON with
+// the error, or on standard error in text output. It returns ExitError.
+func (this *selector) fail(r *Result, err error) (int) {
+
+	r.Error = err.Error()
+
+	if this.json {
+		this.print(r)
+	} else {
+		warn(fmt.Errorf(`%s: %v`, r.Device, err))
+	}
+
+	return ExitError
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`errors`
+	`flag`
+	`fmt`
+	`sort`
+	`strconv`
+	`strings`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+// device is an open device with its wrapper and the Generic wrapper that
+// holds its properties.
+type device struct {
+	gocmdb.GenericUSB
+	gen *usbci.Generic
+	gd *gousb.Device
+}
+
+// selector selects devices by vendor and product ID, bus and port number
+// and serial number, where zero values select all devices, and holds the
+// output format of the command.
+type selector struct {
+	vid    string
+	pid    string
+	bus    int
+	port   int
+	serial string
+	json   bool
+}
+
+// newFlagSet creates the flag set of a command with the device selection
+// and output flags.
+func newFlagSet(name string) (*flag.FlagSet, *selector) {
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	sel := new(selector)
+
+	fs.StringVar(&sel.vid, `vid`, ``, `select devices by vendor ID in hexadecimal`)
+	fs.StringVar(&sel.pid, `pid`, ``, `select devices by product ID in hexadecimal`)
+	fs.IntVar(&sel.bus, `bus`, 0, `select devices by bus number`)
+	fs.IntVar(&sel.port, `port`, 0, `select devices by port number`)
+	fs.StringVar(&sel.serial, `serial`, ``, `select devices by serial number`)
+	fs.BoolVar(&sel.json, `json`, false, `print results as one JSON object per line`)
+
+	return fs, sel
+}
+
+// open opens and wraps the selected devices, ordered by bus and port. Devices
+// that could not be opened or initialized are reported in the error, but the
+// remaining devices are returned.
+func (this *selector) open(ctx *gousb.Context) (devs []device, err error) {
+
+	match, err := this.matcher()
+
+	if err != nil {
+		return devs, err
+	}
+
+	gds, err := ctx.OpenDevices(match)
+
+	var errs []string
+
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	for _, gd := range gds {
+
+		dev, derr := newDevice(gd)
+
+		if derr != nil {
+			errs = append(errs, fmt.Sprintf(`%s: %v`, dev.gen.Identity(), derr))
+		}
+
+		if !this.selects(dev.ID()) {
+			gd.Close()
+			continue
+		}
+
+		devs = append(devs, dev)
+	}
+
+	sort.Slice(devs, func(i, j int) (bool) {
+		a, b := devs[i].gen, devs[j].gen
+		if a.BusNumber != b.BusNumber {
+			return a.BusNumber < b.BusNumber
+		}
+		return a.PortNumber < b.PortNumber
+	})
+
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, `; `))
+	}
+
+	return devs, err
+}
+
+// validate reports whether the selection flags are well-formed, so that
+// commands can refuse them as a usage error before opening any devices.
+func (this *selector) validate() (error) {
+	_, err := this.matcher()
+	return err
+}
+
+// matcher returns a function that reports whether a device descriptor
+// matches the vendor and product IDs and the bus and port numbers of the
+// selection.
+func (this *selector) matcher() (func(*gousb.DeviceDesc) (bool), error) {
+
+	vid, err := parseID(this.vid)
+
+	if err != nil {
+		return nil, fmt.Errorf(`vendor ID: %v`, err)
+	}
+
+	pid, err := parseID(this.pid)
+
+	if err != nil {
+		return nil, fmt.Errorf(`product ID: %v`, err)
+	}
+
+	return func(desc *gousb.DeviceDesc) (bool) {
+		return (vid == 0 || desc.Vendor == vid) &&
+			(pid == 0 || desc.Product == pid) &&
+			(this.bus == 0 || desc.Bus == this.bus) &&
+			(this.port == 0 || desc.Port == this.port)
+	}, nil
+}
+
+// selects reports whether a device with the given serial number matches
+// the serial number of the selection.
+func (this *selector) selects(serial string) (bool) {
+	return this.serial == `` || serial == this.serial
+}
+
+// newDevice wraps a device with the Magtek wrapper if it is a Magtek device
+// that responds to vendor commands and with the Generic wrapper otherwise.
+// Initialization failures are returned with the wrapped device.
+func newDevice(gd *gousb.Device) (device, error) {
+
+	if uint16(gd.Desc.Vendor) == usbci.MagtekVID {
+		if mdev, err := usbci.NewMagtek(gd); mdev != nil {
+			return device{mdev, mdev.Generic, gd}, err
+		}
+	}
+
+	gdev, err := usbci.NewGeneric(gd)
+
+	return device{gdev, gdev, gd}, err
+}
+
+// closeAll closes the underlying devices.
+func closeAll(devs []device) {
+	for _, dev := range devs {
+		dev.gd.Close()
+	}
+}
+
+// parseID parses a hexadecimal vendor or product ID. An empty string is
+// zero, which selects all devices.
+func parseID(s string) (gousb.ID, error) {
+
+	if s == `` {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(s, 16, 16)
+
+	if err != nil {
+		return 0, fmt.Errorf(`invalid ID %q`, s)
+	}
+
+	return gousb.ID(id), nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gocmdb lists, reports, saves and audits USB devices and reads and
+// writes the configurable serial numbers of devices that support them.
+//
+// Usage:
+//
+//	gocmdb [global flags] command [flags] [arguments]
+//
+// Commands:
+//
+//	list                                   list devices
+//	report [-format f] [-pretty] [-inventory]
+//	                                       report devices in json, xml, csv,
+//	                                       nvp or legacy format
+//	save [-dir d] [-format f]              save device snapshots
+//	audit [-dir d] [-format f]             audit devices against snapshots
+//	serial get                             print device serial numbers
+//	serial set SERIAL                      set the serial number of one device
+//	serial erase                           erase device serial numbers
+//	serial copy-factory [LENGTH]           copy factory serial numbers
+//	serial provision -server url POOL      assign serial numbers from a
+//	       [-ca file] [-token-file file]   server pool to unserialized devices
+//	serial manifest [-report f] FILE       write the serial numbers assigned
+//	                                       to readers by factory serial number
+//	                                       in a CSV or JSON manifest
+//	serial rollback -journal file          undo an unfinished journaled batch
+//	reset                                  reset devices
+//	agent [-config file] [-once]           run the inventory agent
+//	reconcile -manifest file [-host name]  report devices missing from,
+//	          [-format f] [-pretty]        unexpected on or mismatched with
+//	                                       the host's expected inventory
+//
+// Every command accepts the device selection flags -vid and -pid, in
+// hexadecimal, -bus and -port, and -serial, and selects all devices if none
+// are given. Commands that print results print tab-separated text, or one
+// JSON object per line with -json. The agent command selects devices with
+// the vendor_id and product_id settings of its configuration file instead.
+//
+// The set, erase, copy-factory and manifest serial actions accept
+// -dry-run, which reports the writes that would be made. All but manifest
+// accept -journal file, which records the previous serial numbers in a
+// rollback journal and restores all devices if any of them fails. If the
+// process dies mid-batch, serial rollback with the same journal restores
+// them.
+//
+// Global flags:
+//
+//	-auditlog file   record audits, serial number writes and resets
+//	-key file        encrypt snapshots with a key from crypt.GenerateKey
+//	-sign file       sign snapshots with a private key
+//	-verify file     verify snapshot signatures with a public key
+//	-policy file     enforce and audit serial number policies from a JSON
+//	                 file read by usbci.LoadPolicies
+//
+// Exit codes:
+//
+//	0  success
+//	1  an operation failed on at least one device
+//	2  invalid usage
+//	3  no devices matched the selection
+//	4  an audit found changes or serial number policy violations, or
+//	   reconcile found missing, unexpected or mismatched devices
+package main
+
+import (
+	`flag`
+	`fmt`
+	`os`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb/auditlog`
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/sign`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	ExitOK int = 0
+	ExitError int = 1
+	ExitUsage int = 2
+	ExitNoDevice int = 3
+	ExitChanges int = 4
+)
+
+var (
+	fAuditLog = flag.String(`auditlog`, ``, `record audits, serial number writes and resets in an audit log`)
+	fKey = flag.String(`key`, ``, `encrypt and decrypt snapshots with the key in this file`)
+	fSign = flag.String(`sign`, ``, `sign snapshots with the private key in this PEM file`)
+	fVerify = flag.String(`verify`, ``, `require snapshot signatures by the public key in this PEM file`)
+	fPolicy = flag.String(`policy`, ``, `enforce and audit the serial number policies in this JSON file`)
+
+	commands = map[string]func([]string) (int){
+		`list`: cmdList,
+		`report`: cmdReport,
+		`save`: cmdSave,
+		`audit`: cmdAudit,
+		`serial`: cmdSerial,
+		`reset`: cmdReset,
+		`agent`: cmdAgent,
+		`reconcile`: cmdReconcile,
+	}
+)
+
+func main() {
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(ExitUsage)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+
+	if !ok {
+		fatal(ExitUsage, fmt.Errorf(`unknown command %q`, flag.Arg(0)))
+	}
+
+	if err := configure(); err != nil {
+		fatal(ExitError, err)
+	}
+
+	os.Exit(cmd(flag.Args()[1:]))
+}
+
+// configure applies the global flags.
+func configure() (err error) {
+
+	if *fAuditLog != `` {
+
+		var l *auditlog.Log
+
+		if l, err = auditlog.Open(*fAuditLog); err != nil {
+			return err
+		}
+
+		l.Attach()
+	}
+
+	if *fKey != `` {
+		c, err := crypt.LoadKey(*fKey)
+		if err != nil {
+			return err
+		}
+		usbci.SetSnapshotCipher(c)
+	}
+
+	if *fSign != `` {
+		s, err := sign.NewSigner(*fSign)
+		if err != nil {
+			return err
+		}
+		usbci.SetSnapshotSigner(s)
+	}
+
+	if *fVerify != `` {
+		v, err := sign.NewVerifier(true, *fVerify)
+		if err != nil {
+			return err
+		}
+		usbci.SetBaselineVerifier(v)
+	}
+
+	if *fPolicy != `` {
+
+		var p *usbci.Policies
+
+		if p, err = usbci.LoadPolicies(*fPolicy); err != nil {
+			return err
+		}
+
+		p.Install()
+	}
+
+	return nil
+}
+
+// run opens the devices selected by a command's flags, calls the command
+// function with them and closes them again. Malformed selection flags are
+// a usage error.
+func run(sel *selector, fn func([]device) (int)) (int) {
+
+	if err := sel.validate(); err != nil {
+		warn(err)
+		return ExitUsage
+	}
+
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, err := sel.open(ctx)
+	defer closeAll(devs)
+
+	if err != nil {
+		warn(err)
+	}
+
+	if len(devs) == 0 {
+		warn(fmt.Errorf(`no devices found`))
+		return ExitNoDevice
+	}
+
+	return exitCode(fn(devs), err, false)
+}
+
+// exitCode maps the outcome of a command to its exit code: the code of a
+// failed command, ExitError if it succeeded but err reports that some
+// devices could not be opened, ExitChanges if it succeeded and found changes,
+// and ExitOK otherwise.
+func exitCode(code int, err error, changed bool) (int) {
+
+	switch {
+	case code != ExitOK:
+		return code
+	case err != nil:
+		return ExitError
+	case changed:
+		return ExitChanges
+	}
+
+	return ExitOK
+}
+
+// usage prints the command synopsis.
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [global flags] command [flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "commands: list, report, save, audit, serial get|set|erase|copy-factory|provision|manifest|rollback, reset, agent, reconcile\n\n")
+	fmt.Fprintf(os.Stderr, "global flags:\n")
+	flag.PrintDefaults()
+}
+
+// warn prints an error without exiting.
+func warn(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+}
+
+// fatal prints an error and exits with the given code.
+func fatal(code int, err error) {
+	warn(err)
+	os.Exit(code)
+}
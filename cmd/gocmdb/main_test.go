@@ -0,0 +1,174 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bytes`
+	`encoding/json`
+	`errors`
+	`testing`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gocmdb/inventory`
+	`github.com/jscherff/gotest`
+)
+
+func TestParseID(t *testing.T) {
+
+	for _, f := range []struct {
+		in string
+		id gousb.ID
+		ok bool
+	}{
+		{``, 0, true},
+		{`0801`, 0x0801, true},
+		{`acd`, 0x0acd, true},
+		{`0ACD`, 0x0acd, true},
+		{`ffff`, 0xffff, true},
+		{`10000`, 0, false},
+		{`0x0801`, 0, false},
+		{`zz`, 0, false},
+	} {
+		id, err := parseID(f.in)
+		gotest.Assert(t, (err == nil) == f.ok, `parseID(%q) error %v`, f.in, err)
+		gotest.Assert(t, id == f.id, `parseID(%q) = %v, want %v`, f.in, id, f.id)
+	}
+}
+
+func TestSelector(t *testing.T) {
+
+	desc := &gousb.DeviceDesc{Vendor: 0x0801, Product: 0x0001, Bus: 1, Port: 3}
+
+	for _, f := range []struct {
+		name string
+		sel selector
+		match bool
+	}{
+		{`empty selection`, selector{}, true},
+		{`vendor`, selector{vid: `0801`}, true},
+		{`other vendor`, selector{vid: `0acd`}, false},
+		{`vendor and product`, selector{vid: `0801`, pid: `0001`}, true},
+		{`other product`, selector{vid: `0801`, pid: `0002`}, false},
+		{`bus and port`, selector{bus: 1, port: 3}, true},
+		{`other bus`, selector{bus: 2}, false},
+		{`other port`, selector{port: 4}, false},
+	} {
+		match, err := f.sel.matcher()
+		gotest.Ok(t, err)
+		gotest.Assert(t, match(desc) == f.match, `%s: match should be %v`, f.name, f.match)
+	}
+
+	for _, sel := range []selector{{vid: `xyz`}, {pid: `10000`}} {
+		gotest.Assert(t, sel.validate() != nil, `invalid ID in %+v should be an error`, sel)
+		gotest.Assert(t, run(&sel, nil) == ExitUsage, `invalid ID in %+v should be a usage error`, sel)
+	}
+
+	for _, f := range []struct {
+		serial string
+		id string
+		selects bool
+	}{
+		{``, `24FFFFF`, true},
+		{``, ``, true},
+		{`24FFFFF`, `24FFFFF`, true},
+		{`24FFFFF`, `24FFFFE`, false},
+		{`24FFFFF`, ``, false},
+	} {
+		sel := &selector{serial: f.serial}
+		gotest.Assert(t, sel.selects(f.id) == f.selects, `serial %q selecting %q should be %v`, f.serial, f.id, f.selects)
+	}
+}
+
+func TestReports(t *testing.T) {
+
+	doc := inventory.New(testdevice.Magtek(t, `mag1`), testdevice.Generic(t, `gen1`))
+
+	for _, f := range []struct {
+		format string
+		pretty bool
+		lines int
+	}{
+		{`json`, false, 2},
+		{`xml`, false, 2},
+		{`csv`, false, 3},
+		{`nvp`, false, 0},
+	} {
+		b, err := deviceReport(doc, f.format, f.pretty)
+		gotest.Ok(t, err)
+		gotest.Assert(t, bytes.HasSuffix(b, []byte("\n")), `%s device report should end with a newline`, f.format)
+
+		if f.lines > 0 {
+			n := bytes.Count(b, []byte("\n"))
+			gotest.Assert(t, n == f.lines, `%s device report should have %d lines, not %d`, f.format, f.lines, n)
+		}
+	}
+
+	b, err := deviceReport(doc, `nvp`, false)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Count(b, []byte("\n\n")) == 1, `NVP device reports should be separated by a blank line`)
+
+	b, err = deviceReport(doc, `json`, true)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Count(b, []byte("\n")) > 2, `pretty JSON device reports should be indented`)
+
+	for _, f := range []struct {
+		format string
+		pretty bool
+	}{
+		{`json`, false},
+		{`json`, true},
+		{`xml`, false},
+		{`xml`, true},
+		{`csv`, false},
+		{`nvp`, false},
+		{`legacy`, false},
+	} {
+		b, err := documentReport(doc, f.format, f.pretty)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(b) > 0 && b[len(b) - 1] == '\n', `%s document report should end with a newline`, f.format)
+	}
+
+	b, err = documentReport(doc, `json`, false)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Count(b, []byte("\n")) == 1, `JSON document report should be one line`)
+
+	var v struct{ Devices []json.RawMessage `json:"devices"` }
+	gotest.Ok(t, json.Unmarshal(b, &v))
+	gotest.Assert(t, len(v.Devices) == 2, `JSON document report should contain both devices`)
+}
+
+func TestExitCode(t *testing.T) {
+
+	oerr := errors.New(`device 1-2: access denied`)
+
+	for _, f := range []struct {
+		code int
+		err error
+		changed bool
+		want int
+	}{
+		{ExitOK, nil, false, ExitOK},
+		{ExitOK, nil, true, ExitChanges},
+		{ExitOK, oerr, false, ExitError},
+		{ExitOK, oerr, true, ExitError},
+		{ExitError, nil, true, ExitError},
+		{ExitUsage, oerr, false, ExitUsage},
+		{ExitNoDevice, nil, false, ExitNoDevice},
+	} {
+		code := exitCode(f.code, f.err, f.changed)
+		gotest.Assert(t, code == f.want, `exitCode(%d, %v, %v) = %d, want %d`, f.code, f.err, f.changed, code, f.want)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`fmt`
+	`os`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb/reconcile`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+// cmdReconcile compares the selected devices with the devices the manifest
+// expects on this host and reports the findings. Unlike other commands, it
+// runs when no devices are attached, since they may all be missing.
+func cmdReconcile(args []string) (int) {
+
+	fs, sel := newFlagSet(`reconcile`)
+	manifest := fs.String(`manifest`, ``, `expected-inventory manifest file`)
+	host := fs.String(`host`, ``, `host name in the manifest; defaults to the local host name`)
+	format := fs.String(`format`, `json`, `report format: json, xml, csv, nvp or legacy`)
+	pretty := fs.Bool(`pretty`, false, `indent json and xml reports`)
+	fs.Parse(args)
+
+	switch *format {
+	case `json`, `xml`, `csv`, `nvp`, `legacy`:
+	default:
+		fatal(ExitUsage, fmt.Errorf(`unknown report format %q`, *format))
+	}
+
+	if *manifest == `` {
+		fatal(ExitUsage, fmt.Errorf(`reconcile: expected -manifest`))
+	}
+
+	if err := sel.validate(); err != nil {
+		fatal(ExitUsage, err)
+	}
+
+	m, err := reconcile.LoadManifest(*manifest)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	if *host == `` {
+		if *host, err = os.Hostname(); err != nil {
+			fatal(ExitError, err)
+		}
+	}
+
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, oerr := sel.open(ctx)
+	defer closeAll(devs)
+
+	if oerr != nil {
+		warn(oerr)
+	}
+
+	gens := make([]*usbci.Generic, len(devs))
+
+	for i, dev := range devs {
+		gens[i] = dev.gen
+	}
+
+	rec, err := m.Reconcile(*host, gens)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	b, err := documentReport(rec, *format, *pretty)
+
+	if err != nil {
+		fatal(ExitError, err)
+	}
+
+	os.Stdout.Write(b)
+
+	return exitCode(ExitOK, oerr, len(rec.Findings) > 0)
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crypt encrypts snapshots and history records at rest with
+// AES-256-GCM. An encrypted payload is the Magic header, a random nonce and
+// the sealed data, so encrypted and plain payloads can be told apart and
+// files written before encryption was enabled remain readable.
+package crypt
+
+import (
+	`bytes`
+	`crypto/aes`
+	`crypto/cipher`
+	`crypto/hmac`
+	`crypto/rand`
+	`crypto/sha256`
+	`encoding/base64`
+	`encoding/hex`
+	`errors`
+	`fmt`
+	`io`
+	`io/ioutil`
+)
+
+const (
+	KeySize int = 32
+	Magic string = "GOCMDB\x00\x01"
+)
+
+var (
+	ErrNotEncrypted = errors.New(`payload is not encrypted`)
+	ErrNoKey = errors.New(`payload is encrypted and no key is configured`)
+	ErrDecrypt = errors.New(`payload cannot be decrypted: wrong key or altered data`)
+)
+
+// Cipher encrypts and decrypts payloads with a single AES-256 key.
+type Cipher struct {
+	aead cipher.AEAD
+	nameKey []byte
+}
+
+// NewCipher instantiates a Cipher from a 32-byte key.
+func NewCipher(key []byte) (*Cipher, error) {
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf(`key must be %d bytes, not %d`, KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(`gocmdb name key`))
+
+	return &Cipher{aead: aead, nameKey: mac.Sum(nil)}, nil
+}
+
+// GenerateKey creates a random key and writes it to a file, readable only
+// by its owner, as a line of base64 text.
+func GenerateKey(fn string) (error) {
+
+	key := make([]byte, KeySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, []byte(base64.StdEncoding.EncodeToString(key) + "\n"), 0600)
+}
+
+// LoadKey instantiates a Cipher from a key file written by GenerateKey.
+func LoadKey(fn string) (*Cipher, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	this, err := NewCipher(key)
+
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return this, nil
+}
+
+// IsEncrypted reports whether a payload was written by Encrypt.
+func IsEncrypted(b []byte) (bool) {
+	return bytes.HasPrefix(b, []byte(Magic))
+}
+
+// Encrypt seals a payload.
+func (this *Cipher) Encrypt(b []byte) ([]byte, error) {
+
+	nonce := make([]byte, this.aead.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(Magic), nonce...)
+
+	return this.aead.Seal(out, nonce, b, []byte(Magic)), nil
+}
+
+// Decrypt opens a payload sealed by Encrypt.
+func (this *Cipher) Decrypt(b []byte) ([]byte, error) {
+
+	if !IsEncrypted(b) {
+		return nil, ErrNotEncrypted
+	}
+
+	b = b[len(Magic):]
+	ns := this.aead.NonceSize()
+
+	if len(b) < ns + this.aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+
+	out, err := this.aead.Open(nil, b[:ns], b[ns:], []byte(Magic))
+
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return out, nil
+}
+
+// EncryptText seals a payload and encodes it as base64 text, for storage in
+// line-oriented files.
+func (this *Cipher) EncryptText(b []byte) ([]byte, error) {
+
+	enc, err := this.Encrypt(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(enc)))
+	base64.StdEncoding.Encode(out, enc)
+
+	return out, nil
+}
+
+// DecryptText opens a payload sealed by EncryptText.
+func (this *Cipher) DecryptText(b []byte) ([]byte, error) {
+
+	enc := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(enc, b)
+
+	if err != nil {
+		return nil, ErrNotEncrypted
+	}
+
+	return this.Decrypt(enc[:n])
+}
+
+// Name derives an opaque, stable name from a sensitive identifier, such as
+// a device key used in a file name, without revealing the identifier.
+func (this *Cipher) Name(id string) (string) {
+
+	mac := hmac.New(sha256.New, this.nameKey)
+	mac.Write([]byte(id))
+
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Open decrypts a payload if it is encrypted and returns plain payloads
+// unchanged. An encrypted payload is an error if the Cipher is nil.
+func (this *Cipher) Open(b []byte) ([]byte, error) {
+
+	if !IsEncrypted(b) {
+		return b, nil
+	}
+
+	if this == nil {
+		return nil, ErrNoKey
+	}
+
+	return this.Decrypt(b)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypt
+
+import (
+	`bytes`
+	`os`
+	`path/filepath`
+	`testing`
+
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gotest`
+)
+
+func TestCipher(t *testing.T) {
+
+	fn := filepath.Join(os.Getenv(`TEMP`), `snapshot.key`)
+
+	err := GenerateKey(fn)
+	gotest.Ok(t, err)
+
+	c, err := LoadKey(fn)
+	gotest.Ok(t, err)
+
+	j := testdata.Jsn(`mag1`)
+
+	b, err := c.Encrypt(j)
+	gotest.Ok(t, err)
+	gotest.Assert(t, IsEncrypted(b), `encrypted payload should be recognized`)
+	gotest.Assert(t, !bytes.Contains(b, []byte(`24FFFFF`)), `encrypted payload should not reveal serial number`)
+
+	b2, err := c.Encrypt(j)
+	gotest.Ok(t, err)
+	gotest.Assert(t, !bytes.Equal(b, b2), `encryptions of the same payload should differ`)
+
+	p, err := c.Decrypt(b)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Equal(p, j), `decrypted payload should match original`)
+
+	b[len(b) - 1] ^= 0x01
+	_, err = c.Decrypt(b)
+	gotest.Assert(t, err == ErrDecrypt, `altered payload should not decrypt`)
+
+	other, err := NewCipher(bytes.Repeat([]byte{1}, KeySize))
+	gotest.Ok(t, err)
+
+	_, err = other.Decrypt(b2)
+	gotest.Assert(t, err == ErrDecrypt, `payload should not decrypt with another key`)
+
+	_, err = NewCipher([]byte(`short`))
+	gotest.Assert(t, err != nil, `short key should produce an error`)
+}
+
+func TestOpen(t *testing.T) {
+
+	c, err := NewCipher(bytes.Repeat([]byte{2}, KeySize))
+	gotest.Ok(t, err)
+
+	j := testdata.Jsn(`gen1`)
+
+	p, err := c.Open(j)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Equal(p, j), `plain payload should be returned unchanged`)
+
+	b, err := c.EncryptText(j)
+	gotest.Ok(t, err)
+	gotest.Assert(t, !bytes.ContainsAny(b, "\n\r"), `text payload should be a single line`)
+
+	p, err = c.DecryptText(b)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Equal(p, j), `decrypted text payload should match original`)
+
+	b, err = c.Encrypt(j)
+	gotest.Ok(t, err)
+
+	var none *Cipher
+
+	_, err = none.Open(b)
+	gotest.Assert(t, err == ErrNoKey, `encrypted payload should not open without a key`)
+
+	gotest.Assert(t, c.Name(`0801-0001-24FFFFF`) == c.Name(`0801-0001-24FFFFF`), `derived names should be stable`)
+	gotest.Assert(t, c.Name(`0801-0001-24FFFFF`) != c.Name(`0801-0001-24FFFFE`), `derived names should be distinct`)
+}
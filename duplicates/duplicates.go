@@ -0,0 +1,382 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package duplicates finds serial numbers shared by more than one device
+// across a fleet, in a history store or a set of snapshot files, explains
+// how each conflict probably arose and proposes corrected serial numbers
+// for the devices whose serial numbers can be configured.
+//
+// Devices are told apart by their history key. Since the key is built from
+// the factory serial number when there is one, two devices of the same
+// vendor and product with the same factory serial number cannot be told
+// apart and are treated as one.
+package duplicates
+
+import (
+	`encoding/json`
+	`fmt`
+	`os`
+	`sort`
+	`strings`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	FieldSerialNum string = `serial_number`
+	FieldDeviceSN string = `device_sn`
+	FieldFactorySN string = `factory_sn`
+	FieldDescriptorSN string = `descriptor_sn`
+
+	// MaxSuffix is the largest numeric suffix tried for a proposal.
+	MaxSuffix int = 99
+)
+
+var (
+	// Fields are the serial number fields checked for duplicates.
+	Fields = []string{FieldSerialNum, FieldDeviceSN, FieldFactorySN, FieldDescriptorSN}
+
+	// ConfigurableTypes are the object types whose device serial number
+	// can be written, and so corrected.
+	ConfigurableTypes = map[string]bool{
+		new(usbci.Magtek).Type(): true,
+	}
+)
+
+// Device is the latest known state of a device.
+type Device struct {
+	Key          string		`json:"key"`
+	Source       string		`json:"source"`
+	HostName     string		`json:"host_name"`
+	VendorID     string		`json:"vendor_id"`
+	ProductID    string		`json:"product_id"`
+	ObjectType   string		`json:"object_type"`
+	SerialNum    string		`json:"serial_number"`
+	DeviceSN     string		`json:"device_sn"`
+	FactorySN    string		`json:"factory_sn"`
+	DescriptorSN string		`json:"descriptor_sn"`
+	FirstSeen    time.Time		`json:"first_seen"`
+	LastSeen     time.Time		`json:"last_seen"`
+}
+
+// Conflict is a serial number reported in the same field by more than one
+// device, oldest device first, with an explanation and the proposed
+// corrections.
+type Conflict struct {
+	Field       string		`json:"field"`
+	Value       string		`json:"value"`
+	Devices     []*Device		`json:"devices"`
+	Explanation string		`json:"explanation"`
+	Proposals   []*Proposal		`json:"proposals,omitempty"`
+}
+
+// Proposal is a proposed new device serial number for a device.
+type Proposal struct {
+	Key      string			`json:"key"`
+	Source   string			`json:"source"`
+	OldValue string			`json:"old_value"`
+	NewValue string			`json:"new_value"`
+	Reason   string			`json:"reason"`
+}
+
+// FromStore returns the latest state of every device in a history store.
+func FromStore(s history.Store) (devs []*Device, err error) {
+
+	keys, err := s.Keys()
+
+	if err != nil {
+		return devs, err
+	}
+
+	for _, key := range keys {
+
+		recs, err := s.Records(key)
+
+		if err != nil {
+			return devs, err
+		}
+
+		if len(recs) == 0 {
+			continue
+		}
+
+		last := recs[len(recs) - 1]
+		dev := new(Device)
+
+		if err = json.Unmarshal(last.Snapshot, dev); err != nil {
+			return devs, fmt.Errorf(`%s: %v`, key, err)
+		}
+
+		dev.Key, dev.Source = key, key
+		dev.HostName = last.HostName
+		dev.FirstSeen, dev.LastSeen = recs[0].Time, last.Time
+
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
+
+// FromFiles returns the state of the devices in snapshot files of any
+// format that RestoreFile reads. Files are dated by their modification
+// time; if several files hold the same device, the newest is used.
+func FromFiles(fns ...string) (devs []*Device, err error) {
+
+	index := make(map[string]*Device)
+
+	for _, fn := range fns {
+
+		fi, err := os.Stat(fn)
+
+		if err != nil {
+			return devs, err
+		}
+
+		gen, _ := usbci.NewGeneric(nil)
+
+		if err = gen.RestoreFile(fn); err != nil {
+			return devs, fmt.Errorf(`%s: %v`, fn, err)
+		}
+
+		dev := &Device{
+			Key: gen.Identity(),
+			Source: fn,
+			HostName: gen.HostName,
+			VendorID: gen.VendorID,
+			ProductID: gen.ProductID,
+			ObjectType: gen.ObjectType,
+			SerialNum: gen.SerialNum,
+			DeviceSN: gen.DeviceSN,
+			FactorySN: gen.FactorySN,
+			DescriptorSN: gen.DescriptorSN,
+			FirstSeen: fi.ModTime(),
+			LastSeen: fi.ModTime(),
+		}
+
+		if old, ok := index[dev.Key]; ok {
+
+			if old.FirstSeen.Before(dev.FirstSeen) {
+				dev.FirstSeen = old.FirstSeen
+			}
+
+			if old.LastSeen.After(dev.LastSeen) {
+				old.FirstSeen = dev.FirstSeen
+				continue
+			}
+
+			*old = *dev
+			continue
+		}
+
+		index[dev.Key] = dev
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
+
+// Find finds the serial numbers reported in the same field by more than
+// one device. Conflicts are ordered by field and value. For conflicts in
+// the reported or device serial number, the device seen first keeps its
+// serial number and a new one is proposed for each other device whose
+// serial number can be configured. A device gets one proposal even if it
+// is in several conflicts, and proposals never collide with any serial
+// number known in the fleet or with each other.
+func Find(devs []*Device) (cs []*Conflict) {
+
+	used := make(map[string]bool)
+
+	for _, dev := range devs {
+		for _, f := range Fields {
+			if v := dev.field(f); v != `` {
+				used[v] = true
+			}
+		}
+	}
+
+	proposed := make(map[string]*Proposal)
+
+	for _, f := range Fields {
+
+		groups := make(map[string][]*Device)
+
+		for _, dev := range devs {
+			if v := dev.field(f); v != `` {
+				groups[v] = append(groups[v], dev)
+			}
+		}
+
+		var values []string
+
+		for v, group := range groups {
+			if len(group) > 1 {
+				values = append(values, v)
+			}
+		}
+
+		sort.Strings(values)
+
+		for _, v := range values {
+
+			group := groups[v]
+
+			sort.SliceStable(group, func(i, j int) (bool) {
+				if !group[i].FirstSeen.Equal(group[j].FirstSeen) {
+					return group[i].FirstSeen.Before(group[j].FirstSeen)
+				}
+				return group[i].Key < group[j].Key
+			})
+
+			c := &Conflict{Field: f, Value: v, Devices: group}
+			c.Explanation = explain(f, v, group)
+
+			if f == FieldSerialNum || f == FieldDeviceSN {
+				for _, dev := range group[1:] {
+					if p := propose(dev, used, proposed); p != nil {
+						c.Proposals = append(c.Proposals, p)
+					}
+				}
+			}
+
+			cs = append(cs, c)
+		}
+	}
+
+	return cs
+}
+
+// String describes the conflict on one line.
+func (this *Conflict) String() (string) {
+
+	srcs := make([]string, len(this.Devices))
+
+	for i, dev := range this.Devices {
+		srcs[i] = dev.Source
+	}
+
+	return fmt.Sprintf(`%s %q is shared by %s: %s`,
+		this.Field, this.Value, strings.Join(srcs, `, `), this.Explanation)
+}
+
+// explain describes the probable cause of a conflict.
+func explain(f, v string, group []*Device) (string) {
+
+	n := len(group)
+
+	switch f {
+
+	case FieldFactorySN:
+		return fmt.Sprintf(`%d devices of different types report the same factory serial number, `+
+			`which the manufacturer should have made unique; check that the snapshots are `+
+			`not copies of each other`, n)
+
+	case FieldDescriptorSN:
+		return fmt.Sprintf(`%d devices report the same USB descriptor serial number; for devices `+
+			`with a configurable serial number it follows the device serial number after a reset`, n)
+	}
+
+	truncated := 0
+
+	for _, dev := range group {
+		if dev.DeviceSN == v && len(dev.FactorySN) > len(v) && strings.HasPrefix(dev.FactorySN, v) {
+			truncated++
+		}
+	}
+
+	switch {
+
+	case truncated == n:
+		return fmt.Sprintf(`the serial numbers of %d devices were copied from the first %d characters `+
+			`of factory serial numbers that share that prefix (CopyFactorySN truncation)`, n, len(v))
+
+	case truncated > 0:
+		return fmt.Sprintf(`%d of %d devices copied the serial number from their factory serial `+
+			`number (CopyFactorySN truncation); the others were set to the same value by hand`,
+			truncated, n)
+
+	case f == FieldSerialNum && group[0].DeviceSN != v:
+		return fmt.Sprintf(`%d devices report the same serial number in their USB descriptors`, n)
+	}
+
+	return fmt.Sprintf(`the configurable serial number of %d devices was set to the same value`, n)
+}
+
+// propose proposes a new device serial number for a device whose serial
+// number can be configured: the shortest longer prefix of its factory
+// serial number that is not in use, or else its current serial number, if
+// it has one, with the smallest numeric suffix that is not in use. Serial
+// numbers that violate the usbci device serial number policy are never
+// proposed, so a device may get no proposal at all.
+func propose(dev *Device, used map[string]bool, proposed map[string]*Proposal) (*Proposal) {
+
+	if !ConfigurableTypes[dev.ObjectType] {
+		return nil
+	}
+
+	if p, ok := proposed[dev.Key]; ok {
+		return p
+	}
+
+	p := &Proposal{Key: dev.Key, Source: dev.Source, OldValue: dev.DeviceSN}
+	gen := &usbci.Generic{HostName: dev.HostName}
+
+	policy := usbci.DeviceSNPolicy()
+
+	allowed := func(v string) (bool) {
+		return !used[v] && (policy == nil || policy.CheckSerial(gen, v) == nil)
+	}
+
+	for n := len(dev.DeviceSN) + 1; n <= len(dev.FactorySN); n++ {
+		if v := dev.FactorySN[:n]; allowed(v) {
+			p.NewValue = v
+			p.Reason = fmt.Sprintf(`first %d characters of the factory serial number`, n)
+			break
+		}
+	}
+
+	for i := 2; dev.DeviceSN != `` && p.NewValue == `` && i <= MaxSuffix; i++ {
+		if v := fmt.Sprintf(`%s-%d`, dev.DeviceSN, i); allowed(v) {
+			p.NewValue = v
+			p.Reason = `current serial number with a unique suffix`
+		}
+	}
+
+	if p.NewValue == `` {
+		return nil
+	}
+
+	used[p.NewValue] = true
+	proposed[dev.Key] = p
+
+	return p
+}
+
+// field returns the value of a serial number field.
+func (this *Device) field(f string) (string) {
+
+	switch f {
+	case FieldSerialNum:
+		return this.SerialNum
+	case FieldDeviceSN:
+		return this.DeviceSN
+	case FieldFactorySN:
+		return this.FactorySN
+	case FieldDescriptorSN:
+		return this.DescriptorSN
+	}
+
+	return ``
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package duplicates
+
+import (
+	`encoding/json`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gotest`
+)
+
+// truncated returns the mag1 snapshot with the given factory serial number
+// and a device serial number copied from its first seven characters.
+func truncated(t *testing.T, fsn string) ([]byte) {
+
+	m := make(map[string]interface{})
+	gotest.Ok(t, json.Unmarshal(testdata.Jsn(`mag1`), &m))
+
+	m[`factory_sn`] = fsn
+	m[`device_sn`] = fsn[:7]
+	m[`serial_number`] = fsn[:7]
+	m[`descriptor_sn`] = fsn[:7]
+
+	b, err := json.Marshal(m)
+	gotest.Ok(t, err)
+
+	return b
+}
+
+func checkConflicts(t *testing.T, cs []*Conflict, newer string) {
+
+	gotest.Assert(t, len(cs) == 3, `three conflicting fields expected`)
+
+	for i, f := range []string{FieldSerialNum, FieldDeviceSN, FieldDescriptorSN} {
+
+		c := cs[i]
+
+		gotest.Assert(t, c.Field == f, `conflicts should be ordered by field`)
+		gotest.Assert(t, c.Value == `B164F78`, `conflict should name the shared value`)
+		gotest.Assert(t, len(c.Devices) == 2, `conflict should name both devices`)
+		gotest.Assert(t, c.Explanation != ``, `conflict should be explained`)
+
+		if f == FieldDescriptorSN {
+			gotest.Assert(t, len(c.Proposals) == 0, `descriptor conflicts have no proposals`)
+			continue
+		}
+
+		gotest.Assert(t, len(c.Proposals) == 1, `newer device should get a proposal`)
+
+		p := c.Proposals[0]
+
+		gotest.Assert(t, p.Source == newer, `proposal should be for the newer device`)
+		gotest.Assert(t, p.OldValue == `B164F78` && p.NewValue == `B164F780`,
+			`proposal should extend the factory serial number prefix`)
+	}
+}
+
+func TestFromFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `duplicates`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, `old.json`)
+	newer := filepath.Join(dir, `new.json`)
+	same := filepath.Join(dir, `same.json`)
+
+	gotest.Ok(t, ioutil.WriteFile(old, truncated(t, `B164F78022713AA`), 0640))
+	gotest.Ok(t, ioutil.WriteFile(newer, truncated(t, `B164F78099999BB`), 0640))
+	gotest.Ok(t, ioutil.WriteFile(same, truncated(t, `B164F78022713AA`), 0640))
+
+	now := time.Now()
+	gotest.Ok(t, os.Chtimes(old, now.Add(-2 * time.Hour), now.Add(-2 * time.Hour)))
+	gotest.Ok(t, os.Chtimes(newer, now.Add(-time.Hour), now.Add(-time.Hour)))
+
+	devs, err := FromFiles(old, newer, same)
+	gotest.Ok(t, err)
+
+	gotest.Assert(t, len(devs) == 2, `files of the same device should be merged`)
+	gotest.Assert(t, devs[0].Source == same, `newest file of a device should be used`)
+	gotest.Assert(t, devs[0].FirstSeen.Before(devs[1].FirstSeen), `oldest file should date a device`)
+
+	checkConflicts(t, Find(devs), newer)
+}
+
+func TestFromStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `duplicates`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	hs, err := history.NewFileStore(dir)
+	gotest.Ok(t, err)
+
+	now := time.Now()
+
+	gotest.Ok(t, hs.Append(&history.Record{Key: `old`, Time: now.Add(-time.Hour),
+		Snapshot: truncated(t, `B164F78022713AA`)}))
+	gotest.Ok(t, hs.Append(&history.Record{Key: `new`, Time: now,
+		Snapshot: truncated(t, `B164F78099999BB`)}))
+
+	devs, err := FromStore(hs)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(devs) == 2, `each key should be a device`)
+
+	checkConflicts(t, Find(devs), `new`)
+}
+
+func TestFindUnique(t *testing.T) {
+
+	devs := []*Device{
+		{Key: `a`, ObjectType: `*usbci.Magtek`, SerialNum: `24FFFFF`, DeviceSN: `24FFFFF`},
+		{Key: `b`, ObjectType: `*usbci.Magtek`, SerialNum: `24FFFFE`, DeviceSN: `24FFFFE`},
+		{Key: `c`, ObjectType: `*usbci.Generic`},
+		{Key: `d`, ObjectType: `*usbci.Generic`},
+	}
+
+	gotest.Assert(t, len(Find(devs)) == 0, `unique and empty serial numbers are not conflicts`)
+}
+
+func TestProposeSuffix(t *testing.T) {
+
+	devs := []*Device{
+		{Key: `a`, ObjectType: `*usbci.Magtek`, DeviceSN: `24FFFFF`},
+		{Key: `b`, ObjectType: `*usbci.Magtek`, DeviceSN: `24FFFFF`},
+		{Key: `c`, ObjectType: `*usbci.Magtek`, DeviceSN: `24FFFFF-2`},
+		{Key: `d`, ObjectType: `*usbci.Generic`, DeviceSN: `24FFFFF`},
+	}
+
+	cs := Find(devs)
+
+	gotest.Assert(t, len(cs) == 1 && len(cs[0].Proposals) == 1,
+		`only configurable devices should get proposals`)
+	gotest.Assert(t, cs[0].Proposals[0].NewValue == `24FFFFF-3`,
+		`suffix proposal should skip serial numbers in use`)
+
+	dev := &Device{Key: `e`, ObjectType: `*usbci.Magtek`, SerialNum: `24FFFFF`}
+	gotest.Assert(t, propose(dev, map[string]bool{}, map[string]*Proposal{}) == nil,
+		`device without a serial number should not get a bare suffix`)
+}
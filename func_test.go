@@ -1,13 +1,18 @@
 package gocmdb
 
 import (
+	`bytes`
 	`crypto/sha256`
+	`encoding/json`
 	`fmt`
+	`io/ioutil`
 	`os`
 	`path/filepath`
 	`reflect`
 	`testing`
 	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/sign`
 	`github.com/jscherff/gocmdb/usbci`
 	`github.com/jscherff/gotest`
 )
@@ -72,6 +77,22 @@ func TestReportMethods(t *testing.T) {
 	b = td.Mag[`mag1`].Legacy()
 	gotest.Ok(t, err)
 	gotest.Assert(t, sha256.Sum256(b) == td.Sig[`Leg`][`mag1`], `unexpected hash signature of NVP output`)
+
+	b, err = td.Mag[`mag1`].CBOR()
+	gotest.Ok(t, err)
+	gotest.Assert(t, sha256.Sum256(b) == td.Sig[`CBOR`][`mag1`], `unexpected hash signature of CBOR output`)
+
+	b, err = td.Mag[`mag1`].MsgPack()
+	gotest.Ok(t, err)
+	gotest.Assert(t, sha256.Sum256(b) == td.Sig[`MSGP`][`mag1`], `unexpected hash signature of MessagePack output`)
+
+	b, err = td.Mag[`mag1`].Protobuf()
+	gotest.Ok(t, err)
+	gotest.Assert(t, sha256.Sum256(b) == td.Sig[`PROTO`][`mag1`], `unexpected hash signature of Protobuf output`)
+
+	b, err = td.Gen[`gen1`].Protobuf()
+	gotest.Ok(t, err)
+	gotest.Assert(t, sha256.Sum256(b) == td.Sig[`PROTO`][`gen1`], `unexpected hash signature of Protobuf output`)
 }
 
 func TestPersistenceMethods(t *testing.T) {
@@ -277,6 +298,687 @@ func TestChangeMethods(t *testing.T) {
 	})
 }
 
+func TestTamperMethods(t *testing.T) {
+
+	t.Run("Save() and TamperFile()", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(td.Jsn[`mag1`])
+		gotest.Ok(t, err)
+
+		fn := filepath.Join(os.Getenv(`TEMP`), `mag1.json`)
+
+		err = td.Mag[`mag1`].Save(fn)
+		gotest.Ok(t, err)
+
+		tf, err := mag3.TamperFile(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(tf) == 0, `device should not show evidence of tampering`)
+
+		mag3.FactorySN = `B164F78022799ZZ`
+
+		tf, err = mag3.TamperFile(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(tf) == 1, `changed factory SN should produce one finding`)
+
+		if len(tf) < 1 { return }
+
+		gotest.Assert(t, tf[0].Kind == usbci.TamperIdentitySwap, `finding should be an identity swap`)
+		gotest.Assert(t, tf[0].Confidence == usbci.ConfidenceHigh, `finding should have high confidence`)
+		gotest.Assert(t, len(mag3.Changes) == 1, `(device).Changes should contain one change`)
+	})
+
+	t.Run("JSON() and TamperJSON()", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(td.Jsn[`mag1`])
+		gotest.Ok(t, err)
+
+		j2, err := td.Mag[`mag2`].JSON()
+		gotest.Ok(t, err)
+
+		tf, err := mag3.TamperJSON(j2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(tf) == 1, `software ID downgrade should produce one finding`)
+
+		if len(tf) < 1 { return }
+
+		gotest.Assert(t, tf[0].Kind == usbci.TamperSoftwareRegression, `finding should be a software regression`)
+		gotest.Assert(t, tf[0].Confidence == usbci.ConfidenceHigh, `finding should have high confidence`)
+	})
+
+	t.Run("TamperSession.Observe()", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(td.Jsn[`mag1`])
+		gotest.Ok(t, err)
+
+		mag4, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag4.RestoreJSON(td.Jsn[`mag1`])
+		gotest.Ok(t, err)
+
+		ts := usbci.NewTamperSession()
+
+		tf := ts.Observe(mag3.Generic)
+		gotest.Assert(t, len(tf) == 0, `first observation should produce no findings`)
+
+		tf = ts.Observe()
+		gotest.Assert(t, len(tf) == 0, `disappearance alone should produce no findings`)
+
+		mag4.ProductID = `0002`
+		tf = ts.Observe(mag4.Generic)
+		gotest.Assert(t, len(tf) == 2, `reappearance as a different device should produce two findings`)
+
+		if len(tf) < 2 { return }
+
+		gotest.Assert(t, tf[0].Kind == usbci.TamperReappearance, `first finding should be a reappearance`)
+		gotest.Assert(t, tf[0].Confidence == usbci.ConfidenceHigh, `reappearance should have high confidence`)
+		gotest.Assert(t, tf[1].Kind == usbci.TamperDeviceSwap, `second finding should be a device swap`)
+	})
+
+	t.Run("AnalyzeTamper() with multi-digit revisions", func(t *testing.T) {
+
+		for _, f := range []struct {
+			old, cur string
+			findings int
+			conf usbci.Confidence
+		}{
+			{`21042840G9`, `21042840G10`, 0, 0},
+			{`21042840G10`, `21042840G9`, 1, usbci.ConfidenceHigh},
+			{`21042840G10`, `21042840G09`, 1, usbci.ConfidenceHigh},
+			{`21042840G02`, `21042840G2`, 0, 0},
+			{`21042840H01`, `21042840G99`, 1, usbci.ConfidenceHigh},
+			{`21042840G01`, `21042839G99`, 0, 0},
+			{`21042839G99`, `21042840G01`, 0, 0},
+			{`ABC2`, `ABC1`, 1, usbci.ConfidenceMedium},
+			{`21042840G01`, `21042840G01`, 0, 0},
+		} {
+			old, cur := *td.Mag[`mag1`].Generic, *td.Mag[`mag1`].Generic
+			old.SoftwareID, cur.SoftwareID = f.old, f.cur
+
+			tf := usbci.AnalyzeTamper(&old, &cur)
+			gotest.Assert(t, len(tf) == f.findings, `%s to %s should produce %d findings`, f.old, f.cur, f.findings)
+
+			if len(tf) > 0 {
+				gotest.Assert(t, tf[0].Confidence == f.conf, `%s to %s should have %s confidence`, f.old, f.cur, f.conf)
+			}
+		}
+	})
+
+	t.Run("AnalyzeTamper() behind hubs", func(t *testing.T) {
+
+		old, cur := *td.Mag[`mag1`].Generic, *td.Mag[`mag1`].Generic
+		old.HubPorts, cur.HubPorts = `1`, `2.1`
+		cur.ProductID = `0002`
+
+		tf := usbci.AnalyzeTamper(&old, &cur)
+		gotest.Assert(t, len(tf) == 0, `device moved behind a hub should not be a swap on the same port`)
+		gotest.Assert(t, cur.FullPortPath() == `001-2.1`, `full port path should include hub ports`)
+
+		cur.HubPorts = `1`
+
+		tf = usbci.AnalyzeTamper(&old, &cur)
+		gotest.Assert(t, len(tf) == 1 && tf[0].Kind == usbci.TamperDeviceSwap, `different device on the same full port path should be a swap`)
+
+		ts := usbci.NewTamperSession()
+		ts.Observe(&old)
+
+		cur.HubPorts = `2.1`
+		tf = ts.Observe(&old, &cur)
+		gotest.Assert(t, len(tf) == 0, `devices on different hub ports should be tracked separately`)
+	})
+}
+
+func TestRestoreFunctions(t *testing.T) {
+
+	t.Run("JSON() and Restore()", func(t *testing.T) {
+
+		j, err := td.Mag[`mag1`].JSON()
+		gotest.Ok(t, err)
+
+		dev, err := usbci.Restore(bytes.NewReader(j))
+		gotest.Ok(t, err)
+
+		mag3, ok := dev.(*usbci.Magtek)
+		gotest.Assert(t, ok, `restored device should be a *usbci.Magtek`)
+		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], mag3), `restored device not identical to saved device`)
+
+		_, ok = dev.(Configurable)
+		gotest.Assert(t, ok, `restored device should be Configurable`)
+	})
+
+	t.Run("RestoreAll() with mixed devices", func(t *testing.T) {
+
+		var buf bytes.Buffer
+
+		err := json.NewEncoder(&buf).Encode([]interface{}{td.Mag[`mag1`], td.Gen[`gen1`]})
+		gotest.Ok(t, err)
+
+		devs, err := usbci.RestoreAll(&buf)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 2, `two devices should be restored`)
+
+		if len(devs) < 2 { return }
+
+		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], devs[0]), `restored Magtek not identical to saved device`)
+		gotest.Assert(t, reflect.DeepEqual(td.Gen[`gen1`], devs[1]), `restored Generic not identical to saved device`)
+	})
+
+	t.Run("RestoreAll() with NDJSON stream", func(t *testing.T) {
+
+		r := bytes.NewReader(bytes.Join([][]byte{td.Jsn[`gen1`], td.Jsn[`mag2`]}, []byte("\n")))
+
+		devs, err := usbci.RestoreAll(r)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 2, `two devices should be restored`)
+
+		if len(devs) < 2 { return }
+
+		gotest.Assert(t, devs[0].Type() == `*usbci.Generic`, `first device should be a *usbci.Generic`)
+		gotest.Assert(t, devs[1].Type() == `*usbci.Magtek`, `second device should be a *usbci.Magtek`)
+	})
+
+	t.Run("Restore() with unknown object type", func(t *testing.T) {
+
+		_, err := usbci.Restore(bytes.NewReader([]byte(`{"object_type":"*usbci.Unknown"}`)))
+		gotest.Assert(t, err != nil, `unknown object type should produce an error`)
+	})
+}
+
+func TestSchemaMigration(t *testing.T) {
+
+	t.Run("RestoreFile() with legacy DeviceInfo JSON", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreFile(filepath.Join(`doc`, `Dynamag.json`))
+		gotest.Ok(t, err)
+
+		gotest.Assert(t, mag3.SchemaVersion == usbci.SchemaVersion, `restored device schema version not current`)
+		gotest.Assert(t, mag3.ObjectType == `*usbci.Magtek`, `restored device object type incorrect`)
+		gotest.Assert(t, mag3.DescriptorSN == `B164F78`, `legacy DescriptSN not migrated`)
+		gotest.Assert(t, mag3.SerialNum == `B164F78`, `legacy DeviceSN not migrated to SerialNum`)
+		gotest.Assert(t, mag3.BusAddress == 4, `legacy BusAddress not converted to integer`)
+		gotest.Assert(t, mag3.BufferSize == 60, `legacy BufferSize not converted to integer`)
+	})
+
+	t.Run("RestoreFile() with legacy DeviceInfo XML", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreFile(filepath.Join(`doc`, `Dynamag_Formatted.xml`))
+		gotest.Ok(t, err)
+
+		gotest.Assert(t, mag3.SchemaVersion == usbci.SchemaVersion, `restored device schema version not current`)
+		gotest.Assert(t, mag3.FactorySN == `B164F78022713AA`, `legacy FactorySN not migrated`)
+		gotest.Assert(t, mag3.DescriptorSN == `B164F78`, `legacy DescriptSN not migrated`)
+		gotest.Assert(t, mag3.USBSubClass == `per-interface`, `legacy USBSubclass not migrated`)
+		gotest.Assert(t, mag3.BusAddress == 29, `legacy BusAddress not converted to integer`)
+	})
+
+	t.Run("CompareFile() with legacy DeviceInfo JSON", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreFile(filepath.Join(`doc`, `Dynamag_Formatted.xml`))
+		gotest.Ok(t, err)
+
+		ss, err := mag3.CompareFile(filepath.Join(`doc`, `Dynamag.json`))
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 0, `legacy JSON and XML snapshots should match`)
+	})
+
+	t.Run("RestoreJSON() with unversioned JSON", func(t *testing.T) {
+
+		var m map[string]interface{}
+
+		err := json.Unmarshal(td.Jsn[`mag1`], &m)
+		gotest.Ok(t, err)
+
+		delete(m, `schema_version`)
+
+		j, err := json.Marshal(m)
+		gotest.Ok(t, err)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(j)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], mag3), `restored device not identical to saved device`)
+	})
+
+	t.Run("RestoreJSON() with unsupported version", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON([]byte(`{"schema_version":99}`))
+		gotest.Assert(t, err != nil, `unsupported schema version should produce an error`)
+	})
+}
+
+func TestTextRestoreMethods(t *testing.T) {
+
+	t.Run("XML() and RestoreXML()", func(t *testing.T) {
+
+		for _, k := range []string{`mag1`, `mag2`} {
+
+			x, err := td.Mag[k].XML()
+			gotest.Ok(t, err)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = mag3.RestoreXML(x)
+			gotest.Ok(t, err)
+			gotest.Assert(t, reflect.DeepEqual(td.Mag[k], mag3), `restored device not identical to saved device`)
+		}
+
+		for _, k := range []string{`gen1`, `gen2`} {
+
+			x, err := td.Gen[k].PrettyXML()
+			gotest.Ok(t, err)
+
+			gen3, err := usbci.NewGeneric(nil)
+			gotest.Ok(t, err)
+
+			err = gen3.RestoreXML(x)
+			gotest.Ok(t, err)
+			gotest.Assert(t, reflect.DeepEqual(td.Gen[k], gen3), `restored device not identical to saved device`)
+		}
+	})
+
+	t.Run("RestoreXML() with legacy DeviceInfo XML", func(t *testing.T) {
+
+		x, err := ioutil.ReadFile(filepath.Join(`doc`, `Dynamag_Formatted.xml`))
+		gotest.Ok(t, err)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreXML(x)
+		gotest.Ok(t, err)
+		gotest.Assert(t, mag3.SerialNum == `B164F78`, `legacy DeviceSN not migrated to SerialNum`)
+
+		x2, err := mag3.XML()
+		gotest.Ok(t, err)
+
+		mag4, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag4.RestoreXML(x2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(mag3, mag4), `upgraded legacy device did not round trip`)
+	})
+
+	t.Run("CSV() and RestoreCSV()", func(t *testing.T) {
+
+		for _, d := range []*usbci.Generic{td.Mag[`mag1`].Generic, td.Gen[`gen1`]} {
+
+			c, err := d.CSV()
+			gotest.Ok(t, err)
+
+			gen3, err := usbci.NewGeneric(nil)
+			gotest.Ok(t, err)
+
+			err = gen3.RestoreCSV(c)
+			gotest.Ok(t, err)
+			gotest.Assert(t, gen3.SoftwareID == d.SoftwareID, `restored CSV field incorrect`)
+
+			c2, err := gen3.CSV()
+			gotest.Ok(t, err)
+			gotest.Assert(t, bytes.Equal(c, c2), `restored device CSV report not identical to saved report`)
+		}
+	})
+
+	t.Run("NVP() and RestoreNVP()", func(t *testing.T) {
+
+		for _, d := range []*usbci.Generic{td.Mag[`mag1`].Generic, td.Gen[`gen1`]} {
+
+			n, err := d.NVP()
+			gotest.Ok(t, err)
+
+			gen3, err := usbci.NewGeneric(nil)
+			gotest.Ok(t, err)
+
+			err = gen3.RestoreNVP(n)
+			gotest.Ok(t, err)
+			gotest.Assert(t, gen3.SerialNum == d.SerialNum, `restored NVP field incorrect`)
+
+			n2, err := gen3.NVP()
+			gotest.Ok(t, err)
+			gotest.Assert(t, bytes.Equal(n, n2), `restored device NVP report not identical to saved report`)
+		}
+	})
+
+	t.Run("AuditXML(), AuditCSV() and AuditNVP()", func(t *testing.T) {
+
+		for _, f := range []struct {
+			name string
+			report func() ([]byte, error)
+			audit func(*usbci.Magtek, []byte) (error)
+			changes [][]string
+		}{
+			{`XML`, td.Mag[`mag1`].XML, (*usbci.Magtek).AuditXML, td.Chg},
+			{`CSV`, td.Mag[`mag1`].CSV, (*usbci.Magtek).AuditCSV, td.Chg[:1]},
+			{`NVP`, td.Mag[`mag1`].NVP, (*usbci.Magtek).AuditNVP, td.Chg[:1]},
+		} {
+			b, err := f.report()
+			gotest.Ok(t, err)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = mag3.RestoreJSON(td.Jsn[`mag2`])
+			gotest.Ok(t, err)
+
+			err = f.audit(mag3, b)
+			gotest.Ok(t, err)
+			gotest.Assert(t, reflect.DeepEqual(mag3.Changes, f.changes), `%s audit should report the changed fields`, f.name)
+
+			err = mag3.RestoreJSON(td.Jsn[`mag1`])
+			gotest.Ok(t, err)
+
+			err = f.audit(mag3, b)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(mag3.Changes) == 0, `%s audit of identical device should report no changes`, f.name)
+		}
+	})
+
+	t.Run("Save() and RestoreFile() with XML, CSV and NVP", func(t *testing.T) {
+
+		for _, ext := range []string{`xml`, `csv`, `nvp`} {
+
+			fn := filepath.Join(os.Getenv(`TEMP`), `mag1.` + ext)
+
+			err := td.Mag[`mag1`].Save(fn)
+			gotest.Ok(t, err)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = mag3.RestoreFile(fn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, mag3.SerialNum == td.Mag[`mag1`].SerialNum, `device not restored from %s file`, ext)
+
+			ss, err := td.Mag[`mag1`].CompareFile(fn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(ss) == 0, `%s file should match saved device`, ext)
+		}
+	})
+}
+
+func TestSignedBaselines(t *testing.T) {
+
+	privFn := filepath.Join(os.Getenv(`TEMP`), `baseline.key`)
+	pubFn := filepath.Join(os.Getenv(`TEMP`), `baseline.pub`)
+
+	err := sign.GenerateKeys(privFn, pubFn)
+	gotest.Ok(t, err)
+
+	signer, err := sign.NewSigner(privFn)
+	gotest.Ok(t, err)
+
+	verifier, err := sign.NewVerifier(true, pubFn)
+	gotest.Ok(t, err)
+
+	defer func() {
+		usbci.SetSnapshotSigner(nil)
+		usbci.SetBaselineVerifier(nil)
+	}()
+
+	fn := filepath.Join(os.Getenv(`TEMP`), `mag1-signed.json`)
+	os.Remove(fn + sign.SignatureExt)
+
+	t.Run("RestoreFile() refuses unsigned baselines", func(t *testing.T) {
+
+		usbci.SetSnapshotSigner(nil)
+		usbci.SetBaselineVerifier(verifier)
+
+		err := td.Mag[`mag1`].Save(fn)
+		gotest.Ok(t, err)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreFile(fn)
+		gotest.Assert(t, err != nil, `unsigned baseline should be refused`)
+	})
+
+	t.Run("Save() signs and RestoreFile() verifies", func(t *testing.T) {
+
+		usbci.SetSnapshotSigner(signer)
+		usbci.SetBaselineVerifier(verifier)
+
+		for _, ext := range []string{`json`, `xml`, `yaml`} {
+
+			fn := filepath.Join(os.Getenv(`TEMP`), `mag1-signed.` + ext)
+
+			err := td.Mag[`mag1`].Save(fn)
+			gotest.Ok(t, err)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = mag3.RestoreFile(fn)
+			gotest.Ok(t, err)
+
+			ss, err := mag3.CompareFile(fn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(ss) == 0, `signed %s baseline should match saved device`, ext)
+		}
+	})
+
+	t.Run("CompareFile() refuses altered baselines", func(t *testing.T) {
+
+		usbci.SetSnapshotSigner(signer)
+		usbci.SetBaselineVerifier(verifier)
+
+		err := td.Mag[`mag1`].Save(fn)
+		gotest.Ok(t, err)
+
+		b, err := ioutil.ReadFile(fn)
+		gotest.Ok(t, err)
+
+		err = ioutil.WriteFile(fn, bytes.Replace(b, []byte(`21042840G01`), []byte(`21042840G02`), 1), 0640)
+		gotest.Ok(t, err)
+
+		_, err = td.Mag[`mag1`].CompareFile(fn)
+		gotest.Assert(t, err != nil, `altered baseline should be refused`)
+
+		usbci.SetBaselineVerifier(nil)
+
+		ss, err := td.Mag[`mag1`].CompareFile(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 1, `altered baseline should be compared when verification is off`)
+	})
+}
+
+func TestEncryptedSnapshots(t *testing.T) {
+
+	c, err := crypt.NewCipher(bytes.Repeat([]byte{0xa5}, crypt.KeySize))
+	gotest.Ok(t, err)
+
+	defer func() {
+		usbci.SetSnapshotCipher(nil)
+	}()
+
+	for _, ext := range []string{`json`, `xml`, `csv`} {
+
+		fn := filepath.Join(os.Getenv(`TEMP`), `mag1-encrypted.` + ext)
+		usbci.SetSnapshotCipher(c)
+
+		err := td.Mag[`mag1`].Save(fn)
+		gotest.Ok(t, err)
+
+		b, err := ioutil.ReadFile(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, crypt.IsEncrypted(b), `%s snapshot should be encrypted`, ext)
+		gotest.Assert(t, !bytes.Contains(b, []byte(td.Mag[`mag1`].SerialNum)), `encrypted snapshot should not reveal serial number`)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(td.Jsn[`mag2`])
+		gotest.Ok(t, err)
+
+		err = mag3.AuditFile(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(mag3.Changes) > 0, `encrypted %s baseline should be audited`, ext)
+
+		usbci.SetSnapshotCipher(nil)
+
+		_, err = mag3.CompareFile(fn)
+		gotest.Assert(t, err != nil, `encrypted baseline should not be readable without a key`)
+	}
+
+	fn := filepath.Join(os.Getenv(`TEMP`), `mag1-plain.json`)
+
+	err = td.Mag[`mag1`].Save(fn)
+	gotest.Ok(t, err)
+
+	usbci.SetSnapshotCipher(c)
+
+	ss, err := td.Mag[`mag1`].CompareFile(fn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(ss) == 0, `unencrypted baseline should remain readable with a key`)
+}
+
+func TestEditableMethods(t *testing.T) {
+
+	var _ Editable = td.Mag[`mag1`]
+
+	t.Run("YAML() and RestoreYAML()", func(t *testing.T) {
+
+		y, err := td.Mag[`mag1`].YAML()
+		gotest.Ok(t, err)
+		gotest.Assert(t, bytes.Contains(y, []byte(`vendor_id: "0801"`)), `numeric strings should be quoted in YAML output`)
+		gotest.Assert(t, !bytes.Contains(y, []byte(`changes`)), `excluded fields should not appear in YAML output`)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreYAML(y)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], mag3), `restored device not identical to saved device`)
+	})
+
+	t.Run("TOML() and RestoreTOML()", func(t *testing.T) {
+
+		b, err := td.Mag[`mag1`].TOML()
+		gotest.Ok(t, err)
+		gotest.Assert(t, bytes.HasPrefix(b, []byte("schema_version = 2\nhost_name = ")), `TOML output should follow JSON field order`)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreTOML(b)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], mag3), `restored device not identical to saved device`)
+	})
+
+	t.Run("Save() and AuditFile() with hand-edited baselines", func(t *testing.T) {
+
+		for _, ext := range []string{`yaml`, `toml`} {
+
+			fn := filepath.Join(os.Getenv(`TEMP`), `mag1.` + ext)
+
+			err := td.Mag[`mag1`].Save(fn)
+			gotest.Ok(t, err)
+
+			b, err := ioutil.ReadFile(fn)
+			gotest.Ok(t, err)
+
+			err = ioutil.WriteFile(fn, bytes.Replace(b, []byte(`21042840G01`), []byte(`21042840G02`), 1), 0640)
+			gotest.Ok(t, err)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = mag3.RestoreJSON(td.Jsn[`mag1`])
+			gotest.Ok(t, err)
+
+			err = mag3.AuditFile(fn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(mag3.Changes) == 1, `edited %s baseline should produce one change`, ext)
+		}
+	})
+}
+
+func TestPackableMethods(t *testing.T) {
+
+	var _ Packable = td.Mag[`mag1`]
+
+	j, err := td.Mag[`mag1`].JSON()
+	gotest.Ok(t, err)
+
+	for _, f := range []struct {
+		name string
+		enc func() ([]byte, error)
+		dec func(*usbci.Magtek, []byte) (error)
+	}{
+		{`CBOR`, td.Mag[`mag1`].CBOR, (*usbci.Magtek).RestoreCBOR},
+		{`MsgPack`, td.Mag[`mag1`].MsgPack, (*usbci.Magtek).RestoreMsgPack},
+		{`Protobuf`, td.Mag[`mag1`].Protobuf, (*usbci.Magtek).RestoreProtobuf},
+	} {
+		t.Run(f.name + `() and Restore` + f.name + `()`, func(t *testing.T) {
+
+			b, err := f.enc()
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(b) < len(j), `%s output should be smaller than JSON output`, f.name)
+
+			mag3, err := usbci.NewMagtek(nil)
+			gotest.Ok(t, err)
+
+			err = f.dec(mag3, b)
+			gotest.Ok(t, err)
+			gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag1`], mag3), `restored device not identical to saved device`)
+		})
+	}
+
+	t.Run("ChangeSet() round trips", func(t *testing.T) {
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = mag3.RestoreJSON(td.Jsn[`mag1`])
+		gotest.Ok(t, err)
+
+		mag3.SetChanges(td.Chg)
+		cs := mag3.ChangeSet()
+
+		b, err := cs.CBOR()
+		gotest.Ok(t, err)
+		cs2 := new(usbci.ChangeSet)
+		gotest.Ok(t, cs2.RestoreCBOR(b))
+		gotest.Assert(t, reflect.DeepEqual(cs, cs2), `restored CBOR change set not identical to saved change set`)
+
+		b, err = cs.MsgPack()
+		gotest.Ok(t, err)
+		cs2 = new(usbci.ChangeSet)
+		gotest.Ok(t, cs2.RestoreMsgPack(b))
+		gotest.Assert(t, reflect.DeepEqual(cs, cs2), `restored MessagePack change set not identical to saved change set`)
+
+		b, err = cs.Protobuf()
+		gotest.Ok(t, err)
+		cs2 = new(usbci.ChangeSet)
+		gotest.Ok(t, cs2.RestoreProtobuf(b))
+		gotest.Assert(t, reflect.DeepEqual(cs, cs2), `restored Protobuf change set not identical to saved change set`)
+	})
+}
+
 func TestSerialMethods(t *testing.T) {
 
 	t.Run("magtek Sureswipe Card Reader", func(t *testing.T) {
@@ -367,3 +1069,144 @@ func TestSerialMethods(t *testing.T) {
 		gotest.Ok(t, err)
 	})
 }
+
+func TestSerialPolicies(t *testing.T) {
+
+	defer func() {
+		usbci.SetDeviceSNPolicy(nil)
+		usbci.SetFactorySNPolicy(nil)
+	}()
+
+	t.Run("Check Digits", func(t *testing.T) {
+
+		cd, err := usbci.CheckDigit(usbci.CheckDigitLuhn, `7992739871`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, cd == `3`, `Luhn check digit of 7992739871 should be 3`)
+
+		cd, err = usbci.CheckDigit(usbci.CheckDigitMod36, `24FFFF`)
+		gotest.Ok(t, err)
+
+		p := &usbci.SerialPolicy{CheckDigit: usbci.CheckDigitMod36}
+		gotest.Ok(t, p.Compile())
+		gotest.Ok(t, p.CheckSerial(nil, `24FFFF` + cd))
+		gotest.Assert(t, p.CheckSerial(nil, `24FFFF` + `#`) != nil, `invalid check digit not detected`)
+
+		_, err = usbci.CheckDigit(`crc`, `24FFFF`)
+		gotest.Assert(t, err != nil, `unknown algorithm should be refused`)
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+
+		p := &usbci.SerialPolicy{
+			Pattern: `^[0-9][0-9A-Z]+$`,
+			MinLength: 7,
+			MaxLength: 7,
+			Charset: `0123456789ABCDEF`,
+			Prefix: `24`,
+			StorePattern: `^STORE(\d+)-`,
+			StorePrefixes: map[string]string{`0421`: `31`},
+		}
+
+		gotest.Ok(t, p.Compile())
+
+		mdev := td.Mag[`mag1`]
+		gotest.Ok(t, p.CheckSerial(mdev.Generic, `24FFFFF`))
+
+		err := p.CheckSerial(mdev.Generic, `x4FFFFFFF`)
+		pe, ok := err.(*usbci.PolicyError)
+
+		gotest.Assert(t, ok, `policy violations should be reported as a PolicyError`)
+		gotest.Assert(t, len(pe.Violations) == 4, `length, charset, pattern and prefix violations expected`)
+
+		err = p.CheckSerial(mdev.Generic, `24FFÉFF`)
+		pe, ok = err.(*usbci.PolicyError)
+		gotest.Assert(t, ok, `policy violations should be reported as a PolicyError`)
+
+		found := false
+
+		for _, v := range pe.Violations {
+			found = found || v == `character 'É' not allowed`
+		}
+
+		gotest.Assert(t, found, `disallowed multibyte character should be reported whole`)
+
+		store := *mdev.Generic
+		store.HostName = `STORE0421-POS1`
+
+		gotest.Ok(t, p.CheckSerial(&store, `31FFFFF`))
+		gotest.Assert(t, p.CheckSerial(&store, `24FFFFF`) != nil, `store prefix not enforced`)
+
+		bad := &usbci.SerialPolicy{MinLength: 8, MaxLength: 7}
+		gotest.Assert(t, bad.Compile() != nil, `inconsistent lengths should be refused`)
+
+		bad = &usbci.SerialPolicy{StorePattern: `^STORE`}
+		gotest.Assert(t, bad.Compile() != nil, `store pattern without subexpression should be refused`)
+
+		lazy := &usbci.SerialPolicy{Pattern: `^24`, StorePattern: `^STORE(\d+)-`, StorePrefixes: map[string]string{`0421`: `31`}}
+		gotest.Assert(t, lazy.CheckSerial(nil, `31FFFFF`) != nil, `pattern of uncompiled policy not enforced`)
+		gotest.Assert(t, lazy.CheckSerial(&store, `24FFFFF`) != nil, `store pattern of uncompiled policy not enforced`)
+
+		lazy.Pattern = `^(24`
+		err = lazy.CheckSerial(nil, `24FFFFF`)
+		_, ok = err.(*usbci.PolicyError)
+		gotest.Assert(t, err != nil && !ok, `invalid pattern of uncompiled policy should be an error`)
+	})
+
+	t.Run("Setters and Audit", func(t *testing.T) {
+
+		dir, err := ioutil.TempDir(``, `policy`)
+		gotest.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		fn := filepath.Join(dir, `policy.json`)
+		gotest.Ok(t, ioutil.WriteFile(fn, []byte(`{"device_sn": {"min_length": 8}, ` +
+			`"factory_sn": {"charset": "0123456789"}}`), 0640))
+
+		p, err := usbci.LoadPolicies(fn)
+		gotest.Ok(t, err)
+		p.Install()
+
+		mdev := td.Mag[`mag1`]
+
+		for _, err := range []error{
+			mdev.SetDeviceSN(`SHORT`),
+			mdev.SetFactorySN(`B164F78022713AA`),
+		} {
+			_, ok := err.(*usbci.PolicyError)
+			gotest.Assert(t, ok, `setter should refuse a serial number that violates policy`)
+		}
+
+		gotest.Assert(t, mdev.DeviceSN == `24FFFFF`, `refused serial number should not be recorded`)
+
+		pe := mdev.CheckSerials()
+
+		gotest.Assert(t, len(pe) == 2, `both serial numbers should be flagged`)
+		gotest.Assert(t, pe[0].Field == usbci.FieldDeviceSN && pe[1].Field == usbci.FieldFactorySN,
+			`violations should name the serial number field`)
+
+		gotest.Assert(t, len(td.Gen[`gen1`].CheckSerials()) == 0, `empty serial numbers should not be flagged`)
+	})
+}
+
+func TestWriteUndo(t *testing.T) {
+
+	mdev := td.Mag[`mag1`]
+
+	clone := func(fsn string) (*usbci.Magtek) {
+		gen := *mdev.Generic
+		gen.FactorySN = fsn
+		return &usbci.Magtek{Generic: &gen}
+	}
+
+	written, other := clone(`B164F78099999BB`), clone(`B164F78011111CC`)
+
+	w := &usbci.Write{Device: mdev.Identity(), NewDevice: written.Identity(), Property: usbci.FieldFactorySN,
+		OldValue: mdev.FactorySN, NewValue: written.FactorySN}
+
+	gotest.Assert(t, w.Of(mdev.Identity()) && w.Of(written.Identity()), `factory SN write should match the device before and after the write`)
+	gotest.Assert(t, !w.Of(other.Identity()), `write should not match another device`)
+	gotest.Assert(t, !(&usbci.Write{Device: mdev.Identity()}).Of(``), `write without new identity should not match an empty identity`)
+
+	err := other.Undo(w)
+	gotest.Assert(t, err != nil, `write of another device should not be undone`)
+}
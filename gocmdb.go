@@ -37,15 +37,40 @@ type Comparable interface {
 	Save(string) (error)
 	RestoreFile(string) (error)
 	RestoreJSON([]byte) (error)
+	RestoreXML([]byte) (error)
+	RestoreCSV([]byte) (error)
+	RestoreNVP([]byte) (error)
 	CompareFile(string) ([][]string, error)
 	CompareJSON([]byte) ([][]string, error)
+	CompareXML([]byte) ([][]string, error)
+	CompareCSV([]byte) ([][]string, error)
+	CompareNVP([]byte) ([][]string, error)
 	AuditFile(string) (error)
 	AuditJSON([]byte) (error)
+	AuditXML([]byte) (error)
+	AuditCSV([]byte) (error)
+	AuditNVP([]byte) (error)
 	AddChange(string, string, string)
 	SetChanges([][]string)
 	GetChanges() ([][]string)
 }
 
+type Editable interface {
+	YAML() ([]byte, error)
+	TOML() ([]byte, error)
+	RestoreYAML([]byte) (error)
+	RestoreTOML([]byte) (error)
+}
+
+type Packable interface {
+	CBOR() ([]byte, error)
+	MsgPack() ([]byte, error)
+	Protobuf() ([]byte, error)
+	RestoreCBOR([]byte) (error)
+	RestoreMsgPack([]byte) (error)
+	RestoreProtobuf([]byte) (error)
+}
+
 type Resettable interface {
 	Refresh() (map[string]bool)
 	Reset() (error)
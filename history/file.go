@@ -0,0 +1,233 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	`bufio`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`regexp`
+	`sort`
+	`strings`
+	`sync`
+
+	`github.com/jscherff/gocmdb/crypt`
+)
+
+const (
+	FileExtension string = `.ndjson`
+)
+
+var (
+	unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+// FileStore is the default Store. It keeps one append-only file per device
+// in a directory, with one JSON record per line. Files are named by the
+// device key, with characters other than letters, digits, '.' and '-'
+// escaped as '_' and two hex digits. If Cipher is set, records are appended
+// encrypted, one base64 line each, and files are named by an opaque digest
+// of the device key instead of the key itself. Records written before the
+// Cipher was set remain readable and precede the encrypted ones.
+type FileStore struct {
+	Dir string
+	Cipher *crypt.Cipher
+	mutex sync.Mutex
+}
+
+// NewFileStore instantiates a FileStore, creating its directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{Dir: dir}, nil
+}
+
+// Append adds a record to the device history file.
+func (this *FileStore) Append(rec *Record) (error) {
+
+	b, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	if this.Cipher != nil {
+		if b, err = this.Cipher.EncryptText(b); err != nil {
+			return err
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fh, err := os.OpenFile(this.filename(rec.Key), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = fh.Write(append(b, '\n')); err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
+
+// Records returns the history of a device, oldest record first.
+func (this *FileStore) Records(key string) (recs []*Record, err error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.Cipher != nil {
+
+		if recs, err = this.read(this.plainFilename(key)); err != nil {
+			return recs, err
+		}
+	}
+
+	more, err := this.read(this.filename(key))
+
+	return append(recs, more...), err
+}
+
+// Keys returns the keys of all devices in the store.
+func (this *FileStore) Keys() (keys []string, err error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fis, err := ioutil.ReadDir(this.Dir)
+
+	if err != nil {
+		return keys, err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, fi := range fis {
+
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), FileExtension) {
+			continue
+		}
+
+		recs, err := this.read(filepath.Join(this.Dir, fi.Name()))
+
+		if err != nil {
+			return keys, err
+		}
+
+		if len(recs) > 0 && !seen[recs[0].Key] {
+			seen[recs[0].Key] = true
+			keys = append(keys, recs[0].Key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// filename maps a device key to the name of its history file.
+func (this *FileStore) filename(key string) (string) {
+	return filepath.Join(this.Dir, FileName(key, this.Cipher) + FileExtension)
+}
+
+// plainFilename maps a device key to the name of its unencrypted history
+// file.
+func (this *FileStore) plainFilename(key string) (string) {
+	return filepath.Join(this.Dir, FileName(key, nil) + FileExtension)
+}
+
+// FileName maps a device key to a file name without extension, for files
+// kept per device such as histories and snapshots. Without a cipher, it is
+// the key with characters other than letters, digits, '.' and '-' escaped
+// as '_' and two hex digits; the mapping is one-to-one, since every '_'
+// begins an escape. With a cipher, it is an opaque digest of the key, so
+// that the name does not reveal serial numbers or host names.
+func FileName(key string, ciph *crypt.Cipher) (string) {
+
+	if ciph != nil {
+		return ciph.Name(key)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c != '_' && !unsafeChars.MatchString(key[i:i+1]) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, `_%02X`, c)
+		}
+	}
+
+	return sb.String()
+}
+
+// read loads all records from a history file.
+func (this *FileStore) read(fn string) (recs []*Record, err error) {
+
+	fh, err := os.Open(fn)
+
+	if os.IsNotExist(err) {
+		return recs, nil
+	}
+
+	if err != nil {
+		return recs, err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		b := scanner.Bytes()
+
+		if b[0] != '{' {
+
+			if this.Cipher == nil {
+				return recs, crypt.ErrNoKey
+			}
+
+			if b, err = this.Cipher.DecryptText(b); err != nil {
+				return recs, err
+			}
+		}
+
+		rec := new(Record)
+
+		if err = json.Unmarshal(b, rec); err != nil {
+			return recs, err
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return recs, scanner.Err()
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package history records every audit of a device so that earlier states
+// are not lost when a new snapshot is saved.
+package history
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+)
+
+var (
+	ErrNotFound = errors.New(`no history found`)
+)
+
+const (
+	fieldNameIx int = 0
+)
+
+// Record is a single audit of a device: its snapshot and the changes found
+// when it was compared with the previous snapshot.
+type Record struct {
+	Key        string		`json:"key"`
+	HostName   string		`json:"host_name"`
+	Time       time.Time		`json:"time"`
+	Snapshot   json.RawMessage	`json:"snapshot"`
+	Changes    [][]string		`json:"changes"`
+}
+
+// Device summarizes the history of a single device.
+type Device struct {
+	Key        string		`json:"key"`
+	FirstSeen  time.Time		`json:"first_seen"`
+	FirstHost  string		`json:"first_host"`
+	LastSeen   time.Time		`json:"last_seen"`
+	LastHost   string		`json:"last_host"`
+	Hosts      []string		`json:"hosts"`
+	Audits     int			`json:"audits"`
+}
+
+// Store is implemented by history backends.
+type Store interface {
+
+	// Append adds a record to the history of the device named by its key.
+	Append(*Record) (error)
+
+	// Records returns the history of a device, oldest record first.
+	Records(string) ([]*Record, error)
+
+	// Keys returns the keys of all devices in the store.
+	Keys() ([]string, error)
+}
+
+// Key returns the stable identity of a device. Devices that implement an
+// Identity method are keyed by it; others by vendor ID, product ID and ID.
+func Key(dev gocmdb.Identifiable) (string) {
+
+	if i, ok := dev.(interface{Identity() (string)}); ok {
+		return i.Identity()
+	}
+
+	return fmt.Sprintf(`%s-%s-%s`, dev.VID(), dev.PID(), dev.ID())
+}
+
+// NewRecord creates a record from the current state of a device and the
+// results of its most recent audit.
+func NewRecord(dev gocmdb.Auditable) (*Record, error) {
+
+	j, err := dev.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Record{
+		Key: Key(dev),
+		HostName: dev.Host(),
+		Time: time.Now(),
+		Snapshot: j,
+		Changes: dev.GetChanges(),
+	}, nil
+}
+
+// Audit compares a device with the latest snapshot in its history, placing
+// the results in the device Changes field, and appends the device's current
+// state and changes to the store. Devices without history are recorded
+// without changes.
+func Audit(s Store, dev gocmdb.Auditable) (*Record, error) {
+
+	last, err := Latest(s, Key(dev))
+
+	switch {
+	case err == ErrNotFound:
+		dev.SetChanges(nil)
+	case err != nil:
+		return nil, err
+	default:
+		if err = dev.AuditJSON(last.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	rec, err := NewRecord(dev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, s.Append(rec)
+}
+
+// Latest returns the most recent record for a device.
+func Latest(s Store, key string) (*Record, error) {
+
+	recs, err := s.Records(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return recs[len(recs)-1], nil
+}
+
+// At returns the record describing the device as it was at time t, which is
+// the latest record made at or before t.
+func At(s Store, key string, t time.Time) (*Record, error) {
+
+	recs, err := s.Records(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(recs) - 1; i >= 0; i-- {
+		if !recs[i].Time.After(t) {
+			return recs[i], nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// LastChange returns the most recent record whose audit found a change in
+// the named field, along with that change.
+func LastChange(s Store, key, field string) (*Record, []string, error) {
+
+	recs, err := s.Records(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := len(recs) - 1; i >= 0; i-- {
+		for _, chg := range recs[i].Changes {
+			if len(chg) > fieldNameIx && chg[fieldNameIx] == field {
+				return recs[i], chg, nil
+			}
+		}
+	}
+
+	return nil, nil, ErrNotFound
+}
+
+// Summary returns first-seen and last-seen information for a device.
+func Summary(s Store, key string) (*Device, error) {
+
+	recs, err := s.Records(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	dev := &Device{Key: key, Audits: len(recs)}
+	seen := make(map[string]bool)
+
+	for i, rec := range recs {
+
+		if i == 0 || rec.Time.Before(dev.FirstSeen) {
+			dev.FirstSeen, dev.FirstHost = rec.Time, rec.HostName
+		}
+		if i == 0 || !rec.Time.Before(dev.LastSeen) {
+			dev.LastSeen, dev.LastHost = rec.Time, rec.HostName
+		}
+		if !seen[rec.HostName] {
+			seen[rec.HostName] = true
+			dev.Hosts = append(dev.Hosts, rec.HostName)
+		}
+	}
+
+	return dev, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	`bytes`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+	`time`
+
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func TestFileStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `history`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	gotest.Ok(t, err)
+
+	t0 := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Audit() without history", func(t *testing.T) {
+
+		mag1 := testdevice.Magtek(t, `mag1`)
+
+		rec, err := Audit(s, mag1)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(rec.Changes) == 0, `first audit should not contain changes`)
+		gotest.Assert(t, rec.Key == mag1.Identity(), `record key should be device identity`)
+
+		rec, err = Latest(s, rec.Key)
+		gotest.Ok(t, err)
+		gotest.Assert(t, rec.HostName == mag1.HostName, `record host should be device host`)
+	})
+
+	t.Run("Audit() with history", func(t *testing.T) {
+
+		mag2 := testdevice.Magtek(t, `mag2`)
+
+		rec, err := Audit(s, mag2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(rec.Changes) == 2, `second audit should contain two changes`)
+		gotest.Assert(t, len(mag2.Changes) == 2, `(device).Changes should contain two changes`)
+	})
+
+	t.Run("At() and LastChange()", func(t *testing.T) {
+
+		mag1 := testdevice.Magtek(t, `mag1`)
+		key := Key(mag1)
+
+		recs, err := s.Records(key)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 2, `history should contain two records`)
+
+		rec, err := NewRecord(mag1)
+		gotest.Ok(t, err)
+
+		rec.Time = t0
+		err = s.Append(rec)
+		gotest.Ok(t, err)
+
+		rec, err = At(s, key, t0.Add(time.Hour))
+		gotest.Ok(t, err)
+		gotest.Assert(t, rec.Time.Equal(t0), `At() should return the record made before the requested time`)
+
+		_, err = At(s, key, t0.Add(-time.Hour))
+		gotest.Assert(t, err == ErrNotFound, `At() should not find records before the first audit`)
+
+		rec, chg, err := LastChange(s, key, `SoftwareID`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, chg[2] == `21042840G02`, `LastChange() returned the wrong change`)
+		gotest.Assert(t, !rec.Time.Equal(t0), `LastChange() returned the wrong record`)
+	})
+
+	t.Run("Summary() and Keys()", func(t *testing.T) {
+
+		mag1 := testdevice.Magtek(t, `mag1`)
+
+		dev, err := Summary(s, Key(mag1))
+		gotest.Ok(t, err)
+		gotest.Assert(t, dev.Audits == 3, `summary should count three audits`)
+		gotest.Assert(t, len(dev.Hosts) == 1 && dev.Hosts[0] == mag1.HostName, `summary hosts incorrect`)
+		gotest.Assert(t, dev.FirstSeen.Equal(t0), `summary first-seen time incorrect`)
+		gotest.Assert(t, dev.LastSeen.After(t0), `summary last-seen time incorrect`)
+
+		keys, err := s.Keys()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(keys) == 1 && keys[0] == Key(mag1), `store should contain one device`)
+	})
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `history`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	gotest.Ok(t, err)
+
+	_, err = Audit(s, testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+
+	s.Cipher, err = crypt.NewCipher(bytes.Repeat([]byte{0x5a}, crypt.KeySize))
+	gotest.Ok(t, err)
+
+	mag2 := testdevice.Magtek(t, `mag2`)
+
+	rec, err := Audit(s, mag2)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(rec.Changes) == 2, `audit should compare with unencrypted history`)
+
+	fis, err := ioutil.ReadDir(dir)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(fis) == 2, `encrypted records should be written to a separate file`)
+
+	for _, fi := range fis {
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		gotest.Ok(t, err)
+
+		if strings.HasPrefix(fi.Name(), s.Cipher.Name(Key(mag2))) {
+			gotest.Assert(t, !bytes.Contains(b, []byte(mag2.SerialNum)), `encrypted history should not reveal serial numbers`)
+		}
+	}
+
+	recs, err := s.Records(Key(mag2))
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(recs) == 2, `history should contain unencrypted and encrypted records`)
+
+	keys, err := s.Keys()
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(keys) == 1, `store should contain one device`)
+
+	s.Cipher = nil
+
+	_, err = s.Keys()
+	gotest.Assert(t, err == crypt.ErrNoKey, `encrypted history should not be readable without a key`)
+}
+
+func TestFileNames(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `history`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	gotest.Ok(t, err)
+
+	keys := []string{`a/b`, `a:b`, `a_b`, `a_2Fb`}
+
+	for _, key := range keys {
+		err = s.Append(&Record{Key: key, Time: time.Now()})
+		gotest.Ok(t, err)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(fis) == len(keys), `keys differing only in unsafe characters should have separate files`)
+
+	for _, key := range keys {
+		recs, err := s.Records(key)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 1 && recs[0].Key == key, `history of %q should contain only its own record`, key)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testdata loads testdata.json, the device reports shared by the
+// tests of every package, from the root of the module. It has no package
+// dependencies, so that the tests of packages below usbci can use it; see
+// package testdevice for devices restored from the reports.
+package testdata
+
+import (
+	`encoding/json`
+	`io/ioutil`
+	`path/filepath`
+	`runtime`
+	`sync`
+)
+
+// TestData holds the JSON reports of the test devices and the changes
+// between mag1 and mag2.
+type TestData struct {
+	Jsn map[string][]byte
+	Chg [][]string
+}
+
+var (
+	td *TestData
+	once sync.Once
+)
+
+// Load returns the test data, reading it on first use. It panics if the
+// file cannot be read, since no test can run without it.
+func Load() (*TestData) {
+
+	once.Do(func() {
+
+		_, fn, _, _ := runtime.Caller(0)
+		fn = filepath.Join(filepath.Dir(fn), `..`, `..`, `testdata.json`)
+
+		td = new(TestData)
+
+		if b, err := ioutil.ReadFile(fn); err != nil {
+			panic(err)
+		} else if err = json.Unmarshal(b, td); err != nil {
+			panic(err)
+		}
+	})
+
+	return td
+}
+
+// Jsn returns the JSON report of a test device.
+func Jsn(k string) ([]byte) {
+	return Load().Jsn[k]
+}
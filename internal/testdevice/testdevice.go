@@ -0,0 +1,49 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testdevice restores usbci devices without a gousb Device from the
+// JSON reports of package testdata, for tests.
+package testdevice
+
+import (
+	`testing`
+
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gotest`
+)
+
+// Magtek restores a Magtek from the JSON report of a test device.
+func Magtek(t testing.TB, k string) (*usbci.Magtek) {
+
+	mag, err := usbci.NewMagtek(nil)
+	gotest.Ok(t, err)
+
+	err = mag.RestoreJSON(testdata.Jsn(k))
+	gotest.Ok(t, err)
+
+	return mag
+}
+
+// Generic restores a Generic from the JSON report of a test device.
+func Generic(t testing.TB, k string) (*usbci.Generic) {
+
+	gen, err := usbci.NewGeneric(nil)
+	gotest.Ok(t, err)
+
+	err = gen.RestoreJSON(testdata.Jsn(k))
+	gotest.Ok(t, err)
+
+	return gen
+}
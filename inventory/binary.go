@@ -0,0 +1,405 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	`bytes`
+	`fmt`
+	`time`
+
+	`github.com/fxamacker/cbor/v2`
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/vmihailenco/msgpack/v5`
+	`google.golang.org/protobuf/encoding/protowire`
+)
+
+// Field numbers of the Inventory message defined in proto/gocmdb.proto.
+const (
+	ProtoSchemaVersion protowire.Number = 1
+	ProtoAgentVersion protowire.Number = 2
+	ProtoHostName protowire.Number = 3
+	ProtoOSName protowire.Number = 4
+	ProtoOSArch protowire.Number = 5
+	ProtoCollected protowire.Number = 6
+	ProtoDevices protowire.Number = 7
+)
+
+// envelope is the binary form of an inventory. The collection time is an
+// RFC 3339 string, as in the Protobuf schema, and each device is embedded
+// in the device's own encoding of the same format.
+type envelope struct {
+	SchemaVersion int		`json:"schema_version"`
+	AgentVersion  string		`json:"agent_version"`
+	HostName      string		`json:"host_name"`
+	OSName        string		`json:"os_name"`
+	OSArch        string		`json:"os_arch"`
+	Collected     string		`json:"collected"`
+}
+
+type cborEnvelope struct {
+	envelope
+	Devices []cbor.RawMessage	`json:"devices"`
+}
+
+type msgpEnvelope struct {
+	envelope
+	Devices []msgpack.RawMessage	`json:"devices"`
+}
+
+// CBOR reports the inventory in CBOR format.
+func (this *Inventory) CBOR() ([]byte, error) {
+
+	env := cborEnvelope{envelope: this.envelope()}
+
+	for i, dev := range this.Devices {
+
+		b, err := packable(i, dev)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := b.CBOR()
+
+		if err != nil {
+			return nil, err
+		}
+
+		env.Devices = append(env.Devices, c)
+	}
+
+	return cbor.Marshal(env)
+}
+
+// MsgPack reports the inventory in MessagePack format.
+func (this *Inventory) MsgPack() ([]byte, error) {
+
+	env := msgpEnvelope{envelope: this.envelope()}
+
+	for i, dev := range this.Devices {
+
+		b, err := packable(i, dev)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := b.MsgPack()
+
+		if err != nil {
+			return nil, err
+		}
+
+		env.Devices = append(env.Devices, m)
+	}
+
+	buf := new(bytes.Buffer)
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag(`json`)
+
+	if err := enc.Encode(env); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Protobuf reports the inventory as a gocmdb.Inventory message.
+func (this *Inventory) Protobuf() ([]byte, error) {
+
+	var b []byte
+	env := this.envelope()
+
+	b = appendVarint(b, ProtoSchemaVersion, env.SchemaVersion)
+	b = appendString(b, ProtoAgentVersion, env.AgentVersion)
+	b = appendString(b, ProtoHostName, env.HostName)
+	b = appendString(b, ProtoOSName, env.OSName)
+	b = appendString(b, ProtoOSArch, env.OSArch)
+	b = appendString(b, ProtoCollected, env.Collected)
+
+	for i, dev := range this.Devices {
+
+		p, err := packable(i, dev)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := p.Protobuf()
+
+		if err != nil {
+			return nil, err
+		}
+
+		b = protowire.AppendTag(b, ProtoDevices, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+
+	return b, nil
+}
+
+// RestoreCBOR restores an inventory from CBOR format. Each device is
+// restored with the wrapper named by its object_type field.
+func RestoreCBOR(b []byte) (*Inventory, error) {
+
+	var env cborEnvelope
+
+	if err := cbor.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+
+	this, err := env.inventory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, c := range env.Devices {
+
+		dev, err := restoreDevice(i, func(p gocmdb.Packable) (error) {
+			return p.RestoreCBOR(c)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		this.Add(dev)
+	}
+
+	return this, nil
+}
+
+// RestoreMsgPack restores an inventory from MessagePack format. Each device
+// is restored with the wrapper named by its object_type field.
+func RestoreMsgPack(b []byte) (*Inventory, error) {
+
+	var env msgpEnvelope
+
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag(`json`)
+
+	if err := dec.Decode(&env); err != nil {
+		return nil, err
+	}
+
+	this, err := env.inventory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range env.Devices {
+
+		dev, err := restoreDevice(i, func(p gocmdb.Packable) (error) {
+			return p.RestoreMsgPack(m)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		this.Add(dev)
+	}
+
+	return this, nil
+}
+
+// RestoreProtobuf restores an inventory from a gocmdb.Inventory message.
+// Each device is restored with the wrapper named by its object_type field.
+func RestoreProtobuf(b []byte) (*Inventory, error) {
+
+	var (
+		env envelope
+		devs [][]byte
+	)
+
+	for len(b) > 0 {
+
+		num, typ, n := protowire.ConsumeTag(b)
+
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		if num == ProtoSchemaVersion && typ == protowire.VarintType {
+
+			v, n := protowire.ConsumeVarint(b)
+
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+
+			env.SchemaVersion = int(v)
+			b = b[n:]
+			continue
+		}
+
+		if typ != protowire.BytesType {
+
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+
+			b = b[n:]
+			continue
+		}
+
+		val, n := protowire.ConsumeBytes(b)
+
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		switch num {
+		case ProtoAgentVersion:
+			env.AgentVersion = string(val)
+		case ProtoHostName:
+			env.HostName = string(val)
+		case ProtoOSName:
+			env.OSName = string(val)
+		case ProtoOSArch:
+			env.OSArch = string(val)
+		case ProtoCollected:
+			env.Collected = string(val)
+		case ProtoDevices:
+			devs = append(devs, val)
+		}
+	}
+
+	this, err := env.inventory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range devs {
+
+		dev, err := restoreDevice(i, func(p gocmdb.Packable) (error) {
+			return p.RestoreProtobuf(m)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		this.Add(dev)
+	}
+
+	return this, nil
+}
+
+// envelope returns the inventory metadata in binary form.
+func (this *Inventory) envelope() (envelope) {
+	return envelope{
+		SchemaVersion: this.SchemaVersion,
+		AgentVersion: this.AgentVersion,
+		HostName: this.HostName,
+		OSName: this.OSName,
+		OSArch: this.OSArch,
+		Collected: this.Collected.Format(time.RFC3339Nano),
+	}
+}
+
+// inventory instantiates an inventory without devices from its metadata.
+func (this envelope) inventory() (*Inventory, error) {
+
+	t, err := time.Parse(time.RFC3339Nano, this.Collected)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Inventory{
+		SchemaVersion: this.SchemaVersion,
+		AgentVersion: this.AgentVersion,
+		HostName: this.HostName,
+		OSName: this.OSName,
+		OSArch: this.OSArch,
+		Collected: t,
+	}, nil
+}
+
+// packable asserts that a device supports the binary encodings.
+func packable(i int, dev gocmdb.Reportable) (gocmdb.Packable, error) {
+
+	if p, ok := dev.(gocmdb.Packable); ok {
+		return p, nil
+	}
+
+	return nil, fmt.Errorf(`device %d: %T does not support binary encodings`, i, dev)
+}
+
+// restoreDevice restores a device report into a Generic wrapper to learn
+// its object type, then restores it again into the registered wrapper.
+func restoreDevice(i int, restore func(gocmdb.Packable) (error)) (gocmdb.Reportable, error) {
+
+	gen, _ := usbci.NewGeneric(nil)
+
+	if err := restore(gen); err != nil {
+		return nil, fmt.Errorf(`device %d: %v`, i, err)
+	}
+
+	obj, err := usbci.NewObject(gen.ObjectType)
+
+	if err != nil {
+		return nil, fmt.Errorf(`device %d: %v`, i, err)
+	}
+
+	p, ok := obj.(gocmdb.Packable)
+
+	if !ok {
+		return nil, fmt.Errorf(`device %d: %T does not support binary encodings`, i, obj)
+	}
+
+	if err = restore(p); err != nil {
+		return nil, fmt.Errorf(`device %d: %v`, i, err)
+	}
+
+	dev, ok := obj.(gocmdb.Reportable)
+
+	if !ok {
+		return nil, fmt.Errorf(`device %d: %T is not reportable`, i, obj)
+	}
+
+	return dev, nil
+}
+
+// appendVarint appends an integer field unless it has the default value.
+func appendVarint(b []byte, num protowire.Number, n int) ([]byte) {
+
+	if n == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(n))
+}
+
+// appendString appends a string field unless it has the default value.
+func appendString(b []byte, num protowire.Number, s string) ([]byte) {
+
+	if s == `` {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
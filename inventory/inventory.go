@@ -0,0 +1,369 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inventory wraps the reports of many devices in a single document
+// with host and collection metadata for upload to a CMDB.
+package inventory
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`fmt`
+	`io`
+	`os`
+	`runtime`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/report`
+)
+
+const (
+	SchemaVersion int = 1
+	TimeFormat string = `20060102T150405Z`
+
+	MarshalPrefix string = ``
+	MarshalIndent string = "\t"
+)
+
+var (
+	// AgentVersion identifies the software that collected the inventory.
+	// Applications may override it, e.g. at link time with -ldflags -X.
+	AgentVersion string = `1.0.0`
+)
+
+// Inventory is a collection of device reports from a single host.
+type Inventory struct {
+	XMLName       xml.Name		`json:"-"              xml:"inventory"`
+	SchemaVersion int		`json:"schema_version" xml:"schema_version,attr"`
+	AgentVersion  string		`json:"agent_version"  xml:"agent_version,attr"`
+	HostName      string		`json:"host_name"      xml:"host_name"`
+	OSName        string		`json:"os_name"        xml:"os_name"`
+	OSArch        string		`json:"os_arch"        xml:"os_arch"`
+	Collected     time.Time		`json:"collected"      xml:"collected"`
+	Devices       Devices		`json:"devices"        xml:"devices"`
+}
+
+// Devices is the list of device reports in an inventory.
+type Devices []gocmdb.Reportable
+
+// Header is the first record of an NDJSON inventory stream.
+type Header struct {
+	SchemaVersion int		`json:"schema_version"`
+	AgentVersion  string		`json:"agent_version"`
+	HostName      string		`json:"host_name"`
+	OSName        string		`json:"os_name"`
+	OSArch        string		`json:"os_arch"`
+	Collected     time.Time		`json:"collected"`
+	DeviceCount   int		`json:"device_count"`
+}
+
+// New instantiates an inventory of the given devices collected now on the
+// local host.
+func New(devs ...gocmdb.Reportable) (*Inventory) {
+
+	host, _ := os.Hostname()
+
+	return &Inventory{
+		SchemaVersion: SchemaVersion,
+		AgentVersion: AgentVersion,
+		HostName: host,
+		OSName: runtime.GOOS,
+		OSArch: runtime.GOARCH,
+		Collected: time.Now().UTC(),
+		Devices: devs,
+	}
+}
+
+// Add appends devices to the inventory.
+func (this *Inventory) Add(devs ...gocmdb.Reportable) {
+	this.Devices = append(this.Devices, devs...)
+}
+
+// Header returns the inventory metadata without the devices.
+func (this *Inventory) Header() (*Header) {
+	return &Header{
+		SchemaVersion: this.SchemaVersion,
+		AgentVersion: this.AgentVersion,
+		HostName: this.HostName,
+		OSName: this.OSName,
+		OSArch: this.OSArch,
+		Collected: this.Collected,
+		DeviceCount: len(this.Devices),
+	}
+}
+
+// Filename constructs a convenient filename from the host name and the
+// collection time.
+func (this *Inventory) Filename() (string) {
+	return fmt.Sprintf(`%s-%s`, this.HostName, this.Collected.UTC().Format(TimeFormat))
+}
+
+// JSON reports the inventory in JSON format.
+func (this *Inventory) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the inventory in formatted JSON format.
+func (this *Inventory) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// XML reports the inventory in XML format.
+func (this *Inventory) XML() ([]byte, error) {
+	return xml.Marshal(this)
+}
+
+// PrettyXML reports the inventory in formatted XML format.
+func (this *Inventory) PrettyXML() ([]byte, error) {
+	return xml.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// NDJSON writes the inventory as a stream of newline-delimited JSON records:
+// a Header record followed by one record per device.
+func (this *Inventory) NDJSON(w io.Writer) (error) {
+
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(this.Header()); err != nil {
+		return err
+	}
+
+	for _, dev := range this.Devices {
+
+		j, err := dev.JSON()
+
+		if err != nil {
+			return err
+		}
+
+		if err = enc.Encode(json.RawMessage(j)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CSV reports the inventory in CSV format with a single header record and
+// one record per device. The columns are the union of the device columns in
+// the order first encountered; devices without a column leave it empty.
+func (this *Inventory) CSV() ([]byte, error) {
+
+	var (
+		cols []string
+		rows []map[string]string
+	)
+
+	index := make(map[string]bool)
+
+	for i, dev := range this.Devices {
+
+		b, err := dev.CSV()
+
+		if err != nil {
+			return nil, err
+		}
+
+		recs, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(recs) != 2 || len(recs[0]) != len(recs[1]) {
+			return nil, fmt.Errorf(`device %d: unexpected CSV report layout`, i)
+		}
+
+		row := make(map[string]string)
+
+		for j, col := range recs[0] {
+
+			if !index[col] {
+				index[col] = true
+				cols = append(cols, col)
+			}
+
+			row[col] = recs[1][j]
+		}
+
+		rows = append(rows, row)
+	}
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+
+	if err := w.Write(cols); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+
+		rec := make([]string, len(cols))
+
+		for i, col := range cols {
+			rec[i] = row[col]
+		}
+
+		if err := w.Write(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// NVP reports the inventory as name-value pairs: a block of inventory
+// metadata followed by one block per device, separated by blank lines.
+func (this *Inventory) NVP() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "SchemaVersion:%d\n", this.SchemaVersion)
+	fmt.Fprintf(buf, "AgentVersion:%s\n", this.AgentVersion)
+	fmt.Fprintf(buf, "HostName:%s\n", this.HostName)
+	fmt.Fprintf(buf, "OSName:%s\n", this.OSName)
+	fmt.Fprintf(buf, "OSArch:%s\n", this.OSArch)
+	fmt.Fprintf(buf, "Collected:%s\n", this.Collected.Format(time.RFC3339))
+	fmt.Fprintf(buf, "DeviceCount:%d\n", len(this.Devices))
+
+	for _, dev := range this.Devices {
+
+		b, err := dev.NVP()
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf.WriteString("\n")
+		buf.Write(b)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Legacy reports the legacy host name and serial number record of each
+// device, one per line.
+func (this *Inventory) Legacy() ([]byte) {
+
+	buf := new(bytes.Buffer)
+
+	for _, dev := range this.Devices {
+		buf.Write(dev.Legacy())
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+// HTML reports the inventory as a printable HTML page with devices grouped
+// by host and device type. See report.Page for details.
+func (this *Inventory) HTML() ([]byte, error) {
+
+	page, err := this.Page(report.Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page.HTML()
+}
+
+// Markdown reports the inventory as a Markdown document with devices
+// grouped by host and device type. See report.Page for details.
+func (this *Inventory) Markdown() ([]byte, error) {
+
+	page, err := this.Page(report.Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Markdown()
+}
+
+// Page builds a printable report page of the inventory with the given
+// columns, dated by the collection time.
+func (this *Inventory) Page(opts report.Options) (*report.Page, error) {
+
+	title := fmt.Sprintf(`Device inventory of %s`, this.HostName)
+	page, err := report.NewPage(title, opts, this.Devices...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page.Generated = this.Collected
+
+	return page, nil
+}
+
+// MarshalJSON reports each device using its own JSON method.
+func (this Devices) MarshalJSON() ([]byte, error) {
+
+	js := make([]json.RawMessage, len(this))
+
+	for i, dev := range this {
+
+		j, err := dev.JSON()
+
+		if err != nil {
+			return nil, err
+		}
+
+		js[i] = j
+	}
+
+	return json.Marshal(js)
+}
+
+// MarshalXML reports each device using its own XML method, re-encoding the
+// tokens so that indentation is applied consistently.
+func (this Devices) MarshalXML(e *xml.Encoder, start xml.StartElement) (error) {
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, dev := range this {
+
+		x, err := dev.XML()
+
+		if err != nil {
+			return err
+		}
+
+		d := xml.NewDecoder(bytes.NewReader(x))
+
+		for {
+			tok, err := d.Token()
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if err = e.EncodeToken(xml.CopyToken(tok)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	`bufio`
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`strings`
+	`testing`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func newInventory(t *testing.T) (*Inventory) {
+	return New(testdevice.Magtek(t, `mag1`), testdevice.Generic(t, `gen1`))
+}
+
+func TestReportMethods(t *testing.T) {
+
+	var _ gocmdb.Reportable = newInventory(t)
+
+	t.Run("JSON()", func(t *testing.T) {
+
+		b, err := newInventory(t).JSON()
+		gotest.Ok(t, err)
+
+		var inv struct {
+			SchemaVersion int			`json:"schema_version"`
+			Devices       []map[string]interface{}	`json:"devices"`
+		}
+
+		err = json.Unmarshal(b, &inv)
+		gotest.Ok(t, err)
+		gotest.Assert(t, inv.SchemaVersion == SchemaVersion, `schema version missing from JSON report`)
+		gotest.Assert(t, len(inv.Devices) == 2, `JSON report should contain two devices`)
+		gotest.Assert(t, inv.Devices[1][`object_type`] == `*usbci.Generic`, `JSON report device order incorrect`)
+	})
+
+	t.Run("PrettyXML()", func(t *testing.T) {
+
+		b, err := newInventory(t).PrettyXML()
+		gotest.Ok(t, err)
+
+		var inv struct {
+			AgentVersion string	`xml:"agent_version,attr"`
+			Devices      []struct {
+				SerialNum string `xml:"SerialNum"`
+			}			`xml:"devices>Generic"`
+		}
+
+		err = xml.Unmarshal(b, &inv)
+		gotest.Ok(t, err)
+		gotest.Assert(t, inv.AgentVersion == AgentVersion, `agent version missing from XML report`)
+		gotest.Assert(t, len(inv.Devices) == 2, `XML report should contain two devices`)
+		gotest.Assert(t, inv.Devices[0].SerialNum == testdevice.Magtek(t, `mag1`).SerialNum, `XML report device data incorrect`)
+	})
+
+	t.Run("CSV()", func(t *testing.T) {
+
+		b, err := newInventory(t).CSV()
+		gotest.Ok(t, err)
+
+		recs, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 3, `CSV report should contain a header and two records`)
+		gotest.Assert(t, len(recs[0]) == len(recs[2]), `CSV report records should match header`)
+
+		for i, col := range recs[0] {
+			if col == `vendor_id` {
+				gotest.Assert(t, recs[2][i] == testdevice.Generic(t, `gen1`).VendorID, `CSV report record incorrect`)
+			}
+		}
+	})
+
+	t.Run("NVP()", func(t *testing.T) {
+
+		b, err := newInventory(t).NVP()
+		gotest.Ok(t, err)
+
+		blocks := strings.Split(strings.TrimSpace(string(b)), "\n\n")
+		gotest.Assert(t, len(blocks) == 3, `NVP report should contain three blocks`)
+		gotest.Assert(t, strings.HasPrefix(blocks[0], `SchemaVersion:`), `NVP report should begin with metadata`)
+	})
+
+	t.Run("NDJSON()", func(t *testing.T) {
+
+		var buf bytes.Buffer
+
+		err := newInventory(t).NDJSON(&buf)
+		gotest.Ok(t, err)
+
+		var lines []string
+		scanner := bufio.NewScanner(&buf)
+
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		gotest.Assert(t, len(lines) == 3, `NDJSON stream should contain a header and two devices`)
+
+		hdr := new(Header)
+		err = json.Unmarshal([]byte(lines[0]), hdr)
+		gotest.Ok(t, err)
+		gotest.Assert(t, hdr.DeviceCount == 2, `NDJSON header device count incorrect`)
+
+		devs, err := usbci.RestoreAll(strings.NewReader(strings.Join(lines[1:], "\n")))
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 2, `NDJSON devices should be restorable`)
+	})
+}
+
+func TestBinaryMethods(t *testing.T) {
+
+	inv := newInventory(t)
+
+	j, err := inv.JSON()
+	gotest.Ok(t, err)
+
+	for _, f := range []struct {
+		name string
+		enc func() ([]byte, error)
+		dec func([]byte) (*Inventory, error)
+	}{
+		{`CBOR`, inv.CBOR, RestoreCBOR},
+		{`MsgPack`, inv.MsgPack, RestoreMsgPack},
+		{`Protobuf`, inv.Protobuf, RestoreProtobuf},
+	} {
+		t.Run(f.name + `()`, func(t *testing.T) {
+
+			b, err := f.enc()
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(b) < len(j), `%s report should be smaller than JSON report`, f.name)
+
+			inv2, err := f.dec(b)
+			gotest.Ok(t, err)
+			gotest.Assert(t, inv2.Collected.Equal(inv.Collected), `%s collection time incorrect`, f.name)
+			gotest.Assert(t, len(inv2.Devices) == 2, `%s report should contain two devices`, f.name)
+
+			_, ok := inv2.Devices[0].(*usbci.Magtek)
+			gotest.Assert(t, ok, `%s device should be restored with its own wrapper`, f.name)
+
+			inv2.Collected = inv.Collected
+			j2, err := inv2.JSON()
+			gotest.Ok(t, err)
+			gotest.Assert(t, bytes.Equal(j, j2), `restored %s inventory not identical to saved inventory`, f.name)
+		})
+	}
+}
+
+func TestPageMethods(t *testing.T) {
+
+	h, err := newInventory(t).HTML()
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(h, []byte(`<h2>John-SurfacePro</h2>`)), `HTML report should group devices by host`)
+
+	m, err := newInventory(t).Markdown()
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Count(m, []byte("\n### ")) == 2, `Markdown report should group devices by type`)
+}
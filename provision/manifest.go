@@ -0,0 +1,160 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provision
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`path/filepath`
+	`strings`
+)
+
+const (
+	ColumnFactorySN string = `factory_sn`
+	ColumnDeviceSN string = `device_sn`
+)
+
+// Assignment assigns a device serial number to the reader with a factory
+// serial number.
+type Assignment struct {
+	FactorySN string		`json:"factory_sn"`
+	DeviceSN  string		`json:"device_sn"`
+}
+
+// Manifest is a list of assignments, such as one received for a new store.
+type Manifest []*Assignment
+
+// LoadManifest reads a manifest from a JSON file, holding an array of
+// assignments, or from a CSV file, with a header row naming the factory_sn
+// and device_sn columns. Other columns are ignored. The format is chosen by
+// the file extension.
+func LoadManifest(fn string) (m Manifest, err error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return m, err
+	}
+
+	switch strings.ToLower(filepath.Ext(fn)) {
+
+	case `.json`:
+		err = json.Unmarshal(b, &m)
+
+	case `.csv`:
+		m, err = ParseCSV(b)
+
+	default:
+		return m, fmt.Errorf(`%s: unsupported manifest format %q`, fn, filepath.Ext(fn))
+	}
+
+	if err == nil {
+		err = m.Validate()
+	}
+
+	if err != nil {
+		return m, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return m, nil
+}
+
+// ParseCSV parses a manifest in CSV form.
+func ParseCSV(b []byte) (m Manifest, err error) {
+
+	r := csv.NewReader(bytes.NewReader(b))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+
+	recs, err := r.ReadAll()
+
+	if err != nil {
+		return m, err
+	}
+
+	if len(recs) == 0 {
+		return m, fmt.Errorf(`missing header row`)
+	}
+
+	cols := map[string]int{ColumnFactorySN: -1, ColumnDeviceSN: -1}
+
+	for i, name := range recs[0] {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := cols[name]; ok {
+			cols[name] = i
+		}
+	}
+
+	for name, i := range cols {
+		if i < 0 {
+			return m, fmt.Errorf(`missing column %q`, name)
+		}
+	}
+
+	for n, rec := range recs[1:] {
+
+		if len(rec) == 1 && strings.TrimSpace(rec[0]) == `` {
+			continue
+		}
+
+		fi, di := cols[ColumnFactorySN], cols[ColumnDeviceSN]
+
+		if fi >= len(rec) || di >= len(rec) {
+			return m, fmt.Errorf(`line %d: missing columns`, n + 2)
+		}
+
+		m = append(m, &Assignment{FactorySN: rec[fi], DeviceSN: rec[di]})
+	}
+
+	return m, nil
+}
+
+// Validate trims the serial numbers of a manifest and checks that no
+// assignment or serial number is empty and that no factory or device
+// serial number is assigned twice.
+func (this Manifest) Validate() (error) {
+
+	fsns := make(map[string]bool)
+	dsns := make(map[string]bool)
+
+	for i, a := range this {
+
+		if a == nil {
+			return fmt.Errorf(`assignment %d: empty`, i + 1)
+		}
+
+		a.FactorySN = strings.TrimSpace(a.FactorySN)
+		a.DeviceSN = strings.TrimSpace(a.DeviceSN)
+
+		switch {
+
+		case a.FactorySN == `` || a.DeviceSN == ``:
+			return fmt.Errorf(`assignment %d: empty serial number`, i + 1)
+
+		case fsns[a.FactorySN]:
+			return fmt.Errorf(`assignment %d: factory serial number %q listed twice`, i + 1, a.FactorySN)
+
+		case dsns[a.DeviceSN]:
+			return fmt.Errorf(`assignment %d: device serial number %q assigned twice`, i + 1, a.DeviceSN)
+		}
+
+		fsns[a.FactorySN], dsns[a.DeviceSN] = true, true
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provision writes the device serial numbers of attached readers
+// from a manifest that maps factory serial numbers to asset serial numbers,
+// as received when a new store is rolled out.
+package provision
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`fmt`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+)
+
+// Status is the outcome of an assignment.
+type Status string
+
+const (
+	StatusProvisioned Status = `provisioned`
+	StatusCorrect Status = `already-correct`
+	StatusPending Status = `pending`
+	StatusFailed Status = `failed`
+	StatusNotFound Status = `not-found`
+	StatusUnlisted Status = `unlisted`
+)
+
+// Reader is an attached reader whose serial numbers can be configured, such
+// as a usbci.Magtek.
+type Reader interface {
+	gocmdb.Configurable
+	GetFactorySN() (string, error)
+}
+
+// Result is the outcome of one assignment, or of a reader that is not in
+// the manifest.
+type Result struct {
+	FactorySN string		`json:"factory_sn"`
+	DeviceSN  string		`json:"device_sn,omitempty"`
+	OldValue  string		`json:"old_value,omitempty"`
+	NewValue  string		`json:"new_value,omitempty"`
+	Status    Status		`json:"status"`
+	Error     string		`json:"error,omitempty"`
+}
+
+// Report is the outcome of provisioning from a manifest: one result per
+// assignment, in manifest order, followed by the attached readers that are
+// not in the manifest.
+type Report struct {
+	Time    time.Time		`json:"time"`
+	DryRun  bool			`json:"dry_run"`
+	Results []*Result		`json:"results"`
+	Counts  map[Status]int		`json:"counts"`
+}
+
+// Run matches the attached readers to the manifest by factory serial number
+// and writes the assigned device serial number of each reader found, then
+// verifies it by refreshing the reader and reading it back. Readers that
+// already have their assigned serial number are not written. An assigned
+// serial number held by another attached reader is not written either,
+// since that would duplicate it, unless that reader is itself assigned a
+// new serial number; the assignment then waits until that reader has been
+// provisioned, whatever their order in the manifest. Readers cannot swap
+// serial numbers directly, since one of them would have to hold a duplicate;
+// such assignments fail. With dryRun, nothing is written and the readers
+// that would be written are reported as pending.
+func Run(m Manifest, devs []Reader, dryRun bool) (*Report, error) {
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	rpt := &Report{Time: time.Now(), DryRun: dryRun, Counts: make(map[Status]int)}
+
+	byFactory := make(map[string]Reader)
+	byDevice := make(map[string]string)
+	listed := make(map[string]bool)
+
+	var unlisted []*Result
+
+	for _, a := range m {
+		listed[a.FactorySN] = true
+	}
+
+	for _, dev := range devs {
+
+		fsn, err := dev.GetFactorySN()
+
+		if err != nil || fsn == `` {
+			continue
+		}
+
+		if _, ok := byFactory[fsn]; ok {
+			return nil, fmt.Errorf(`factory serial number %q is reported by two attached readers`, fsn)
+		}
+
+		byFactory[fsn] = dev
+		dsn, err := dev.GetDeviceSN()
+
+		if err == nil && dsn != `` {
+			byDevice[dsn] = fsn
+		}
+
+		if !listed[fsn] {
+			unlisted = append(unlisted, &Result{FactorySN: fsn, OldValue: dsn, Status: StatusUnlisted})
+		}
+	}
+
+	var todo []int
+	pending := make(map[string]bool)
+
+	for i, a := range m {
+
+		r := &Result{FactorySN: a.FactorySN, DeviceSN: a.DeviceSN}
+		rpt.Results = append(rpt.Results, r)
+
+		if _, ok := byFactory[a.FactorySN]; !ok {
+			r.Status = StatusNotFound
+			continue
+		}
+
+		todo = append(todo, i)
+		pending[a.FactorySN] = true
+	}
+
+	for len(todo) > 0 {
+
+		var waiting []int
+
+		for _, i := range todo {
+
+			a, r := m[i], rpt.Results[i]
+
+			if owner, ok := byDevice[a.DeviceSN]; ok && owner != a.FactorySN && pending[owner] {
+				waiting = append(waiting, i)
+				continue
+			}
+
+			r.Status, r.Error = provision(byFactory[a.FactorySN], a, byDevice, r, dryRun)
+			delete(pending, a.FactorySN)
+		}
+
+		if len(waiting) == len(todo) {
+
+			for _, i := range waiting {
+				a, r := m[i], rpt.Results[i]
+				r.OldValue, _ = byFactory[a.FactorySN].GetDeviceSN()
+				r.Status = StatusFailed
+				r.Error = fmt.Sprintf(`serial number in use by the reader with factory serial number %q, ` +
+					`which is waiting for a serial number in turn`, byDevice[a.DeviceSN])
+			}
+
+			break
+		}
+
+		todo = waiting
+	}
+
+	rpt.Results = append(rpt.Results, unlisted...)
+
+	for _, r := range rpt.Results {
+		rpt.Counts[r.Status]++
+	}
+
+	return rpt, nil
+}
+
+// provision writes and verifies the assignment of one reader.
+func provision(dev Reader, a *Assignment, byDevice map[string]string, r *Result, dryRun bool) (Status, string) {
+
+	var err error
+
+	if r.OldValue, err = dev.GetDeviceSN(); err != nil {
+		return StatusFailed, err.Error()
+	}
+
+	if r.OldValue == a.DeviceSN {
+		r.NewValue = r.OldValue
+		return StatusCorrect, ``
+	}
+
+	if owner, ok := byDevice[a.DeviceSN]; ok && owner != a.FactorySN {
+		return StatusFailed, fmt.Sprintf(`serial number in use by the reader with factory serial number %q`, owner)
+	}
+
+	if dryRun {
+		delete(byDevice, r.OldValue)
+		byDevice[a.DeviceSN] = a.FactorySN
+		return StatusPending, ``
+	}
+
+	if err = dev.SetDeviceSN(a.DeviceSN); err != nil {
+		return StatusFailed, err.Error()
+	}
+
+	if errs := dev.Refresh(); errs[`DeviceSN`] {
+		return StatusFailed, `serial number cannot be read back`
+	}
+
+	if r.NewValue = dev.ID(); r.NewValue != a.DeviceSN {
+		return StatusFailed, fmt.Sprintf(`serial number reads back as %q`, r.NewValue)
+	}
+
+	delete(byDevice, r.OldValue)
+	byDevice[a.DeviceSN] = a.FactorySN
+
+	return StatusProvisioned, ``
+}
+
+// Failed reports whether any assignment failed.
+func (this *Report) Failed() (bool) {
+	return this.Counts[StatusFailed] > 0
+}
+
+// JSON returns the report as indented JSON.
+func (this *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(this, ``, `  `)
+}
+
+// CSV returns the results as CSV with a header row.
+func (this *Report) CSV() ([]byte, error) {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{`factory_sn`, `device_sn`, `old_value`, `new_value`, `status`, `error`})
+
+	for _, r := range this.Results {
+		w.Write([]string{r.FactorySN, r.DeviceSN, r.OldValue, r.NewValue, string(r.Status), r.Error})
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provision
+
+import (
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+// testReader is a Magtek reader whose NVRAM is simulated in memory.
+type testReader struct {
+	*usbci.Magtek
+	nvram string
+	writes int
+	fail bool
+}
+
+func newReader(t *testing.T, fsn, dsn string) (*testReader) {
+
+	mag := testdevice.Magtek(t, `mag1`)
+	mag.FactorySN = fsn
+
+	return &testReader{Magtek: mag, nvram: dsn}
+}
+
+func (this *testReader) GetFactorySN() (string, error) {
+	return this.FactorySN, nil
+}
+
+func (this *testReader) GetDeviceSN() (string, error) {
+	return this.nvram, nil
+}
+
+func (this *testReader) SetDeviceSN(val string) (error) {
+	this.writes++
+	if this.fail {
+		this.nvram = val[:len(val) - 1]
+	} else {
+		this.nvram = val
+	}
+	return nil
+}
+
+func (this *testReader) Refresh() (map[string]bool) {
+	this.DeviceSN, this.SerialNum = this.nvram, this.nvram
+	return map[string]bool{}
+}
+
+func TestLoadManifest(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `provision`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	csvFn := filepath.Join(dir, `store.csv`)
+	gotest.Ok(t, ioutil.WriteFile(csvFn, []byte("store,Device_SN,Factory_SN\n" +
+		"0421, S0421A1 ,B164F78022713AA\n0421,S0421A2,B164F78099999BB\n"), 0640))
+
+	m, err := LoadManifest(csvFn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(m) == 2, `two assignments expected`)
+	gotest.Assert(t, m[0].FactorySN == `B164F78022713AA` && m[0].DeviceSN == `S0421A1`,
+		`columns should be found by name and values trimmed`)
+
+	jsonFn := filepath.Join(dir, `store.json`)
+	gotest.Ok(t, ioutil.WriteFile(jsonFn, []byte(`[{"factory_sn": "B164F78022713AA", "device_sn": "S0421A1"}]`), 0640))
+
+	m, err = LoadManifest(jsonFn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(m) == 1, `one assignment expected`)
+
+	for _, bad := range []string{
+		"factory_sn\nB164F78022713AA\n",
+		"factory_sn,device_sn\nB164F78022713AA,S1\nB164F78022713AA,S2\n",
+		"factory_sn,device_sn\nB164F78022713AA,S1\nB164F78099999BB,S1\n",
+		"factory_sn,device_sn\nB164F78022713AA,\n",
+	} {
+		gotest.Ok(t, ioutil.WriteFile(csvFn, []byte(bad), 0640))
+		_, err = LoadManifest(csvFn)
+		gotest.Assert(t, err != nil, `invalid manifest should be refused`)
+	}
+
+	gotest.Ok(t, ioutil.WriteFile(jsonFn, []byte(`[null]`), 0640))
+	_, err = LoadManifest(jsonFn)
+	gotest.Assert(t, err != nil && strings.Contains(err.Error(), `assignment 1: empty`), `empty assignment should be refused`)
+
+	_, err = LoadManifest(filepath.Join(dir, `store.xls`))
+	gotest.Assert(t, err != nil, `unknown manifest format should be refused`)
+}
+
+func TestRun(t *testing.T) {
+
+	m := Manifest{
+		{FactorySN: `FACTORY1`, DeviceSN: `S0421A1`},
+		{FactorySN: `FACTORY2`, DeviceSN: `S0421A2`},
+		{FactorySN: `FACTORY3`, DeviceSN: `S0421A3`},
+		{FactorySN: `FACTORY4`, DeviceSN: `S0421A4`},
+		{FactorySN: `FACTORY5`, DeviceSN: `S0421A5`},
+	}
+
+	newReaders := func() ([]*testReader) {
+
+		rs := []*testReader{
+			newReader(t, `FACTORY1`, `FACTORY`),
+			newReader(t, `FACTORY2`, `S0421A2`),
+			newReader(t, `FACTORY3`, ``),
+			newReader(t, `FACTORY9`, `S0421A5`),
+			newReader(t, `FACTORY5`, ``),
+		}
+
+		rs[2].fail = true
+
+		return rs
+	}
+
+	readers := func(rs []*testReader) (devs []Reader) {
+		for _, r := range rs {
+			devs = append(devs, r)
+		}
+		return devs
+	}
+
+	t.Run("Dry Run", func(t *testing.T) {
+
+		rs := newReaders()
+		rpt, err := Run(m, readers(rs), true)
+		gotest.Ok(t, err)
+
+		for _, r := range rs {
+			gotest.Assert(t, r.writes == 0, `dry run should not write`)
+		}
+
+		gotest.Assert(t, rpt.Results[0].Status == StatusPending, `reader to be written should be pending`)
+		gotest.Assert(t, rpt.Results[1].Status == StatusCorrect, `correct reader should be skipped`)
+	})
+
+	t.Run("Provision", func(t *testing.T) {
+
+		rs := newReaders()
+		rpt, err := Run(m, readers(rs), false)
+		gotest.Ok(t, err)
+
+		want := []Status{StatusProvisioned, StatusCorrect, StatusFailed, StatusNotFound, StatusFailed, StatusUnlisted}
+		gotest.Assert(t, len(rpt.Results) == len(want), `one result per assignment and unlisted reader expected`)
+
+		for i, s := range want {
+			gotest.Assert(t, rpt.Results[i].Status == s, `result %d: unexpected status %s`, i, rpt.Results[i].Status)
+		}
+
+		gotest.Assert(t, rs[0].nvram == `S0421A1` && rs[0].ID() == `S0421A1`, `serial number should be written and refreshed`)
+		gotest.Assert(t, rs[1].writes == 0, `correct reader should not be written`)
+		gotest.Assert(t, strings.Contains(rpt.Results[2].Error, `reads back`), `verification failure should be reported`)
+		gotest.Assert(t, rs[4].writes == 0, `serial number held by another reader should not be written`)
+		gotest.Assert(t, rpt.Failed() && rpt.Counts[StatusFailed] == 2, `failures should be counted`)
+
+		b, err := rpt.CSV()
+		gotest.Ok(t, err)
+		gotest.Assert(t, strings.Count(string(b), "\n") == len(want) + 1, `CSV report should have a header and a row per result`)
+	})
+
+	t.Run("Passed Serial Numbers", func(t *testing.T) {
+
+		m := Manifest{
+			{FactorySN: `FACTORY2`, DeviceSN: `S0421A1`},
+			{FactorySN: `FACTORY1`, DeviceSN: `S0421A2`},
+		}
+
+		for _, dryRun := range []bool{true, false} {
+
+			rs := []*testReader{newReader(t, `FACTORY1`, `S0421A1`), newReader(t, `FACTORY2`, ``)}
+			rpt, err := Run(m, readers(rs), dryRun)
+			gotest.Ok(t, err)
+			gotest.Assert(t, !rpt.Failed(), `serial number released by a later assignment should be reassigned`)
+
+			if !dryRun {
+				gotest.Assert(t, rs[0].nvram == `S0421A2` && rs[1].nvram == `S0421A1`, `serial numbers should be passed along`)
+			}
+		}
+	})
+
+	t.Run("Swapped Serial Numbers", func(t *testing.T) {
+
+		m := Manifest{
+			{FactorySN: `FACTORY1`, DeviceSN: `S0421A2`},
+			{FactorySN: `FACTORY2`, DeviceSN: `S0421A1`},
+		}
+
+		rs := []*testReader{newReader(t, `FACTORY1`, `S0421A1`), newReader(t, `FACTORY2`, `S0421A2`)}
+		rpt, err := Run(m, readers(rs), false)
+		gotest.Ok(t, err)
+		gotest.Assert(t, rpt.Counts[StatusFailed] == 2, `swapped serial numbers should fail`)
+		gotest.Assert(t, rs[0].writes == 0 && rs[1].writes == 0, `swapped serial numbers should not be written`)
+		gotest.Assert(t, rpt.Results[0].OldValue == `S0421A1`, `failed assignment should report the current serial number`)
+	})
+
+	t.Run("Duplicate Readers", func(t *testing.T) {
+		devs := []Reader{newReader(t, `FACTORY1`, ``), newReader(t, `FACTORY1`, ``)}
+		_, err := Run(m, devs, false)
+		gotest.Assert(t, err != nil, `readers with the same factory serial number should be refused`)
+	})
+}
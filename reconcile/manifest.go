@@ -0,0 +1,132 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reconcile
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`regexp`
+	`strings`
+)
+
+var (
+	ErrHostNotFound = errors.New(`host not in manifest`)
+
+	portPathPattern = regexp.MustCompile(`^\d{3}-\d+(\.\d+)*$`)
+	hexIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}$`)
+)
+
+// Expected is a device expected on a host. The serial number and port
+// path are optional; if given, the device must have them. The port path
+// has the form returned by usbci.Generic.FullPortPath, e.g. 001-2.4 for a
+// device behind a hub, or 001-002 for a device on a root port.
+type Expected struct {
+	Name      string		`json:"name,omitempty"`
+	VendorID  string		`json:"vendor_id"`
+	ProductID string		`json:"product_id"`
+	SerialNum string		`json:"serial_number,omitempty"`
+	PortPath  string		`json:"port_path,omitempty"`
+}
+
+// Host lists the devices expected on a host, such as a register.
+type Host struct {
+	HostName string			`json:"host_name"`
+	Devices  []*Expected		`json:"devices"`
+}
+
+// Manifest lists the devices expected on each host.
+type Manifest struct {
+	Hosts []*Host			`json:"hosts"`
+}
+
+// LoadManifest reads and validates a manifest from a JSON file.
+func LoadManifest(fn string) (*Manifest, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := new(Manifest)
+
+	if err = json.Unmarshal(b, this); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	if err = this.Validate(); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return this, nil
+}
+
+// Validate checks that every host is named once and that every expected
+// device has a valid vendor and product ID and, if given, port path.
+func (this *Manifest) Validate() (error) {
+
+	hosts := make(map[string]bool)
+
+	for i, h := range this.Hosts {
+
+		name := strings.ToLower(h.HostName)
+
+		switch {
+		case name == ``:
+			return fmt.Errorf(`host %d: empty host name`, i + 1)
+		case hosts[name]:
+			return fmt.Errorf(`host %q listed twice`, h.HostName)
+		}
+
+		hosts[name] = true
+
+		for j, e := range h.Devices {
+
+			switch {
+			case !hexIDPattern.MatchString(e.VendorID) || !hexIDPattern.MatchString(e.ProductID):
+				return fmt.Errorf(`host %q: device %d: vendor and product IDs must be four hex digits`, h.HostName, j + 1)
+			case e.PortPath != `` && !portPathPattern.MatchString(e.PortPath):
+				return fmt.Errorf(`host %q: device %d: invalid port path %q`, h.HostName, j + 1, e.PortPath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Host returns the expected devices of a host, ignoring the case of its
+// name, or ErrHostNotFound.
+func (this *Manifest) Host(name string) (*Host, error) {
+
+	for _, h := range this.Hosts {
+		if strings.EqualFold(h.HostName, name) {
+			return h, nil
+		}
+	}
+
+	return nil, fmt.Errorf(`%s: %v`, name, ErrHostNotFound)
+}
+
+// label names an expected device in findings.
+func (this *Expected) label() (string) {
+
+	if this.Name != `` {
+		return this.Name
+	}
+
+	return fmt.Sprintf(`%s:%s`, this.VendorID, this.ProductID)
+}
@@ -0,0 +1,417 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reconcile compares the devices attached to a host with the
+// devices a manifest says it should have, such as the peripherals of each
+// register, and reports missing, unexpected and mismatched devices in the
+// same formats as device reports.
+package reconcile
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`fmt`
+	`strings`
+	`time`
+
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+// Categories of findings.
+const (
+	CategoryMissing string = `missing`
+	CategoryUnexpected string = `unexpected`
+	CategoryMismatched string = `mismatched`
+
+	FieldSerialNum string = `serial_number`
+	FieldPortPath string = `port_path`
+	FieldVendorProduct string = `vendor_product`
+
+	TimeFormat string = `20060102T150405Z`
+
+	MarshalPrefix string = ``
+	MarshalIndent string = "\t"
+)
+
+var (
+	csvHeader = []string{`host_name`, `category`, `name`, `vendor_id`, `product_id`,
+		`serial_number`, `port_path`, `field`, `expected`, `actual`, `detail`}
+)
+
+// Finding is a missing, unexpected or mismatched device. Mismatches have
+// one finding per mismatched field. The device fields describe the attached
+// device, or the expected device if it is missing.
+type Finding struct {
+	Category  string		`json:"category"                 xml:"category"`
+	Name      string		`json:"name,omitempty"           xml:"name,omitempty"`
+	VendorID  string		`json:"vendor_id"                xml:"vendor_id"`
+	ProductID string		`json:"product_id"               xml:"product_id"`
+	SerialNum string		`json:"serial_number,omitempty"  xml:"serial_number,omitempty"`
+	PortPath  string		`json:"port_path,omitempty"      xml:"port_path,omitempty"`
+	Field     string		`json:"field,omitempty"          xml:"field,omitempty"`
+	Expected  string		`json:"expected,omitempty"       xml:"expected,omitempty"`
+	Actual    string		`json:"actual,omitempty"         xml:"actual,omitempty"`
+	Detail    string		`json:"detail"                   xml:"detail"`
+}
+
+// Reconciliation is the result of comparing the devices of a host with its
+// manifest. It implements gocmdb.Reportable.
+type Reconciliation struct {
+	XMLName    xml.Name		`json:"-"           xml:"reconciliation"`
+	HostName   string		`json:"host_name"   xml:"host_name"`
+	Reconciled time.Time		`json:"reconciled"  xml:"reconciled"`
+	Expected   int			`json:"expected"    xml:"expected"`
+	Attached   int			`json:"attached"    xml:"attached"`
+	Matched    int			`json:"matched"     xml:"matched"`
+	Findings   []*Finding		`json:"findings"    xml:"findings>finding"`
+}
+
+// Reconcile compares the attached devices of a host with the manifest.
+func (this *Manifest) Reconcile(hostName string, devs []*usbci.Generic) (*Reconciliation, error) {
+
+	h, err := this.Host(hostName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Reconcile(devs), nil
+}
+
+// Reconcile compares attached devices with the expected devices of a
+// host. Expected devices are matched to attached devices of the same
+// vendor and product ID, the most specific first. An expected device that
+// can only be matched to a device at another port path, with another
+// serial number or of another type at its port path is mismatched.
+func (this *Host) Reconcile(devs []*usbci.Generic) (*Reconciliation) {
+
+	rec := &Reconciliation{
+		HostName: this.HostName,
+		Reconciled: time.Now().UTC(),
+		Expected: len(this.Devices),
+		Attached: len(devs),
+		Findings: []*Finding{},
+	}
+
+	var exps []*Expected
+
+	for _, rank := range []int{3, 2, 1, 0} {
+		for _, e := range this.Devices {
+			if specificity(e) == rank {
+				exps = append(exps, e)
+			}
+		}
+	}
+
+	used := make(map[*usbci.Generic]bool)
+	matched := make(map[*Expected]bool)
+
+	passes := []func(*Expected, *usbci.Generic) (bool){
+
+		// Exact match.
+		func(e *Expected, d *usbci.Generic) (bool) {
+			return sameType(e, d) &&
+				(e.SerialNum == `` || e.SerialNum == d.SerialNum) &&
+				(e.PortPath == `` || samePort(e, d))
+		},
+
+		// Device moved to another port.
+		func(e *Expected, d *usbci.Generic) (bool) {
+			return e.SerialNum != `` && sameType(e, d) && e.SerialNum == d.SerialNum
+		},
+
+		// Device of the same type replaced at the port.
+		func(e *Expected, d *usbci.Generic) (bool) {
+			return sameType(e, d) && samePort(e, d)
+		},
+
+		// Device of another type at the port.
+		func(e *Expected, d *usbci.Generic) (bool) {
+			return samePort(e, d)
+		},
+
+		// Device of the same type replaced elsewhere.
+		func(e *Expected, d *usbci.Generic) (bool) {
+			return sameType(e, d)
+		},
+	}
+
+	for _, pass := range passes {
+
+		for _, e := range exps {
+
+			if matched[e] {
+				continue
+			}
+
+			for _, d := range devs {
+
+				if used[d] || !pass(e, d) {
+					continue
+				}
+
+				used[d], matched[e] = true, true
+
+				if fs := compare(e, d); len(fs) > 0 {
+					rec.Findings = append(rec.Findings, fs...)
+				} else {
+					rec.Matched++
+				}
+
+				break
+			}
+		}
+	}
+
+	for _, e := range this.Devices {
+		if !matched[e] {
+			rec.Findings = append(rec.Findings, &Finding{
+				Category: CategoryMissing,
+				Name: e.Name,
+				VendorID: e.VendorID,
+				ProductID: e.ProductID,
+				SerialNum: e.SerialNum,
+				PortPath: e.PortPath,
+				Detail: fmt.Sprintf(`expected %s is not attached`, e.label()),
+			})
+		}
+	}
+
+	for _, d := range devs {
+		if !used[d] {
+			rec.Findings = append(rec.Findings, &Finding{
+				Category: CategoryUnexpected,
+				VendorID: d.VendorID,
+				ProductID: d.ProductID,
+				SerialNum: d.SerialNum,
+				PortPath: d.FullPortPath(),
+				Detail: fmt.Sprintf(`%s %s:%s is not in the manifest`,
+					describe(d), d.VendorID, d.ProductID),
+			})
+		}
+	}
+
+	return rec
+}
+
+// compare returns a mismatch finding for each field of an expected device
+// that the attached device it was matched to does not have.
+func compare(e *Expected, d *usbci.Generic) (fs []*Finding) {
+
+	mismatch := func(field, expected, actual, detail string) {
+		fs = append(fs, &Finding{
+			Category: CategoryMismatched,
+			Name: e.Name,
+			VendorID: d.VendorID,
+			ProductID: d.ProductID,
+			SerialNum: d.SerialNum,
+			PortPath: d.FullPortPath(),
+			Field: field,
+			Expected: expected,
+			Actual: actual,
+			Detail: detail,
+		})
+	}
+
+	if !sameType(e, d) {
+		mismatch(FieldVendorProduct, e.VendorID + `:` + e.ProductID, d.VendorID + `:` + d.ProductID,
+			fmt.Sprintf(`another type of device is attached where %s is expected`, e.label()))
+	}
+
+	if e.SerialNum != `` && e.SerialNum != d.SerialNum {
+		mismatch(FieldSerialNum, e.SerialNum, d.SerialNum,
+			fmt.Sprintf(`%s has been replaced or its serial number changed`, e.label()))
+	}
+
+	if e.PortPath != `` && !samePort(e, d) {
+		mismatch(FieldPortPath, e.PortPath, d.FullPortPath(),
+			fmt.Sprintf(`%s is attached at another port`, e.label()))
+	}
+
+	return fs
+}
+
+// sameType reports whether a device has the vendor and product ID of an
+// expected device.
+func sameType(e *Expected, d *usbci.Generic) (bool) {
+	return strings.EqualFold(e.VendorID, d.VendorID) && strings.EqualFold(e.ProductID, d.ProductID)
+}
+
+// samePort reports whether a device is attached at the port path of an
+// expected device. Port numbers are compared as numbers, so that 001-002
+// names the same port as 001-2.
+func samePort(e *Expected, d *usbci.Generic) (bool) {
+	return e.PortPath != `` && normalPortPath(e.PortPath) == normalPortPath(d.FullPortPath())
+}
+
+// normalPortPath strips the leading zeros of the port numbers of a port
+// path, leaving the bus number as is.
+func normalPortPath(path string) (string) {
+
+	i := strings.Index(path, `-`)
+
+	if i < 0 {
+		return path
+	}
+
+	ports := strings.Split(path[i+1:], `.`)
+
+	for j, p := range ports {
+		if ports[j] = strings.TrimLeft(p, `0`); ports[j] == `` {
+			ports[j] = `0`
+		}
+	}
+
+	return path[:i+1] + strings.Join(ports, `.`)
+}
+
+// specificity ranks expected devices by the number of optional fields set,
+// with serial numbers ranking above port paths.
+func specificity(e *Expected) (n int) {
+
+	if e.SerialNum != `` {
+		n += 2
+	}
+
+	if e.PortPath != `` {
+		n++
+	}
+
+	return n
+}
+
+// describe names a device by its product name, if it has one.
+func describe(d *usbci.Generic) (string) {
+
+	if d.ProductName != `` {
+		return d.ProductName
+	}
+
+	return `device`
+}
+
+// Count returns the number of findings of a category.
+func (this *Reconciliation) Count(category string) (n int) {
+
+	for _, f := range this.Findings {
+		if f.Category == category {
+			n++
+		}
+	}
+
+	return n
+}
+
+// JSON reports the reconciliation in JSON format.
+func (this *Reconciliation) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the reconciliation in formatted JSON format.
+func (this *Reconciliation) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// XML reports the reconciliation in XML format.
+func (this *Reconciliation) XML() ([]byte, error) {
+	return xml.Marshal(this)
+}
+
+// PrettyXML reports the reconciliation in formatted XML format.
+func (this *Reconciliation) PrettyXML() ([]byte, error) {
+	return xml.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// CSV reports the findings in CSV format with a single header record and
+// one record per finding.
+func (this *Reconciliation) CSV() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+
+	if err := w.Write(csvHeader); err != nil {
+		return nil, err
+	}
+
+	for _, f := range this.Findings {
+
+		rec := []string{this.HostName, f.Category, f.Name, f.VendorID, f.ProductID,
+			f.SerialNum, f.PortPath, f.Field, f.Expected, f.Actual, f.Detail}
+
+		if err := w.Write(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// NVP reports the reconciliation as name-value pairs: a block of summary
+// fields followed by one block per finding, separated by blank lines.
+func (this *Reconciliation) NVP() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "HostName:%s\n", this.HostName)
+	fmt.Fprintf(buf, "Reconciled:%s\n", this.Reconciled.Format(time.RFC3339))
+	fmt.Fprintf(buf, "Expected:%d\n", this.Expected)
+	fmt.Fprintf(buf, "Attached:%d\n", this.Attached)
+	fmt.Fprintf(buf, "Matched:%d\n", this.Matched)
+	fmt.Fprintf(buf, "FindingCount:%d\n", len(this.Findings))
+
+	for _, f := range this.Findings {
+
+		buf.WriteString("\n")
+
+		for _, nv := range [][2]string{
+			{`Category`, f.Category},
+			{`Name`, f.Name},
+			{`VendorID`, f.VendorID},
+			{`ProductID`, f.ProductID},
+			{`SerialNum`, f.SerialNum},
+			{`PortPath`, f.PortPath},
+			{`Field`, f.Field},
+			{`Expected`, f.Expected},
+			{`Actual`, f.Actual},
+			{`Detail`, f.Detail},
+		} {
+			fmt.Fprintf(buf, "%s:%s\n", nv[0], nv[1])
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Legacy reports one comma-separated line per finding with the host name,
+// category, vendor and product ID and serial number.
+func (this *Reconciliation) Legacy() ([]byte) {
+
+	buf := new(bytes.Buffer)
+
+	for _, f := range this.Findings {
+		fmt.Fprintf(buf, "%s,%s,%s:%s,%s\n", this.HostName, f.Category, f.VendorID, f.ProductID, f.SerialNum)
+	}
+
+	return buf.Bytes()
+}
+
+// Filename constructs a convenient filename from the host name and the
+// reconciliation time.
+func (this *Reconciliation) Filename() (string) {
+	return fmt.Sprintf(`%s-reconcile-%s`, this.HostName, this.Reconciled.UTC().Format(TimeFormat))
+}
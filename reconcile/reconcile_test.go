@@ -0,0 +1,176 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reconcile
+
+import (
+	`bytes`
+	`encoding/json`
+	`encoding/xml`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func newDevice(t *testing.T, k string, port int, sn string) (*usbci.Generic) {
+
+	gen := testdevice.Generic(t, k)
+	gen.PortNumber = port
+
+	if sn != `` {
+		gen.SerialNum = sn
+	}
+
+	return gen
+}
+
+const manifest = `{"hosts": [{"host_name": "REG01", "devices": [
+	{"name": "card reader", "vendor_id": "0801", "product_id": "0001", "serial_number": "24FFFFF", "port_path": "001-001"},
+	{"name": "keyboard reader", "vendor_id": "0ACD", "product_id": "2030", "port_path": "001-003"},
+	{"name": "pin pad reader", "vendor_id": "0801", "product_id": "0001", "serial_number": "S000001", "port_path": "001-004"},
+	{"name": "scanner", "vendor_id": "0c2e", "product_id": "0200"},
+	{"name": "printer", "vendor_id": "04b8", "product_id": "0202", "port_path": "001-006"}
+]}]}`
+
+func TestLoadManifest(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `reconcile`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, `manifest.json`)
+	gotest.Ok(t, ioutil.WriteFile(fn, []byte(manifest), 0640))
+
+	m, err := LoadManifest(fn)
+	gotest.Ok(t, err)
+
+	_, err = m.Host(`reg01`)
+	gotest.Ok(t, err)
+
+	_, err = m.Reconcile(`REG02`, nil)
+	gotest.Assert(t, err != nil && strings.Contains(err.Error(), ErrHostNotFound.Error()), `unknown host should not be found`)
+
+	for _, bad := range []string{
+		`{"hosts": [{"host_name": ""}]}`,
+		`{"hosts": [{"host_name": "REG01"}, {"host_name": "reg01"}]}`,
+		`{"hosts": [{"host_name": "REG01", "devices": [{"vendor_id": "801", "product_id": "0001"}]}]}`,
+		`{"hosts": [{"host_name": "REG01", "devices": [{"vendor_id": "0801", "product_id": "0001", "port_path": "1-1"}]}]}`,
+	} {
+		gotest.Ok(t, ioutil.WriteFile(fn, []byte(bad), 0640))
+		_, err = LoadManifest(fn)
+		gotest.Assert(t, err != nil, `invalid manifest should be refused`)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+
+	m := new(Manifest)
+	gotest.Ok(t, json.Unmarshal([]byte(manifest), m))
+	gotest.Ok(t, m.Validate())
+
+	devs := []*usbci.Generic{
+		newDevice(t, `mag1`, 2, ``),
+		newDevice(t, `gen1`, 3, ``),
+		newDevice(t, `mag2`, 4, `24FFFFE`),
+		newDevice(t, `gen2`, 5, ``),
+		newDevice(t, `gen1`, 6, ``),
+	}
+
+	rec, err := m.Reconcile(`REG01`, devs)
+	gotest.Ok(t, err)
+
+	var _ gocmdb.Reportable = rec
+
+	gotest.Assert(t, rec.Expected == 5 && rec.Attached == 5 && rec.Matched == 1, `one device should match exactly`)
+
+	want := []struct{category, field, name string}{
+		{CategoryMismatched, FieldPortPath, `card reader`},
+		{CategoryMismatched, FieldSerialNum, `pin pad reader`},
+		{CategoryMismatched, FieldVendorProduct, `printer`},
+		{CategoryMissing, ``, `scanner`},
+		{CategoryUnexpected, ``, ``},
+	}
+
+	gotest.Assert(t, len(rec.Findings) == len(want), `%d findings expected, got %d`, len(want), len(rec.Findings))
+
+	for i, w := range want {
+		f := rec.Findings[i]
+		gotest.Assert(t, f.Category == w.category && f.Field == w.field && f.Name == w.name,
+			`finding %d: unexpected %s %s %s`, i, f.Category, f.Field, f.Name)
+	}
+
+	gotest.Assert(t, rec.Findings[0].Expected == `001-001` && rec.Findings[0].Actual == `001-002`,
+		`moved device should report both port paths`)
+	gotest.Assert(t, rec.Findings[4].PortPath == `001-005`, `unexpected device should report its port path`)
+	gotest.Assert(t, rec.Count(CategoryMismatched) == 3, `three mismatches expected`)
+
+	t.Run("Hubs", func(t *testing.T) {
+
+		m := new(Manifest)
+		gotest.Ok(t, json.Unmarshal([]byte(`{"hosts": [{"host_name": "REG01", "devices": [
+			{"name": "card reader", "vendor_id": "0801", "product_id": "0001", "port_path": "001-2.4"},
+			{"name": "keyboard reader", "vendor_id": "0ACD", "product_id": "2030", "port_path": "001-003"}
+		]}]}`), m))
+		gotest.Ok(t, m.Validate())
+
+		mag, gen := newDevice(t, `mag1`, 4, ``), newDevice(t, `gen1`, 1, ``)
+		mag.HubPorts, gen.HubPorts = `2.4`, `3`
+
+		rec, err := m.Reconcile(`REG01`, []*usbci.Generic{mag, gen})
+		gotest.Ok(t, err)
+		gotest.Assert(t, rec.Matched == 2 && len(rec.Findings) == 0, `devices should match on their full port paths`)
+
+		mag.HubPorts = `3.4`
+
+		rec, err = m.Reconcile(`REG01`, []*usbci.Generic{mag, gen})
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(rec.Findings) == 1 && rec.Findings[0].Actual == `001-3.4`,
+			`device moved to another hub should report its full port path`)
+	})
+
+	t.Run("Reports", func(t *testing.T) {
+
+		j, err := rec.JSON()
+		gotest.Ok(t, err)
+
+		jr := new(Reconciliation)
+		gotest.Ok(t, json.Unmarshal(j, jr))
+		gotest.Assert(t, len(jr.Findings) == len(rec.Findings), `JSON report should hold every finding`)
+
+		x, err := rec.PrettyXML()
+		gotest.Ok(t, err)
+
+		xr := new(Reconciliation)
+		gotest.Ok(t, xml.Unmarshal(x, xr))
+		gotest.Assert(t, len(xr.Findings) == len(rec.Findings), `XML report should hold every finding`)
+
+		c, err := rec.CSV()
+		gotest.Ok(t, err)
+		gotest.Assert(t, bytes.Count(c, []byte("\n")) == len(rec.Findings) + 1, `CSV report should have a header and a row per finding`)
+
+		n, err := rec.NVP()
+		gotest.Ok(t, err)
+		gotest.Assert(t, bytes.Contains(n, []byte("FindingCount:5\n")), `NVP report should count findings`)
+
+		gotest.Assert(t, bytes.Count(rec.Legacy(), []byte("\n")) == len(rec.Findings), `legacy report should have a line per finding`)
+		gotest.Assert(t, strings.HasPrefix(rec.Filename(), `REG01-reconcile-`), `filename should start with the host name`)
+	})
+}
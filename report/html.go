@@ -0,0 +1,121 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	`bytes`
+	`html/template`
+
+	`github.com/jscherff/gocmdb`
+)
+
+const (
+	htmlStyle string = `<style>
+body { font-family: sans-serif; font-size: 10pt; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #999; padding: 2px 6px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.changed { background: #ffe699; }
+.problem { background: #f4b6b6; }
+h2 { page-break-before: auto; }
+</style>`
+
+	htmlCell string = `{{define "cell"}}<td` +
+		`{{if .Problem}} class="problem" title="{{.Problem}}"` +
+		`{{else if .Changed}} class="changed" title="was {{.Old}}"{{end}}>` +
+		`{{.Value}}{{if .Changed}} <small>(was {{.Old}})</small>{{end}}</td>{{end}}`
+
+	htmlNotes string = `{{define "notes"}}` +
+		`{{if .Problem}}<strong>{{.Problem}}</strong><br>{{end}}` +
+		`{{range .Changes}}{{index . 0}}: {{index . 1}} &rarr; {{index . 2}}<br>{{end}}{{end}}`
+
+	// HTMLPageTemplate renders a page as a printable HTML document.
+	HTMLPageTemplate string = htmlCell + htmlNotes + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+{{range .Hosts}}<h2>{{if .Name}}{{.Name}}{{else}}Unknown host{{end}}</h2>
+{{range .Types}}<h3>{{.Name}} ({{len .Rows}})</h3>
+<table>
+<tr>{{range $.Columns}}<th>{{.}}</th>{{end}}<th>notes</th></tr>
+{{range .Rows}}<tr>{{range .Cells}}{{template "cell" .}}{{end}}<td>{{template "notes" .}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`
+
+	// HTMLDeviceTemplate renders a single device as a printable HTML
+	// document with one field per table row.
+	HTMLDeviceTemplate string = htmlCell + htmlNotes + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+{{range .Rows}}<table>
+{{range .Cells}}<tr><th>{{.Name}}</th>{{template "cell" .}}</tr>
+{{end}}<tr><th>notes</th><td>{{template "notes" .}}</td></tr>
+</table>
+{{end}}</body>
+</html>
+`
+)
+
+var (
+	htmlPage = template.Must(template.New(`page`).Parse(HTMLPageTemplate))
+	htmlDevice = template.Must(template.New(`device`).Parse(HTMLDeviceTemplate))
+)
+
+// HTML renders the page as an HTML document. Changed fields are
+// highlighted with their previous values and flagged serial numbers are
+// marked with the problem found.
+func (this *Page) HTML() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	if err := htmlPage.Execute(buf, this); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// HTML renders a single device as an HTML document.
+func HTML(dev gocmdb.Reportable, opts Options) ([]byte, error) {
+
+	page, err := NewPage(deviceTitle(dev), opts, dev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := htmlDevice.Execute(buf, page); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	`bytes`
+	`fmt`
+	`strings`
+	`text/template`
+
+	`github.com/jscherff/gocmdb`
+)
+
+const (
+	mdCell string = `{{define "cell"}}` +
+		`{{if .Problem}}{{if .Value}}**{{md .Value}}** {{end}}⚠` +
+		`{{else if .Changed}}**{{md .Value}}** (was {{md .Old}})` +
+		`{{else}}{{md .Value}}{{end}}{{end}}`
+
+	mdNotes string = `{{define "notes"}}` +
+		`{{if .Problem}}⚠ {{md .Problem}}{{if .Changes}}<br>{{end}}{{end}}` +
+		`{{range $i, $c := .Changes}}{{if $i}}<br>{{end}}` +
+		`{{md (index $c 0)}}: {{md (index $c 1)}} → {{md (index $c 2)}}{{end}}{{end}}`
+
+	// MarkdownPageTemplate renders a page as a Markdown document.
+	MarkdownPageTemplate string = mdCell + mdNotes + `# {{md .Title}}
+
+Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}
+{{range .Hosts}}
+## {{if .Name}}{{md .Name}}{{else}}Unknown host{{end}}
+{{range .Types}}
+### {{md .Name}} ({{len .Rows}})
+
+|{{range $.Columns}} {{md .}} |{{end}} notes |
+|{{range $.Columns}} --- |{{end}} --- |
+{{range .Rows}}|{{range .Cells}} {{template "cell" .}} |{{end}} {{template "notes" .}} |
+{{end}}{{end}}{{end}}`
+
+	// MarkdownDeviceTemplate renders a single device as a Markdown
+	// document with one field per table row.
+	MarkdownDeviceTemplate string = mdCell + mdNotes + `# {{md .Title}}
+
+Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}
+{{range .Rows}}
+| field | value |
+| --- | --- |
+{{range .Cells}}| {{md .Name}} | {{template "cell" .}} |
+{{end}}| notes | {{template "notes" .}} |
+{{end}}`
+)
+
+var (
+	mdFuncs = template.FuncMap{`md`: escapeMarkdown}
+
+	mdPage = template.Must(template.New(`page`).Funcs(mdFuncs).Parse(MarkdownPageTemplate))
+	mdDevice = template.Must(template.New(`device`).Funcs(mdFuncs).Parse(MarkdownDeviceTemplate))
+
+	mdEscaper = strings.NewReplacer(
+		`\`, `\\`, `|`, `\|`, `*`, `\*`, `_`, `\_`, "`", "\\`",
+		`[`, `\[`, `]`, `\]`, `<`, `&lt;`, `>`, `&gt;`, "\n", ` `,
+	)
+)
+
+// Markdown renders the page as a Markdown document with one table per host
+// and device type. Changed fields are shown in bold with their previous
+// values and flagged serial numbers are marked with the problem found.
+func (this *Page) Markdown() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	if err := mdPage.Execute(buf, this); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Markdown renders a single device as a Markdown document.
+func Markdown(dev gocmdb.Reportable, opts Options) ([]byte, error) {
+
+	page, err := NewPage(deviceTitle(dev), opts, dev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := mdDevice.Execute(buf, page); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// escapeMarkdown escapes characters with meaning in Markdown table cells.
+func escapeMarkdown(s string) (string) {
+	return mdEscaper.Replace(s)
+}
+
+// deviceTitle constructs the title of a single-device page.
+func deviceTitle(dev gocmdb.Reportable) (string) {
+
+	if id, ok := dev.(gocmdb.Identifiable); ok {
+		return fmt.Sprintf(`%s %s:%s %s`, id.Type(), id.VID(), id.PID(), id.ID())
+	}
+
+	return dev.Filename()
+}
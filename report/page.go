@@ -0,0 +1,266 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	`fmt`
+	`sort`
+	`strings`
+	`time`
+	`unicode`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/schema`
+)
+
+const (
+	SerialField string = `serial_number`
+
+	// Indexes of the elements of a change, as returned by GetChanges.
+	FieldNameIx int = 0
+	OldValueIx int = 1
+	NewValueIx int = 2
+)
+
+var (
+	// DefaultFields are the columns of a page when Options.Fields is empty.
+	DefaultFields = []string{
+		`serial_number`,
+		`vendor_id`,
+		`product_id`,
+		`vendor_name`,
+		`product_name`,
+		`product_ver`,
+		`software_id`,
+		`port_number`,
+		`bus_number`,
+	}
+
+	// ValidateSerial checks a serial number for display on a page. Devices
+	// whose serial number fails the check are flagged. Applications may
+	// replace it to enforce their own serial number policy.
+	ValidateSerial = validateSerial
+)
+
+// Page is a printable report of devices grouped by host and device type,
+// rendered as HTML or Markdown.
+type Page struct {
+	Title     string
+	Generated time.Time
+	Columns   []string
+	Hosts     []*HostGroup
+}
+
+// HostGroup holds the devices of one host.
+type HostGroup struct {
+	Name  string
+	Types []*TypeGroup
+}
+
+// TypeGroup holds the devices of one type on one host.
+type TypeGroup struct {
+	Name string
+	Rows []*Row
+}
+
+// Row is one device on a page.
+type Row struct {
+	Cells   []*Cell
+	Changes [][]string
+	Problem string
+}
+
+// Cell is one field of a device on a page. Changed cells carry the value
+// from before the last audit; cells with a problem carry its description.
+type Cell struct {
+	Name    string
+	Value   string
+	Old     string
+	Changed bool
+	Problem string
+}
+
+// NewPage builds a page of devices. The Options select, order and rename
+// the columns; if no fields are selected, DefaultFields are used.
+func NewPage(title string, opts Options, devs ...gocmdb.Reportable) (*Page, error) {
+
+	if len(opts.Fields) == 0 {
+		opts.Fields = DefaultFields
+	}
+
+	this := &Page{Title: title, Generated: time.Now()}
+
+	for _, name := range opts.Fields {
+		if rename, ok := opts.Rename[name]; ok {
+			name = rename
+		}
+		this.Columns = append(this.Columns, name)
+	}
+
+	hosts := make(map[string]*HostGroup)
+	types := make(map[string]*TypeGroup)
+
+	for i, dev := range devs {
+
+		row, err := newRow(dev, opts)
+
+		if err != nil {
+			return nil, fmt.Errorf(`device %d: %v`, i, err)
+		}
+
+		host, typ := ``, fmt.Sprintf(`%T`, dev)
+
+		if id, ok := dev.(gocmdb.Identifiable); ok {
+			host, typ = id.Host(), id.Type()
+		}
+
+		hg, ok := hosts[host]
+
+		if !ok {
+			hg = &HostGroup{Name: host}
+			hosts[host] = hg
+			this.Hosts = append(this.Hosts, hg)
+		}
+
+		tg, ok := types[host + "\x00" + typ]
+
+		if !ok {
+			tg = &TypeGroup{Name: typ}
+			types[host + "\x00" + typ] = tg
+			hg.Types = append(hg.Types, tg)
+		}
+
+		tg.Rows = append(tg.Rows, row)
+	}
+
+	sort.Slice(this.Hosts, func(i, j int) (bool) {
+		return this.Hosts[i].Name < this.Hosts[j].Name
+	})
+
+	for _, hg := range this.Hosts {
+		sort.Slice(hg.Types, func(i, j int) (bool) {
+			return hg.Types[i].Name < hg.Types[j].Name
+		})
+	}
+
+	return this, nil
+}
+
+// Rows returns all rows of the page in display order.
+func (this *Page) Rows() (rows []*Row) {
+
+	for _, hg := range this.Hosts {
+		for _, tg := range hg.Types {
+			rows = append(rows, tg.Rows...)
+		}
+	}
+
+	return rows
+}
+
+// newRow projects a device into a row, marking the cells changed in the
+// last audit and the serial number cell if the serial number is flagged.
+func newRow(dev gocmdb.Reportable, opts Options) (*Row, error) {
+
+	rec, err := Project(dev, Options{Fields: opts.Fields})
+
+	if err != nil {
+		return nil, err
+	}
+
+	row := new(Row)
+
+	if c, ok := dev.(interface{GetChanges() ([][]string)}); ok {
+		row.Changes = c.GetChanges()
+	}
+
+	changes := make(map[string][]string)
+
+	if len(row.Changes) > 0 {
+
+		fs, err := schema.Fields(dev, `json`)
+
+		if err != nil {
+			return nil, err
+		}
+
+		names := make(map[string]string)
+
+		for _, f := range fs {
+			names[f.GoName] = f.Name
+		}
+
+		for _, chg := range row.Changes {
+			if len(chg) > NewValueIx {
+				changes[names[chg[FieldNameIx]]] = chg
+			}
+		}
+	}
+
+	sn := ``
+
+	if id, ok := dev.(gocmdb.Identifiable); ok {
+		sn = id.ID()
+	} else if v, ok := rec.Map()[SerialField]; ok {
+		sn = toString(v)
+	}
+
+	if err := ValidateSerial(sn); err != nil {
+		row.Problem = err.Error()
+	}
+
+	for _, f := range rec {
+
+		cell := &Cell{Name: f.Name, Value: toString(f.Value)}
+
+		if chg, ok := changes[f.Name]; ok {
+			cell.Changed, cell.Old = true, chg[OldValueIx]
+		}
+
+		if f.Name == SerialField {
+			cell.Problem = row.Problem
+		}
+
+		if rename, ok := opts.Rename[f.Name]; ok {
+			cell.Name = rename
+		}
+
+		row.Cells = append(row.Cells, cell)
+	}
+
+	return row, nil
+}
+
+// validateSerial flags serial numbers that are missing, contain spaces or
+// non-printable characters, or consist of a single repeated character, as
+// placeholder serial numbers often do.
+func validateSerial(sn string) (error) {
+
+	if sn == `` {
+		return fmt.Errorf(`serial number missing`)
+	}
+
+	for _, r := range sn {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return fmt.Errorf(`serial number %q contains invalid characters`, sn)
+		}
+	}
+
+	if len(sn) > 1 && strings.Count(sn, sn[:1]) == len(sn) {
+		return fmt.Errorf(`serial number %q is a placeholder`, sn)
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report produces custom reports from reportable objects: a chosen
+// subset of fields in a chosen order under chosen names, or free-form text
+// rendered with text/template. Fields are identified by their JSON report
+// names, so every field of the JSON report is available regardless of the
+// struct tags that govern the fixed formats.
+package report
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`fmt`
+	`io`
+
+	`github.com/jscherff/gocmdb`
+)
+
+const (
+	MarshalPrefix string = ``
+	MarshalIndent string = "\t"
+)
+
+// Options select, order and rename the fields of a report.
+type Options struct {
+
+	// Fields lists the JSON names of the fields to report, in report order.
+	// If empty, all fields of the JSON report are reported in their order.
+	Fields []string
+
+	// Rename maps JSON names to the names used in the report.
+	Rename map[string]string
+}
+
+// Field is a single named value in a report.
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Record is the projection of one object: its selected fields in order.
+type Record []Field
+
+// Project selects, orders and renames the fields of an object's JSON report.
+// Numeric values are kept as json.Number so that they print as written.
+func Project(obj gocmdb.Reportable, opts Options) (Record, error) {
+
+	j, err := obj.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := decode(j)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Fields) == 0 {
+		return all.rename(opts.Rename), nil
+	}
+
+	index := make(map[string]interface{})
+
+	for _, f := range all {
+		index[f.Name] = f.Value
+	}
+
+	var rec Record
+
+	for _, name := range opts.Fields {
+
+		val, ok := index[name]
+
+		if !ok {
+			return nil, fmt.Errorf(`unknown field %q`, name)
+		}
+
+		rec = append(rec, Field{name, val})
+	}
+
+	return rec.rename(opts.Rename), nil
+}
+
+// Names returns the field names of the record in order.
+func (this Record) Names() ([]string) {
+
+	names := make([]string, len(this))
+
+	for i, f := range this {
+		names[i] = f.Name
+	}
+
+	return names
+}
+
+// Values returns the field values of the record in order as strings.
+func (this Record) Values() ([]string) {
+
+	vals := make([]string, len(this))
+
+	for i, f := range this {
+		vals[i] = toString(f.Value)
+	}
+
+	return vals
+}
+
+// Map returns the record as a map of field names to values, as used for
+// template data.
+func (this Record) Map() (map[string]interface{}) {
+
+	m := make(map[string]interface{})
+
+	for _, f := range this {
+		m[f.Name] = f.Value
+	}
+
+	return m
+}
+
+// JSON reports the record as a JSON object with fields in record order.
+func (this Record) JSON() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{`)
+
+	for i, f := range this {
+
+		if i > 0 {
+			buf.WriteString(`,`)
+		}
+
+		k, err := json.Marshal(f.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := json.Marshal(f.Value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(k)
+		buf.WriteString(`:`)
+		buf.Write(v)
+	}
+
+	buf.WriteString(`}`)
+
+	return buf.Bytes(), nil
+}
+
+// PrettyJSON reports the record as a formatted JSON object.
+func (this Record) PrettyJSON() ([]byte, error) {
+
+	j, err := this.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err = json.Indent(buf, j, MarshalPrefix, MarshalIndent); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CSV reports the record as a header record of names and a record of values.
+func (this Record) CSV() ([]byte, error) {
+	return CSV(this)
+}
+
+// NVP reports the record as name:value pairs, one per line.
+func (this Record) NVP() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	for _, f := range this {
+		fmt.Fprintf(buf, "%s:%s\n", f.Name, toString(f.Value))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CSV reports many records as a single header record followed by one
+// record of values per record. All records must have the same field names,
+// as they do when projected with the same Options.
+func CSV(recs ...Record) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+
+	for i, rec := range recs {
+
+		if i == 0 {
+			if err := w.Write(rec.Names()); err != nil {
+				return nil, err
+			}
+		} else if !sameNames(recs[0], rec) {
+			return nil, fmt.Errorf(`record %d: field names differ from record 0`, i)
+		}
+
+		if err := w.Write(rec.Values()); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// rename returns the record with fields renamed.
+func (this Record) rename(names map[string]string) (Record) {
+
+	for i, f := range this {
+		if name, ok := names[f.Name]; ok {
+			this[i].Name = name
+		}
+	}
+
+	return this
+}
+
+// decode decodes a flat JSON object into a record, preserving key order.
+func decode(j []byte) (Record, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf(`report is not a JSON object`)
+	}
+
+	var rec Record
+
+	for dec.More() {
+
+		tok, err := dec.Token()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var val interface{}
+
+		if err = dec.Decode(&val); err != nil {
+			return nil, err
+		}
+
+		rec = append(rec, Field{tok.(string), val})
+	}
+
+	if _, err := dec.Token(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// sameNames reports whether two records have the same field names.
+func sameNames(a, b Record) (bool) {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+
+	return true
+}
+
+// toString formats a value as it appears in text reports.
+func toString(v interface{}) (string) {
+
+	if v == nil {
+		return ``
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	`bytes`
+	`testing`
+
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func TestProject(t *testing.T) {
+
+	rec, err := Project(testdevice.Magtek(t, `mag1`), Options{})
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(rec) == 25, `unprojected record should have all JSON fields`)
+
+	opts := Options{
+		Fields: []string{`serial_number`, `bus_number`, `host_name`},
+		Rename: map[string]string{`serial_number`: `asset_tag`},
+	}
+
+	rec, err = Project(testdevice.Magtek(t, `mag1`), opts)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(rec) == 3, `projected record should have selected fields`)
+	gotest.Assert(t, rec[0].Name == `asset_tag`, `projected field should be renamed`)
+	gotest.Assert(t, rec[2].Name == `host_name`, `projected fields should be in selected order`)
+
+	j, err := rec.JSON()
+	gotest.Ok(t, err)
+	gotest.Assert(t, string(j) == `{"asset_tag":"24FFFFF","bus_number":1,"host_name":"John-SurfacePro"}`,
+		`unexpected JSON projection`)
+
+	n, err := rec.NVP()
+	gotest.Ok(t, err)
+	gotest.Assert(t, string(n) == "asset_tag:24FFFFF\nbus_number:1\nhost_name:John-SurfacePro\n",
+		`unexpected NVP projection`)
+
+	rec2, err := Project(testdevice.Generic(t, `gen1`), opts)
+	gotest.Ok(t, err)
+
+	c, err := CSV(rec, rec2)
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Count(c, []byte("\n")) == 3, `CSV projection should have a header and two records`)
+	gotest.Assert(t, bytes.HasPrefix(c, []byte("asset_tag,bus_number,host_name\n")), `unexpected CSV header`)
+
+	_, err = Project(testdevice.Magtek(t, `mag1`), Options{Fields: []string{`hostname`}})
+	gotest.Assert(t, err != nil, `unknown field should produce an error`)
+}
+
+func TestTemplate(t *testing.T) {
+
+	tmpl, err := NewTemplate(`legacy`, LegacyTemplate, Options{})
+	gotest.Ok(t, err)
+
+	b, err := tmpl.Report(testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Equal(b, testdevice.Magtek(t, `mag1`).Legacy()), `legacy template should match Legacy() report`)
+
+	tmpl, err = NewTemplate(`fixed`, FixedTemplate, Options{})
+	gotest.Ok(t, err)
+
+	b, err = tmpl.Report(testdevice.Generic(t, `gen1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(b) == 48, `fixed-width record should be 48 characters`)
+
+	tmpl, err = NewTemplate(`summary`, SummaryTemplate, Options{})
+	gotest.Ok(t, err)
+
+	b, err = tmpl.Report(testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, string(b) == `Mag-Tek USB Swipe Reader (0801:0001) S/N 24FFFFF on John-SurfacePro`,
+		`unexpected summary report`)
+
+	opts := Options{Fields: []string{`serial_number`}, Rename: map[string]string{`serial_number`: `sn`}}
+	tmpl, err = NewTemplate(`custom`, `{{upper .sn | lpad 10}}|{{truncate 3 .sn}}`, opts)
+	gotest.Ok(t, err)
+
+	b, err = tmpl.Report(testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, string(b) == `   24FFFFF|24F`, `unexpected custom report`)
+
+	tmpl, err = NewTemplate(`missing`, `{{.host_name}}`, opts)
+	gotest.Ok(t, err)
+
+	_, err = tmpl.Report(testdevice.Magtek(t, `mag1`))
+	gotest.Assert(t, err != nil, `field outside projection should produce an error`)
+}
+
+func newAuditedDevice(t *testing.T) (*usbci.Magtek) {
+
+	j, err := testdevice.Magtek(t, `mag2`).JSON()
+	gotest.Ok(t, err)
+
+	mag, err := usbci.NewMagtek(nil)
+	gotest.Ok(t, err)
+	gotest.Ok(t, mag.RestoreJSON(j))
+
+	j, err = testdevice.Magtek(t, `mag1`).JSON()
+	gotest.Ok(t, err)
+	gotest.Ok(t, mag.AuditJSON(j))
+
+	return mag
+}
+
+func TestPage(t *testing.T) {
+
+	mag := newAuditedDevice(t)
+
+	gen, err := usbci.NewGeneric(nil)
+	gotest.Ok(t, err)
+
+	j, err := testdevice.Generic(t, `gen1`).JSON()
+	gotest.Ok(t, err)
+	gotest.Ok(t, gen.RestoreJSON(j))
+	gen.SerialNum = ``
+
+	page, err := NewPage(`Register 1`, Options{}, mag, gen)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(page.Hosts) == 1 && len(page.Hosts[0].Types) == 2, `page should group devices by host and type`)
+	gotest.Assert(t, page.Hosts[0].Types[0].Name == `*usbci.Generic`, `device types should be sorted`)
+
+	rows := page.Rows()
+	gotest.Assert(t, rows[0].Problem == `serial number missing`, `missing serial number should be flagged`)
+	gotest.Assert(t, rows[1].Problem == ``, `valid serial number should not be flagged`)
+	gotest.Assert(t, rows[1].Cells[6].Changed && rows[1].Cells[6].Old == `21042840G01`, `changed field should be marked`)
+
+	h, err := page.HTML()
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(h, []byte(`<td class="changed" title="was 21042840G01">21042840G02`)),
+		`HTML page should highlight changed fields`)
+	gotest.Assert(t, bytes.Contains(h, []byte(`<td class="problem" title="serial number missing">`)),
+		`HTML page should flag missing serial numbers`)
+	gotest.Assert(t, bytes.Contains(h, []byte(`<h3>*usbci.Magtek (1)</h3>`)), `HTML page should have device type headings`)
+
+	m, err := page.Markdown()
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(m, []byte(`| **21042840G02** (was 21042840G01) |`)),
+		`Markdown page should highlight changed fields`)
+	gotest.Assert(t, bytes.Contains(m, []byte(`### \*usbci.Generic (1)`)), `Markdown page should escape headings`)
+	gotest.Assert(t, bytes.Contains(m, []byte(`⚠ serial number missing`)), `Markdown page should flag missing serial numbers`)
+}
+
+func TestDevicePage(t *testing.T) {
+
+	mag := newAuditedDevice(t)
+
+	h, err := HTML(mag, Options{})
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(h, []byte(`<tr><th>software_id</th><td class="changed"`)),
+		`HTML device page should highlight changed fields`)
+
+	m, err := Markdown(mag, Options{Fields: []string{`serial_number`, `usb_spec`}})
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(m, []byte("| usb\\_spec | **2.00** (was 1.10) |\n")),
+		`Markdown device page should highlight changed fields`)
+	gotest.Assert(t, bytes.Contains(m, []byte(`SoftwareID: 21042840G01 → 21042840G02`)),
+		`Markdown device page should list all changes`)
+
+	gotest.Assert(t, ValidateSerial(`0000000`) != nil, `placeholder serial number should be flagged`)
+	gotest.Assert(t, ValidateSerial(`B16 4F78`) != nil, `serial number with spaces should be flagged`)
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	`bytes`
+	`io`
+	`io/ioutil`
+	`path/filepath`
+	`strings`
+	`text/template`
+	`time`
+	`unicode/utf8`
+
+	`github.com/jscherff/gocmdb`
+)
+
+// Built-in templates. Template data is the projected record, so fields are
+// referenced by JSON name, or by their new name if renamed: {{.host_name}}.
+const (
+	// LegacyTemplate reproduces the Legacy() report.
+	LegacyTemplate string = `{{.host_name}},{{.serial_number}}`
+
+	// SummaryTemplate is a one-line summary suitable for a ticket.
+	SummaryTemplate string = `{{.vendor_name}} {{.product_name}} ` +
+		`({{.vendor_id}}:{{.product_id}}) ` +
+		`S/N {{default "unknown" .serial_number}} on {{.host_name}}`
+
+	// FixedTemplate is a fixed-width record of host name, vendor ID,
+	// product ID and serial number.
+	FixedTemplate string = `{{fixed 24 .host_name}}{{fixed 4 .vendor_id}}` +
+		`{{fixed 4 .product_id}}{{fixed 16 .serial_number}}`
+)
+
+// Funcs are the helper functions available to templates.
+var Funcs = template.FuncMap{
+	`upper`: func(v interface{}) (string) { return strings.ToUpper(toString(v)) },
+	`lower`: func(v interface{}) (string) { return strings.ToLower(toString(v)) },
+	`trim`: func(v interface{}) (string) { return strings.TrimSpace(toString(v)) },
+	`pad`: pad,
+	`lpad`: lpad,
+	`fixed`: fixed,
+	`truncate`: truncate,
+	`default`: dflt,
+	`join`: join,
+	`replace`: func(from, to string, v interface{}) (string) {
+		return strings.Replace(toString(v), from, to, -1)
+	},
+	`now`: func() (time.Time) { return time.Now().UTC() },
+	`date`: func(layout string, t time.Time) (string) { return t.Format(layout) },
+}
+
+// Template renders custom reports from the projected fields of an object.
+type Template struct {
+	*template.Template
+	Options Options
+}
+
+// NewTemplate parses a template with the helper functions. References to
+// fields that the projection does not contain are errors when executed.
+func NewTemplate(name, text string, opts Options) (*Template, error) {
+
+	t, err := template.New(name).Funcs(Funcs).Option(`missingkey=error`).Parse(text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Template{t, opts}, nil
+}
+
+// ParseFile parses a template from a file, named after the file.
+func ParseFile(fn string, opts Options) (*Template, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTemplate(filepath.Base(fn), string(b), opts)
+}
+
+// Execute renders the template for one object.
+func (this *Template) Execute(w io.Writer, obj gocmdb.Reportable) (error) {
+
+	rec, err := Project(obj, this.Options)
+
+	if err != nil {
+		return err
+	}
+
+	return this.Template.Execute(w, rec.Map())
+}
+
+// Report renders the template for one object and returns the result.
+func (this *Template) Report(obj gocmdb.Reportable) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	if err := this.Execute(buf, obj); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// pad pads a value with spaces on the right to at least width characters.
+func pad(width int, v interface{}) (string) {
+
+	s := toString(v)
+
+	if n := utf8.RuneCountInString(s); n < width {
+		s += strings.Repeat(` `, width - n)
+	}
+
+	return s
+}
+
+// lpad pads a value with spaces on the left to at least width characters.
+func lpad(width int, v interface{}) (string) {
+
+	s := toString(v)
+
+	if n := utf8.RuneCountInString(s); n < width {
+		s = strings.Repeat(` `, width - n) + s
+	}
+
+	return s
+}
+
+// truncate shortens a value to at most width characters.
+func truncate(width int, v interface{}) (string) {
+
+	s := toString(v)
+
+	if utf8.RuneCountInString(s) > width {
+		s = string([]rune(s)[:width])
+	}
+
+	return s
+}
+
+// fixed pads or truncates a value to exactly width characters.
+func fixed(width int, v interface{}) (string) {
+	return pad(width, truncate(width, v))
+}
+
+// dflt returns the default if the value is empty or zero.
+func dflt(def string, v interface{}) (string) {
+
+	if s := toString(v); s != `` && s != `0` {
+		return s
+	}
+
+	return def
+}
+
+// join joins values with a separator.
+func join(sep string, vs ...interface{}) (string) {
+
+	ss := make([]string, len(vs))
+
+	for i, v := range vs {
+		ss[i] = toString(v)
+	}
+
+	return strings.Join(ss, sep)
+}
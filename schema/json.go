@@ -0,0 +1,242 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`reflect`
+	`sort`
+	`strings`
+)
+
+const (
+	JSONSchemaDraft string = `http://json-schema.org/draft-07/schema#`
+
+	MarshalPrefix string = ``
+	MarshalIndent string = "\t"
+)
+
+// Schema is a JSON Schema document or subschema. Only the keywords needed
+// to describe reportable objects are supported.
+type Schema struct {
+	Schema               string			`json:"$schema,omitempty"`
+	Title                string			`json:"title,omitempty"`
+	Type                 string			`json:"type"`
+	Properties           map[string]*Schema		`json:"properties,omitempty"`
+	Required             []string			`json:"required,omitempty"`
+	AdditionalProperties *bool			`json:"additionalProperties,omitempty"`
+	Items                *Schema			`json:"items,omitempty"`
+}
+
+// JSONSchema generates a JSON Schema for the JSON report of an object. The
+// schema is strict: every field the encoder always writes is required and
+// no other properties are allowed.
+func JSONSchema(v interface{}) (*Schema, error) {
+
+	fs, err := Fields(v, `json`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := objectSchema(fs)
+	s.Schema = JSONSchemaDraft
+	s.Title = typeName(v)
+
+	return s, nil
+}
+
+// JSON reports the schema in JSON format.
+func (this *Schema) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the schema in formatted JSON format.
+func (this *Schema) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// Validate checks a JSON payload against the schema.
+func (this *Schema) Validate(j []byte) (error) {
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	var errs ValidationError
+
+	this.validate(`$`, v, &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validate checks a decoded value against the schema.
+func (this *Schema) validate(path string, v interface{}, errs *ValidationError) {
+
+	switch this.Type {
+
+	case `object`:
+
+		m, ok := v.(map[string]interface{})
+
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected object`, path))
+			return
+		}
+
+		for _, k := range this.Required {
+			if _, ok := m[k]; !ok {
+				*errs = append(*errs, fmt.Sprintf(`%s: missing property %q`, path, k))
+			}
+		}
+
+		keys := make([]string, 0, len(m))
+
+		for k := range m {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if ps, ok := this.Properties[k]; ok {
+				ps.validate(path + `.` + k, m[k], errs)
+			} else if this.AdditionalProperties != nil && !*this.AdditionalProperties {
+				*errs = append(*errs, fmt.Sprintf(`%s: unexpected property %q`, path, k))
+			}
+		}
+
+	case `array`:
+
+		if v == nil {
+			return
+		}
+
+		a, ok := v.([]interface{})
+
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected array`, path))
+			return
+		}
+
+		if this.Items != nil {
+			for i, e := range a {
+				this.Items.validate(fmt.Sprintf(`%s[%d]`, path, i), e, errs)
+			}
+		}
+
+	case `string`:
+
+		if _, ok := v.(string); !ok {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected string`, path))
+		}
+
+	case `integer`:
+
+		n, ok := v.(json.Number)
+
+		if _, err := n.Int64(); !ok || err != nil {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected integer`, path))
+		}
+
+	case `number`:
+
+		if _, ok := v.(json.Number); !ok {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected number`, path))
+		}
+
+	case `boolean`:
+
+		if _, ok := v.(bool); !ok {
+			*errs = append(*errs, fmt.Sprintf(`%s: expected boolean`, path))
+		}
+	}
+}
+
+// objectSchema builds an object schema from a list of fields.
+func objectSchema(fs []Field) (*Schema) {
+
+	no := false
+
+	s := &Schema{
+		Type: `object`,
+		Properties: make(map[string]*Schema),
+		AdditionalProperties: &no,
+	}
+
+	for _, f := range fs {
+
+		s.Properties[f.Name] = typeSchema(f.Type)
+
+		if !f.OmitEmpty {
+			s.Required = append(s.Required, f.Name)
+		}
+	}
+
+	return s
+}
+
+// typeSchema builds the schema for a Go type.
+func typeSchema(t reflect.Type) (*Schema) {
+
+	switch t.Kind() {
+
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+
+	case reflect.String:
+		return &Schema{Type: `string`}
+
+	case reflect.Bool:
+		return &Schema{Type: `boolean`}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: `integer`}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: `number`}
+
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: `array`, Items: typeSchema(t.Elem())}
+
+	case reflect.Struct:
+		return objectSchema(fields(t, `json`))
+
+	default:
+		return &Schema{Type: `object`}
+	}
+}
+
+// typeName returns the object type reported by an object, or its Go type.
+func typeName(v interface{}) (string) {
+
+	if t, ok := v.(interface{Type() (string)}); ok {
+		return t.Type()
+	}
+
+	return strings.TrimPrefix(reflect.TypeOf(v).String(), `*`)
+}
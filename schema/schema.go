@@ -0,0 +1,145 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema generates JSON Schema and XML Schema definitions for
+// reportable objects from their struct tags and validates report payloads
+// against them.
+package schema
+
+import (
+	`fmt`
+	`reflect`
+	`strings`
+
+	`github.com/jscherff/gocmdb`
+)
+
+// Field describes a field as it appears in one report format.
+type Field struct {
+	Name      string
+	GoName    string
+	Type      reflect.Type
+	OmitEmpty bool
+}
+
+// ValidationError lists every way in which a payload violates a schema.
+type ValidationError []string
+
+// Error joins the violations into a single message.
+func (this ValidationError) Error() (string) {
+	return `schema violations: ` + strings.Join(this, `; `)
+}
+
+// Fields returns the fields of a struct, or pointer to struct, as they
+// appear in the report format named by tag: json, xml, csv or nvp. Fields
+// tagged "-" are excluded and untagged embedded structs are flattened, as
+// they are by the encoders. The nvp format always uses Go field names.
+func Fields(v interface{}, tag string) ([]Field, error) {
+
+	t := reflect.TypeOf(v)
+
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf(`%T is not a struct`, v)
+	}
+
+	return fields(t, tag), nil
+}
+
+// fields walks the fields of a struct type.
+func fields(t reflect.Type, tag string) (fs []Field) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		opts := strings.Split(f.Tag.Get(tag), `,`)
+
+		if opts[0] == `-` {
+			continue
+		}
+
+		if f.Anonymous && opts[0] == `` {
+
+			ft := f.Type
+
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				fs = append(fs, fields(ft, tag)...)
+				continue
+			}
+		}
+
+		if f.PkgPath != `` {
+			continue
+		}
+
+		fd := Field{Name: opts[0], GoName: f.Name, Type: f.Type}
+
+		if fd.Name == `` || tag == `nvp` {
+			fd.Name = f.Name
+		}
+
+		for _, opt := range opts[1:] {
+			if opt == `omitempty` {
+				fd.OmitEmpty = true
+			}
+		}
+
+		fs = append(fs, fd)
+	}
+
+	return fs
+}
+
+// ValidateReport checks the JSON and XML reports of an object against the
+// schemas generated from the object itself. Use it before uploading a
+// report to catch objects whose output has drifted from their definition.
+func ValidateReport(obj gocmdb.Reportable) (error) {
+
+	js, err := JSONSchema(obj)
+
+	if err != nil {
+		return err
+	}
+
+	xs, err := XSD(obj)
+
+	if err != nil {
+		return err
+	}
+
+	j, err := obj.JSON()
+
+	if err != nil {
+		return err
+	}
+
+	if err = js.Validate(j); err != nil {
+		return err
+	}
+
+	x, err := obj.XML()
+
+	if err != nil {
+		return err
+	}
+
+	return xs.Validate(x)
+}
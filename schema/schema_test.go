@@ -0,0 +1,89 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	`bytes`
+	`testing`
+
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func TestFields(t *testing.T) {
+
+	fs, err := Fields(testdevice.Magtek(t, `mag1`), `json`)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(fs) == 26, `JSON report should have 26 fields`)
+	gotest.Assert(t, fs[0].Name == `schema_version`, `embedded Generic fields should be flattened`)
+
+	fs, err = Fields(testdevice.Magtek(t, `mag1`), `csv`)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(fs) == 10, `CSV report should have 10 fields`)
+
+	fs, err = Fields(testdevice.Magtek(t, `mag1`), `nvp`)
+	gotest.Ok(t, err)
+	gotest.Assert(t, fs[1].Name == `HostName`, `NVP report should use Go field names`)
+
+	_, err = Fields(`string`, `json`)
+	gotest.Assert(t, err != nil, `non-struct should produce an error`)
+}
+
+func TestJSONSchema(t *testing.T) {
+
+	s, err := JSONSchema(testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, s.Title == `*usbci.Magtek`, `schema title should be the object type`)
+	gotest.Assert(t, s.Properties[`bus_number`].Type == `integer`, `bus_number should be an integer`)
+	gotest.Assert(t, s.Properties[`Changes`] == nil, `excluded fields should not appear in schema`)
+
+	j, err := testdevice.Magtek(t, `mag1`).JSON()
+	gotest.Ok(t, err)
+	gotest.Ok(t, s.Validate(j))
+
+	err = s.Validate(bytes.Replace(j, []byte(`"bus_number":1`), []byte(`"bus_number":"1"`), 1))
+	gotest.Assert(t, err != nil, `string bus number should not validate`)
+
+	err = s.Validate(bytes.Replace(j, []byte(`"host_name"`), []byte(`"hostname"`), 1))
+	verrs, ok := err.(ValidationError)
+	gotest.Assert(t, ok && len(verrs) == 2, `renamed property should be missing and unexpected`)
+}
+
+func TestXSD(t *testing.T) {
+
+	s, err := XSD(testdevice.Magtek(t, `mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, s.Element.Name == `Generic`, `root element should match XML report`)
+
+	b, err := s.PrettyXML()
+	gotest.Ok(t, err)
+	gotest.Assert(t, bytes.Contains(b, []byte(`<xs:element name="BusNumber" type="xs:integer"></xs:element>`)),
+		`schema should declare integer elements`)
+
+	x, err := testdevice.Generic(t, `gen1`).XML()
+	gotest.Ok(t, err)
+	gotest.Ok(t, s.Validate(x))
+
+	err = s.Validate(bytes.Replace(x, []byte(`<BusNumber>1</BusNumber>`), []byte(`<BusNumber>one</BusNumber>`), 1))
+	gotest.Assert(t, err != nil, `non-integer bus number should not validate`)
+
+	err = s.Validate(bytes.Replace(x, []byte(`<HostName>`), []byte(`<Host>`), 1))
+	gotest.Assert(t, err != nil, `unknown element should not validate`)
+}
+
+func TestValidateReport(t *testing.T) {
+	gotest.Ok(t, ValidateReport(testdevice.Magtek(t, `mag1`)))
+	gotest.Ok(t, ValidateReport(testdevice.Generic(t, `gen1`)))
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	`bytes`
+	`encoding/xml`
+	`fmt`
+	`io`
+	`reflect`
+	`strconv`
+	`strings`
+)
+
+const (
+	XMLSchemaNamespace string = `http://www.w3.org/2001/XMLSchema`
+)
+
+// XMLSchema is an XML Schema (XSD) document describing a single root
+// element whose children are simple-typed elements in a fixed sequence,
+// which is the shape of every XML report.
+type XMLSchema struct {
+	XMLName   xml.Name		`xml:"xs:schema"`
+	Namespace string		`xml:"xmlns:xs,attr"`
+	Element   XMLElement		`xml:"xs:element"`
+}
+
+// XMLElement is an element declaration.
+type XMLElement struct {
+	Name        string		`xml:"name,attr"`
+	Type        string		`xml:"type,attr,omitempty"`
+	MinOccurs   string		`xml:"minOccurs,attr,omitempty"`
+	ComplexType *XMLComplexType	`xml:"xs:complexType,omitempty"`
+}
+
+// XMLComplexType is a complex type consisting of a sequence of elements.
+type XMLComplexType struct {
+	Sequence    []XMLElement	`xml:"xs:sequence>xs:element"`
+}
+
+// XSD generates an XML Schema for the XML report of an object. The root
+// element name is taken from the object's own XML report when available,
+// since wrappers may report the element of an embedded type.
+func XSD(v interface{}) (*XMLSchema, error) {
+
+	fs, err := Fields(v, `xml`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root := XMLElement{Name: xmlRootName(v), ComplexType: new(XMLComplexType)}
+
+	for _, f := range fs {
+
+		el := XMLElement{Name: f.Name, Type: xsdType(f.Type)}
+
+		if f.OmitEmpty {
+			el.MinOccurs = `0`
+		}
+
+		root.ComplexType.Sequence = append(root.ComplexType.Sequence, el)
+	}
+
+	return &XMLSchema{Namespace: XMLSchemaNamespace, Element: root}, nil
+}
+
+// XML reports the schema in XML format.
+func (this *XMLSchema) XML() ([]byte, error) {
+
+	b, err := xml.Marshal(this)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+// PrettyXML reports the schema in formatted XML format.
+func (this *XMLSchema) PrettyXML() ([]byte, error) {
+
+	b, err := xml.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+// Validate checks an XML payload against the schema: the root element, the
+// presence and order of child elements, and the lexical form of integer and
+// boolean values.
+func (this *XMLSchema) Validate(x []byte) (error) {
+
+	var (
+		errs ValidationError
+		children []string
+		values = make(map[string]string)
+		name string
+		text bytes.Buffer
+		depth int
+	)
+
+	dec := xml.NewDecoder(bytes.NewReader(x))
+
+	for {
+		tok, err := dec.Token()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Local != this.Element.Name {
+				errs = append(errs, fmt.Sprintf(`root element is %q, expected %q`,
+					t.Name.Local, this.Element.Name))
+			} else if depth == 2 {
+				name = t.Name.Local
+				children = append(children, name)
+				text.Reset()
+			} else if depth > 2 {
+				errs = append(errs, fmt.Sprintf(`%s: unexpected nested element %q`, name, t.Name.Local))
+			}
+
+		case xml.CharData:
+			if depth == 2 {
+				text.Write(t)
+			}
+
+		case xml.EndElement:
+			if depth == 2 {
+				values[name] = text.String()
+			}
+			depth--
+		}
+	}
+
+	i := 0
+
+	var seq []XMLElement
+
+	if this.Element.ComplexType != nil {
+		seq = this.Element.ComplexType.Sequence
+	}
+
+	for _, el := range seq {
+
+		if i < len(children) && children[i] == el.Name {
+
+			if msg := checkXSDValue(el.Type, values[el.Name]); msg != `` {
+				errs = append(errs, fmt.Sprintf(`%s: %s`, el.Name, msg))
+			}
+
+			i++
+
+		} else if el.MinOccurs != `0` {
+			errs = append(errs, fmt.Sprintf(`missing or misplaced element %q`, el.Name))
+		}
+	}
+
+	for ; i < len(children); i++ {
+		errs = append(errs, fmt.Sprintf(`unexpected element %q`, children[i]))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// checkXSDValue checks the lexical form of a simple-typed value.
+func checkXSDValue(typ, val string) (string) {
+
+	switch typ {
+
+	case `xs:integer`:
+		if _, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64); err != nil {
+			return `expected integer`
+		}
+
+	case `xs:boolean`:
+		switch strings.TrimSpace(val) {
+		case `true`, `false`, `1`, `0`:
+		default:
+			return `expected boolean`
+		}
+
+	case `xs:decimal`:
+		if _, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil {
+			return `expected decimal`
+		}
+	}
+
+	return ``
+}
+
+// xsdType maps a Go type to a built-in XML Schema type.
+func xsdType(t reflect.Type) (string) {
+
+	switch t.Kind() {
+
+	case reflect.Bool:
+		return `xs:boolean`
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return `xs:integer`
+
+	case reflect.Float32, reflect.Float64:
+		return `xs:decimal`
+
+	default:
+		return `xs:string`
+	}
+}
+
+// xmlRootName returns the root element name of an object's XML report.
+func xmlRootName(v interface{}) (string) {
+
+	if r, ok := v.(interface{XML() ([]byte, error)}); ok {
+
+		if b, err := r.XML(); err == nil {
+
+			dec := xml.NewDecoder(bytes.NewReader(b))
+
+			for {
+				tok, err := dec.Token()
+
+				if err != nil {
+					break
+				}
+
+				if se, ok := tok.(xml.StartElement); ok {
+					return se.Name.Local
+				}
+			}
+		}
+	}
+
+	t := reflect.TypeOf(v)
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
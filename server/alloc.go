@@ -0,0 +1,377 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`sort`
+	`strings`
+	`sync`
+	`time`
+)
+
+const (
+	StateReserved string = `reserved`
+	StateConfirmed string = `confirmed`
+	StateReleased string = `released`
+
+	DefaultReservationTTL time.Duration = time.Hour
+)
+
+var (
+	ErrPoolNotFound = errors.New(`serial pool not found`)
+	ErrPoolExhausted = errors.New(`serial pool exhausted`)
+	ErrAllocationNotFound = errors.New(`serial allocation not found`)
+	ErrAllocationOwner = errors.New(`serial allocated to another device`)
+	ErrAllocationState = errors.New(`serial allocation is not reserved`)
+)
+
+// Pool hands out serial numbers by formatting a counter with a format such
+// as "S%06d". Next is the next counter value; Last, if not zero, is the
+// last value the pool may hand out.
+type Pool struct {
+	Name   string			`json:"name"`
+	Format string			`json:"format"`
+	Next   int64			`json:"next"`
+	Last   int64			`json:"last,omitempty"`
+}
+
+// Allocation is a serial number reserved for, and later confirmed as
+// written to, a device.
+type Allocation struct {
+	Serial    string		`json:"serial"`
+	Pool      string		`json:"pool"`
+	Key       string		`json:"key"`
+	HostName  string		`json:"host_name,omitempty"`
+	State     string		`json:"state"`
+	Reserved  time.Time		`json:"reserved"`
+	Expires   time.Time		`json:"expires,omitempty"`
+	Confirmed time.Time		`json:"confirmed,omitempty"`
+}
+
+// Allocator reserves unique serial numbers from pools. Every change is
+// written to its state file before it is returned, so a serial number is
+// never handed out twice, even across restarts. Reservations that are not
+// confirmed within TTL expire. Released and expired serial numbers are not
+// handed out again, since they may have been written to a device anyway.
+type Allocator struct {
+	TTL time.Duration
+	fn string
+	state allocState
+	mutex sync.Mutex
+}
+
+// allocState is the persistent state of an Allocator.
+type allocState struct {
+	Pools       map[string]*Pool		`json:"pools"`
+	Allocations map[string]*Allocation	`json:"allocations"`
+}
+
+// NewAllocator instantiates an Allocator with its state file, adding the
+// given pools if they are not yet in the state. Counters of existing pools
+// are kept; their formats and limits are updated.
+func NewAllocator(fn string, pools ...*Pool) (*Allocator, error) {
+
+	this := &Allocator{
+		TTL: DefaultReservationTTL,
+		fn: fn,
+		state: allocState{
+			Pools: make(map[string]*Pool),
+			Allocations: make(map[string]*Allocation),
+		},
+	}
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err == nil {
+		err = json.Unmarshal(b, &this.state)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	for _, p := range pools {
+
+		if err = p.validate(); err != nil {
+			return nil, err
+		}
+
+		if old, ok := this.state.Pools[p.Name]; ok {
+			old.Format, old.Last = p.Format, p.Last
+		} else {
+			np := *p
+			this.state.Pools[p.Name] = &np
+		}
+	}
+
+	return this, this.save()
+}
+
+// LoadPools reads pool definitions from a JSON file holding an array of
+// pools.
+func LoadPools(fn string) (pools []*Pool, err error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &pools); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return pools, nil
+}
+
+// Pools returns the pools, by name.
+func (this *Allocator) Pools() (pools []*Pool) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, p := range this.state.Pools {
+		np := *p
+		pools = append(pools, &np)
+	}
+
+	sort.Slice(pools, func(i, j int) (bool) {
+		return pools[i].Name < pools[j].Name
+	})
+
+	return pools
+}
+
+// Reserve reserves the next serial number of a pool for the device with
+// the given key. Serial numbers for which inUse returns true, such as
+// those already reported by known devices, are skipped; an error from
+// inUse ends the reservation. A device that already holds a reservation
+// or confirmed allocation in the pool gets the same serial number again,
+// so that a retried request is harmless.
+func (this *Allocator) Reserve(pool, key, host string, inUse func(string) (bool, error)) (*Allocation, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	p, ok := this.state.Pools[pool]
+
+	if !ok {
+		return nil, ErrPoolNotFound
+	}
+
+	now := time.Now()
+
+	if err := this.expire(now); err != nil {
+		return nil, err
+	}
+
+	for _, a := range this.state.Allocations {
+		if a.Pool == pool && a.Key == key && a.State != StateReleased {
+			na := *a
+			return &na, nil
+		}
+	}
+
+	for {
+		if p.Last != 0 && p.Next > p.Last {
+			return nil, ErrPoolExhausted
+		}
+
+		sn := fmt.Sprintf(p.Format, p.Next)
+
+		if _, ok := this.state.Allocations[sn]; ok {
+			p.Next++
+			continue
+		}
+
+		if inUse != nil {
+			if used, err := inUse(sn); err != nil {
+				return nil, err
+			} else if used {
+				p.Next++
+				continue
+			}
+		}
+
+		p.Next++
+
+		a := &Allocation{
+			Serial: sn,
+			Pool: pool,
+			Key: key,
+			HostName: host,
+			State: StateReserved,
+			Reserved: now,
+			Expires: now.Add(this.TTL),
+		}
+
+		this.state.Allocations[sn] = a
+
+		if err := this.save(); err != nil {
+			delete(this.state.Allocations, sn)
+			p.Next--
+			return nil, err
+		}
+
+		na := *a
+		return &na, nil
+	}
+}
+
+// Confirm confirms that a reserved serial number was written to the device
+// it was reserved for. Confirming a confirmed allocation again is harmless.
+func (this *Allocator) Confirm(sn, key string) (*Allocation, error) {
+	return this.update(sn, key, StateConfirmed)
+}
+
+// Release releases a reserved serial number that could not be written.
+func (this *Allocator) Release(sn, key string) (*Allocation, error) {
+	return this.update(sn, key, StateReleased)
+}
+
+// Allocation returns the allocation of a serial number.
+func (this *Allocator) Allocation(sn string) (*Allocation, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if err := this.expire(time.Now()); err != nil {
+		return nil, err
+	}
+
+	a, ok := this.state.Allocations[sn]
+
+	if !ok {
+		return nil, ErrAllocationNotFound
+	}
+
+	na := *a
+	return &na, nil
+}
+
+// update moves a reserved allocation to a new state.
+func (this *Allocator) update(sn, key, state string) (*Allocation, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+
+	if err := this.expire(now); err != nil {
+		return nil, err
+	}
+
+	a, ok := this.state.Allocations[sn]
+
+	switch {
+	case !ok:
+		return nil, ErrAllocationNotFound
+	case a.Key != key:
+		return nil, ErrAllocationOwner
+	case a.State == state:
+		na := *a
+		return &na, nil
+	case a.State != StateReserved:
+		return nil, ErrAllocationState
+	}
+
+	old := *a
+	a.State, a.Expires = state, time.Time{}
+
+	if state == StateConfirmed {
+		a.Confirmed = now
+	}
+
+	if err := this.save(); err != nil {
+		*a = old
+		return nil, err
+	}
+
+	na := *a
+	return &na, nil
+}
+
+// expire releases reservations that have expired and writes the state
+// file if any did, so that they stay released after a restart.
+func (this *Allocator) expire(now time.Time) (error) {
+
+	var expired []*Allocation
+
+	for _, a := range this.state.Allocations {
+		if a.State == StateReserved && !a.Expires.IsZero() && now.After(a.Expires) {
+			expired = append(expired, a)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	exp := make([]time.Time, len(expired))
+
+	for i, a := range expired {
+		exp[i] = a.Expires
+		a.State, a.Expires = StateReleased, time.Time{}
+	}
+
+	if err := this.save(); err != nil {
+
+		for i, a := range expired {
+			a.State, a.Expires = StateReserved, exp[i]
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// save writes the state file atomically.
+func (this *Allocator) save() (error) {
+
+	b, err := json.Marshal(&this.state)
+
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(this.fn + `.tmp`, b, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(this.fn + `.tmp`, this.fn)
+}
+
+// validate checks that a pool has a name and a format with one integer verb.
+func (this *Pool) validate() (error) {
+
+	if this.Name == `` {
+		return fmt.Errorf(`serial pool has no name`)
+	}
+
+	if strings.Count(strings.Replace(this.Format, `%%`, ``, -1), `%`) != 1 ||
+		strings.Contains(fmt.Sprintf(this.Format, int64(0)), `%!`) {
+		return fmt.Errorf(`serial pool %q: format %q must contain one integer verb`, this.Name, this.Format)
+	}
+
+	return nil
+}
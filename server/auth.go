@@ -0,0 +1,129 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`bufio`
+	`crypto/sha256`
+	`crypto/subtle`
+	`fmt`
+	`net/http`
+	`os`
+	`strings`
+)
+
+// Authorizer decides whether a request may use the CMDB. It returns an
+// error to refuse the request, which is answered with 401 Unauthorized.
+type Authorizer func(*http.Request) (error)
+
+// BearerTokens returns an Authorizer that accepts requests carrying one of
+// the given tokens in an "Authorization: Bearer" header.
+func BearerTokens(tokens ...string) (Authorizer) {
+
+	return func(r *http.Request) (error) {
+
+		auth := r.Header.Get(`Authorization`)
+
+		if !strings.HasPrefix(auth, `Bearer `) {
+			return fmt.Errorf(`bearer token required`)
+		}
+
+		tok := []byte(strings.TrimSpace(strings.TrimPrefix(auth, `Bearer `)))
+		ok := 0
+
+		for _, t := range tokens {
+			ok |= subtle.ConstantTimeCompare(tok, []byte(t))
+		}
+
+		if ok == 0 {
+			return fmt.Errorf(`invalid bearer token`)
+		}
+
+		return nil
+	}
+}
+
+// ClientCert is an Authorizer that accepts requests made over TLS with a
+// client certificate verified against the server's client CAs.
+func ClientCert(r *http.Request) (error) {
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return fmt.Errorf(`verified client certificate required`)
+	}
+
+	return nil
+}
+
+// AnyOf returns an Authorizer that accepts requests accepted by any of the
+// given Authorizers.
+func AnyOf(as ...Authorizer) (Authorizer) {
+
+	return func(r *http.Request) (err error) {
+
+		err = fmt.Errorf(`not authorized`)
+
+		for _, a := range as {
+			if err = a(r); err == nil {
+				return nil
+			}
+		}
+
+		return err
+	}
+}
+
+// caller returns an opaque identity of the caller of a request, derived
+// from its bearer token or verified client certificate, so that state kept
+// for one caller is not shared with another. It is empty for requests with
+// neither.
+func caller(r *http.Request) (string) {
+
+	if auth := r.Header.Get(`Authorization`); auth != `` {
+		return fmt.Sprintf(`token:%x`, sha256.Sum256([]byte(auth)))
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return fmt.Sprintf(`cert:%x`, sha256.Sum256(r.TLS.VerifiedChains[0][0].Raw))
+	}
+
+	return ``
+}
+
+// LoadTokens reads bearer tokens from a file, one per line. Blank lines and
+// lines beginning with '#' are ignored.
+func LoadTokens(fn string) (tokens []string, err error) {
+
+	fh, err := os.Open(fn)
+
+	if err != nil {
+		return tokens, err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != `` && !strings.HasPrefix(line, `#`) {
+			tokens = append(tokens, line)
+		}
+	}
+
+	if err = scanner.Err(); err == nil && len(tokens) == 0 {
+		err = fmt.Errorf(`%s: no tokens`, fn)
+	}
+
+	return tokens, err
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`crypto/sha256`
+	`fmt`
+	`net/http`
+	`sync`
+	`time`
+)
+
+const (
+	IdempotencyHeader string = `Idempotency-Key`
+	MaxIdempotencyKeys int = 10000
+	IdempotencyTTL time.Duration = 24 * time.Hour
+)
+
+var (
+	errKeyReused = &statusError{http.StatusUnprocessableEntity,
+		fmt.Errorf(`idempotency key was used with a different request body`)}
+)
+
+// idempotency remembers the responses to submissions by caller and
+// idempotency key, so that a retried submission is answered without being
+// applied again. Keys are kept in memory for IdempotencyTTL, up to
+// MaxIdempotencyKeys. The mutex only guards the map; a submission in
+// progress holds a reservation on its key, so that submissions with other
+// keys proceed while it is applied.
+type idempotency struct {
+	mutex sync.Mutex
+	responses map[string]*response
+	order []string
+}
+
+// response is a remembered response, the digest of the request body it
+// answers and the time it was made. Done is closed when the submission
+// holding the reservation finishes; v is nil if it failed.
+type response struct {
+	v interface{}
+	sum [sha256.Size]byte
+	time time.Time
+	done chan struct{}
+}
+
+// reserve returns the remembered response to a submission, waiting for a
+// submission in progress with the same key to finish. If there is none, it
+// reserves the key and returns a nil response; the caller must then call
+// release. A key reused with a different body is refused.
+func (this *idempotency) reserve(key string, body []byte) (*response, interface{}, error) {
+
+	sum := sha256.Sum256(body)
+
+	for {
+		this.mutex.Lock()
+
+		if this.responses == nil {
+			this.responses = make(map[string]*response)
+		}
+
+		resp, ok := this.responses[key]
+
+		if !ok || (resp.v != nil && time.Since(resp.time) > IdempotencyTTL) {
+
+			resp = &response{sum: sum, done: make(chan struct{})}
+
+			if !ok {
+				this.order = append(this.order, key)
+			}
+
+			this.responses[key] = resp
+			this.mutex.Unlock()
+
+			return resp, nil, nil
+		}
+
+		this.mutex.Unlock()
+
+		if resp.sum != sum {
+			return nil, nil, errKeyReused
+		}
+
+		<-resp.done
+
+		if resp.v != nil {
+			return nil, resp.v, nil
+		}
+
+		// The submission holding the reservation failed, so it was
+		// forgotten; try to reserve the key again.
+	}
+}
+
+// release finishes a reservation, remembering the response, or forgetting
+// the key if v is nil so that the submission can be retried, and forgets
+// the oldest responses beyond MaxIdempotencyKeys.
+func (this *idempotency) release(key string, resp *response, v interface{}) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	resp.v, resp.time = v, time.Now()
+	close(resp.done)
+
+	if v == nil {
+		this.forget(key)
+	}
+
+	for len(this.order) > MaxIdempotencyKeys {
+		if r := this.responses[this.order[0]]; r != nil && r.v == nil {
+			break
+		}
+		delete(this.responses, this.order[0])
+		this.order = this.order[1:]
+	}
+}
+
+// forget removes a key. The caller must hold the mutex.
+func (this *idempotency) forget(key string) {
+
+	delete(this.responses, key)
+
+	for i, k := range this.order {
+		if k == key {
+			this.order = append(this.order[:i], this.order[i + 1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,586 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server is a CMDB for USB devices. It accepts device registrations
+// and audit submissions from clients and agents over a REST API, answers
+// serial number lookups and records host check-ins. All requests and
+// responses are JSON:
+//
+//	POST /v1/devices                        register device JSON reports, one or an array
+//	GET  /v1/devices                        list device summaries
+//	GET  /v1/devices/{key}                  latest snapshot of a device, its baseline
+//	GET  /v1/devices/{key}/history          audit history of a device
+//	POST /v1/audits                         submit history records, one or an array
+//	GET  /v1/serials/{serial}               find devices by serial number
+//	POST /v1/checkins                       record a host check-in
+//	GET  /v1/hosts                          list host check-ins
+//	GET  /v1/pools                          list serial number pools
+//	POST /v1/pools/{pool}/allocations       reserve a serial number
+//	GET  /v1/allocations/{serial}           get a serial number allocation
+//	POST /v1/allocations/{serial}/confirm   confirm a reserved serial number
+//	POST /v1/allocations/{serial}/release   release a reserved serial number
+//
+// Device keys are the stable identities computed by history.Key. The server
+// computes them from the submitted reports rather than trusting clients.
+// Audit submissions with an Idempotency-Key header are applied once; a
+// retry by the same caller with the same key and body within IdempotencyTTL
+// gets the first response, and a retry with a different body is refused
+// with 422 Unprocessable Entity.
+// Serial number allocation is available if the server has an Allocator.
+//
+// Every request, including queries, is passed to the server's Authorize
+// hook, such as BearerTokens or ClientCert, and refused with 401
+// Unauthorized if it returns an error, since device histories, serial
+// numbers and host names are inventory data as well. Without a hook
+// requests are not authenticated, and the server must only be reachable
+// by trusted hosts.
+package server
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`net`
+	`net/http`
+	`net/url`
+	`strings`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/usbci`
+)
+
+const (
+	APIPrefix string = `/v1/`
+	MaxBodySize int64 = 8 << 20
+)
+
+var (
+	errNoAllocator = &statusError{http.StatusNotFound, fmt.Errorf(`serial allocation is not configured`)}
+)
+
+// Server handles the REST API.
+type Server struct {
+	Store Store
+	Allocator *Allocator
+	Authorize Authorizer
+	audits idempotency
+}
+
+// AllocationRequest is the body of requests to reserve, confirm or release
+// a serial number: the key of the device and, for reservations, its host.
+type AllocationRequest struct {
+	Key      string			`json:"key"`
+	HostName string			`json:"host_name,omitempty"`
+}
+
+// Registration is the outcome of registering a device.
+type Registration struct {
+	Key     string			`json:"key"`
+	Created bool			`json:"created"`
+}
+
+// Accepted is the response to an audit submission.
+type Accepted struct {
+	Accepted int			`json:"accepted"`
+}
+
+// Error is the body of an error response.
+type Error struct {
+	Error string			`json:"error"`
+}
+
+// statusError is an error with an HTTP status.
+type statusError struct {
+	status int
+	err error
+}
+
+func (this *statusError) Error() (string) {
+	return this.err.Error()
+}
+
+// New instantiates a Server with the given store.
+func New(s Store) (*Server) {
+	return &Server{Store: s}
+}
+
+// ServeHTTP routes a request to its handler.
+func (this *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := r.URL.EscapedPath()
+
+	if !strings.HasPrefix(path, APIPrefix) {
+		this.fail(w, http.StatusNotFound, fmt.Errorf(`not found`))
+		return
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(path, APIPrefix), `/`), `/`)
+
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			this.fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	var (
+		v interface{}
+		status = http.StatusOK
+		err error
+	)
+
+	if err = this.authorize(r); err != nil {
+		this.fail(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	route := r.Method + ` ` + parts[0]
+
+	switch {
+	case route == `POST devices` && len(parts) == 1:
+		status, v, err = this.register(r)
+	case route == `GET devices` && len(parts) == 1:
+		v, err = Devices(this.Store)
+	case route == `GET devices` && len(parts) == 2:
+		v, err = this.baseline(parts[1])
+	case route == `GET devices` && len(parts) == 3 && parts[2] == `history`:
+		v, err = this.history(parts[1])
+	case route == `POST audits` && len(parts) == 1:
+		v, err = this.audit(r)
+	case route == `GET serials` && len(parts) == 2:
+		v, err = this.findSerial(parts[1])
+	case route == `POST checkins` && len(parts) == 1:
+		v, err = this.checkIn(r)
+	case route == `GET hosts` && len(parts) == 1:
+		v, err = this.Store.CheckIns()
+	case route == `GET pools` && len(parts) == 1:
+		v, err = this.pools()
+	case route == `POST pools` && len(parts) == 3 && parts[2] == `allocations`:
+		status, v, err = this.reserve(r, parts[1])
+	case route == `GET allocations` && len(parts) == 2:
+		v, err = this.allocation(parts[1])
+	case route == `POST allocations` && len(parts) == 3 && parts[2] == `confirm`:
+		v, err = this.confirm(r, parts[1])
+	case route == `POST allocations` && len(parts) == 3 && parts[2] == `release`:
+		v, err = this.release(r, parts[1])
+	default:
+		err = &statusError{http.StatusNotFound, fmt.Errorf(`no route for %s %s`, r.Method, r.URL.Path)}
+	}
+
+	if err != nil {
+		status = http.StatusInternalServerError
+		if se, ok := err.(*statusError); ok {
+			status = se.status
+		}
+		this.fail(w, status, err)
+		return
+	}
+
+	this.reply(w, status, v)
+}
+
+// register registers the devices in a JSON device report or an array of
+// reports. Devices already registered are left unchanged.
+func (this *Server) register(r *http.Request) (int, []*Registration, error) {
+
+	b, err := readBody(r)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rs, err := usbci.RestoreAll(bytes.NewReader(b))
+
+	if err != nil {
+		return 0, nil, badRequest(err)
+	}
+
+	status := http.StatusOK
+	regs := make([]*Registration, 0, len(rs))
+
+	for i, rdev := range rs {
+
+		dev, ok := rdev.(gocmdb.Auditable)
+
+		if !ok {
+			return 0, nil, badRequest(fmt.Errorf(`device %d: type %s cannot be registered`, i, rdev.Type()))
+		}
+
+		reg := &Registration{Key: history.Key(dev)}
+
+		if _, err = history.Latest(this.Store, reg.Key); err == history.ErrNotFound {
+
+			rec, err := history.NewRecord(dev)
+
+			if err != nil {
+				return 0, nil, err
+			}
+
+			rec.Changes = nil
+
+			if err = this.Store.Append(rec); err != nil {
+				return 0, nil, err
+			}
+
+			reg.Created, status = true, http.StatusCreated
+
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		regs = append(regs, reg)
+	}
+
+	return status, regs, nil
+}
+
+// baseline returns the latest snapshot of a device.
+func (this *Server) baseline(key string) (json.RawMessage, error) {
+
+	rec, err := history.Latest(this.Store, key)
+
+	if err == history.ErrNotFound {
+		return nil, notFound(key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rec.Snapshot, nil
+}
+
+// history returns the audit history of a device.
+func (this *Server) history(key string) ([]*history.Record, error) {
+
+	recs, err := this.Store.Records(key)
+
+	if err == nil && len(recs) == 0 {
+		err = notFound(key)
+	}
+
+	return recs, err
+}
+
+// audit appends submitted history records, each holding the snapshot of a
+// device and the changes found by its audit. The key, host name and time
+// of a record are filled in from its snapshot and the current time if
+// they are missing; a key that does not match the snapshot is refused.
+// A submission with an idempotency key already applied for the same caller
+// is answered with the first response and not applied again; the key may
+// not be reused with a different body.
+func (this *Server) audit(r *http.Request) (*Accepted, error) {
+
+	b, err := readBody(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []*history.Record
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`[`)) {
+		err = json.Unmarshal(b, &recs)
+	} else {
+		rec := new(history.Record)
+		err = json.Unmarshal(b, rec)
+		recs = append(recs, rec)
+	}
+
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	for i, rec := range recs {
+
+		rdev, err := usbci.Restore(bytes.NewReader(rec.Snapshot))
+
+		if err != nil {
+			return nil, badRequest(fmt.Errorf(`record %d: %v`, i, err))
+		}
+
+		dev, ok := rdev.(gocmdb.Identifiable)
+
+		if !ok {
+			return nil, badRequest(fmt.Errorf(`record %d: type %s cannot be audited`, i, rdev.Type()))
+		}
+
+		key := history.Key(dev)
+
+		if rec.Key != `` && rec.Key != key {
+			return nil, badRequest(fmt.Errorf(`record %d: key %q does not match snapshot key %q`, i, rec.Key, key))
+		}
+
+		rec.Key = key
+
+		if rec.HostName == `` {
+			rec.HostName = dev.Host()
+		}
+
+		if rec.Time.IsZero() {
+			rec.Time = time.Now()
+		}
+	}
+
+	if ikey := r.Header.Get(IdempotencyHeader); ikey != `` {
+
+		ikey = caller(r) + "\x00" + ikey
+		resp, v, err := this.audits.reserve(ikey, b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if v != nil {
+			return v.(*Accepted), nil
+		}
+
+		acc, err := this.appendAll(recs)
+
+		if err != nil {
+			this.audits.release(ikey, resp, nil)
+			return nil, err
+		}
+
+		this.audits.release(ikey, resp, acc)
+
+		return acc, nil
+	}
+
+	return this.appendAll(recs)
+}
+
+// appendAll appends audit records to the store.
+func (this *Server) appendAll(recs []*history.Record) (*Accepted, error) {
+
+	for _, rec := range recs {
+		if err := this.Store.Append(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Accepted{Accepted: len(recs)}, nil
+}
+
+// findSerial returns the devices with a serial number.
+func (this *Server) findSerial(sn string) ([]*Device, error) {
+
+	devs, err := this.Store.FindSerial(sn)
+
+	if devs == nil {
+		devs = []*Device{}
+	}
+
+	return devs, err
+}
+
+// checkIn records a host check-in.
+func (this *Server) checkIn(r *http.Request) (*CheckIn, error) {
+
+	b, err := readBody(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ci := new(CheckIn)
+
+	if err = json.Unmarshal(b, ci); err != nil {
+		return nil, badRequest(err)
+	}
+
+	if ci.HostName == `` {
+		return nil, badRequest(fmt.Errorf(`host_name is required`))
+	}
+
+	ci.Time = time.Now()
+
+	if ci.Address, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+		ci.Address = r.RemoteAddr
+	}
+
+	return ci, this.Store.CheckIn(ci)
+}
+
+// pools returns the serial number pools.
+func (this *Server) pools() ([]*Pool, error) {
+
+	if this.Allocator == nil {
+		return nil, errNoAllocator
+	}
+
+	pools := this.Allocator.Pools()
+
+	if pools == nil {
+		pools = []*Pool{}
+	}
+
+	return pools, nil
+}
+
+// reserve reserves a serial number from a pool for a device, skipping
+// serial numbers already reported by known devices.
+func (this *Server) reserve(r *http.Request, pool string) (int, *Allocation, error) {
+
+	req, err := this.allocationRequest(r)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	a, err := this.Allocator.Reserve(pool, req.Key, req.HostName, func(sn string) (bool, error) {
+		devs, err := this.Store.FindSerial(sn)
+		return len(devs) > 0, err
+	})
+
+	if err != nil {
+		return 0, nil, allocError(err)
+	}
+
+	return http.StatusCreated, a, nil
+}
+
+// allocation returns the allocation of a serial number.
+func (this *Server) allocation(sn string) (*Allocation, error) {
+
+	if this.Allocator == nil {
+		return nil, errNoAllocator
+	}
+
+	a, err := this.Allocator.Allocation(sn)
+
+	return a, allocError(err)
+}
+
+// confirm confirms a reserved serial number.
+func (this *Server) confirm(r *http.Request, sn string) (*Allocation, error) {
+
+	req, err := this.allocationRequest(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := this.Allocator.Confirm(sn, req.Key)
+
+	return a, allocError(err)
+}
+
+// release releases a reserved serial number.
+func (this *Server) release(r *http.Request, sn string) (*Allocation, error) {
+
+	req, err := this.allocationRequest(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := this.Allocator.Release(sn, req.Key)
+
+	return a, allocError(err)
+}
+
+// allocationRequest reads the body of an allocation request.
+func (this *Server) allocationRequest(r *http.Request) (*AllocationRequest, error) {
+
+	if this.Allocator == nil {
+		return nil, errNoAllocator
+	}
+
+	b, err := readBody(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(AllocationRequest)
+
+	if err = json.Unmarshal(b, req); err != nil {
+		return nil, badRequest(err)
+	}
+
+	if req.Key == `` {
+		return nil, badRequest(fmt.Errorf(`key is required`))
+	}
+
+	return req, nil
+}
+
+// authorize passes a request to the Authorize hook.
+func (this *Server) authorize(r *http.Request) (error) {
+
+	if this.Authorize == nil {
+		return nil
+	}
+
+	return this.Authorize(r)
+}
+
+// reply writes a JSON response.
+func (this *Server) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// fail writes a JSON error response.
+func (this *Server) fail(w http.ResponseWriter, status int, err error) {
+	this.reply(w, status, &Error{Error: err.Error()})
+}
+
+// readBody reads a request body of up to MaxBodySize bytes.
+func readBody(r *http.Request) ([]byte, error) {
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodySize + 1))
+
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	if int64(len(b)) > MaxBodySize {
+		return nil, &statusError{http.StatusRequestEntityTooLarge, fmt.Errorf(`request body exceeds %d bytes`, MaxBodySize)}
+	}
+
+	return b, nil
+}
+
+// badRequest wraps an error in a 400 Bad Request status.
+func badRequest(err error) (error) {
+	return &statusError{http.StatusBadRequest, err}
+}
+
+// allocError gives allocation errors their HTTP status.
+func allocError(err error) (error) {
+
+	switch err {
+	case nil:
+		return nil
+	case ErrPoolNotFound, ErrAllocationNotFound:
+		return &statusError{http.StatusNotFound, err}
+	case ErrPoolExhausted, ErrAllocationOwner, ErrAllocationState:
+		return &statusError{http.StatusConflict, err}
+	}
+
+	return err
+}
+
+// notFound returns a 404 Not Found error for a device key.
+func notFound(key string) (error) {
+	return &statusError{http.StatusNotFound, fmt.Errorf(`device %q: %v`, key, history.ErrNotFound)}
+}
@@ -0,0 +1,510 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`bytes`
+	`encoding/json`
+	`errors`
+	`io/ioutil`
+	`net/http`
+	`net/http/httptest`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/sqlstore`
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func newServer(t *testing.T) (*httptest.Server, string, func()) {
+
+	dir, err := ioutil.TempDir(``, `server`)
+	gotest.Ok(t, err)
+
+	hs, err := history.NewFileStore(filepath.Join(dir, `history`))
+	gotest.Ok(t, err)
+
+	s, err := NewHistoryStore(hs, filepath.Join(dir, `checkins.json`))
+	gotest.Ok(t, err)
+
+	ts := httptest.NewServer(New(s))
+
+	return ts, dir, func() { ts.Close(); os.RemoveAll(dir) }
+}
+
+func call(t *testing.T, method, url string, body []byte, v interface{}) (int) {
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	gotest.Ok(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	gotest.Ok(t, err)
+	defer resp.Body.Close()
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		gotest.Ok(t, err)
+	}
+
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+
+	ts, _, cleanup := newServer(t)
+	defer cleanup()
+
+	mag1 := testdevice.Magtek(t, `mag1`)
+
+	t.Run("register", func(t *testing.T) {
+
+		var regs []*Registration
+
+		status := call(t, `POST`, ts.URL + `/v1/devices`, testdata.Jsn(`mag1`), &regs)
+		gotest.Assert(t, status == http.StatusCreated, `new device should be created`)
+		gotest.Assert(t, len(regs) == 1 && regs[0].Created, `registration should report creation`)
+		gotest.Assert(t, regs[0].Key == mag1.Identity(), `registration key should be device identity`)
+
+		body := append(append([]byte(`[`), testdata.Jsn(`mag1`)...), append([]byte(`,`), append(testdata.Jsn(`gen1`), ']')...)...)
+
+		status = call(t, `POST`, ts.URL + `/v1/devices`, body, &regs)
+		gotest.Assert(t, status == http.StatusCreated, `array with new device should be created`)
+		gotest.Assert(t, len(regs) == 2 && !regs[0].Created && regs[1].Created,
+			`known device should not be created again`)
+
+		var e Error
+
+		status = call(t, `POST`, ts.URL + `/v1/devices`, []byte(`{"vendor_id": "0801"}`), &e)
+		gotest.Assert(t, status == http.StatusBadRequest && e.Error != ``, `report without type should be refused`)
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+
+		var snap json.RawMessage
+
+		status := call(t, `GET`, ts.URL + `/v1/devices/` + mag1.Identity(), nil, &snap)
+		gotest.Assert(t, status == http.StatusOK, `baseline should be found`)
+
+		ss, err := mag1.CompareJSON(snap)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 0, `baseline should match registered device`)
+
+		status = call(t, `GET`, ts.URL + `/v1/devices/unknown`, nil, nil)
+		gotest.Assert(t, status == http.StatusNotFound, `unknown device should not be found`)
+	})
+
+	t.Run("audit", func(t *testing.T) {
+
+		mag2 := testdevice.Magtek(t, `mag2`)
+
+		err := mag2.AuditJSON(testdata.Jsn(`mag1`))
+		gotest.Ok(t, err)
+
+		rec, err := history.NewRecord(mag2)
+		gotest.Ok(t, err)
+
+		b, err := json.Marshal([]*history.Record{rec})
+		gotest.Ok(t, err)
+
+		status := call(t, `POST`, ts.URL + `/v1/audits`, b, nil)
+		gotest.Assert(t, status == http.StatusOK, `audit should be accepted`)
+
+		var recs []*history.Record
+
+		status = call(t, `GET`, ts.URL + `/v1/devices/` + mag1.Identity() + `/history`, nil, &recs)
+		gotest.Assert(t, status == http.StatusOK, `history should be found`)
+		gotest.Assert(t, len(recs) == 2 && len(recs[1].Changes) == 2, `history should contain the audit`)
+
+		submit := func(b []byte, token string) (int) {
+
+			req, err := http.NewRequest(`POST`, ts.URL + `/v1/audits`, bytes.NewReader(b))
+			gotest.Ok(t, err)
+			req.Header.Set(IdempotencyHeader, `audit-1`)
+
+			if token != `` {
+				req.Header.Set(`Authorization`, `Bearer ` + token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			gotest.Ok(t, err)
+			resp.Body.Close()
+
+			return resp.StatusCode
+		}
+
+		b, _ = json.Marshal(rec)
+
+		for i := 0; i < 2; i++ {
+			gotest.Assert(t, submit(b, ``) == http.StatusOK, `audit with idempotency key should be accepted`)
+		}
+
+		status = call(t, `GET`, ts.URL + `/v1/devices/` + mag1.Identity() + `/history`, nil, &recs)
+		gotest.Assert(t, status == http.StatusOK && len(recs) == 3, `repeated idempotency key should be applied once`)
+
+		rec.HostName = `other-host`
+		b2, _ := json.Marshal(rec)
+
+		gotest.Assert(t, submit(b2, ``) == http.StatusUnprocessableEntity, `idempotency key reused with another body should be refused`)
+		gotest.Assert(t, submit(b, `other`) == http.StatusOK, `idempotency key of another caller should be accepted`)
+
+		status = call(t, `GET`, ts.URL + `/v1/devices/` + mag1.Identity() + `/history`, nil, &recs)
+		gotest.Assert(t, status == http.StatusOK && len(recs) == 4, `idempotency keys should be kept per caller`)
+
+		rec.Key = `forged`
+		b, _ = json.Marshal(rec)
+
+		status = call(t, `POST`, ts.URL + `/v1/audits`, b, nil)
+		gotest.Assert(t, status == http.StatusBadRequest, `record with wrong key should be refused`)
+	})
+
+	t.Run("serials", func(t *testing.T) {
+
+		var devs []*Device
+
+		status := call(t, `GET`, ts.URL + `/v1/serials/` + mag1.SerialNum, nil, &devs)
+		gotest.Assert(t, status == http.StatusOK, `serial lookup should succeed`)
+		gotest.Assert(t, len(devs) == 1 && devs[0].Key == mag1.Identity(), `serial should identify device`)
+
+		status = call(t, `GET`, ts.URL + `/v1/serials/NONE`, nil, &devs)
+		gotest.Assert(t, status == http.StatusOK && len(devs) == 0, `unknown serial should find nothing`)
+
+		status = call(t, `GET`, ts.URL + `/v1/devices`, nil, &devs)
+		gotest.Assert(t, status == http.StatusOK && len(devs) == 2, `all devices should be listed`)
+	})
+
+	t.Run("checkins", func(t *testing.T) {
+
+		var ci CheckIn
+
+		status := call(t, `POST`, ts.URL + `/v1/checkins`, []byte(`{"host_name": "register-1", "device_count": 2}`), &ci)
+		gotest.Assert(t, status == http.StatusOK, `check-in should succeed`)
+		gotest.Assert(t, !ci.Time.IsZero() && ci.Address != ``, `server should record time and address`)
+
+		status = call(t, `POST`, ts.URL + `/v1/checkins`, []byte(`{}`), nil)
+		gotest.Assert(t, status == http.StatusBadRequest, `check-in without host should be refused`)
+
+		var cis []*CheckIn
+
+		status = call(t, `GET`, ts.URL + `/v1/hosts`, nil, &cis)
+		gotest.Assert(t, status == http.StatusOK && len(cis) == 1, `host should be listed`)
+		gotest.Assert(t, cis[0].DeviceCount == 2, `check-in should keep device count`)
+	})
+}
+
+func TestHistoryStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `server`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	hs, err := history.NewFileStore(dir)
+	gotest.Ok(t, err)
+
+	fn := filepath.Join(dir, `checkins.json`)
+
+	s, err := NewHistoryStore(hs, fn)
+	gotest.Ok(t, err)
+
+	err = s.CheckIn(&CheckIn{HostName: `b`})
+	gotest.Ok(t, err)
+	err = s.CheckIn(&CheckIn{HostName: `a`})
+	gotest.Ok(t, err)
+
+	s, err = NewHistoryStore(hs, fn)
+	gotest.Ok(t, err)
+
+	cis, err := s.CheckIns()
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(cis) == 2 && cis[0].HostName == `a`, `check-ins should persist, sorted by host`)
+}
+
+func TestFindSerial(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `server`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := history.NewFileStore(filepath.Join(dir, `history`))
+	gotest.Ok(t, err)
+
+	repo, err := sqlstore.Open(filepath.Join(dir, `cmdb.db`))
+	gotest.Ok(t, err)
+	defer repo.Close()
+
+	for name, hs := range map[string]history.Store{`file`: fs, `sql`: repo} {
+
+		t.Run(name, func(t *testing.T) {
+
+			s, err := NewHistoryStore(hs, ``)
+			gotest.Ok(t, err)
+
+			mag := testdevice.Magtek(t, `mag1`)
+
+			rec, err := history.NewRecord(mag)
+			gotest.Ok(t, err)
+			err = s.Append(rec)
+			gotest.Ok(t, err)
+
+			sn := mag.SerialNum
+
+			devs, err := s.FindSerial(sn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(devs) == 1 && devs[0].Key == mag.Identity(), `serial should identify device`)
+
+			mag.SerialNum = `NEW0001`
+
+			rec, err = history.NewRecord(mag)
+			gotest.Ok(t, err)
+			err = s.Append(rec)
+			gotest.Ok(t, err)
+
+			devs, err = s.FindSerial(sn)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(devs) == 0, `old serial should no longer be found`)
+
+			devs, err = s.FindSerial(`NEW0001`)
+			gotest.Ok(t, err)
+			gotest.Assert(t, len(devs) == 1 && devs[0].SerialNum == `NEW0001`, `new serial should be found`)
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+
+	var id idempotency
+
+	a, v, err := id.reserve(`a`, []byte(`1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, a != nil && v == nil, `first submission should reserve its key`)
+
+	b, _, err := id.reserve(`b`, []byte(`1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, b != nil, `submission with another key should not wait`)
+	id.release(`b`, b, &Accepted{Accepted: 1})
+
+	_, _, err = id.reserve(`a`, []byte(`2`))
+	gotest.Assert(t, err == errKeyReused, `key reused with another body should be refused`)
+
+	done := make(chan interface{})
+
+	go func() {
+		_, v, _ := id.reserve(`a`, []byte(`1`))
+		done <- v
+	}()
+
+	acc := &Accepted{Accepted: 2}
+	id.release(`a`, a, acc)
+	gotest.Assert(t, <-done == acc, `retry should wait for and get the first response`)
+}
+
+func TestAuthorize(t *testing.T) {
+
+	ts, dir, cleanup := newServer(t)
+	defer cleanup()
+
+	fn := filepath.Join(dir, `tokens`)
+	err := ioutil.WriteFile(fn, []byte("# agents\nsecret\n\n"), 0600)
+	gotest.Ok(t, err)
+
+	tokens, err := LoadTokens(fn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, len(tokens) == 1 && tokens[0] == `secret`, `comments and blank lines should be ignored`)
+
+	ts.Config.Handler.(*Server).Authorize = BearerTokens(tokens...)
+
+	send := func(method, path string, body []byte, token string) (int) {
+
+		req, err := http.NewRequest(method, ts.URL + path, bytes.NewReader(body))
+		gotest.Ok(t, err)
+
+		if token != `` {
+			req.Header.Set(`Authorization`, `Bearer ` + token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		gotest.Ok(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	post := func(token string) (int) {
+		return send(`POST`, `/v1/checkins`, []byte(`{"host_name": "h"}`), token)
+	}
+
+	gotest.Assert(t, post(``) == http.StatusUnauthorized, `change without token should be refused`)
+	gotest.Assert(t, post(`wrong`) == http.StatusUnauthorized, `change with wrong token should be refused`)
+	gotest.Assert(t, post(`secret`) == http.StatusOK, `change with token should be accepted`)
+
+	for _, path := range []string{`/v1/devices`, `/v1/devices/unknown/history`, `/v1/serials/24FFFFF`, `/v1/hosts`} {
+		gotest.Assert(t, send(`GET`, path, nil, ``) == http.StatusUnauthorized, `query of %s without token should be refused`, path)
+		gotest.Assert(t, send(`GET`, path, nil, `secret`) != http.StatusUnauthorized, `query of %s with token should be accepted`, path)
+	}
+
+	req := httptest.NewRequest(`POST`, `/v1/checkins`, nil)
+	gotest.Assert(t, ClientCert(req) != nil, `request without TLS should have no client certificate`)
+	gotest.Assert(t, AnyOf(ClientCert, BearerTokens(`x`))(req) != nil, `no authorizer should accept the request`)
+
+	req.Header.Set(`Authorization`, `Bearer x`)
+	gotest.Assert(t, AnyOf(ClientCert, BearerTokens(`x`))(req) == nil, `either authorizer should accept the request`)
+}
+
+func TestAllocator(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `server`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, `allocations.json`)
+
+	_, err = NewAllocator(fn, &Pool{Name: `bad`, Format: `S%s%d`})
+	gotest.Assert(t, err != nil, `format with two verbs should be refused`)
+
+	a, err := NewAllocator(fn, &Pool{Name: `store`, Format: `S%06d`, Next: 1, Last: 4})
+	gotest.Ok(t, err)
+
+	inUse := func(sn string) (bool, error) { return sn == `S000002`, nil }
+
+	_, err = a.Reserve(`store`, `dev1`, `host`, func(string) (bool, error) { return false, errors.New(`offline`) })
+	gotest.Assert(t, err != nil && err.Error() == `offline`, `lookup error should end the reservation`)
+
+	r1, err := a.Reserve(`store`, `dev1`, `host`, inUse)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r1.Serial == `S000001` && r1.State == StateReserved, `first serial should be reserved`)
+
+	r, err := a.Reserve(`store`, `dev1`, `host`, inUse)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r.Serial == r1.Serial, `repeated reservation should return the same serial`)
+
+	r2, err := a.Reserve(`store`, `dev2`, `host`, inUse)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r2.Serial == `S000003`, `serial in use should be skipped`)
+
+	_, err = a.Confirm(r2.Serial, `dev1`)
+	gotest.Assert(t, err == ErrAllocationOwner, `other device should not confirm`)
+
+	r, err = a.Confirm(r1.Serial, `dev1`)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r.State == StateConfirmed && !r.Confirmed.IsZero(), `reservation should be confirmed`)
+
+	_, err = a.Release(r1.Serial, `dev1`)
+	gotest.Assert(t, err == ErrAllocationState, `confirmed serial should not be released`)
+
+	_, err = a.Release(r2.Serial, `dev2`)
+	gotest.Ok(t, err)
+
+	a, err = NewAllocator(fn)
+	gotest.Ok(t, err)
+
+	r, err = a.Reserve(`store`, `dev2`, `host`, nil)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r.Serial == `S000004`, `released serial should not be reused after restart`)
+
+	a.TTL = -time.Second
+
+	_, err = a.Reserve(`store`, `dev3`, `host`, nil)
+	gotest.Assert(t, err == ErrPoolExhausted, `pool should be exhausted after last serial`)
+
+	r, err = a.Allocation(`S000004`)
+	gotest.Ok(t, err)
+	gotest.Assert(t, r.State == StateReserved, `reservation should not expire before its TTL`)
+
+	_, err = a.Reserve(`other`, `dev1`, `host`, nil)
+	gotest.Assert(t, err == ErrPoolNotFound, `unknown pool should be an error`)
+
+	a, err = NewAllocator(fn, &Pool{Name: `short`, Format: `T%06d`, Next: 1})
+	gotest.Ok(t, err)
+	a.TTL = -time.Second
+
+	r, err = a.Reserve(`short`, `dev1`, `host`, nil)
+	gotest.Ok(t, err)
+
+	_, err = a.Allocation(r.Serial)
+	gotest.Ok(t, err)
+
+	b, err := ioutil.ReadFile(fn)
+	gotest.Ok(t, err)
+
+	var state allocState
+	gotest.Ok(t, json.Unmarshal(b, &state))
+	gotest.Assert(t, state.Allocations[r.Serial].State == StateReleased, `expired reservation should be saved as released`)
+}
+
+func TestAllocationAPI(t *testing.T) {
+
+	ts, dir, cleanup := newServer(t)
+	defer cleanup()
+
+	var e Error
+
+	status := call(t, `GET`, ts.URL + `/v1/pools`, nil, &e)
+	gotest.Assert(t, status == http.StatusNotFound, `allocation should require an allocator`)
+
+	alloc, err := NewAllocator(filepath.Join(dir, `allocations.json`), &Pool{Name: `store`, Format: `24%05d`, Next: 0})
+	gotest.Ok(t, err)
+
+	ts.Config.Handler.(*Server).Allocator = alloc
+
+	status = call(t, `POST`, ts.URL + `/v1/devices`, testdata.Jsn(`mag1`), nil)
+	gotest.Assert(t, status == http.StatusCreated, `device should be registered`)
+
+	var a Allocation
+
+	status = call(t, `POST`, ts.URL + `/v1/pools/store/allocations`, []byte(`{"key": "k1"}`), &a)
+	gotest.Assert(t, status == http.StatusCreated, `serial should be reserved`)
+	gotest.Assert(t, a.Serial == `2400000`, `first serial should be reserved`)
+
+	status = call(t, `POST`, ts.URL + `/v1/pools/store/allocations`, []byte(`{}`), &e)
+	gotest.Assert(t, status == http.StatusBadRequest, `reservation without key should be refused`)
+
+	status = call(t, `POST`, ts.URL + `/v1/allocations/2400000/confirm`, []byte(`{"key": "k2"}`), &e)
+	gotest.Assert(t, status == http.StatusConflict, `other device should not confirm`)
+
+	status = call(t, `POST`, ts.URL + `/v1/allocations/2400000/confirm`, []byte(`{"key": "k1"}`), &a)
+	gotest.Assert(t, status == http.StatusOK && a.State == StateConfirmed, `owner should confirm`)
+
+	status = call(t, `GET`, ts.URL + `/v1/allocations/2400001`, nil, &e)
+	gotest.Assert(t, status == http.StatusNotFound, `unallocated serial should not be found`)
+
+	ts.Config.Handler.(*Server).Authorize = BearerTokens(`secret`)
+
+	status = call(t, `POST`, ts.URL + `/v1/pools/store/allocations`, []byte(`{"key": "k3"}`), &e)
+	gotest.Assert(t, status == http.StatusUnauthorized, `reservation should require authorization`)
+
+	status = call(t, `POST`, ts.URL + `/v1/allocations/2400000/confirm`, []byte(`{"key": "k1"}`), &e)
+	gotest.Assert(t, status == http.StatusUnauthorized, `confirmation should require authorization`)
+
+	status = call(t, `POST`, ts.URL + `/v1/allocations/2400000/release`, []byte(`{"key": "k1"}`), &e)
+	gotest.Assert(t, status == http.StatusUnauthorized, `release should require authorization`)
+
+	status = call(t, `GET`, ts.URL + `/v1/allocations/2400000`, nil, &e)
+	gotest.Assert(t, status == http.StatusUnauthorized, `allocation queries should require authorization`)
+
+	req, err := http.NewRequest(`GET`, ts.URL + `/v1/allocations/2400000`, nil)
+	gotest.Ok(t, err)
+	req.Header.Set(`Authorization`, `Bearer secret`)
+
+	resp, err := http.DefaultClient.Do(req)
+	gotest.Ok(t, err)
+	defer resp.Body.Close()
+
+	gotest.Ok(t, json.NewDecoder(resp.Body).Decode(&a))
+	gotest.Assert(t, resp.StatusCode == http.StatusOK && a.State == StateConfirmed, `authorized allocation query should be answered`)
+}
@@ -0,0 +1,303 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`encoding/json`
+	`io/ioutil`
+	`os`
+	`sort`
+	`sync`
+	`time`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/sqlstore`
+)
+
+// CheckIn is the most recent contact from a host.
+type CheckIn struct {
+	HostName     string		`json:"host_name"`
+	AgentVersion string		`json:"agent_version,omitempty"`
+	OSName       string		`json:"os_name,omitempty"`
+	OSArch       string		`json:"os_arch,omitempty"`
+	DeviceCount  int		`json:"device_count"`
+	Address      string		`json:"address,omitempty"`
+	Time         time.Time		`json:"time"`
+}
+
+// Device summarizes the latest known state of a registered device.
+type Device struct {
+	Key        string		`json:"key"`
+	HostName   string		`json:"host_name"`
+	VendorID   string		`json:"vendor_id"`
+	ProductID  string		`json:"product_id"`
+	SerialNum  string		`json:"serial_number"`
+	ObjectType string		`json:"object_type"`
+	LastSeen   time.Time		`json:"last_seen"`
+}
+
+// Store is implemented by server backends. Devices are kept with the
+// history.Store methods, so any history backend can hold them, and host
+// check-ins with CheckIn and CheckIns.
+type Store interface {
+	history.Store
+
+	// FindSerial returns the summaries of all devices whose latest
+	// snapshot reports the given serial number.
+	FindSerial(sn string) ([]*Device, error)
+
+	// CheckIn records the latest contact from a host.
+	CheckIn(*CheckIn) (error)
+
+	// CheckIns returns the latest contact from every host, by host name.
+	CheckIns() ([]*CheckIn, error)
+}
+
+// HistoryStore is a Store that keeps devices in a history.Store, such as a
+// history.FileStore or an sqlstore.Repo, and check-ins in a JSON file.
+// Serial numbers are looked up with the index of an sqlstore.Repo; for
+// other backends HistoryStore builds an index in memory on the first lookup
+// and keeps it current as records are appended.
+type HistoryStore struct {
+	history.Store
+	fn string
+	checkIns map[string]*CheckIn
+	serials map[string]map[string]bool
+	keySerial map[string]string
+	mutex sync.Mutex
+	indexMutex sync.Mutex
+}
+
+// NewHistoryStore instantiates a HistoryStore. Check-ins are kept only in
+// memory if fn is empty.
+func NewHistoryStore(hs history.Store, fn string) (*HistoryStore, error) {
+
+	this := &HistoryStore{Store: hs, fn: fn, checkIns: make(map[string]*CheckIn)}
+
+	if fn == `` {
+		return this, nil
+	}
+
+	b, err := ioutil.ReadFile(fn)
+
+	if os.IsNotExist(err) {
+		return this, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return this, json.Unmarshal(b, &this.checkIns)
+}
+
+// CheckIn records the latest contact from a host.
+func (this *HistoryStore) CheckIn(ci *CheckIn) (error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.checkIns[ci.HostName] = ci
+
+	if this.fn == `` {
+		return nil
+	}
+
+	b, err := json.Marshal(this.checkIns)
+
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(this.fn + `.tmp`, b, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(this.fn + `.tmp`, this.fn)
+}
+
+// CheckIns returns the latest contact from every host, by host name.
+func (this *HistoryStore) CheckIns() (cis []*CheckIn, err error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, ci := range this.checkIns {
+		cis = append(cis, ci)
+	}
+
+	sort.Slice(cis, func(i, j int) (bool) {
+		return cis[i].HostName < cis[j].HostName
+	})
+
+	return cis, nil
+}
+
+// Devices returns the summaries of all devices in a store.
+func Devices(s Store) (devs []*Device, err error) {
+
+	keys, err := s.Keys()
+
+	if err != nil {
+		return devs, err
+	}
+
+	for _, key := range keys {
+
+		dev, err := Summary(s, key)
+
+		if err != nil {
+			return devs, err
+		}
+
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
+
+// Append appends a record to the underlying store and updates the serial
+// number index.
+func (this *HistoryStore) Append(rec *history.Record) (error) {
+
+	this.indexMutex.Lock()
+	defer this.indexMutex.Unlock()
+
+	if err := this.Store.Append(rec); err != nil {
+		return err
+	}
+
+	if this.serials != nil {
+
+		dev := new(Device)
+
+		if err := json.Unmarshal(rec.Snapshot, dev); err != nil {
+			this.serials, this.keySerial = nil, nil
+			return nil
+		}
+
+		this.index(rec.Key, dev.SerialNum)
+	}
+
+	return nil
+}
+
+// FindSerial returns the summaries of all devices whose latest snapshot
+// reports the given serial number.
+func (this *HistoryStore) FindSerial(sn string) (devs []*Device, err error) {
+
+	if repo, ok := this.Store.(*sqlstore.Repo); ok {
+		return findBySerial(repo, sn)
+	}
+
+	this.indexMutex.Lock()
+	defer this.indexMutex.Unlock()
+
+	if this.serials == nil {
+
+		all, err := Devices(this)
+
+		if err != nil {
+			return devs, err
+		}
+
+		this.serials = make(map[string]map[string]bool)
+		this.keySerial = make(map[string]string)
+
+		for _, dev := range all {
+			this.index(dev.Key, dev.SerialNum)
+		}
+	}
+
+	var keys []string
+
+	for key := range this.serials[sn] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		dev, err := Summary(this, key)
+
+		if err != nil {
+			return devs, err
+		}
+
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
+
+// index records the latest serial number of a device.
+func (this *HistoryStore) index(key, sn string) {
+
+	if old, ok := this.keySerial[key]; ok {
+		delete(this.serials[old], key)
+	}
+
+	if this.serials[sn] == nil {
+		this.serials[sn] = make(map[string]bool)
+	}
+
+	this.serials[sn][key] = true
+	this.keySerial[key] = sn
+}
+
+// findBySerial looks up a serial number with the index of a repository.
+func findBySerial(repo *sqlstore.Repo, sn string) (devs []*Device, err error) {
+
+	dis, err := repo.FindBySerial(sn)
+
+	if err != nil {
+		return devs, err
+	}
+
+	for _, di := range dis {
+		devs = append(devs, &Device{
+			Key: di.Key,
+			HostName: di.LastHost,
+			VendorID: di.VendorID,
+			ProductID: di.ProductID,
+			SerialNum: di.SerialNum,
+			ObjectType: di.ObjectType,
+			LastSeen: di.LastSeen,
+		})
+	}
+
+	return devs, nil
+}
+
+// Summary returns the summary of a device from its latest snapshot.
+func Summary(s Store, key string) (*Device, error) {
+
+	rec, err := history.Latest(s, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dev := &Device{Key: key, HostName: rec.HostName, LastSeen: rec.Time}
+
+	if err = json.Unmarshal(rec.Snapshot, dev); err != nil {
+		return nil, err
+	}
+
+	dev.Key, dev.HostName = key, rec.HostName
+
+	return dev, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	`crypto/ed25519`
+	`crypto/rand`
+	`crypto/x509`
+	`encoding/pem`
+	`fmt`
+	`io/ioutil`
+)
+
+const (
+	PrivateKeyType string = `PRIVATE KEY`
+	PublicKeyType string = `PUBLIC KEY`
+)
+
+// GenerateKeys creates a new key pair and writes the private key to one PEM
+// file, readable only by its owner, and the public key to another.
+func GenerateKeys(privFn, pubFn string) (error) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+
+	if err != nil {
+		return err
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+
+	if err != nil {
+		return err
+	}
+
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: PrivateKeyType, Bytes: privDER})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: PublicKeyType, Bytes: pubDER})
+
+	if err = ioutil.WriteFile(privFn, privPEM, 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(pubFn, pubPEM, 0644)
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PKCS #8 PEM file.
+func LoadPrivateKey(fn string) (ed25519.PrivateKey, error) {
+
+	der, err := readPEM(fn, PrivateKeyType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	if priv, ok := key.(ed25519.PrivateKey); ok {
+		return priv, nil
+	}
+
+	return nil, fmt.Errorf(`%s: not an Ed25519 private key`, fn)
+}
+
+// LoadPublicKey reads an Ed25519 public key from a PKIX PEM file.
+func LoadPublicKey(fn string) (ed25519.PublicKey, error) {
+
+	der, err := readPEM(fn, PublicKeyType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	if pub, ok := key.(ed25519.PublicKey); ok {
+		return pub, nil
+	}
+
+	return nil, fmt.Errorf(`%s: not an Ed25519 public key`, fn)
+}
+
+// readPEM reads the first PEM block of the given type from a file.
+func readPEM(fn, typ string) ([]byte, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+
+		if block, b = pem.Decode(b); block == nil {
+			return nil, fmt.Errorf(`%s: no %s block found`, fn, typ)
+		}
+
+		if block.Type == typ {
+			return block.Bytes, nil
+		}
+	}
+}
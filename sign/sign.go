@@ -0,0 +1,180 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sign creates and verifies detached Ed25519 signatures of reports
+// and snapshot files so that alterations in transit can be detected. A
+// signature is stored beside the file it signs, in a file with the same
+// name plus SignatureExt, as a single line of base64 text.
+package sign
+
+import (
+	`bytes`
+	`crypto/ed25519`
+	`encoding/base64`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+)
+
+const (
+	SignatureExt string = `.sig`
+)
+
+var (
+	ErrUnsigned = errors.New(`no signature`)
+	ErrInvalidSignature = errors.New(`invalid signature`)
+)
+
+// Signer signs reports with an Ed25519 private key.
+type Signer struct {
+	Key ed25519.PrivateKey
+}
+
+// Verifier verifies signatures with any of a set of Ed25519 public keys,
+// so that keys can be rotated. If Require is set, unsigned files are
+// refused; otherwise only invalid signatures are.
+type Verifier struct {
+	Keys    []ed25519.PublicKey
+	Require bool
+}
+
+// NewSigner instantiates a Signer with the private key in a PEM file.
+func NewSigner(fn string) (*Signer, error) {
+
+	key, err := LoadPrivateKey(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{Key: key}, nil
+}
+
+// NewVerifier instantiates a Verifier with the public keys in PEM files.
+func NewVerifier(require bool, fns ...string) (*Verifier, error) {
+
+	this := &Verifier{Require: require}
+
+	for _, fn := range fns {
+
+		key, err := LoadPublicKey(fn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		this.Keys = append(this.Keys, key)
+	}
+
+	if len(this.Keys) == 0 {
+		return nil, fmt.Errorf(`no public keys`)
+	}
+
+	return this, nil
+}
+
+// Sign returns the detached signature of a payload in base64 text form.
+func (this *Signer) Sign(b []byte) ([]byte) {
+
+	sig := ed25519.Sign(this.Key, b)
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(sig)))
+	base64.StdEncoding.Encode(enc, sig)
+
+	return append(enc, '\n')
+}
+
+// SignReport calls a report method, such as the JSON or XML method of a
+// Reportable object, and returns the report with its detached signature.
+func (this *Signer) SignReport(report func() ([]byte, error)) (b, sig []byte, err error) {
+
+	if b, err = report(); err != nil {
+		return nil, nil, err
+	}
+
+	return b, this.Sign(b), nil
+}
+
+// SignFile writes the detached signature of a file beside it.
+func (this *Signer) SignFile(fn string) (error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn + SignatureExt, this.Sign(b), 0640)
+}
+
+// WriteFile writes a payload to a file and its detached signature beside it.
+func (this *Signer) WriteFile(fn string, b []byte, perm os.FileMode) (error) {
+
+	if err := ioutil.WriteFile(fn, b, perm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn + SignatureExt, this.Sign(b), perm)
+}
+
+// Verify checks a detached signature in base64 text form against a payload.
+// It returns ErrUnsigned if the signature is empty and ErrInvalidSignature
+// if no key verifies it.
+func (this *Verifier) Verify(b, sig []byte) (error) {
+
+	sig = bytes.TrimSpace(sig)
+
+	if len(sig) == 0 {
+		return ErrUnsigned
+	}
+
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(sig)))
+	n, err := base64.StdEncoding.Decode(raw, sig)
+
+	if err != nil || n != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	for _, key := range this.Keys {
+		if ed25519.Verify(key, b, raw[:n]) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// VerifyFile checks the contents of a file, already read by the caller,
+// against the detached signature beside it. A missing signature is an
+// error only if the Verifier requires signatures.
+func (this *Verifier) VerifyFile(fn string, b []byte) (error) {
+
+	sig, err := ioutil.ReadFile(fn + SignatureExt)
+
+	if os.IsNotExist(err) {
+		sig, err = nil, nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = this.Verify(b, sig); err == ErrUnsigned && !this.Require {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return nil
+}
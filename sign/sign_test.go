@@ -0,0 +1,111 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	`bytes`
+	`os`
+	`path/filepath`
+	`testing`
+
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gotest`
+)
+
+func report(k string) (func() ([]byte, error)) {
+	return func() ([]byte, error) {
+		return testdata.Jsn(k), nil
+	}
+}
+
+func newKeys(t *testing.T, name string) (privFn, pubFn string) {
+
+	privFn = filepath.Join(os.Getenv(`TEMP`), name + `.key`)
+	pubFn = filepath.Join(os.Getenv(`TEMP`), name + `.pub`)
+
+	gotest.Ok(t, GenerateKeys(privFn, pubFn))
+
+	return privFn, pubFn
+}
+
+func TestKeys(t *testing.T) {
+
+	privFn, pubFn := newKeys(t, `keys`)
+
+	_, err := LoadPrivateKey(privFn)
+	gotest.Ok(t, err)
+
+	_, err = LoadPublicKey(pubFn)
+	gotest.Ok(t, err)
+
+	_, err = LoadPublicKey(privFn)
+	gotest.Assert(t, err != nil, `private key file should not load as a public key`)
+
+	fi, err := os.Stat(privFn)
+	gotest.Ok(t, err)
+	gotest.Assert(t, fi.Mode().Perm() == 0600, `private key file should be readable only by its owner`)
+}
+
+func TestSignReport(t *testing.T) {
+
+	privFn, pubFn := newKeys(t, `report`)
+	_, otherFn := newKeys(t, `other`)
+
+	s, err := NewSigner(privFn)
+	gotest.Ok(t, err)
+
+	v, err := NewVerifier(false, otherFn, pubFn)
+	gotest.Ok(t, err)
+
+	for _, k := range []string{`mag1`, `mag2`, `gen1`, `gen2`} {
+
+		b, sig, err := s.SignReport(report(k))
+		gotest.Ok(t, err)
+		gotest.Ok(t, v.Verify(b, sig))
+
+		b = bytes.Replace(b, []byte(`"host_name"`), []byte(`"hostname"`), 1)
+		gotest.Assert(t, v.Verify(b, sig) == ErrInvalidSignature, `altered report should not verify`)
+	}
+
+	v, err = NewVerifier(false, otherFn)
+	gotest.Ok(t, err)
+
+	b, sig, err := s.SignReport(report(`mag1`))
+	gotest.Ok(t, err)
+	gotest.Assert(t, v.Verify(b, sig) == ErrInvalidSignature, `report signed with unknown key should not verify`)
+	gotest.Assert(t, v.Verify(b, nil) == ErrUnsigned, `empty signature should be reported as unsigned`)
+}
+
+func TestVerifyFile(t *testing.T) {
+
+	privFn, pubFn := newKeys(t, `file`)
+
+	s, err := NewSigner(privFn)
+	gotest.Ok(t, err)
+
+	j := testdata.Jsn(`mag1`)
+	fn := filepath.Join(os.Getenv(`TEMP`), `signed.json`)
+	gotest.Ok(t, s.WriteFile(fn, j, 0640))
+
+	v, err := NewVerifier(true, pubFn)
+	gotest.Ok(t, err)
+	gotest.Ok(t, v.VerifyFile(fn, j))
+
+	gotest.Ok(t, os.Remove(fn + SignatureExt))
+	gotest.Assert(t, v.VerifyFile(fn, j) != nil, `unsigned file should be refused when signatures are required`)
+
+	v.Require = false
+	gotest.Ok(t, v.VerifyFile(fn, j))
+}
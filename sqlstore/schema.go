@@ -0,0 +1,196 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlstore
+
+import (
+	`database/sql`
+	`fmt`
+)
+
+// Migrations holds the schema changes applied by Open, in order. The schema
+// version of a database is the number of migrations applied to it and is
+// kept in the SQLite user_version pragma. Append new migrations; never edit
+// or reorder existing ones.
+var Migrations = [][]string{
+
+	// Version 1: hosts, devices, snapshots and changes.
+	[]string{
+		`CREATE TABLE hosts (
+			id INTEGER PRIMARY KEY,
+			host_name TEXT NOT NULL UNIQUE,
+			first_seen TEXT NOT NULL,
+			last_seen TEXT NOT NULL
+		)`,
+		`CREATE TABLE devices (
+			id INTEGER PRIMARY KEY,
+			device_key TEXT NOT NULL UNIQUE,
+			vendor_id TEXT NOT NULL,
+			product_id TEXT NOT NULL,
+			serial_number TEXT NOT NULL,
+			object_type TEXT NOT NULL,
+			first_seen TEXT NOT NULL,
+			last_seen TEXT NOT NULL,
+			last_host_id INTEGER NOT NULL REFERENCES hosts(id)
+		)`,
+		`CREATE TABLE snapshots (
+			id INTEGER PRIMARY KEY,
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			host_id INTEGER NOT NULL REFERENCES hosts(id),
+			taken_at TEXT NOT NULL,
+			snapshot TEXT NOT NULL
+		)`,
+		`CREATE TABLE changes (
+			id INTEGER PRIMARY KEY,
+			snapshot_id INTEGER NOT NULL REFERENCES snapshots(id),
+			field_name TEXT NOT NULL,
+			old_value TEXT NOT NULL,
+			new_value TEXT NOT NULL
+		)`,
+		`CREATE INDEX devices_serial_number ON devices(serial_number)`,
+		`CREATE INDEX snapshots_device_id ON snapshots(device_id, taken_at)`,
+		`CREATE INDEX changes_snapshot_id ON changes(snapshot_id)`,
+		`CREATE INDEX changes_field_name ON changes(field_name)`,
+	},
+}
+
+// SchemaVersion returns the schema version of the database.
+func (this *Repo) SchemaVersion() (int, error) {
+	return schemaVersion(this.db)
+}
+
+// migrate applies all migrations newer than the schema version of the
+// database, each in its own transaction.
+func migrate(db *sql.DB) (error) {
+
+	ver, err := schemaVersion(db)
+
+	if err != nil {
+		return err
+	}
+
+	if ver > len(Migrations) {
+		return fmt.Errorf(`database schema version %d is newer than supported version %d`,
+			ver, len(Migrations))
+	}
+
+	for ; ver < len(Migrations); ver++ {
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range Migrations[ver] {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf(`migration %d: %v`, ver+1, err)
+			}
+		}
+
+		if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, ver+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaVersion reads the schema version from the user_version pragma.
+func schemaVersion(db *sql.DB) (ver int, err error) {
+	err = db.QueryRow(`PRAGMA user_version`).Scan(&ver)
+	return ver, err
+}
+
+const (
+
+	sqlUpsertHost = `
+		INSERT INTO hosts (host_name, first_seen, last_seen)
+		VALUES (?1, ?2, ?2)
+		ON CONFLICT (host_name) DO UPDATE SET
+			first_seen = min(first_seen, excluded.first_seen),
+			last_seen = max(last_seen, excluded.last_seen)`
+
+	sqlSelectHostID = `
+		SELECT id FROM hosts WHERE host_name = ?`
+
+	sqlUpsertDevice = `
+		INSERT INTO devices (device_key, vendor_id, product_id, serial_number,
+			object_type, first_seen, last_seen, last_host_id)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?6, ?7)
+		ON CONFLICT (device_key) DO UPDATE SET
+			vendor_id = CASE WHEN excluded.last_seen >= last_seen
+				THEN excluded.vendor_id ELSE vendor_id END,
+			product_id = CASE WHEN excluded.last_seen >= last_seen
+				THEN excluded.product_id ELSE product_id END,
+			serial_number = CASE WHEN excluded.last_seen >= last_seen
+				THEN excluded.serial_number ELSE serial_number END,
+			object_type = CASE WHEN excluded.last_seen >= last_seen
+				THEN excluded.object_type ELSE object_type END,
+			last_host_id = CASE WHEN excluded.last_seen >= last_seen
+				THEN excluded.last_host_id ELSE last_host_id END,
+			first_seen = min(first_seen, excluded.first_seen),
+			last_seen = max(last_seen, excluded.last_seen)`
+
+	sqlSelectDeviceID = `
+		SELECT id FROM devices WHERE device_key = ?`
+
+	sqlInsertSnapshot = `
+		INSERT INTO snapshots (device_id, host_id, taken_at, snapshot)
+		VALUES (?, ?, ?, ?)`
+
+	sqlInsertChange = `
+		INSERT INTO changes (snapshot_id, field_name, old_value, new_value)
+		VALUES (?, ?, ?, ?)`
+
+	sqlSelectSnapshots = `
+		SELECT s.id, h.host_name, s.taken_at, s.snapshot
+		FROM snapshots s
+		JOIN devices d ON d.id = s.device_id
+		JOIN hosts h ON h.id = s.host_id
+		WHERE d.device_key = ?
+		ORDER BY s.taken_at, s.id`
+
+	sqlSelectChanges = `
+		SELECT field_name, old_value, new_value
+		FROM changes WHERE snapshot_id = ?
+		ORDER BY id`
+
+	sqlSelectKeys = `
+		SELECT device_key FROM devices ORDER BY device_key`
+
+	sqlSelectDevices = `
+		SELECT d.device_key, d.vendor_id, d.product_id, d.serial_number,
+			d.object_type, d.first_seen, d.last_seen, h.host_name
+		FROM devices d
+		JOIN hosts h ON h.id = d.last_host_id
+		ORDER BY d.device_key`
+
+	sqlSelectDevicesBySerial = `
+		SELECT d.device_key, d.vendor_id, d.product_id, d.serial_number,
+			d.object_type, d.first_seen, d.last_seen, h.host_name
+		FROM devices d
+		JOIN hosts h ON h.id = d.last_host_id
+		WHERE d.serial_number = ?
+		ORDER BY d.device_key`
+
+	sqlSelectHosts = `
+		SELECT host_name FROM hosts ORDER BY host_name`
+)
@@ -0,0 +1,399 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlstore persists device inventory and audit history in an
+// embedded SQLite database. It uses a pure-Go driver and does not require
+// cgo.
+package sqlstore
+
+import (
+	`database/sql`
+	`encoding/json`
+	`time`
+
+	`github.com/jscherff/gocmdb`
+	`github.com/jscherff/gocmdb/history`
+	_ `modernc.org/sqlite`
+)
+
+const (
+	DriverName string = `sqlite`
+	TimeFormat string = `2006-01-02T15:04:05.000000000Z07:00`
+)
+
+// Repo is a device repository backed by a SQLite database. It implements
+// history.Store, so it can be used wherever a file-based history is used.
+type Repo struct {
+	db *sql.DB
+}
+
+// DeviceInfo summarizes a device known to the repository.
+type DeviceInfo struct {
+	Key        string		`json:"key"`
+	VendorID   string		`json:"vendor_id"`
+	ProductID  string		`json:"product_id"`
+	SerialNum  string		`json:"serial_number"`
+	ObjectType string		`json:"object_type"`
+	FirstSeen  time.Time		`json:"first_seen"`
+	LastSeen   time.Time		`json:"last_seen"`
+	LastHost   string		`json:"last_host"`
+}
+
+// Open opens or creates the database named by dsn and applies any pending
+// schema migrations.
+func Open(dsn string) (*Repo, error) {
+
+	db, err := sql.Open(DriverName, dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(`PRAGMA foreign_keys = ON`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Repo{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (this *Repo) Close() (error) {
+	return this.db.Close()
+}
+
+// Save records the current state of a device as its newest snapshot,
+// analogous to saving it to a JSON file.
+func (this *Repo) Save(dev gocmdb.Auditable) (error) {
+
+	rec, err := history.NewRecord(dev)
+
+	if err != nil {
+		return err
+	}
+
+	return this.Append(rec)
+}
+
+// Restore restores a device from its newest snapshot, analogous to
+// restoring it from a JSON file.
+func (this *Repo) Restore(key string, dev gocmdb.Comparable) (error) {
+
+	rec, err := history.Latest(this, key)
+
+	if err != nil {
+		return err
+	}
+
+	return dev.RestoreJSON(rec.Snapshot)
+}
+
+// Compare compares a device with its newest snapshot and returns an array
+// of differences, analogous to comparing it with a JSON file.
+func (this *Repo) Compare(dev gocmdb.Auditable) ([][]string, error) {
+
+	rec, err := history.Latest(this, history.Key(dev))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dev.CompareJSON(rec.Snapshot)
+}
+
+// Audit compares a device with its newest snapshot, places the results in
+// the device Changes field, and records the device state and changes as a
+// new snapshot.
+func (this *Repo) Audit(dev gocmdb.Auditable) (error) {
+	_, err := history.Audit(this, dev)
+	return err
+}
+
+// Append adds a snapshot and its changes to the history of a device,
+// registering the device and host if they are not yet known.
+func (this *Repo) Append(rec *history.Record) (err error) {
+
+	var ident struct {
+		VendorID   string	`json:"vendor_id"`
+		ProductID  string	`json:"product_id"`
+		SerialNum  string	`json:"serial_number"`
+		ObjectType string	`json:"object_type"`
+	}
+
+	if err = json.Unmarshal(rec.Snapshot, &ident); err != nil {
+		return err
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	ts := rec.Time.UTC().Format(TimeFormat)
+
+	tx, err := this.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec(sqlUpsertHost, rec.HostName, ts); err != nil {
+		return err
+	}
+
+	var hostID int64
+
+	if err = tx.QueryRow(sqlSelectHostID, rec.HostName).Scan(&hostID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(sqlUpsertDevice,
+		rec.Key,
+		ident.VendorID,
+		ident.ProductID,
+		ident.SerialNum,
+		ident.ObjectType,
+		ts,
+		hostID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	var deviceID int64
+
+	if err = tx.QueryRow(sqlSelectDeviceID, rec.Key).Scan(&deviceID); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(sqlInsertSnapshot, deviceID, hostID, ts, string(rec.Snapshot))
+
+	if err != nil {
+		return err
+	}
+
+	snapshotID, err := res.LastInsertId()
+
+	if err != nil {
+		return err
+	}
+
+	for _, chg := range rec.Changes {
+
+		if len(chg) < 3 {
+			continue
+		}
+
+		if _, err = tx.Exec(sqlInsertChange, snapshotID, chg[0], chg[1], chg[2]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Records returns the snapshots of a device with their changes, oldest
+// first.
+func (this *Repo) Records(key string) (recs []*history.Record, err error) {
+
+	rows, err := this.db.Query(sqlSelectSnapshots, key)
+
+	if err != nil {
+		return recs, err
+	}
+
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+
+		var (
+			id int64
+			ts, snap string
+		)
+
+		rec := &history.Record{Key: key}
+
+		if err = rows.Scan(&id, &rec.HostName, &ts, &snap); err != nil {
+			return recs, err
+		}
+
+		if rec.Time, err = time.Parse(TimeFormat, ts); err != nil {
+			return recs, err
+		}
+
+		rec.Snapshot = json.RawMessage(snap)
+		recs = append(recs, rec)
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return recs, err
+	}
+
+	for i, id := range ids {
+		if recs[i].Changes, err = this.changes(id); err != nil {
+			return recs, err
+		}
+	}
+
+	return recs, nil
+}
+
+// Keys returns the keys of all devices in the repository.
+func (this *Repo) Keys() (keys []string, err error) {
+
+	rows, err := this.db.Query(sqlSelectKeys)
+
+	if err != nil {
+		return keys, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var key string
+
+		if err = rows.Scan(&key); err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Devices returns summaries of all devices in the repository.
+func (this *Repo) Devices() ([]*DeviceInfo, error) {
+	return this.queryDevices(sqlSelectDevices)
+}
+
+// FindBySerial returns summaries of all devices whose most recently
+// reported serial number matches sn.
+func (this *Repo) FindBySerial(sn string) ([]*DeviceInfo, error) {
+	return this.queryDevices(sqlSelectDevicesBySerial, sn)
+}
+
+// Hosts returns the names of all hosts on which devices have been seen.
+func (this *Repo) Hosts() (hosts []string, err error) {
+
+	rows, err := this.db.Query(sqlSelectHosts)
+
+	if err != nil {
+		return hosts, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var host string
+
+		if err = rows.Scan(&host); err != nil {
+			return hosts, err
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, rows.Err()
+}
+
+// changes returns the changes recorded with a snapshot.
+func (this *Repo) changes(snapshotID int64) (ss [][]string, err error) {
+
+	rows, err := this.db.Query(sqlSelectChanges, snapshotID)
+
+	if err != nil {
+		return ss, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var f, o, n string
+
+		if err = rows.Scan(&f, &o, &n); err != nil {
+			return ss, err
+		}
+
+		ss = append(ss, []string{f, o, n})
+	}
+
+	return ss, rows.Err()
+}
+
+// queryDevices runs a device summary query.
+func (this *Repo) queryDevices(query string, args ...interface{}) (devs []*DeviceInfo, err error) {
+
+	rows, err := this.db.Query(query, args...)
+
+	if err != nil {
+		return devs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var first, last string
+		dev := new(DeviceInfo)
+
+		err = rows.Scan(
+			&dev.Key,
+			&dev.VendorID,
+			&dev.ProductID,
+			&dev.SerialNum,
+			&dev.ObjectType,
+			&first,
+			&last,
+			&dev.LastHost,
+		)
+
+		if err != nil {
+			return devs, err
+		}
+
+		if dev.FirstSeen, err = time.Parse(TimeFormat, first); err != nil {
+			return devs, err
+		}
+
+		if dev.LastSeen, err = time.Parse(TimeFormat, last); err != nil {
+			return devs, err
+		}
+
+		devs = append(devs, dev)
+	}
+
+	return devs, rows.Err()
+}
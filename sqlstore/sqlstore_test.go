@@ -0,0 +1,95 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlstore
+
+import (
+	`reflect`
+	`testing`
+
+	`github.com/jscherff/gocmdb/history`
+	`github.com/jscherff/gocmdb/usbci`
+	`github.com/jscherff/gocmdb/internal/testdata`
+	`github.com/jscherff/gocmdb/internal/testdevice`
+	`github.com/jscherff/gotest`
+)
+
+func TestRepo(t *testing.T) {
+
+	repo, err := Open(`:memory:`)
+	gotest.Ok(t, err)
+	defer repo.Close()
+
+	t.Run("SchemaVersion()", func(t *testing.T) {
+
+		ver, err := repo.SchemaVersion()
+		gotest.Ok(t, err)
+		gotest.Assert(t, ver == len(Migrations), `database schema not fully migrated`)
+	})
+
+	t.Run("Save() and Restore()", func(t *testing.T) {
+
+		mag1 := testdevice.Magtek(t, `mag1`)
+
+		err := repo.Save(mag1)
+		gotest.Ok(t, err)
+
+		mag3, err := usbci.NewMagtek(nil)
+		gotest.Ok(t, err)
+
+		err = repo.Restore(history.Key(mag1), mag3)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(mag1, mag3), `restored device not identical to saved device`)
+	})
+
+	t.Run("Compare() and Audit()", func(t *testing.T) {
+
+		mag2 := testdevice.Magtek(t, `mag2`)
+
+		ss, err := repo.Compare(mag2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ss) == 2, `modified device should not match original`)
+
+		err = repo.Audit(mag2)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(mag2.Changes, testdata.Load().Chg), `(device).Changes contains bad data`)
+
+		recs, err := repo.Records(history.Key(mag2))
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(recs) == 2, `repository should contain two snapshots`)
+		gotest.Assert(t, reflect.DeepEqual(recs[1].Changes, testdata.Load().Chg), `stored changes contain bad data`)
+
+		_, chg, err := history.LastChange(repo, history.Key(mag2), `USBSpec`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, chg[2] == `2.00`, `LastChange() returned the wrong change`)
+	})
+
+	t.Run("Devices(), FindBySerial() and Hosts()", func(t *testing.T) {
+
+		mag1 := testdevice.Magtek(t, `mag1`)
+
+		devs, err := repo.Devices()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 1, `repository should contain one device`)
+
+		devs, err = repo.FindBySerial(mag1.SerialNum)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(devs) == 1 && devs[0].LastHost == mag1.HostName, `device not found by serial number`)
+		gotest.Assert(t, !devs[0].LastSeen.Before(devs[0].FirstSeen), `device last seen before first seen`)
+
+		hosts, err := repo.Hosts()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(hosts) == 1 && hosts[0] == mag1.HostName, `repository should contain one host`)
+	})
+}
@@ -48,6 +48,9 @@ var (
 			`Leg`:  make(map[string][32]byte),
 			`PXML`: make(map[string][32]byte),
 			`PJSN`: make(map[string][32]byte),
+			`CBOR`: make(map[string][32]byte),
+			`MSGP`: make(map[string][32]byte),
+			`PROTO`: make(map[string][32]byte),
 		},
 
 		Chg: [][]string{
@@ -131,6 +134,21 @@ func generateSigs() error {
 		} else {
 			td.Sig[`PJSN`][k] = sha256.Sum256(b)
 		}
+		if b, err := d.CBOR(); err != nil {
+			return err
+		} else {
+			td.Sig[`CBOR`][k] = sha256.Sum256(b)
+		}
+		if b, err := d.MsgPack(); err != nil {
+			return err
+		} else {
+			td.Sig[`MSGP`][k] = sha256.Sum256(b)
+		}
+		if b, err := d.Protobuf(); err != nil {
+			return err
+		} else {
+			td.Sig[`PROTO`][k] = sha256.Sum256(b)
+		}
 
 		b := d.Legacy()
 		td.Sig[`Leg`][k] = sha256.Sum256(b)
@@ -168,6 +186,21 @@ func generateSigs() error {
 		} else {
 			td.Sig[`PJSN`][k] = sha256.Sum256(b)
 		}
+		if b, err := d.CBOR(); err != nil {
+			return err
+		} else {
+			td.Sig[`CBOR`][k] = sha256.Sum256(b)
+		}
+		if b, err := d.MsgPack(); err != nil {
+			return err
+		} else {
+			td.Sig[`MSGP`][k] = sha256.Sum256(b)
+		}
+		if b, err := d.Protobuf(); err != nil {
+			return err
+		} else {
+			td.Sig[`PROTO`][k] = sha256.Sum256(b)
+		}
 
 		b := d.Legacy()
 		td.Sig[`Leg`][k] = sha256.Sum256(b)
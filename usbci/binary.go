@@ -0,0 +1,108 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`bytes`
+
+	`github.com/fxamacker/cbor/v2`
+	`github.com/vmihailenco/msgpack/v5`
+)
+
+// CBOR and MessagePack reports use the JSON field names and exclusions.
+// Protobuf reports follow the schema in proto/gocmdb.proto.
+
+// ChangeSet is the result of an audit in a form suitable for submission to
+// a CMDB: the identity of the device and its list of changes.
+type ChangeSet struct {
+	HostName  string		`json:"host_name"`
+	VendorID  string		`json:"vendor_id"`
+	ProductID string		`json:"product_id"`
+	SerialNum string		`json:"serial_number"`
+	Changes   [][]string		`json:"changes"`
+}
+
+// ChangeSet returns the identity of the device and its Changes slice.
+func (this *Generic) ChangeSet() (*ChangeSet) {
+	return &ChangeSet{
+		HostName: this.HostName,
+		VendorID: this.VendorID,
+		ProductID: this.ProductID,
+		SerialNum: this.SerialNum,
+		Changes: this.Changes,
+	}
+}
+
+// CBOR reports all unfiltered fields in CBOR format.
+func (this *Generic) CBOR() ([]byte, error) {
+	return cbor.Marshal(this)
+}
+
+// MsgPack reports all unfiltered fields in MessagePack format.
+func (this *Generic) MsgPack() ([]byte, error) {
+	return marshalMsgPack(this)
+}
+
+// RestoreCBOR restores the object from a CBOR report.
+func (this *Generic) RestoreCBOR(b []byte) (error) {
+	return cbor.Unmarshal(b, this)
+}
+
+// RestoreMsgPack restores the object from a MessagePack report.
+func (this *Generic) RestoreMsgPack(b []byte) (error) {
+	return unmarshalMsgPack(b, this)
+}
+
+// CBOR reports the change set in CBOR format.
+func (this *ChangeSet) CBOR() ([]byte, error) {
+	return cbor.Marshal(this)
+}
+
+// MsgPack reports the change set in MessagePack format.
+func (this *ChangeSet) MsgPack() ([]byte, error) {
+	return marshalMsgPack(this)
+}
+
+// RestoreCBOR restores the change set from CBOR format.
+func (this *ChangeSet) RestoreCBOR(b []byte) (error) {
+	return cbor.Unmarshal(b, this)
+}
+
+// RestoreMsgPack restores the change set from MessagePack format.
+func (this *ChangeSet) RestoreMsgPack(b []byte) (error) {
+	return unmarshalMsgPack(b, this)
+}
+
+// marshalMsgPack encodes an object using its JSON field names.
+func marshalMsgPack(v interface{}) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag(`json`)
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// unmarshalMsgPack decodes an object using its JSON field names.
+func unmarshalMsgPack(b []byte, v interface{}) (error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag(`json`)
+	return dec.Decode(v)
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`io`
+
+	`github.com/BurntSushi/toml`
+	`gopkg.in/yaml.v3`
+)
+
+// YAML and TOML reports are derived from the JSON report, so they carry the
+// same field names, field order and exclusions, and restoring them goes
+// through RestoreJSON, including its schema upgrades.
+
+// YAML reports all unfiltered fields in YAML format.
+func (this *Generic) YAML() ([]byte, error) {
+
+	j, err := this.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonToYAML(j)
+}
+
+// TOML reports all unfiltered fields in TOML format.
+func (this *Generic) TOML() ([]byte, error) {
+
+	j, err := this.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonToTOML(j)
+}
+
+// RestoreYAML restores the object from a YAML report.
+func (this *Generic) RestoreYAML(y []byte) (error) {
+
+	var v interface{}
+
+	if err := yaml.Unmarshal(y, &v); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return this.RestoreJSON(j)
+}
+
+// RestoreTOML restores the object from a TOML report.
+func (this *Generic) RestoreTOML(t []byte) (error) {
+
+	var v map[string]interface{}
+
+	if _, err := toml.Decode(string(t), &v); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return this.RestoreJSON(j)
+}
+
+// jsonToYAML converts a JSON document to block-style YAML, preserving the
+// order of object keys.
+func jsonToYAML(j []byte) ([]byte, error) {
+
+	var node yaml.Node
+
+	if err := yaml.Unmarshal(j, &node); err != nil {
+		return nil, err
+	}
+
+	resetStyle(&node)
+
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// resetStyle clears the flow and quoting styles that a JSON document
+// carries so that the YAML encoder chooses the most readable style.
+func resetStyle(node *yaml.Node) {
+
+	node.Style = 0
+
+	for _, n := range node.Content {
+		resetStyle(n)
+	}
+}
+
+// jsonToTOML converts a flat JSON object to TOML key/value pairs,
+// preserving the order of object keys. Reports are flat, so nested objects
+// and arrays are not supported.
+func jsonToTOML(j []byte) ([]byte, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf(`report is not a JSON object`)
+	}
+
+	buf := new(bytes.Buffer)
+
+	for dec.More() {
+
+		tok, err := dec.Token()
+
+		if err != nil {
+			return nil, err
+		}
+
+		key := tok.(string)
+
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		}
+
+		var val []byte
+
+		switch v := tok.(type) {
+
+		case string:
+			val, err = json.Marshal(v)
+
+		case json.Number:
+			val = []byte(v.String())
+
+		case bool:
+			val = []byte(fmt.Sprint(v))
+
+		case nil:
+			continue
+
+		default:
+			err = fmt.Errorf(`field %s: nested values are not supported`, key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(buf, "%s = %s\n", key, val)
+	}
+
+	if _, err := dec.Token(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`fmt`
+	`sync`
+	`time`
+)
+
+// Actions recorded by events.
+const (
+	EventAudit string = `audit`
+	EventSetDeviceSN string = `set-device-sn`
+	EventEraseDeviceSN string = `erase-device-sn`
+	EventSetFactorySN string = `set-factory-sn`
+	EventCopyFactorySN string = `copy-factory-sn`
+	EventReset string = `reset`
+)
+
+// Event records an audit, NVRAM write or reset of a device, whether or not
+// it succeeded. DryRun marks writes skipped by the write handler.
+type Event struct {
+	Time       time.Time		`json:"time"`
+	Action     string		`json:"action"`
+	Device     string		`json:"device"`
+	HostName   string		`json:"host_name"`
+	ObjectType string		`json:"object_type"`
+	OldValue   string		`json:"old_value,omitempty"`
+	NewValue   string		`json:"new_value,omitempty"`
+	Changes    [][]string		`json:"changes,omitempty"`
+	DryRun     bool			`json:"dry_run,omitempty"`
+	Error      string		`json:"error,omitempty"`
+}
+
+var (
+	eventHandler func(*Event) (error)
+	eventMutex sync.RWMutex
+)
+
+// SetEventHandler installs a function that receives every event, such as
+// an audit log writer, replacing any previous handler. A nil handler turns
+// events off. If the handler returns an error for an operation that
+// succeeded, the operation returns that error, so that operations cannot
+// silently go unrecorded.
+func SetEventHandler(fn func(*Event) (error)) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventHandler = fn
+}
+
+// event sends an event about this device to the handler, if any, and
+// returns the error of the operation or, failing that, of the handler.
+func (this *Generic) event(e *Event, err error) (error) {
+
+	eventMutex.RLock()
+	fn := eventHandler
+	eventMutex.RUnlock()
+
+	if fn == nil {
+		return err
+	}
+
+	e.Time = time.Now().UTC()
+	e.Device = this.Identity()
+	e.HostName = this.HostName
+	e.ObjectType = this.ObjectType
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if herr := fn(e); herr != nil && err == nil {
+		return fmt.Errorf(`event handler: %v`, herr)
+	}
+
+	return err
+}
+
+// audited sends an audit event with the result of an audit.
+func (this *Generic) audited(err error) (error) {
+	return this.event(&Event{Action: EventAudit, Changes: this.Changes}, err)
+}
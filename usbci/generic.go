@@ -19,10 +19,16 @@ import (
 	`encoding/xml`
 	`errors`
 	`fmt`
+	`io/ioutil`
 	`os`
+	`path/filepath`
 	`reflect`
+	`strings`
+	`sync`
 
 	`github.com/google/gousb`
+	`github.com/jscherff/gocmdb/crypt`
+	`github.com/jscherff/gocmdb/sign`
 	`github.com/jscherff/goutil`
 )
 
@@ -59,11 +65,69 @@ const (
 	MarshalIndent string = "\t"
 )
 
+var (
+	snapshotSigner *sign.Signer
+	baselineVerifier *sign.Verifier
+	snapshotCipher *crypt.Cipher
+	snapshotMutex sync.RWMutex
+)
+
+// SetSnapshotSigner installs a signer that signs every file written by Save
+// with a detached signature beside the file. A nil signer turns signing off.
+func SetSnapshotSigner(s *sign.Signer) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	snapshotSigner = s
+}
+
+// SnapshotSigner returns the installed snapshot signer, if any.
+func SnapshotSigner() (*sign.Signer) {
+	snapshotMutex.RLock()
+	defer snapshotMutex.RUnlock()
+	return snapshotSigner
+}
+
+// SetBaselineVerifier installs a verifier that checks the detached signature
+// of every file read by RestoreFile, and so by CompareFile and AuditFile,
+// and refuses invalidly signed files, and unsigned files if it requires
+// signatures. A nil verifier turns verification off.
+func SetBaselineVerifier(v *sign.Verifier) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	baselineVerifier = v
+}
+
+// BaselineVerifier returns the installed baseline verifier, if any.
+func BaselineVerifier() (*sign.Verifier) {
+	snapshotMutex.RLock()
+	defer snapshotMutex.RUnlock()
+	return baselineVerifier
+}
+
+// SetSnapshotCipher installs a cipher that encrypts every file written by
+// Save and decrypts encrypted files read by RestoreFile, and so by
+// CompareFile and AuditFile. Unencrypted files remain readable. A nil cipher
+// turns encryption off.
+func SetSnapshotCipher(c *crypt.Cipher) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	snapshotCipher = c
+}
+
+// SnapshotCipher returns the installed snapshot cipher, if any.
+func SnapshotCipher() (*crypt.Cipher) {
+	snapshotMutex.RLock()
+	defer snapshotMutex.RUnlock()
+	return snapshotCipher
+}
+
 // Generic decorates a gousb Device with Generic Properties and API.
 type Generic struct {
 
 	*gousb.Device			`json:"-" xml:"-" csv:"-" nvp:"-" cmp:"-"`
 
+	SchemaVersion int		`json:"schema_version" csv:"schema_version" cmp:"-"`
+
 	HostName     string		`json:"host_name"     csv:"host_name"`
 	VendorID     string		`json:"vendor_id"     csv:"vendor_id"`
 	ProductID    string		`json:"product_id"    csv:"product_id"`
@@ -77,6 +141,7 @@ type Generic struct {
 	PortNumber   int		`json:"port_number"   csv:"-" nvp:"-" cmp:"-"`
 	BusNumber    int		`json:"bus_number"    csv:"-" nvp:"-" cmp:"-"`
 	BusAddress   int		`json:"bus_address"   csv:"-" nvp:"-" cmp:"-"`
+	HubPorts     string		`json:"hub_ports,omitempty" xml:",omitempty" csv:"-" nvp:"-" cmp:"-"`
 	BufferSize   int		`json:"buffer_size"   csv:"-" nvp:"-"`
 	MaxPktSize   int		`json:"max_pkt_size"  csv:"-" nvp:"-"`
 	USBSpec	     string		`json:"usb_spec"      csv:"-" nvp:"-"`
@@ -99,7 +164,7 @@ type Generic struct {
 // NewGeneric instantiates a Generic wrapper for an existing gousb Device.
 func NewGeneric(gd *gousb.Device) (*Generic, error) {
 
-	this := &Generic{Device: gd}
+	this := &Generic{Device: gd, SchemaVersion: SchemaVersion}
 
 	if gd == nil {
 		return this, nil
@@ -127,6 +192,8 @@ func NewGeneric(gd *gousb.Device) (*Generic, error) {
 // Init initializes API properties.
 func (this *Generic) Init() (errs map[string]bool) {
 
+	errs = make(map[string]bool)
+
 	var err error
 
 	if this.HostName, err = os.Hostname(); err != nil {
@@ -147,6 +214,7 @@ func (this *Generic) Init() (errs map[string]bool) {
 	this.BusNumber = this.Desc.Bus
 	this.BusAddress = this.Desc.Address
 	this.PortNumber = this.Desc.Port
+	this.HubPorts = hubPorts(this.Desc.Path)
 	this.USBSpec = this.Desc.Spec.String()
 	this.USBClass = this.Desc.Class.String()
 	this.USBSubClass = this.Desc.SubClass.String()
@@ -162,6 +230,8 @@ func (this *Generic) Init() (errs map[string]bool) {
 // Refresh updates properties whose underlying values may have changed.
 func (this *Generic) Refresh() (errs map[string]bool) {
 
+	errs = make(map[string]bool)
+
 	var err error
 
 	if this.SerialNum, err = this.SerialNumber(); err != nil {
@@ -171,6 +241,11 @@ func (this *Generic) Refresh() (errs map[string]bool) {
 	return errs
 }
 
+// Reset performs a USB port reset of the device.
+func (this *Generic) Reset() (error) {
+	return this.event(&Event{Action: EventReset}, this.Device.Reset())
+}
+
 // ID is a convenience method to retrieve the device serial number.
 func (this *Generic) ID() (string) {
 	return this.SerialNum
@@ -196,63 +271,239 @@ func (this *Generic) Type() (string) {
 	return reflect.TypeOf(this).String()
 }
 
-// Save saves the object to a JSON file.
+// Save saves the object to a JSON file, or to a file in another format if
+// the filename has a .yaml, .yml, .toml, .xml, .csv or .nvp extension. The
+// file is encrypted if a snapshot cipher is installed, then signed if a
+// snapshot signer is installed.
 func (this *Generic) Save(fn string) (error) {
-	return goutil.SaveObject(this, fn)
+
+	var (
+		b []byte
+		err error
+		cipher = SnapshotCipher()
+		signer = SnapshotSigner()
+	)
+
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case `.yaml`, `.yml`:
+		b, err = this.YAML()
+	case `.toml`:
+		b, err = this.TOML()
+	case `.xml`:
+		b, err = this.PrettyXML()
+	case `.csv`:
+		b, err = this.CSV()
+	case `.nvp`:
+		b, err = this.NVP()
+	default:
+		if cipher == nil {
+			err = goutil.SaveObject(this, fn)
+		} else {
+			b, err = this.JSON()
+		}
+	}
+
+	if err == nil && b != nil && cipher != nil {
+		b, err = cipher.Encrypt(b)
+	}
+
+	if err == nil && b != nil {
+		err = ioutil.WriteFile(fn, b, 0640)
+	}
+
+	if err == nil && signer != nil {
+		err = signer.SignFile(fn)
+	}
+
+	return err
 }
 
-// RestoreFile restores the object from a JSON file.
+// RestoreFile restores the object from a JSON or XML file, or from a file
+// in another format if the filename has a .yaml, .yml, .toml, .csv or .nvp
+// extension. Files written with an earlier schema version, including legacy
+// DeviceInfo JSON and XML files, are upgraded to the current version. The
+// file signature is checked if a baseline verifier is installed, and
+// encrypted files are decrypted with the snapshot cipher.
 func (this *Generic) RestoreFile(fn string) (error) {
-	return goutil.RestoreObject(fn, this)
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return err
+	}
+
+	if v := BaselineVerifier(); v != nil {
+		if err = v.VerifyFile(fn, b); err != nil {
+			return err
+		}
+	}
+
+	if b, err = SnapshotCipher().Open(b); err != nil {
+		return fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case `.yaml`, `.yml`:
+		return this.RestoreYAML(b)
+	case `.toml`:
+		return this.RestoreTOML(b)
+	case `.csv`:
+		return this.RestoreCSV(b)
+	case `.nvp`:
+		return this.RestoreNVP(b)
+	}
+
+	if isXML(b) {
+		return this.RestoreXML(b)
+	}
+
+	return this.RestoreJSON(b)
 }
 
-// RestoreJSON restores the object from a JSON file.
+// RestoreJSON restores the object from a JSON file. Reports written with an
+// earlier schema version are upgraded to the current version.
 func (this *Generic) RestoreJSON(j []byte) (error) {
+
+	j, err := UpgradeJSON(j)
+
+	if err != nil {
+		return err
+	}
+
 	return json.Unmarshal(j, &this)
 }
 
-// CompareFile compares fields and properties and returns an array of differences.
-func (this *Generic) CompareFile(fn string) (ss [][]string, err error) {
+// RestoreXML restores the object from an XML report, including the legacy
+// DeviceInfo layout.
+func (this *Generic) RestoreXML(x []byte) (error) {
 
-	gusb, err := NewGeneric(nil)
+	j, err := UpgradeXML(x)
 
 	if err != nil {
-		return ss, err
+		return err
 	}
 
-	if err = gusb.RestoreFile(fn); err != nil {
-		return ss, err
+	return this.RestoreJSON(j)
+}
+
+// RestoreCSV restores the fields present in a CSV report. Other fields are
+// left unchanged.
+func (this *Generic) RestoreCSV(c []byte) (error) {
+
+	j, err := UpgradeCSV(c)
+
+	if err != nil {
+		return err
 	}
 
-	return goutil.CompareObjects(gusb, this, `cmp`)
+	return this.RestoreJSON(j)
 }
 
-// CompareJSON compares fields and properties and returns an array of differences.
-func (this *Generic) CompareJSON(b []byte) (ss [][]string, err error) {
+// RestoreNVP restores the fields present in an NVP report. Other fields are
+// left unchanged.
+func (this *Generic) RestoreNVP(n []byte) (error) {
 
-	gusb, err := NewGeneric(nil)
+	j, err := UpgradeNVP(n)
 
 	if err != nil {
-		return ss, err
+		return err
 	}
 
-	if err = gusb.RestoreJSON(b); err != nil {
-		return ss, err
-	}
+	return this.RestoreJSON(j)
+}
 
-	return goutil.CompareObjects(gusb, this, `cmp`)
+// CompareFile compares fields and properties and returns an array of differences.
+// Fields that the file format does not report are not compared.
+func (this *Generic) CompareFile(fn string) (ss [][]string, err error) {
+
+	ext := strings.ToLower(filepath.Ext(fn))
+
+	return this.compare(ext == `.csv` || ext == `.nvp`, func(gusb *Generic) (error) {
+		return gusb.RestoreFile(fn)
+	})
+}
+
+// CompareJSON compares fields and properties and returns an array of differences.
+func (this *Generic) CompareJSON(b []byte) (ss [][]string, err error) {
+	return this.compare(false, func(gusb *Generic) (error) {
+		return gusb.RestoreJSON(b)
+	})
+}
+
+// CompareXML compares fields and properties and returns an array of differences.
+func (this *Generic) CompareXML(b []byte) (ss [][]string, err error) {
+	return this.compare(false, func(gusb *Generic) (error) {
+		return gusb.RestoreXML(b)
+	})
+}
+
+// CompareCSV compares the fields in a CSV report and returns an array of
+// differences.
+func (this *Generic) CompareCSV(b []byte) (ss [][]string, err error) {
+	return this.compare(true, func(gusb *Generic) (error) {
+		return gusb.RestoreCSV(b)
+	})
+}
+
+// CompareNVP compares the fields in an NVP report and returns an array of
+// differences.
+func (this *Generic) CompareNVP(b []byte) (ss [][]string, err error) {
+	return this.compare(true, func(gusb *Generic) (error) {
+		return gusb.RestoreNVP(b)
+	})
 }
 
 // AuditFile calls CompareFile and places the results in the Changes field.
 func (this *Generic) AuditFile(fn string) (err error) {
 	this.Changes, err = this.CompareFile(fn)
-	return err
+	return this.audited(err)
 }
 
 // AuditJSON calls CompareJSON and places the results in the Changes field.
 func (this *Generic) AuditJSON(j []byte) (err error) {
 	this.Changes, err = this.CompareJSON(j)
-	return err
+	return this.audited(err)
+}
+
+// AuditXML calls CompareXML and places the results in the Changes field.
+func (this *Generic) AuditXML(x []byte) (err error) {
+	this.Changes, err = this.CompareXML(x)
+	return this.audited(err)
+}
+
+// AuditCSV calls CompareCSV and places the results in the Changes field.
+func (this *Generic) AuditCSV(c []byte) (err error) {
+	this.Changes, err = this.CompareCSV(c)
+	return this.audited(err)
+}
+
+// AuditNVP calls CompareNVP and places the results in the Changes field.
+func (this *Generic) AuditNVP(n []byte) (err error) {
+	this.Changes, err = this.CompareNVP(n)
+	return this.audited(err)
+}
+
+// compare restores a baseline object and compares it with this one. If the
+// baseline report is partial, the baseline starts as a copy of this object
+// so that fields missing from the report do not appear as changes.
+func (this *Generic) compare(partial bool, restore func(*Generic) (error)) (ss [][]string, err error) {
+
+	gusb, err := NewGeneric(nil)
+
+	if err != nil {
+		return ss, err
+	}
+
+	if partial {
+		*gusb = *this
+		gusb.Device, gusb.Changes, gusb.Vendor = nil, nil, nil
+	}
+
+	if err = restore(gusb); err != nil {
+		return ss, err
+	}
+
+	return goutil.CompareObjects(gusb, this, `cmp`)
 }
 
 // AddChange appends manual changes to the devices Changes slice.
@@ -270,6 +521,26 @@ func (this *Generic) GetChanges() ([][]string) {
 	return this.Changes
 }
 
+// Identity constructs a key that identifies the physical device regardless
+// of changes to its configurable serial number. It prefers the factory serial
+// number, then the descriptor serial number, then the reported serial number,
+// and falls back to the host name and port path for unserialized devices.
+func (this *Generic) Identity() (string) {
+
+	for _, sn := range []string{this.FactorySN, this.DescriptorSN, this.SerialNum} {
+		if sn != `` {
+			return fmt.Sprintf(`%s-%s-%s`, this.VendorID, this.ProductID, sn)
+		}
+	}
+
+	return fmt.Sprintf(`%s-%s-%s-%s`,
+		this.VendorID,
+		this.ProductID,
+		this.HostName,
+		this.PortPath(),
+	)
+}
+
 // Filename constructs a convenient filename from the bus number, bus address,
 // vendor ID, and product ID. Filenames guaranteed unique on a single computer.
 func (this *Generic) Filename() (string) {
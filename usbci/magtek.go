@@ -66,7 +66,7 @@ type Magtek struct {
 // NewMagtek instantiates a Magtek wrapper for an existing gousb Device.
 func NewMagtek(gd *gousb.Device) (*Magtek, error) {
 
-	this := &Magtek{&Generic{Device: gd}}
+	this := &Magtek{&Generic{Device: gd, SchemaVersion: SchemaVersion}}
 
 	if gd == nil {
 		return this, nil
@@ -176,24 +176,36 @@ func (this *Magtek) GetProductVer() (string, error) {
 	return val, err
 }
 
-// SetDeviceSN sets the device configurable serial number in NVRAM.
+// SetDeviceSN sets the device configurable serial number in NVRAM if it
+// satisfies the device serial number policy.
 func (this *Magtek) SetDeviceSN(val string) (error) {
-	return this.setProperty(PropDeviceSN, val)
+	e := &Event{Action: EventSetDeviceSN, OldValue: this.DeviceSN, NewValue: val}
+	if err := checkSerial(DeviceSNPolicy(), this.Generic, FieldDeviceSN, val); err != nil {
+		return this.event(e, err)
+	}
+	return this.write(e, PropDeviceSN, val)
 }
 
 // EraseDeviceSN removes the device configurable serial number from NVRAM.
 func (this *Magtek) EraseDeviceSN() (error) {
-	return this.setProperty(PropDeviceSN, ``)
+	e := &Event{Action: EventEraseDeviceSN, OldValue: this.DeviceSN}
+	return this.write(e, PropDeviceSN, ``)
 }
 
-// SetFactorySN sets the device factory device serial number in NVRAM.
+// SetFactorySN sets the device factory device serial number in NVRAM if it
+// satisfies the factory serial number policy.
 // This will fail with result code 07 if serial number is already set.
 func (this *Magtek) SetFactorySN(val string) (error) {
-	return this.setProperty(PropFactorySN, val)
+	e := &Event{Action: EventSetFactorySN, OldValue: this.FactorySN, NewValue: val}
+	if err := checkSerial(FactorySNPolicy(), this.Generic, FieldFactorySN, val); err != nil {
+		return this.event(e, err)
+	}
+	return this.write(e, PropFactorySN, val)
 }
 
 // CopyFactorySN copies 'length' characters from the device factory
-// serial number to the configurable serial number in NVRAM.
+// serial number to the configurable serial number in NVRAM if the copy
+// satisfies the device serial number policy.
 func (this *Magtek) CopyFactorySN(n int) (error) {
 
 	val, err := this.GetFactorySN()
@@ -207,9 +219,13 @@ func (this *Magtek) CopyFactorySN(n int) (error) {
 	}
 
 	n = int(math.Min(float64(n), float64(len(val))))
-	err = this.SetDeviceSN(val[:n])
+	e := &Event{Action: EventCopyFactorySN, OldValue: this.DeviceSN, NewValue: val[:n]}
 
-	return err
+	if err = checkSerial(DeviceSNPolicy(), this.Generic, FieldDeviceSN, val[:n]); err != nil {
+		return this.event(e, err)
+	}
+
+	return this.write(e, PropDeviceSN, val[:n])
 }
 
 // Reset overides inherited Reset method with a low-level vendor reset.
@@ -239,7 +255,7 @@ func (this *Magtek) Reset() (error) {
 		data)
 
 	if err != nil {
-		return err
+		return this.event(&Event{Action: EventReset}, err)
 	}
 
 	if data[0] > 0x00 {
@@ -248,7 +264,7 @@ func (this *Magtek) Reset() (error) {
 
 	time.Sleep(5 * time.Second)
 
-	return err
+	return this.event(&Event{Action: EventReset}, err)
 }
 
 // GetBufferSize uses trial and error to find the control transfer data
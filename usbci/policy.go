@@ -0,0 +1,389 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`regexp`
+	`strings`
+	`sync`
+	`unicode/utf8`
+)
+
+const (
+	CheckDigitLuhn string = `luhn`
+	CheckDigitMod36 string = `mod36`
+
+	FieldDeviceSN string = `DeviceSN`
+	FieldFactorySN string = `FactorySN`
+)
+
+var (
+	deviceSNPolicy SerialChecker
+	factorySNPolicy SerialChecker
+	policyMutex sync.RWMutex
+
+	checkDigitAlphabets = map[string]string{
+		CheckDigitLuhn: `0123456789`,
+		CheckDigitMod36: `0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ`,
+	}
+)
+
+// SetDeviceSNPolicy installs a policy that SetDeviceSN and CopyFactorySN
+// enforce before writing and that CheckSerials checks. A nil policy turns
+// the checks off.
+func SetDeviceSNPolicy(p SerialChecker) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+	deviceSNPolicy = p
+}
+
+// DeviceSNPolicy returns the installed device serial number policy, if any.
+func DeviceSNPolicy() (SerialChecker) {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	return deviceSNPolicy
+}
+
+// SetFactorySNPolicy installs a policy that SetFactorySN enforces before
+// writing and that CheckSerials checks. A nil policy turns the checks off.
+func SetFactorySNPolicy(p SerialChecker) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+	factorySNPolicy = p
+}
+
+// FactorySNPolicy returns the installed factory serial number policy, if
+// any.
+func FactorySNPolicy() (SerialChecker) {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	return factorySNPolicy
+}
+
+// SerialChecker checks a serial number proposed for, or reported by, a
+// device. It returns a *PolicyError if the serial number is not allowed.
+type SerialChecker interface {
+	CheckSerial(dev *Generic, sn string) (error)
+}
+
+// PolicyError lists the rules of a policy that a serial number violates.
+type PolicyError struct {
+	Field      string		`json:"field"`
+	Serial     string		`json:"serial"`
+	Violations []string		`json:"violations"`
+}
+
+// Error describes the violations.
+func (this *PolicyError) Error() (string) {
+	return fmt.Sprintf(`%s %q violates serial number policy: %s`,
+		this.Field, this.Serial, strings.Join(this.Violations, `; `))
+}
+
+// SerialPolicy is a SerialChecker built from simple rules. Every rule that
+// is set must be satisfied. The check digit, if any, is the last character
+// and covers all the others. The required prefix is the one in
+// StorePrefixes for the store whose ID is the first submatch of
+// StorePattern in the host name of the device, or Prefix otherwise.
+// Patterns are compiled on first use if Compile was not called.
+type SerialPolicy struct {
+	Pattern       string		`json:"pattern,omitempty"`
+	MinLength     int		`json:"min_length,omitempty"`
+	MaxLength     int		`json:"max_length,omitempty"`
+	Charset       string		`json:"charset,omitempty"`
+	CheckDigit    string		`json:"check_digit,omitempty"`
+	Prefix        string		`json:"prefix,omitempty"`
+	StorePattern  string		`json:"store_pattern,omitempty"`
+	StorePrefixes map[string]string	`json:"store_prefixes,omitempty"`
+
+	pattern *regexp.Regexp
+	storePattern *regexp.Regexp
+	mutex sync.Mutex
+}
+
+// Policies holds the policies for each writable serial number.
+type Policies struct {
+	DeviceSN  *SerialPolicy		`json:"device_sn,omitempty"`
+	FactorySN *SerialPolicy		`json:"factory_sn,omitempty"`
+}
+
+// LoadPolicies reads and compiles serial number policies from a JSON file.
+func LoadPolicies(fn string) (*Policies, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := new(Policies)
+
+	if err = json.Unmarshal(b, this); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	for _, p := range []*SerialPolicy{this.DeviceSN, this.FactorySN} {
+		if p == nil {
+			continue
+		}
+		if err = p.Compile(); err != nil {
+			return nil, fmt.Errorf(`%s: %v`, fn, err)
+		}
+	}
+
+	return this, nil
+}
+
+// Install makes the policies the ones enforced by the serial number setters.
+func (this *Policies) Install() {
+
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+
+	deviceSNPolicy, factorySNPolicy = nil, nil
+
+	if this.DeviceSN != nil {
+		deviceSNPolicy = this.DeviceSN
+	}
+
+	if this.FactorySN != nil {
+		factorySNPolicy = this.FactorySN
+	}
+}
+
+// Compile validates the rules of a policy and compiles its patterns, so
+// that invalid rules are found before the policy is used. LoadPolicies
+// compiles the policies it loads.
+func (this *SerialPolicy) Compile() (error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.compile()
+}
+
+// compiled compiles the patterns of a policy if they were not compiled or
+// have changed since, and returns the compiled patterns.
+func (this *SerialPolicy) compiled() (pattern, storePattern *regexp.Regexp, err error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !samePattern(this.pattern, this.Pattern) || !samePattern(this.storePattern, this.StorePattern) {
+		err = this.compile()
+	}
+
+	return this.pattern, this.storePattern, err
+}
+
+// samePattern reports whether a compiled pattern, or its absence, matches
+// the pattern source.
+func samePattern(re *regexp.Regexp, src string) (bool) {
+	if re == nil {
+		return src == ``
+	}
+	return re.String() == src
+}
+
+// compile validates the rules of a policy and compiles its patterns.
+func (this *SerialPolicy) compile() (err error) {
+
+	this.pattern, this.storePattern = nil, nil
+
+	if this.Pattern != `` {
+		if this.pattern, err = regexp.Compile(this.Pattern); err != nil {
+			return fmt.Errorf(`pattern: %v`, err)
+		}
+	}
+
+	if this.StorePattern != `` {
+
+		if this.storePattern, err = regexp.Compile(this.StorePattern); err != nil {
+			return fmt.Errorf(`store pattern: %v`, err)
+		}
+
+		if this.storePattern.NumSubexp() < 1 {
+			return fmt.Errorf(`store pattern must have a subexpression for the store ID`)
+		}
+	}
+
+	if this.MaxLength > 0 && this.MinLength > this.MaxLength {
+		return fmt.Errorf(`minimum length %d exceeds maximum length %d`, this.MinLength, this.MaxLength)
+	}
+
+	if _, ok := checkDigitAlphabets[this.CheckDigit]; this.CheckDigit != `` && !ok {
+		return fmt.Errorf(`unknown check digit algorithm %q`, this.CheckDigit)
+	}
+
+	return nil
+}
+
+// CheckSerial checks a serial number against every rule of the policy. It
+// returns an error other than a *PolicyError if the rules are invalid.
+func (this *SerialPolicy) CheckSerial(dev *Generic, sn string) (error) {
+
+	pattern, storePattern, err := this.compiled()
+
+	if err != nil {
+		return fmt.Errorf(`serial number policy: %v`, err)
+	}
+
+	var v []string
+
+	if this.MinLength > 0 && len(sn) < this.MinLength {
+		v = append(v, fmt.Sprintf(`shorter than %d characters`, this.MinLength))
+	}
+
+	if this.MaxLength > 0 && len(sn) > this.MaxLength {
+		v = append(v, fmt.Sprintf(`longer than %d characters`, this.MaxLength))
+	}
+
+	if this.Charset != `` {
+		if i := strings.IndexFunc(sn, func(r rune) (bool) {
+			return !strings.ContainsRune(this.Charset, r)
+		}); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(sn[i:])
+			v = append(v, fmt.Sprintf(`character %q not allowed`, r))
+		}
+	}
+
+	if pattern != nil && !pattern.MatchString(sn) {
+		v = append(v, fmt.Sprintf(`does not match %s`, this.Pattern))
+	}
+
+	if prefix := this.prefix(dev, storePattern); !strings.HasPrefix(sn, prefix) {
+		v = append(v, fmt.Sprintf(`does not start with %q`, prefix))
+	}
+
+	if this.CheckDigit != `` && !validCheckDigit(sn, checkDigitAlphabets[this.CheckDigit]) {
+		v = append(v, fmt.Sprintf(`invalid %s check digit`, this.CheckDigit))
+	}
+
+	if len(v) > 0 {
+		return &PolicyError{Serial: sn, Violations: v}
+	}
+
+	return nil
+}
+
+// prefix returns the prefix required for the store of a device.
+func (this *SerialPolicy) prefix(dev *Generic, storePattern *regexp.Regexp) (string) {
+
+	if storePattern != nil && dev != nil {
+		if m := storePattern.FindStringSubmatch(dev.HostName); m != nil {
+			if prefix, ok := this.StorePrefixes[m[1]]; ok {
+				return prefix
+			}
+		}
+	}
+
+	return this.Prefix
+}
+
+// CheckDigit computes the check digit of a serial number without one using
+// the named algorithm: Luhn over decimal digits or Luhn mod 36 over digits
+// and upper-case letters.
+func CheckDigit(algorithm, sn string) (string, error) {
+
+	alpha, ok := checkDigitAlphabets[algorithm]
+
+	if !ok {
+		return ``, fmt.Errorf(`unknown check digit algorithm %q`, algorithm)
+	}
+
+	sum, ok := luhnSum(sn, alpha, true)
+
+	if !ok {
+		return ``, fmt.Errorf(`serial number %q has characters outside the %s alphabet`, sn, algorithm)
+	}
+
+	n := len(alpha)
+
+	return string(alpha[(n - sum % n) % n]), nil
+}
+
+// validCheckDigit reports whether the last character of a serial number is
+// its Luhn mod N check digit.
+func validCheckDigit(sn, alpha string) (bool) {
+	sum, ok := luhnSum(sn, alpha, false)
+	return ok && len(sn) > 1 && sum % len(alpha) == 0
+}
+
+// luhnSum computes the Luhn mod N sum of a string, doubling every second
+// character from the right, starting with the last if double is set.
+func luhnSum(s, alpha string, double bool) (sum int, ok bool) {
+
+	n := len(alpha)
+
+	for i := len(s) - 1; i >= 0; i-- {
+
+		d := strings.IndexByte(alpha, s[i])
+
+		if d < 0 {
+			return 0, false
+		}
+
+		if double {
+			d *= 2
+			d = d / n + d % n
+		}
+
+		sum += d
+		double = !double
+	}
+
+	return sum, true
+}
+
+// CheckSerials checks the device and factory serial numbers of a device
+// against the installed policies, so that devices configured before the
+// policies were introduced, or by other tools, can be flagged. Empty serial
+// numbers are not checked.
+func (this *Generic) CheckSerials() (pe []*PolicyError) {
+
+	for _, c := range []struct{field, sn string; policy SerialChecker}{
+		{FieldDeviceSN, this.DeviceSN, DeviceSNPolicy()},
+		{FieldFactorySN, this.FactorySN, FactorySNPolicy()},
+	} {
+		if c.policy == nil || c.sn == `` {
+			continue
+		}
+		if err := checkSerial(c.policy, this, c.field, c.sn); err != nil {
+			if e, ok := err.(*PolicyError); ok {
+				pe = append(pe, e)
+			} else {
+				pe = append(pe, &PolicyError{Field: c.field, Serial: c.sn, Violations: []string{err.Error()}})
+			}
+		}
+	}
+
+	return pe
+}
+
+// checkSerial applies a policy, if any, to a serial number for a field.
+func checkSerial(policy SerialChecker, dev *Generic, field, sn string) (error) {
+
+	if policy == nil {
+		return nil
+	}
+
+	err := policy.CheckSerial(dev, sn)
+
+	if e, ok := err.(*PolicyError); ok {
+		e.Field = field
+	}
+
+	return err
+}
@@ -0,0 +1,306 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`fmt`
+	`reflect`
+	`strings`
+
+	`google.golang.org/protobuf/encoding/protowire`
+)
+
+// Field numbers of the Device, Change and ChangeSet messages defined in
+// proto/gocmdb.proto. Device field numbers are keyed by JSON field name.
+var (
+	ProtoDeviceFields = map[string]protowire.Number{
+		`schema_version`: 1,
+		`host_name`: 2,
+		`vendor_id`: 3,
+		`product_id`: 4,
+		`serial_number`: 5,
+		`vendor_name`: 6,
+		`product_name`: 7,
+		`product_ver`: 8,
+		`firmware_ver`: 9,
+		`software_id`: 10,
+		`port_number`: 11,
+		`bus_number`: 12,
+		`bus_address`: 13,
+		`buffer_size`: 14,
+		`max_pkt_size`: 15,
+		`usb_spec`: 16,
+		`usb_class`: 17,
+		`usb_subclass`: 18,
+		`usb_protocol`: 19,
+		`device_speed`: 20,
+		`device_ver`: 21,
+		`object_type`: 22,
+		`device_sn`: 23,
+		`factory_sn`: 24,
+		`descriptor_sn`: 25,
+		`hub_ports`: 26,
+	}
+
+	// protoFields lists the Generic struct fields in report order with
+	// their field numbers.
+	protoFields []protoField
+)
+
+const (
+	ProtoChangeFieldName protowire.Number = 1
+	ProtoChangeOldValue protowire.Number = 2
+	ProtoChangeNewValue protowire.Number = 3
+
+	ProtoChangeSetHostName protowire.Number = 1
+	ProtoChangeSetVendorID protowire.Number = 2
+	ProtoChangeSetProductID protowire.Number = 3
+	ProtoChangeSetSerialNum protowire.Number = 4
+	ProtoChangeSetChanges protowire.Number = 5
+)
+
+type protoField struct {
+	index int
+	num protowire.Number
+}
+
+func init() {
+
+	t := reflect.TypeOf(Generic{})
+
+	for i := 0; i < t.NumField(); i++ {
+
+		tag := strings.Split(t.Field(i).Tag.Get(`json`), `,`)[0]
+
+		if tag == `` || tag == `-` {
+			continue
+		}
+
+		num, ok := ProtoDeviceFields[tag]
+
+		if !ok {
+			panic(fmt.Sprintf(`usbci: no protobuf field number for %s`, tag))
+		}
+
+		protoFields = append(protoFields, protoField{i, num})
+	}
+}
+
+// Protobuf reports all unfiltered fields as a gocmdb.Device message.
+func (this *Generic) Protobuf() ([]byte, error) {
+
+	var b []byte
+	v := reflect.ValueOf(this).Elem()
+
+	for _, pf := range protoFields {
+
+		f := v.Field(pf.index)
+
+		switch f.Kind() {
+
+		case reflect.String:
+			if s := f.String(); s != `` {
+				b = protowire.AppendTag(b, pf.num, protowire.BytesType)
+				b = protowire.AppendString(b, s)
+			}
+
+		case reflect.Int:
+			if n := f.Int(); n != 0 {
+				b = protowire.AppendTag(b, pf.num, protowire.VarintType)
+				b = protowire.AppendVarint(b, uint64(n))
+			}
+
+		default:
+			return nil, fmt.Errorf(`unsupported field kind %s`, f.Kind())
+		}
+	}
+
+	return b, nil
+}
+
+// RestoreProtobuf restores the object from a gocmdb.Device message.
+func (this *Generic) RestoreProtobuf(b []byte) (error) {
+
+	fields := make(map[protowire.Number]int)
+
+	for _, pf := range protoFields {
+		fields[pf.num] = pf.index
+	}
+
+	v := reflect.ValueOf(this).Elem()
+
+	for len(b) > 0 {
+
+		num, typ, n := protowire.ConsumeTag(b)
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+		i, ok := fields[num]
+
+		switch {
+
+		case ok && typ == protowire.BytesType && v.Field(i).Kind() == reflect.String:
+			var s string
+			if s, n = protowire.ConsumeString(b); n >= 0 {
+				v.Field(i).SetString(s)
+			}
+
+		case ok && typ == protowire.VarintType && v.Field(i).Kind() == reflect.Int:
+			var u uint64
+			if u, n = protowire.ConsumeVarint(b); n >= 0 {
+				v.Field(i).SetInt(int64(int32(u)))
+			}
+
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// Protobuf reports the change set as a gocmdb.ChangeSet message.
+func (this *ChangeSet) Protobuf() ([]byte, error) {
+
+	var b []byte
+
+	b = appendProtoString(b, ProtoChangeSetHostName, this.HostName)
+	b = appendProtoString(b, ProtoChangeSetVendorID, this.VendorID)
+	b = appendProtoString(b, ProtoChangeSetProductID, this.ProductID)
+	b = appendProtoString(b, ProtoChangeSetSerialNum, this.SerialNum)
+
+	for _, chg := range this.Changes {
+
+		if len(chg) < 3 {
+			return nil, fmt.Errorf(`malformed change %v`, chg)
+		}
+
+		var c []byte
+
+		c = appendProtoString(c, ProtoChangeFieldName, chg[FieldNameIx])
+		c = appendProtoString(c, ProtoChangeOldValue, chg[OldValueIx])
+		c = appendProtoString(c, ProtoChangeNewValue, chg[NewValueIx])
+
+		b = protowire.AppendTag(b, ProtoChangeSetChanges, protowire.BytesType)
+		b = protowire.AppendBytes(b, c)
+	}
+
+	return b, nil
+}
+
+// RestoreProtobuf restores the change set from a gocmdb.ChangeSet message.
+func (this *ChangeSet) RestoreProtobuf(b []byte) (error) {
+
+	this.Changes = nil
+
+	return consumeProto(b, func(num protowire.Number, val []byte) (error) {
+
+		switch num {
+
+		case ProtoChangeSetHostName:
+			this.HostName = string(val)
+		case ProtoChangeSetVendorID:
+			this.VendorID = string(val)
+		case ProtoChangeSetProductID:
+			this.ProductID = string(val)
+		case ProtoChangeSetSerialNum:
+			this.SerialNum = string(val)
+
+		case ProtoChangeSetChanges:
+
+			chg := make([]string, 3)
+
+			err := consumeProto(val, func(num protowire.Number, val []byte) (error) {
+				switch num {
+				case ProtoChangeFieldName:
+					chg[FieldNameIx] = string(val)
+				case ProtoChangeOldValue:
+					chg[OldValueIx] = string(val)
+				case ProtoChangeNewValue:
+					chg[NewValueIx] = string(val)
+				}
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			this.Changes = append(this.Changes, chg)
+		}
+
+		return nil
+	})
+}
+
+// appendProtoString appends a string field unless it has the default value.
+func appendProtoString(b []byte, num protowire.Number, s string) ([]byte) {
+
+	if s == `` {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consumeProto calls fn with the number and value of each length-delimited
+// field of a message, skipping fields of other wire types.
+func consumeProto(b []byte, fn func(protowire.Number, []byte) (error)) (error) {
+
+	for len(b) > 0 {
+
+		num, typ, n := protowire.ConsumeTag(b)
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		if typ == protowire.BytesType {
+
+			val, n := protowire.ConsumeBytes(b)
+
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+
+			if err := fn(num, val); err != nil {
+				return err
+			}
+
+			b = b[n:]
+			continue
+		}
+
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
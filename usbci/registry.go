@@ -0,0 +1,167 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`io`
+	`sync`
+)
+
+// Restorable is implemented by device wrappers that can be restored from
+// their own JSON reports. All wrappers in this package also implement the
+// gocmdb interfaces appropriate to their type.
+type Restorable interface {
+	Type() (string)
+	RestoreJSON([]byte) (error)
+}
+
+var (
+	registry = make(map[string]func() (Restorable))
+	registryMutex sync.RWMutex
+)
+
+func init() {
+	Register(new(Generic).Type(), func() (Restorable) {
+		d, _ := NewGeneric(nil)
+		return d
+	})
+	Register(new(Magtek).Type(), func() (Restorable) {
+		d, _ := NewMagtek(nil)
+		return d
+	})
+}
+
+// Register associates an object type, as reported in the object_type field,
+// with a function that instantiates an empty wrapper of that type. It
+// replaces any function previously registered for the object type.
+func Register(objectType string, fn func() (Restorable)) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[objectType] = fn
+}
+
+// NewObject instantiates an empty wrapper for the named object type.
+func NewObject(objectType string) (Restorable, error) {
+
+	registryMutex.RLock()
+	fn, ok := registry[objectType]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf(`unknown object type %q`, objectType)
+	}
+
+	return fn(), nil
+}
+
+// Restore reads a single JSON device report, instantiates the wrapper named
+// by its object_type field, and restores the wrapper from the report.
+func Restore(r io.Reader) (Restorable, error) {
+
+	var j json.RawMessage
+
+	if err := json.NewDecoder(r).Decode(&j); err != nil {
+		return nil, err
+	}
+
+	return restoreJSON(j)
+}
+
+// RestoreAll reads a JSON array of device reports, or a stream of reports
+// such as NDJSON, and restores each with the wrapper named by its own
+// object_type field. Reports of different object types may be mixed.
+func RestoreAll(r io.Reader) (devs []Restorable, err error) {
+
+	dec := json.NewDecoder(r)
+
+	var first json.RawMessage
+
+	if err = dec.Decode(&first); err == io.EOF {
+		return devs, nil
+	} else if err != nil {
+		return devs, err
+	}
+
+	var js []json.RawMessage
+
+	if bytes.HasPrefix(bytes.TrimSpace(first), []byte(`[`)) {
+
+		if err = json.Unmarshal(first, &js); err != nil {
+			return devs, err
+		}
+
+	} else {
+
+		js = append(js, first)
+
+		for {
+			var j json.RawMessage
+
+			if err = dec.Decode(&j); err == io.EOF {
+				break
+			} else if err != nil {
+				return devs, err
+			}
+
+			js = append(js, j)
+		}
+	}
+
+	for i, j := range js {
+
+		dev, err := restoreJSON(j)
+
+		if err != nil {
+			return devs, fmt.Errorf(`device %d: %v`, i, err)
+		}
+
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
+
+// restoreJSON restores a single device report using the registry.
+func restoreJSON(j []byte) (Restorable, error) {
+
+	j, err := UpgradeJSON(j)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr struct {
+		ObjectType string `json:"object_type"`
+	}
+
+	if err = json.Unmarshal(j, &hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr.ObjectType == `` {
+		return nil, fmt.Errorf(`report has no object type`)
+	}
+
+	dev, err := NewObject(hdr.ObjectType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dev, dev.RestoreJSON(j)
+}
@@ -0,0 +1,382 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`fmt`
+	`io`
+	`reflect`
+	`strconv`
+	`strings`
+)
+
+// Report schema versions. SchemaVersion is the version written by this
+// package; older reports are upgraded when restored.
+const (
+	// SchemaVersionLegacy is the DeviceInfo layout used before the Generic
+	// wrapper, with Go field names or descript_sn and string bus numbers.
+	SchemaVersionLegacy int = 0
+
+	// SchemaVersionUnversioned is the Generic layout before reports carried
+	// a schema_version field.
+	SchemaVersionUnversioned int = 1
+
+	SchemaVersion int = 2
+
+	LegacyObjectType string = `*usbci.Magtek`
+)
+
+var (
+	// migrations upgrade a decoded report from the version matching their
+	// index to the next version.
+	migrations = []func(map[string]interface{}) (error){
+		migrateLegacy,
+		migrateUnversioned,
+	}
+
+	// fieldNames maps JSON tags, lower-case Go field names and legacy
+	// names to the JSON tags of the current schema.
+	fieldNames = map[string]string{
+		`descript_sn`: `descriptor_sn`,
+		`descriptsn`: `descriptor_sn`,
+	}
+
+	// fieldKinds maps the JSON tags of the current schema to field kinds.
+	fieldKinds = make(map[string]reflect.Kind)
+)
+
+func init() {
+
+	t := reflect.TypeOf(Generic{})
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get(`json`), `,`)[0]
+
+		if tag == `` || tag == `-` {
+			continue
+		}
+
+		fieldNames[tag] = tag
+		fieldNames[strings.ToLower(f.Name)] = tag
+		fieldKinds[tag] = f.Type.Kind()
+	}
+}
+
+// UpgradeJSON upgrades a JSON report of any earlier schema version to the
+// current version. Reports that are already current are returned unchanged.
+// A report encoded as a JSON string, as some legacy tools wrote them, is
+// decoded first.
+func UpgradeJSON(j []byte) ([]byte, error) {
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if s, ok := v.(string); ok {
+		return UpgradeJSON([]byte(s))
+	}
+
+	m, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf(`report is not a JSON object`)
+	}
+
+	ver, err := detectVersion(m)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ver == SchemaVersion {
+		return j, nil
+	}
+
+	if err = upgrade(m, ver); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+// UpgradeXML converts an XML report of any schema version, including the
+// legacy DeviceInfo layout, to a JSON report of the current version.
+func UpgradeXML(x []byte) ([]byte, error) {
+
+	m := make(map[string]interface{})
+	dec := xml.NewDecoder(bytes.NewReader(x))
+
+	var (
+		root, name string
+		text bytes.Buffer
+		depth int
+	)
+
+	for {
+		tok, err := dec.Token()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				root = t.Name.Local
+			} else if depth == 2 {
+				name = t.Name.Local
+				text.Reset()
+			}
+
+		case xml.CharData:
+			if depth == 2 {
+				text.Write(t)
+			}
+
+		case xml.EndElement:
+			if depth == 2 {
+				m[name] = strings.TrimSpace(text.String())
+			}
+			depth--
+		}
+	}
+
+	if root == `` {
+		return nil, fmt.Errorf(`report has no root element`)
+	}
+
+	ver := SchemaVersionUnversioned
+
+	if root == `DeviceInfo` {
+		ver = SchemaVersionLegacy
+	}
+
+	return upgradeFields(m, ver)
+}
+
+// UpgradeCSV converts a CSV report, a header record of field names and a
+// record of values, to a JSON report of the current version. CSV reports
+// contain only a subset of fields; the others are omitted.
+func UpgradeCSV(c []byte) ([]byte, error) {
+
+	recs, err := csv.NewReader(bytes.NewReader(c)).ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) != 2 || len(recs[0]) != len(recs[1]) {
+		return nil, fmt.Errorf(`report is not a single CSV record with header`)
+	}
+
+	m := make(map[string]interface{})
+
+	for i, name := range recs[0] {
+		m[name] = recs[1][i]
+	}
+
+	return upgradeFields(m, SchemaVersionUnversioned)
+}
+
+// UpgradeNVP converts an NVP report, one name:value pair per line, to a
+// JSON report of the current version. NVP reports contain only a subset of
+// fields; the others are omitted.
+func UpgradeNVP(n []byte) ([]byte, error) {
+
+	m := make(map[string]interface{})
+
+	for i, line := range strings.Split(string(n), "\n") {
+
+		if line = strings.TrimRight(line, "\r"); line == `` {
+			continue
+		}
+
+		kv := strings.SplitN(line, `:`, 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf(`line %d: expected name:value pair`, i + 1)
+		}
+
+		m[kv[0]] = kv[1]
+	}
+
+	if len(m) == 0 {
+		return nil, fmt.Errorf(`report has no name:value pairs`)
+	}
+
+	return upgradeFields(m, SchemaVersionUnversioned)
+}
+
+// upgradeFields normalizes a report decoded from a text format, whose values
+// are all strings, and upgrades it from its own schema_version field or, if
+// it has none, from the given version.
+func upgradeFields(m map[string]interface{}, ver int) ([]byte, error) {
+
+	if err := normalize(m); err != nil {
+		return nil, err
+	}
+
+	if v, ok := m[`schema_version`]; ok {
+		ver = v.(int)
+	}
+
+	if err := upgrade(m, ver); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+// isXML reports whether a report appears to be XML rather than JSON.
+func isXML(b []byte) (bool) {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte(`<`))
+}
+
+// detectVersion determines the schema version of a decoded JSON report.
+func detectVersion(m map[string]interface{}) (int, error) {
+
+	if v, ok := m[`schema_version`]; ok {
+
+		n, ok := v.(json.Number)
+
+		if !ok {
+			return 0, fmt.Errorf(`invalid schema version %v`, v)
+		}
+
+		ver, err := strconv.Atoi(n.String())
+
+		if err != nil {
+			return 0, fmt.Errorf(`invalid schema version %v`, v)
+		}
+
+		return ver, nil
+	}
+
+	for k, v := range m {
+
+		if fieldNames[k] != k {
+			return SchemaVersionLegacy, nil
+		}
+
+		if _, ok := v.(string); ok && fieldKinds[k] == reflect.Int {
+			return SchemaVersionLegacy, nil
+		}
+	}
+
+	return SchemaVersionUnversioned, nil
+}
+
+// upgrade applies migrations to a decoded report until it is current.
+func upgrade(m map[string]interface{}, ver int) (error) {
+
+	if ver > SchemaVersion || ver < 0 {
+		return fmt.Errorf(`unsupported schema version %d`, ver)
+	}
+
+	for ; ver < SchemaVersion; ver++ {
+		if err := migrations[ver](m); err != nil {
+			return fmt.Errorf(`schema version %d: %v`, ver, err)
+		}
+	}
+
+	m[`schema_version`] = SchemaVersion
+
+	return nil
+}
+
+// normalize renames the fields of a decoded report to the JSON tags of the
+// current schema, converts values to the kinds of the current fields, and
+// drops fields the current schema does not have.
+func normalize(m map[string]interface{}) (error) {
+
+	for k, v := range m {
+
+		delete(m, k)
+
+		name, ok := fieldNames[k]
+
+		if !ok {
+			name, ok = fieldNames[strings.ToLower(k)]
+		}
+
+		if !ok {
+			continue
+		}
+
+		switch fieldKinds[name] {
+
+		case reflect.Int:
+
+			s := strings.TrimSpace(fmt.Sprint(v))
+
+			if s == `` {
+				m[name] = 0
+			} else if n, err := strconv.Atoi(s); err != nil {
+				return fmt.Errorf(`field %s: %v`, name, err)
+			} else {
+				m[name] = n
+			}
+
+		case reflect.String:
+			m[name] = fmt.Sprint(v)
+
+		default:
+			m[name] = v
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacy upgrades the DeviceInfo layout to the unversioned Generic
+// layout. DeviceInfo was only used for Magtek readers, and its device serial
+// number served as the serial number.
+func migrateLegacy(m map[string]interface{}) (error) {
+
+	if err := normalize(m); err != nil {
+		return err
+	}
+
+	if _, ok := m[`serial_number`]; !ok {
+		m[`serial_number`] = m[`device_sn`]
+	}
+
+	if _, ok := m[`object_type`]; !ok {
+		m[`object_type`] = LegacyObjectType
+	}
+
+	return nil
+}
+
+// migrateUnversioned upgrades the unversioned Generic layout, which differs
+// from the current layout only by the schema_version field added by upgrade.
+func migrateUnversioned(m map[string]interface{}) (error) {
+	return nil
+}
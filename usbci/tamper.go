@@ -0,0 +1,383 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`fmt`
+	`strconv`
+	`strings`
+)
+
+// TamperKind identifies the class of a tamper finding.
+type TamperKind string
+
+const (
+	TamperIdentitySwap TamperKind = `identity-swap`
+	TamperSoftwareRegression TamperKind = `software-regression`
+	TamperDeviceSwap TamperKind = `device-swap`
+	TamperReappearance TamperKind = `reappearance`
+)
+
+// Confidence indicates how strongly a finding suggests tampering.
+type Confidence int
+
+const (
+	ConfidenceLow Confidence = iota + 1
+	ConfidenceMedium
+	ConfidenceHigh
+)
+
+var confidenceNames = map[Confidence]string{
+	ConfidenceLow: `low`,
+	ConfidenceMedium: `medium`,
+	ConfidenceHigh: `high`,
+}
+
+// String returns the name of the confidence level.
+func (this Confidence) String() (string) {
+	if s, ok := confidenceNames[this]; ok {
+		return s
+	}
+	return fmt.Sprintf(`confidence(%d)`, int(this))
+}
+
+// MarshalText reports the confidence level by name in text-based formats.
+func (this Confidence) MarshalText() ([]byte, error) {
+	return []byte(this.String()), nil
+}
+
+// UnmarshalText restores a confidence level from its name.
+func (this *Confidence) UnmarshalText(b []byte) (error) {
+	for k, v := range confidenceNames {
+		if v == string(b) {
+			*this = k
+			return nil
+		}
+	}
+	return fmt.Errorf(`unknown confidence level %q`, string(b))
+}
+
+// TamperFinding describes a single indication that a device may have been
+// swapped or tampered with since its baseline was recorded.
+type TamperFinding struct {
+	Kind       TamperKind	`json:"kind"        xml:"kind"`
+	Field      string	`json:"field"       xml:"field"`
+	OldValue   string	`json:"old_value"   xml:"old_value"`
+	NewValue   string	`json:"new_value"   xml:"new_value"`
+	Confidence Confidence	`json:"confidence"  xml:"confidence"`
+	Detail     string	`json:"detail"      xml:"detail"`
+}
+
+// String renders the finding in the same style as audit change logs.
+func (this TamperFinding) String() (string) {
+	return fmt.Sprintf(`[%s/%s] %q was %q, now %q: %s`,
+		this.Kind,
+		this.Confidence,
+		this.Field,
+		this.OldValue,
+		this.NewValue,
+		this.Detail,
+	)
+}
+
+// TamperFile calls AuditFile and then analyzes the baseline and the current
+// device for evidence of a device swap.
+func (this *Generic) TamperFile(fn string) (tf []TamperFinding, err error) {
+
+	base, err := NewGeneric(nil)
+
+	if err != nil {
+		return tf, err
+	}
+
+	if err = base.RestoreFile(fn); err != nil {
+		return tf, err
+	}
+
+	if err = this.AuditFile(fn); err != nil {
+		return tf, err
+	}
+
+	return AnalyzeTamper(base, this), nil
+}
+
+// TamperJSON calls AuditJSON and then analyzes the baseline and the current
+// device for evidence of a device swap.
+func (this *Generic) TamperJSON(j []byte) (tf []TamperFinding, err error) {
+
+	base, err := NewGeneric(nil)
+
+	if err != nil {
+		return tf, err
+	}
+
+	if err = base.RestoreJSON(j); err != nil {
+		return tf, err
+	}
+
+	if err = this.AuditJSON(j); err != nil {
+		return tf, err
+	}
+
+	return AnalyzeTamper(base, this), nil
+}
+
+// AnalyzeTamper compares the identity fields of a baseline device with those
+// of the current device. Unlike CompareObjects, it considers fields excluded
+// from audits, such as the port path, and interprets the differences.
+func AnalyzeTamper(old, cur *Generic) (tf []TamperFinding) {
+
+	samePort := old.BusNumber == cur.BusNumber && old.PortNumber == cur.PortNumber &&
+		(old.HubPorts == `` || cur.HubPorts == `` || old.HubPorts == cur.HubPorts)
+
+	if samePort && (old.VendorID != cur.VendorID || old.ProductID != cur.ProductID) {
+		tf = append(tf, TamperFinding{
+			Kind: TamperDeviceSwap,
+			Field: `VendorID:ProductID`,
+			OldValue: old.VendorID + `:` + old.ProductID,
+			NewValue: cur.VendorID + `:` + cur.ProductID,
+			Confidence: ConfidenceHigh,
+			Detail: fmt.Sprintf(`different device type on port path %s`, cur.FullPortPath()),
+		})
+	}
+
+	if old.DeviceSN == cur.DeviceSN {
+
+		if old.FactorySN != cur.FactorySN {
+
+			conf := ConfidenceHigh
+
+			if old.FactorySN == `` || cur.FactorySN == `` {
+				conf = ConfidenceLow
+			}
+
+			tf = append(tf, TamperFinding{
+				Kind: TamperIdentitySwap,
+				Field: `FactorySN`,
+				OldValue: old.FactorySN,
+				NewValue: cur.FactorySN,
+				Confidence: conf,
+				Detail: fmt.Sprintf(`factory serial number changed but device serial number %q did not`, cur.DeviceSN),
+			})
+		}
+
+		if old.DescriptorSN != cur.DescriptorSN {
+
+			conf := ConfidenceMedium
+
+			if old.DescriptorSN == `` || cur.DescriptorSN == `` {
+				conf = ConfidenceLow
+			}
+
+			tf = append(tf, TamperFinding{
+				Kind: TamperIdentitySwap,
+				Field: `DescriptorSN`,
+				OldValue: old.DescriptorSN,
+				NewValue: cur.DescriptorSN,
+				Confidence: conf,
+				Detail: fmt.Sprintf(`descriptor serial number changed but device serial number %q did not`, cur.DeviceSN),
+			})
+		}
+	}
+
+	if older, samePart := olderSoftware(old.SoftwareID, cur.SoftwareID); older {
+
+		conf := ConfidenceMedium
+
+		if samePart {
+			conf = ConfidenceHigh
+		}
+
+		tf = append(tf, TamperFinding{
+			Kind: TamperSoftwareRegression,
+			Field: `SoftwareID`,
+			OldValue: old.SoftwareID,
+			NewValue: cur.SoftwareID,
+			Confidence: conf,
+			Detail: `software ID is older than the baseline`,
+		})
+	}
+
+	return tf
+}
+
+// PortPath returns the bus and port number identifying the physical location
+// of the device on the host.
+func (this *Generic) PortPath() (string) {
+	return fmt.Sprintf(`%03d-%03d`, this.BusNumber, this.PortNumber)
+}
+
+// FullPortPath returns the bus number and the port numbers from the root hub
+// to the device, which identify its location even behind hubs, e.g. 001-2.4,
+// or PortPath if the port numbers are unknown.
+func (this *Generic) FullPortPath() (string) {
+
+	if this.HubPorts == `` {
+		return this.PortPath()
+	}
+
+	return fmt.Sprintf(`%03d-%s`, this.BusNumber, this.HubPorts)
+}
+
+// hubPorts joins the port numbers from the root hub to a device with dots.
+func hubPorts(path []int) (string) {
+
+	ss := make([]string, len(path))
+
+	for i, n := range path {
+		ss[i] = strconv.Itoa(n)
+	}
+
+	return strings.Join(ss, `.`)
+}
+
+// olderSoftware reports whether software ID cur is older than software ID
+// old and whether both share a part number. Magtek software IDs consist of
+// a part number followed by a revision letter and number, e.g. 21042840G01;
+// revisions are compared by letter and then by number, so that G10 is newer
+// than G9. IDs with different part numbers belong to different software or
+// devices and are never older. IDs that do not have this form are compared
+// as strings.
+func olderSoftware(old, cur string) (older, samePart bool) {
+
+	if old == `` || cur == `` {
+		return false, false
+	}
+
+	op, ol, on, ok1 := splitSoftwareID(old)
+	cp, cl, cn, ok2 := splitSoftwareID(cur)
+
+	if !ok1 || !ok2 {
+		return cur < old, false
+	}
+
+	if op != cp {
+		return false, false
+	}
+
+	if ol != cl {
+		return cl < ol, true
+	}
+
+	return cn < on, true
+}
+
+// splitSoftwareID splits a software ID into its part number, revision
+// letter and revision number.
+func splitSoftwareID(id string) (part, letter string, rev int, ok bool) {
+
+	part = softwarePart(id)
+	rest := id[len(part):]
+
+	i := strings.IndexFunc(rest, func(r rune) bool {
+		return r >= '0' && r <= '9'
+	})
+
+	if part == `` || part == id || i <= 0 {
+		return part, ``, 0, false
+	}
+
+	rev, err := strconv.Atoi(rest[i:])
+
+	return part, rest[:i], rev, err == nil
+}
+
+// softwarePart strips the revision suffix from a Magtek software ID, which
+// consists of an eight-digit part number followed by a revision letter and
+// number, e.g. 21042840G01.
+func softwarePart(id string) (string) {
+	if i := strings.IndexFunc(id, func(r rune) bool {
+		return r < '0' || r > '9'
+	}); i > 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// TamperSession tracks devices across successive enumerations so that a
+// device that disappears and reappears during a session can be reported.
+type TamperSession struct {
+	seen map[string]*Generic
+	gone map[string]*Generic
+}
+
+// NewTamperSession instantiates an empty TamperSession.
+func NewTamperSession() (*TamperSession) {
+	return &TamperSession{
+		seen: make(map[string]*Generic),
+		gone: make(map[string]*Generic),
+	}
+}
+
+// Observe records the devices present during one enumeration pass and
+// returns findings for devices that changed identity on the same port path
+// or reappeared after being absent from a previous pass.
+func (this *TamperSession) Observe(devs ...*Generic) (tf []TamperFinding) {
+
+	present := make(map[string]bool)
+
+	for _, dev := range devs {
+
+		key := dev.FullPortPath()
+		present[key] = true
+
+		if old, ok := this.gone[key]; ok {
+
+			delete(this.gone, key)
+			found := AnalyzeTamper(old, dev)
+
+			conf := ConfidenceLow
+
+			if len(found) > 0 || !sameIdentity(old, dev) {
+				conf = ConfidenceHigh
+			}
+
+			tf = append(tf, TamperFinding{
+				Kind: TamperReappearance,
+				Field: `PortPath`,
+				OldValue: old.ID(),
+				NewValue: dev.ID(),
+				Confidence: conf,
+				Detail: fmt.Sprintf(`device disappeared and reappeared on port path %s`, key),
+			})
+
+			tf = append(tf, found...)
+
+		} else if old, ok := this.seen[key]; ok {
+			tf = append(tf, AnalyzeTamper(old, dev)...)
+		}
+
+		this.seen[key] = dev
+	}
+
+	for key, dev := range this.seen {
+		if !present[key] {
+			this.gone[key] = dev
+			delete(this.seen, key)
+		}
+	}
+
+	return tf
+}
+
+// sameIdentity reports whether two devices carry the same identity fields.
+func sameIdentity(a, b *Generic) (bool) {
+	return a.VendorID == b.VendorID &&
+		a.ProductID == b.ProductID &&
+		a.SerialNum == b.SerialNum &&
+		a.DeviceSN == b.DeviceSN &&
+		a.FactorySN == b.FactorySN &&
+		a.DescriptorSN == b.DescriptorSN
+}
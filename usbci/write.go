@@ -0,0 +1,163 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usbci
+
+import (
+	`fmt`
+	`sync`
+)
+
+const (
+	EventRollback string = `rollback`
+)
+
+// Write describes an NVRAM property write by one of the Configurable
+// setters. OldValue is read from NVRAM just before the write. NewDevice is
+// the identity the device will have after the write if the write changes
+// it, as a factory serial number write does.
+type Write struct {
+	Device   string			`json:"device"`
+	NewDevice string		`json:"new_device,omitempty"`
+	HostName string			`json:"host_name"`
+	Action   string			`json:"action"`
+	Property string			`json:"property"`
+	OldValue string			`json:"old_value"`
+	NewValue string			`json:"new_value"`
+}
+
+var (
+	writeHandler func(*Write) (bool, error)
+	writeMutex sync.RWMutex
+
+	propertyIDs = map[string]uint8{
+		FieldDeviceSN: PropDeviceSN,
+		FieldFactorySN: PropFactorySN,
+	}
+)
+
+// SetWriteHandler installs a function that the Configurable setters call
+// before every NVRAM write, after the serial number policies are checked,
+// replacing any previous handler. If the handler returns an error, the
+// write is not made and the setter returns the error. If it returns false,
+// the write is skipped and the setter succeeds, which allows dry runs. A
+// nil handler lets every write through.
+func SetWriteHandler(fn func(*Write) (bool, error)) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	writeHandler = fn
+}
+
+// write writes a property through the write handler, if any, and sends
+// the event of the setter. Skipped writes are sent as dry-run events.
+func (this *Magtek) write(e *Event, id uint8, val string) (error) {
+
+	writeMutex.RLock()
+	fn := writeHandler
+	writeMutex.RUnlock()
+
+	if fn == nil {
+		return this.event(e, this.setProperty(id, val))
+	}
+
+	w := &Write{
+		Device: this.Identity(),
+		HostName: this.HostName,
+		Action: e.Action,
+		Property: propertyName(id),
+		NewValue: val,
+	}
+
+	if id := this.identityAfter(id, val); id != w.Device {
+		w.NewDevice = id
+	}
+
+	var err error
+
+	if w.OldValue, err = this.getProperty(id); err != nil {
+		return this.event(e, err)
+	}
+
+	if id == PropFactorySN && len(w.OldValue) <= 1 {
+		w.OldValue = ``
+	}
+
+	apply, err := fn(w)
+
+	if err != nil {
+		return this.event(e, fmt.Errorf(`write handler: %v`, err))
+	}
+
+	if !apply {
+		e.DryRun = true
+		return this.event(e, nil)
+	}
+
+	return this.event(e, this.setProperty(id, val))
+}
+
+// Undo restores the value a property had before a write, such as one
+// recorded in a rollback journal. It bypasses the serial number policies
+// and the write handler, since the value was in NVRAM before.
+func (this *Magtek) Undo(w *Write) (error) {
+
+	e := &Event{Action: EventRollback, OldValue: w.NewValue, NewValue: w.OldValue}
+
+	if !w.Of(this.Identity()) {
+		return this.event(e, fmt.Errorf(`write of device %q cannot be undone on device %q`,
+			w.Device, this.Identity()))
+	}
+
+	id, ok := propertyIDs[w.Property]
+
+	if !ok {
+		return this.event(e, fmt.Errorf(`unknown property %q`, w.Property))
+	}
+
+	return this.event(e, this.setProperty(id, w.OldValue))
+}
+
+// Of reports whether the write was made to the device with the given
+// identity, either before or after the write.
+func (this *Write) Of(id string) (bool) {
+	return id == this.Device || (this.NewDevice != `` && id == this.NewDevice)
+}
+
+// identityAfter returns the identity the device will have after a property
+// write.
+func (this *Magtek) identityAfter(id uint8, val string) (string) {
+
+	gen := *this.Generic
+
+	switch id {
+	case PropFactorySN:
+		gen.FactorySN = val
+	case PropDeviceSN:
+		gen.DeviceSN, gen.SerialNum = val, val
+	}
+
+	return gen.Identity()
+}
+
+// propertyName returns the field name of a property.
+func propertyName(id uint8) (string) {
+
+	for name, pid := range propertyIDs {
+		if pid == id {
+			return name
+		}
+	}
+
+	return fmt.Sprintf(`property-%d`, id)
+}